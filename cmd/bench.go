@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BENCH_STEPS       = 8   // number of rates we try, doubling each time
+	BENCH_DROP_PCT    = 1.0 // a rate is sustained if we drop less than this
+	BENCH_TICK        = time.Millisecond
+	BENCH_DRAIN       = 500 * time.Millisecond // wait for packets in flight after each step
+	BENCH_PAYLOAD_LEN = 24
+)
+
+// marks our --bench packets
+var BENCH_MAGIC = []byte("UP2020BN")
+
+// TEST-NET-1 source so we don't look like one of our own broadcasts
+var BENCH_SRC_IP = net.IPv4(192, 0, 2, 1).To4()
+
+// benchStep is the result of sending at one rate
+type benchStep struct {
+	Rate     int     `json:"rate"` // packets/sec
+	Sent     uint64  `json:"sent"`
+	Received uint64  `json:"received"`
+	DropPct  float64 `json:"drop_pct"`
+	P50Usec  int64   `json:"latency_p50_usec"`
+	P95Usec  int64   `json:"latency_p95_usec"`
+	P99Usec  int64   `json:"latency_p99_usec"`
+}
+
+// benchResult is what --bench reports
+type benchResult struct {
+	From        string      `json:"from"`
+	To          string      `json:"to"`
+	Port        int32       `json:"port"`
+	Steps       []benchStep `json:"steps"`
+	MaxRate     int         `json:"max_sustained_rate"` // highest rate with fewer than BENCH_DROP_PCT drops
+	DropOnset   int         `json:"drop_onset_rate"`    // first rate with drops, 0 if none
+	StepSeconds float64     `json:"step_seconds"`
+}
+
+// benchRecorder collects the latency of the --bench packets we receive
+type benchRecorder struct {
+	lock      sync.Mutex
+	step      uint64 // current step, packets from other steps are ignored
+	received  uint64
+	latencies []time.Duration
+}
+
+func (r *benchRecorder) Start(step uint64) {
+	r.lock.Lock()
+	r.step = step
+	r.received = 0
+	r.latencies = []time.Duration{}
+	r.lock.Unlock()
+}
+
+func (r *benchRecorder) Add(step uint64, latency time.Duration) {
+	r.lock.Lock()
+	if step == r.step {
+		r.received++
+		r.latencies = append(r.latencies, latency)
+	}
+	r.lock.Unlock()
+}
+
+// Result returns the received packets and latency percentiles
+func (r *benchRecorder) Result(step *benchStep) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	step.Received = r.received
+	if step.Sent > 0 && step.Received < step.Sent {
+		step.DropPct = float64(step.Sent-step.Received) * 100 / float64(step.Sent)
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	percentile := func(p int) int64 {
+		if len(r.latencies) == 0 {
+			return 0
+		}
+		return r.latencies[(len(r.latencies)-1)*p/100].Microseconds()
+	}
+	step.P50Usec, step.P95Usec, step.P99Usec = percentile(50), percentile(95), percentile(99)
+}
+
+// benchPacket builds a --bench packet for the link type which is
+// broadcast to the port and carries the step, sequence and send time
+func benchPacket(l *Listen, port int32, step uint64, seq uint64, now time.Time) ([]byte, error) {
+	payload := make([]byte, BENCH_PAYLOAD_LEN)
+	copy(payload, BENCH_MAGIC)
+	binary.BigEndian.PutUint32(payload[8:], uint32(step))
+	binary.BigEndian.PutUint32(payload[12:], uint32(seq))
+	binary.BigEndian.PutUint64(payload[16:], uint64(now.UnixNano()))
+
+	ip4 := layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    BENCH_SRC_IP,
+		DstIP:    net.IPv4bcast,
+	}
+	udp := layers.UDP{
+		SrcPort: layers.UDPPort(port),
+		DstPort: layers.UDPPort(port),
+	}
+	if err := udp.SetNetworkLayerForChecksum(&ip4); err != nil {
+		return nil, err
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, opts, &ip4, &udp, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+
+	linkType := l.handle.LinkType()
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		eth := layers.Ethernet{
+			DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			SrcMAC:       l.netif.HardwareAddr,
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		if err := eth.SerializeTo(buffer, opts); err != nil {
+			return nil, err
+		}
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		if err := serializeLoopback(buffer, linkType, layers.ProtocolFamilyIPv4); err != nil {
+			return nil, err
+		}
+	case layers.LinkTypeRaw:
+	default:
+		return nil, fmt.Errorf("unsupported linktype: %s", linkType)
+	}
+	return buffer.Bytes(), nil
+}
+
+// readBench reads the --bench packets forwarded out the handle until it is closed
+func readBench(handle *pcap.Handle, rec *benchRecorder) {
+	for {
+		data, ci, err := handle.ReadPacketData()
+		switch err {
+		case nil:
+		case pcap.NextErrorTimeoutExpired:
+			continue
+		default:
+			return
+		}
+		d, err := decodePacket(data, handle.LinkType())
+		if err != nil || !d.IsIPv4UDP() || len(d.payload) < BENCH_PAYLOAD_LEN ||
+			!bytes.Equal(d.payload[:len(BENCH_MAGIC)], BENCH_MAGIC) {
+			continue
+		}
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(d.payload[16:])))
+		rec.Add(uint64(binary.BigEndian.Uint32(d.payload[8:])), ci.Timestamp.Sub(sent))
+	}
+}
+
+// runBench injects packets into the from interface at increasing rates and
+// measures how many are forwarded out the to interface and how long it
+// takes.  The results are printed to stdout as JSON.
+func runBench(from *Listen, to *Listen, port int32, duration time.Duration, rate int) error {
+	var send, recv *pcap.Handle
+	var err error
+	if err = inNetns(from.netns, func() error {
+		send, err = pcap.OpenLive(from.device, int32(from.capture.snaplen), false, from.timeout)
+		return err
+	}); err != nil {
+		return fmt.Errorf("%s: %s", from.label, err)
+	}
+	defer send.Close()
+	if err = inNetns(to.netns, func() error {
+		if recv, err = pcap.OpenLive(to.device, int32(to.capture.snaplen), false, to.timeout); err != nil {
+			return err
+		}
+		// we only want the packets we forward out this interface
+		return recv.SetBPFFilter(fmt.Sprintf("udp port %d and src host %s", port, BENCH_SRC_IP))
+	}); err != nil {
+		return fmt.Errorf("%s: %s", to.label, err)
+	}
+	rec := &benchRecorder{}
+	go readBench(recv, rec)
+
+	stepTime := duration / BENCH_STEPS
+	result := benchResult{
+		From:        from.label,
+		To:          to.label,
+		Port:        port,
+		Steps:       []benchStep{},
+		StepSeconds: stepTime.Seconds(),
+	}
+	log.Infof("Benchmarking %s => %s for %s starting at %d packets/sec", from.label, to.label, duration, rate)
+	for i := 0; i < BENCH_STEPS; i++ {
+		stepRate := rate << i
+		step := benchStep{Rate: stepRate}
+		rec.Start(uint64(i))
+
+		ticker := time.NewTicker(BENCH_TICK)
+		start := time.Now()
+		for now := range ticker.C {
+			if now.Sub(start) >= stepTime {
+				break
+			}
+			// catch up to where we should be
+			want := uint64(now.Sub(start).Seconds() * float64(stepRate))
+			for ; step.Sent < want; step.Sent++ {
+				data, err := benchPacket(from, port, uint64(i), step.Sent, time.Now())
+				if err != nil {
+					ticker.Stop()
+					return err
+				}
+				if err = send.WritePacketData(data); err != nil {
+					rateLog.Warnf("bench", "Unable to send --bench packet: %s", err)
+				}
+			}
+		}
+		ticker.Stop()
+		time.Sleep(BENCH_DRAIN)
+
+		rec.Result(&step)
+		log.Infof("--bench %d packets/sec: sent=%d received=%d drops=%.2f%%", stepRate, step.Sent,
+			step.Received, step.DropPct)
+		result.Steps = append(result.Steps, step)
+		if step.DropPct >= BENCH_DROP_PCT {
+			result.DropOnset = stepRate
+			break
+		}
+		result.MaxRate = stepRate
+	}
+	recv.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/google/gopacket"
+)
+
+// serializeBuffers are reused by sendPacket so we don't allocate a new
+// buffer for every packet we send
+var serializeBuffers = sync.Pool{
+	New: func() interface{} {
+		return gopacket.NewSerializeBuffer()
+	},
+}
+
+// getSerializeBuffer returns an empty buffer from our pool.  Every layer we
+// serialize writes all of the bytes it prepends, so no stale data from a
+// previous packet ends up in the new one.  The buffer and its Bytes() must not
+// be used after calling putSerializeBuffer.
+func getSerializeBuffer() gopacket.SerializeBuffer {
+	buffer := serializeBuffers.Get().(gopacket.SerializeBuffer)
+	_ = buffer.Clear() // never fails
+	return buffer
+}
+
+// putSerializeBuffer returns the buffer to our pool
+func putSerializeBuffer(buffer gopacket.SerializeBuffer) {
+	serializeBuffers.Put(buffer)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// A pooled buffer which held a larger packet must build exactly the same bytes
+// as a new buffer
+func TestSerializeBufferNoStaleBytes(t *testing.T) {
+	l := Listen{linkType: layers.LinkTypeRaw, rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}}}
+	dstip := net.ParseIP("192.168.1.255").To4()
+	_, big := testPacket(t, "10.0.0.5", "255.255.255.255", 5000, 9003, bytes.Repeat([]byte{0xff}, 1400))
+	_, small := testPacket(t, "10.0.0.6", "255.255.255.255", 5001, 9003, []byte("hello"))
+
+	buffer := getSerializeBuffer()
+	if _, err := l.buildPacket(buffer, Send{decoded: big}, dstip, big.payload, big.ip4.Length); err != nil {
+		t.Fatal(err)
+	}
+	putSerializeBuffer(buffer)
+
+	buffer = getSerializeBuffer()
+	defer putSerializeBuffer(buffer)
+	pooled, err := l.buildPacket(buffer, Send{decoded: small}, dstip, small.payload, small.ip4.Length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := l.buildPacket(gopacket.NewSerializeBuffer(), Send{decoded: small}, dstip, small.payload, small.ip4.Length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pooled.data, fresh.data) {
+		t.Errorf("pooled buffer built\n%x\nexpected\n%x", pooled.data, fresh.data)
+	}
+}
+
+func benchmarkBuildPacket(b *testing.B, pooled bool) {
+	l := Listen{
+		linkType: layers.LinkTypeEthernet,
+		netif:    &net.Interface{HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}},
+		rewrite:  Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}},
+	}
+	dstip := net.ParseIP("192.168.1.255").To4()
+	_, d := testPacket(b, "10.0.0.5", "255.255.255.255", 5000, 9003, make([]byte, 512))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buffer gopacket.SerializeBuffer
+		if pooled {
+			buffer = getSerializeBuffer()
+		} else {
+			buffer = gopacket.NewSerializeBuffer()
+		}
+		if _, err := l.buildPacket(buffer, Send{srcif: "eth0", decoded: d}, dstip, d.payload, d.ip4.Length); err != nil {
+			b.Fatal(err)
+		}
+		if pooled {
+			putSerializeBuffer(buffer)
+		}
+	}
+}
+
+func BenchmarkBuildPacketPooled(b *testing.B) {
+	benchmarkBuildPacket(b, true)
+}
+
+func BenchmarkBuildPacketNewBuffer(b *testing.B) {
+	benchmarkBuildPacket(b, false)
+}
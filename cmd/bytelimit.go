@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// byteLimiter is a token bucket which limits how many bytes per second we
+// forward.  The bucket holds up to one second worth of bytes so short bursts
+// are allowed.
+type byteLimiter struct {
+	lock   sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64 // bytes we may still forward
+	last   time.Time
+}
+
+func newByteLimiter(rate int64) *byteLimiter {
+	return &byteLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+	}
+}
+
+// Allow returns true if we may forward a packet of the given size at now
+func (b *byteLimiter) Allow(size int, now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+
+	if b.tokens < float64(size) {
+		return false
+	}
+	b.tokens -= float64(size)
+	return true
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteLimiter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		size  int
+		at    time.Duration // since now
+		allow bool
+	}{
+		{"burst", 600, 0, true},
+		{"rest of the burst", 400, 0, true},
+		{"empty", 1, 0, false},
+		{"refilled 100", 100, 100 * time.Millisecond, true},
+		{"not yet", 100, 150 * time.Millisecond, false},
+		{"refilled 50 more", 100, 200 * time.Millisecond, true},
+		{"earlier time doesn't refill", 100, 100 * time.Millisecond, false},
+		{"at most a second", 1000, time.Hour, true},
+		{"not over a second", 1, time.Hour, false},
+		{"larger than the bucket", 1001, 2 * time.Hour, false},
+		{"still full", 1000, 2 * time.Hour, true},
+	}
+	b := newByteLimiter(1000)
+	for _, test := range tests {
+		if allow := b.Allow(test.size, now.Add(test.at)); allow != test.allow {
+			t.Errorf("%s: %d bytes allowed %v", test.name, test.size, allow)
+		}
+	}
+}
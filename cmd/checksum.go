@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/google/gopacket/layers"
+)
+
+// checksumAdd adds the data as big endian 16bit words to the ones complement
+// sum.  An odd trailing byte is padded with zero.
+func checksumAdd(sum uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds the carries back into a 16bit ones complement sum
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderSum returns the sum of the IPv4 pseudo-header used by the UDP
+// and UDP-Lite checksums
+func pseudoHeaderSum(ip4 *layers.IPv4, proto layers.IPProtocol, length int) uint32 {
+	sum := checksumAdd(0, ip4.SrcIP.To4())
+	sum = checksumAdd(sum, ip4.DstIP.To4())
+	return sum + uint32(proto) + uint32(length)
+}
+
+// checksumsValid returns false if the IPv4 header or UDP checksum of a
+// decoded packet is wrong.  A zero UDP checksum means the sender didn't
+// compute one which is valid for UDP, but not UDP-Lite.
+func (d *Decoded) checksumsValid() bool {
+	if checksumFold(checksumAdd(0, d.ip4.Contents)) != 0xffff {
+		return false
+	}
+
+	switch {
+	case d.Has(layers.LayerTypeUDP):
+		if d.udp.Checksum == 0 {
+			return true
+		}
+		datagram := d.ip4.Payload
+		sum := pseudoHeaderSum(&d.ip4, layers.IPProtocolUDP, len(datagram))
+		return checksumFold(checksumAdd(sum, datagram)) == 0xffff
+	case d.Has(layers.LayerTypeUDPLite):
+		datagram := d.ip4.Payload
+		covered := datagram
+		if coverage := int(d.udp.Length); coverage > len(datagram) || coverage > 0 && coverage < 8 {
+			return false
+		} else if coverage > 0 {
+			covered = datagram[:coverage]
+		}
+		sum := pseudoHeaderSum(&d.ip4, layers.IPProtocolUDPLite, len(datagram))
+		return checksumFold(checksumAdd(sum, covered)) == 0xffff
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestChecksumsValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(d *Decoded)
+		valid   bool
+	}{
+		{"valid", func(d *Decoded) {}, true},
+		{"zero udp checksum", func(d *Decoded) {
+			binary.BigEndian.PutUint16(d.ip4.Payload[6:], 0)
+			d.udp.Checksum = 0
+		}, true},
+		{"corrupt payload", func(d *Decoded) { d.ip4.Payload[len(d.ip4.Payload)-1] ^= 0xff }, false},
+		{"corrupt udp checksum", func(d *Decoded) { d.ip4.Payload[6] ^= 0xff }, false},
+		{"corrupt ipv4 header", func(d *Decoded) { d.ip4.Contents[8] ^= 0xff }, false},
+		{"corrupt ipv4 header and zero udp checksum", func(d *Decoded) {
+			d.ip4.Contents[8] ^= 0xff
+			d.udp.Checksum = 0
+		}, false},
+	}
+	for _, test := range tests {
+		_, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 9003, []byte("hello"))
+		test.corrupt(d)
+		if valid := d.checksumsValid(); valid != test.valid {
+			t.Errorf("%s: expected %v, got %v", test.name, test.valid, valid)
+		}
+	}
+}
+
+// UDP-Lite requires a checksum over the bytes covered by it
+func TestChecksumsValidUDPLite(t *testing.T) {
+	tests := []struct {
+		name     string
+		coverage uint16
+		zero     bool
+		valid    bool
+	}{
+		{"everything", 0, false, true},
+		{"header", 8, false, true},
+		{"some", 10, false, true},
+		{"zero checksum", 0, true, false},
+		{"coverage under the header", 4, false, false},
+		{"coverage over the datagram", 100, false, false},
+	}
+	for _, test := range tests {
+		_, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 9003, []byte("hello world"))
+		d.ip4.Protocol = layers.IPProtocolUDPLite
+		datagram := d.ip4.Payload
+		binary.BigEndian.PutUint16(datagram[4:], test.coverage)
+		binary.BigEndian.PutUint16(datagram[6:], 0)
+		if !test.zero {
+			covered := datagram
+			if test.coverage >= 8 && int(test.coverage) <= len(datagram) {
+				covered = datagram[:test.coverage]
+			}
+			sum := pseudoHeaderSum(&d.ip4, layers.IPProtocolUDPLite, len(datagram))
+			binary.BigEndian.PutUint16(datagram[6:], ^checksumFold(checksumAdd(sum, covered)))
+		}
+		d.layers = []gopacket.LayerType{layers.LayerTypeIPv4}
+		if !d.decodeUDPLite() {
+			t.Fatalf("%s: not decoded as UDP-Lite", test.name)
+		}
+		if valid := d.checksumsValid(); valid != test.valid {
+			t.Errorf("%s: expected %v, got %v", test.name, test.valid, valid)
+		}
+	}
+}
+
+// --verify-checksum is opt-in since some senders don't compute a checksum
+func TestParseVerifyChecksum(t *testing.T) {
+	tests := []struct {
+		args   []string
+		verify bool
+	}{
+		{[]string{}, false},
+		{[]string{"--verify-checksum"}, true},
+		{[]string{"--verify-checksum=false"}, false},
+	}
+	for _, test := range tests {
+		cli := CLI{}
+		if _, err := newParser(&cli).Parse(test.args); err != nil {
+			t.Fatalf("%v: %s", test.args, err)
+		}
+		if cli.VerifyCsum != test.verify {
+			t.Errorf("%v: --verify-checksum is %v", test.args, cli.VerifyCsum)
+		}
+	}
+}
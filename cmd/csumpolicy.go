@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// How we set the UDP checksum of the packets we send
+const (
+	CSUM_COMPUTE  = "compute"  // compute a new checksum
+	CSUM_ZERO     = "zero"     // send a zero (no) checksum
+	CSUM_PRESERVE = "preserve" // send the checksum of the packet we received
+)
+
+// checksumPolicy picks how we set the UDP checksum of the packets we send
+// out an interface to each destination
+type checksumPolicy struct {
+	mode string            // mode for destinations without their own
+	dsts map[string]string // mode by destination IP
+}
+
+// parseChecksumMode parses a --checksum-policy of <target>@<mode> where
+// target is an interface or destination IPv4 address
+func parseChecksumMode(value string) (string, string, error) {
+	target, mode, err := splitInterfaceArg(value)
+	if err != nil {
+		return "", "", fmt.Errorf("%s is not in the format of <interface|ip>@<mode>", value)
+	}
+	switch mode {
+	case CSUM_COMPUTE, CSUM_ZERO, CSUM_PRESERVE:
+	default:
+		return "", "", fmt.Errorf("%s is not a valid mode [compute|zero|preserve]", mode)
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		if ip.To4() == nil {
+			return "", "", fmt.Errorf("%s is not an IPv4 address", target)
+		}
+		target = ip.String()
+	}
+	return target, mode, nil
+}
+
+// Mode returns how we set the UDP checksum of packets we send to dstip
+func (c checksumPolicy) Mode(dstip net.IP) string {
+	if mode, ok := c.dsts[dstip.String()]; ok {
+		return mode
+	}
+	return c.mode
+}
+
+// Preserves returns true if we preserve the checksum for any destination
+func (c checksumPolicy) Preserves() bool {
+	if c.mode == CSUM_PRESERVE {
+		return true
+	}
+	for _, mode := range c.dsts {
+		if mode == CSUM_PRESERVE {
+			return true
+		}
+	}
+	return false
+}
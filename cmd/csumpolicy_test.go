@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestParseChecksumMode(t *testing.T) {
+	tests := []struct {
+		value  string
+		target string
+		mode   string
+		err    string
+	}{
+		{"eth0@zero", "eth0", CSUM_ZERO, ""},
+		{"10.0.1.5@preserve", "10.0.1.5", CSUM_PRESERVE, ""},
+		{"::ffff:10.0.1.5@compute", "10.0.1.5", CSUM_COMPUTE, ""},
+		{"eth0", "", "", "eth0 is not in the format of <interface|ip>@<mode>"},
+		{"eth0@never", "", "", "never is not a valid mode"},
+		{"fe80::1@zero", "", "", "fe80::1 is not an IPv4 address"},
+	}
+	for _, test := range tests {
+		target, mode, err := parseChecksumMode(test.value)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.value, test.err, err)
+			}
+		} else if err != nil || target != test.target || mode != test.mode {
+			t.Errorf("%s: parsed %s@%s: %v", test.value, target, mode, err)
+		}
+	}
+}
+
+// One packet sent to each destination gets the checksum of its policy
+func TestChecksumPolicyDestinations(t *testing.T) {
+	l := Listen{iname: "csum0", label: "csum0", linkType: layers.LinkTypeRaw,
+		rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE,
+			dsts: map[string]string{"10.0.1.255": CSUM_ZERO, "10.0.2.255": CSUM_PRESERVE}}}}
+	_, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+	if d.udp.Checksum == 0 {
+		t.Fatalf("source packet has no checksum")
+	}
+
+	tests := []struct {
+		dst      string
+		mode     string
+		checksum func(sent *Decoded) bool
+	}{
+		{"10.0.1.255", CSUM_ZERO, func(sent *Decoded) bool { return sent.udp.Checksum == 0 }},
+		{"10.0.2.255", CSUM_PRESERVE, func(sent *Decoded) bool {
+			return sent.udp.Checksum == d.udp.Checksum && !sent.checksumsValid()
+		}},
+		{"10.0.3.255", CSUM_COMPUTE, func(sent *Decoded) bool {
+			return sent.udp.Checksum != 0 && sent.udp.Checksum != d.udp.Checksum && sent.checksumsValid()
+		}},
+	}
+	for _, test := range tests {
+		dstip := net.ParseIP(test.dst).To4()
+		if mode := l.rewrite.checksums.Mode(dstip); mode != test.mode {
+			t.Errorf("%s: mode is %s, expected %s", test.dst, mode, test.mode)
+		}
+		built, err := l.buildPacket(gopacket.NewSerializeBuffer(), Send{srcif: "eth0", decoded: d}, dstip,
+			d.payload, d.ip4.Length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent, err := decodePacket(built.data, layers.LinkTypeRaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !test.checksum(sent) {
+			t.Errorf("%s: sent with %s checksum %#04x, received with %#04x", test.dst, test.mode,
+				sent.udp.Checksum, d.udp.Checksum)
+		}
+	}
+	if !l.rewrite.checksums.Preserves() || (checksumPolicy{mode: CSUM_COMPUTE}).Preserves() {
+		t.Errorf("only the policy with a preserve destination preserves checksums")
+	}
+}
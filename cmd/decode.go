@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Decoded holds the layers of a captured packet which we decode once in
+// handlePackets and then pass along to sendPacket
+type Decoded struct {
+	eth     layers.Ethernet
+	dot1q   layers.Dot1Q     // 802.1Q VLAN tag if present
+	loop    layers.Loopback  // BSD NULL/Loopback used for OpenVPN tunnels/etc
+	radio   layers.RadioTap  // 802.11 monitor mode interfaces
+	dot11   layers.Dot11     // 802.11 header
+	qos     layers.Dot11Data // what follows the QoS control of QoS data frames
+	llc     layers.LLC       // 802.11 data frames use LLC/SNAP
+	snap    layers.SNAP      // EtherType of 802.11 data frames
+	ip4     layers.IPv4      // we only support v4
+	udp     layers.UDP
+	payload gopacket.Payload
+	layers  []gopacket.LayerType // layers which were decoded
+}
+
+// decodePacket decodes the packet data for the given link type.  The returned
+// Decoded always contains whatever layers we were able to decode, even if
+// there is an error.
+func decodePacket(data []byte, linkType layers.LinkType) (*Decoded, error) {
+	d := &Decoded{
+		layers: []gopacket.LayerType{},
+	}
+	var parser *gopacket.DecodingLayerParser
+
+	switch linkType.String() {
+	case layers.LinkTypeNull.String(), layers.LinkTypeLoop.String():
+		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeLoopback, &d.loop, &d.ip4, &d.udp)
+	case layers.LinkTypeEthernet.String():
+		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &d.eth, &d.dot1q, &d.ip4, &d.udp)
+	case layers.LinkTypeRaw.String():
+		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &d.ip4, &d.udp)
+	case layers.LinkTypeIEEE80211Radio.String():
+		// 802.11 data frames carry IPv4 via LLC/SNAP
+		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeRadioTap, &d.radio, &d.dot11,
+			&d.qos, &d.llc, &d.snap, &d.ip4, &d.udp)
+	default:
+		return d, fmt.Errorf("unsupported linktype: %s", linkType.String())
+	}
+
+	// We stop at the UDP layer and forward whatever it contains.  This
+	// also means we don't care which application protocol gopacket thinks
+	// lives on the port.
+	parser.IgnoreUnsupported = true
+	if err := parser.DecodeLayers(data, &d.layers); err != nil {
+		return d, err
+	}
+	if d.Has(layers.LayerTypeUDP) {
+		d.payload = gopacket.Payload(d.udp.Payload)
+	} else if d.Has(layers.LayerTypeIPv4) {
+		d.decodeUDPLite()
+	}
+	return d, nil
+}
+
+// Has returns true if the given layer was decoded
+func (d *Decoded) Has(layerType gopacket.LayerType) bool {
+	for _, lt := range d.layers {
+		if lt == layerType {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIPv4UDP returns true if we decoded both an IPv4 and UDP header
+func (d *Decoded) IsIPv4UDP() bool {
+	return d.Has(layers.LayerTypeIPv4) && d.Has(layers.LayerTypeUDP)
+}
+
+// IsIPv6 returns true if the L2 header says this is an IPv6 packet, which
+// we don't support
+func (d *Decoded) IsIPv6() bool {
+	switch {
+	case d.Has(layers.LayerTypeDot1Q):
+		return d.dot1q.Type == layers.EthernetTypeIPv6
+	case d.Has(layers.LayerTypeEthernet):
+		return d.eth.EthernetType == layers.EthernetTypeIPv6
+	case d.Has(layers.LayerTypeSNAP):
+		return d.snap.Type == layers.EthernetTypeIPv6
+	case d.Has(layers.LayerTypeLoopback):
+		switch d.loop.Family {
+		case layers.ProtocolFamilyIPv6BSD, layers.ProtocolFamilyIPv6FreeBSD,
+			layers.ProtocolFamilyIPv6Darwin, layers.ProtocolFamilyIPv6Linux:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testFrame returns the IPv4 packet with the link layer header of linkType
+func testFrame(t testing.TB, linkType layers.LinkType, packet []byte) []byte {
+	t.Helper()
+	var link gopacket.SerializableLayer
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		link = &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+			DstMAC:       layers.EthernetBroadcast,
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+	case layers.LinkTypeNull:
+		link = &layers.Loopback{Family: layers.ProtocolFamilyIPv4}
+	case layers.LinkTypeRaw:
+		return packet
+	default:
+		t.Fatalf("unsupported link type %s", linkType)
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{}, link, gopacket.Payload(packet)); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDecodePacket(t *testing.T) {
+	payload := []byte("hello world")
+	packet, _ := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 9003, payload)
+	for _, linkType := range []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeNull, layers.LinkTypeRaw} {
+		d, err := decodePacket(testFrame(t, linkType, packet.Data()), linkType)
+		if err != nil {
+			t.Fatalf("%s: %s", linkType, err)
+		}
+		if !d.IsIPv4UDP() || !d.ip4.SrcIP.Equal(net.ParseIP("10.0.0.5")) || d.udp.DstPort != 9003 ||
+			!bytes.Equal(d.payload, payload) {
+			t.Errorf("%s: decoded %v %s:%d", linkType, d.layers, d.ip4.SrcIP, d.udp.DstPort)
+		}
+	}
+	if _, err := decodePacket(packet.Data(), layers.LinkTypeFDDI); err == nil {
+		t.Errorf("FDDI should not be supported")
+	}
+}
+
+// Each captured packet is decoded once by decodePacket and the Decoded is
+// passed to sendPacket
+func BenchmarkDecodePacket(b *testing.B) {
+	packet, _ := testPacket(b, "10.0.0.5", "10.0.0.255", 5000, 9003, make([]byte, 512))
+	data := testFrame(b, layers.LinkTypeEthernet, packet.Data())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodePacket(data, layers.LinkTypeEthernet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// What we used to do: check the layers of a fully decoded packet when it is
+// captured and then decode it again to send it
+func BenchmarkDecodePacketTwice(b *testing.B) {
+	packet, _ := testPacket(b, "10.0.0.5", "10.0.0.255", 5000, 9003, make([]byte, 512))
+	data := testFrame(b, layers.LinkTypeEthernet, packet.Data())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default)
+		if p.NetworkLayer() == nil || p.TransportLayer() == nil {
+			b.Fatal("unable to decode packet")
+		}
+		if _, err := decodePacket(data, layers.LinkTypeEthernet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// We only forward IPv4, so IPv6 packets and destinations must not be
+// mistaken for packets we failed to forward
+func TestFamilyMismatch(t *testing.T) {
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP("fe80::5"), DstIP: net.ParseIP("ff02::c")}
+	udp := &layers.UDP{SrcPort: 5000, DstPort: 1900}
+	if err := udp.SetNetworkLayerForChecksum(ip6); err != nil {
+		t.Fatal(err)
+	}
+	serialize := func(ls ...gopacket.SerializableLayer) []byte {
+		buffer := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buffer, opts, append(ls, udp, gopacket.Payload("hello"))...); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Bytes()
+	}
+	eth := func(etherType layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{SrcMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, DstMAC: layers.EthernetBroadcast,
+			EthernetType: etherType}
+	}
+
+	// IPv6 packets on an IPv4 interface
+	tests := []struct {
+		name     string
+		linkType layers.LinkType
+		data     []byte
+	}{
+		{"ethernet", layers.LinkTypeEthernet, serialize(eth(layers.EthernetTypeIPv6), ip6)},
+		{"vlan", layers.LinkTypeEthernet, serialize(eth(layers.EthernetTypeDot1Q),
+			&layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeIPv6}, ip6)},
+		{"null", layers.LinkTypeNull, serialize(&layers.Loopback{Family: layers.ProtocolFamilyIPv6Linux}, ip6)},
+	}
+	for _, test := range tests {
+		d, _ := decodePacket(test.data, test.linkType)
+		if !d.IsIPv6() {
+			t.Errorf("%s: not an IPv6 packet", test.name)
+		}
+		l := Listen{iname: "eth0", label: "eth0", linkType: test.linkType, stats: &Stats{},
+			capture: Capture{snaplen: DEFAULT_SNAPLEN}}
+		packet := gopacket.NewPacket(test.data, test.linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		packet.Metadata().CaptureInfo = gopacket.CaptureInfo{Length: len(test.data), CaptureLength: len(test.data)}
+		l.processPacket(&SendPktFeed{}, packet, test.linkType)
+		if l.stats.Dropped(DropNonIPv4) != 1 || l.stats.Snapshot().Forwarded != 0 {
+			t.Errorf("%s: drops are %v", test.name, l.stats.Snapshot().Drops)
+		}
+	}
+	packet, _ := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+	if d, _ := decodePacket(testFrame(t, layers.LinkTypeEthernet, packet.Data()), layers.LinkTypeEthernet); d.IsIPv6() {
+		t.Errorf("IPv4 packet is IPv6")
+	}
+
+	// IPv4 packets to an IPv6 destination are dropped with a warning once
+	_, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+	l := Listen{iname: "eth1", label: "eth1", stats: &Stats{}}
+	for i := 0; i < 2; i++ {
+		err, _ := l.sendPacket(Send{srcif: "eth0", decoded: d}, net.ParseIP("fe80::9"))
+		if dropReasonOf(err) != DropNonIPv4Dst || !strings.Contains(err.Error(), "fe80::9 is not an IPv4 address") {
+			t.Errorf("sending to fe80::9: %v", err)
+		}
+	}
+	if l.familyWarned != 1 {
+		t.Errorf("didn't warn about our IPv6 destination")
+	}
+
+	// and we know some destinations are IPv6 when we start
+	cli := CLI{Interface: []string{"eth1"}, FixedIp: []string{"eth1@fe80::9", "eth1@10.0.0.9"}}
+	o, errs := parseInterfaceOptions(&cli)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "--fixed-ip eth1@fe80::9 IP address is not a valid IPv4 address") {
+		t.Errorf("expected an error for the IPv6 --fixed-ip, got %v", errs)
+	}
+	if len(o.fixedIPs["eth1"]) != 1 {
+		t.Errorf("fixed IPs are %v", o.fixedIPs)
+	}
+}
+
+// An 802.11 data frame from a monitor mode interface, with a radiotap header,
+// carrying an SSDP NOTIFY 10.0.0.5:5000 -> 239.255.255.250:1900
+const WIFI_FRAME = "000012002e48000010028509a000c4010000" + // radiotap: flags (FCS), rate, channel, signal, antenna
+	"08020000" + "01005e7ffffa" + "02000000aa01" + "02000000bb05" + "1000" + // dot11: data, FromDS
+	"aaaa03000000" + "0800" + // LLC/SNAP
+	"4500002500004000401140c90a000005effffffa" + // IPv4
+	"1388076c0011c1bc" + "4e4f54494659202a20" + // UDP "NOTIFY * "
+	"32f906f6" // FCS
+
+func TestDecodeWifi(t *testing.T) {
+	frame, err := hex.DecodeString(WIFI_FRAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same frame with a different 802.11 header and a new FCS
+	reframe := func(dot11 string) []byte {
+		header, err := hex.DecodeString(dot11)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := append(append(append([]byte{}, frame[:18]...), header...), frame[42:len(frame)-4]...)
+		fcs := make([]byte, 4)
+		binary.LittleEndian.PutUint32(fcs, crc32.ChecksumIEEE(data[18:]))
+		return append(data, fcs...)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		udp  bool
+	}{
+		{"data", frame, true},
+		{"QoS data", reframe("88020000" + "01005e7ffffa" + "02000000aa01" + "02000000bb05" + "1000" + "0000"), true},
+		{"beacon", reframe("80000000" + "ffffffffffff" + "02000000aa01" + "02000000aa01" + "1000"), false},
+	}
+	for _, test := range tests {
+		d, _ := decodePacket(test.data, layers.LinkTypeIEEE80211Radio)
+		if d.IsIPv4UDP() != test.udp {
+			t.Fatalf("%s: decoded %v", test.name, d.layers)
+		}
+		if !d.dot11.ChecksumValid() {
+			t.Errorf("%s: invalid FCS", test.name)
+		}
+		if !test.udp {
+			continue
+		}
+		if !d.ip4.SrcIP.Equal(net.ParseIP("10.0.0.5")) || d.udp.DstPort != 1900 || string(d.payload) != "NOTIFY * " {
+			t.Errorf("%s: decoded %s:%d %q", test.name, d.ip4.SrcIP, d.udp.DstPort, d.payload)
+		}
+		if !d.checksumsValid() {
+			t.Errorf("%s: checksums are invalid", test.name)
+		}
+	}
+}
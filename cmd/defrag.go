@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long we hold onto an incomplete set of fragments
+const DEFRAG_TIMEOUT = 30 * time.Second
+
+// isFragment returns true if the IPv4 header is for a fragmented packet
+func isFragment(ip4 *layers.IPv4) bool {
+	return ip4.Flags&layers.IPv4MoreFragments != 0 || ip4.FragOffset != 0
+}
+
+// defragPacket passes an IPv4 fragment to our defragmenter.  Returns true
+// when we have a complete datagram along with the reassembled packet and
+// its link type which is always LinkTypeRaw.  Otherwise returns the
+// linkType of the fragment.
+func (l *Listen) defragPacket(packet gopacket.Packet, linkType layers.LinkType, ip4 *layers.IPv4) (gopacket.Packet, layers.LinkType, bool) {
+	atomic.AddUint64(&l.stats.Fragments, 1)
+	md := packet.Metadata()
+	out, err := l.capture.defragger.DefragIPv4WithTimestamp(ip4, md.Timestamp)
+	if err != nil {
+		log.Debugf("%s: Unable to defragment packet: %s", l.label, err)
+		l.drop(DropDefragError, packet)
+		return nil, linkType, false
+	} else if out == nil {
+		// need more fragments
+		return nil, linkType, false
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buffer, opts, out, gopacket.Payload(out.Payload)); err != nil {
+		log.Warnf("%s: Unable to serialize defragmented packet: %s", l.label, err)
+		return nil, linkType, false
+	}
+
+	data := buffer.Bytes()
+	reassembled := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Lazy)
+	rmd := reassembled.Metadata()
+	rmd.CaptureInfo = md.CaptureInfo
+	rmd.CaptureLength = len(data)
+	rmd.Length = len(data)
+	log.Debugf("%s: reassembled %d byte datagram", l.label, len(data))
+	return reassembled, layers.LinkTypeRaw, true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+)
+
+// Each fragment is counted as it arrives, but a datagram is only received
+// and forwarded once all of its fragments have been reassembled
+func TestProcessPacketFragments(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 30)
+	packet, _ := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, payload)
+	datagram := packet.Data()[20:] // the UDP header and payload
+
+	// fragment the datagram at 8 byte aligned offsets
+	fragment := func(offset, end int) []byte {
+		ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: 1234, Protocol: layers.IPProtocolUDP,
+			SrcIP: net.ParseIP("10.0.0.5"), DstIP: net.ParseIP("10.0.0.255"), FragOffset: uint16(offset / 8)}
+		if end < len(datagram) {
+			ip4.Flags = layers.IPv4MoreFragments
+		} else {
+			end = len(datagram)
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buffer, opts, ip4, gopacket.Payload(datagram[offset:end])); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		offsets []int // of each fragment in the order they arrive
+	}{
+		{"in order", []int{0, 104, 208}},
+		{"out of order", []int{208, 0, 104}},
+		{"two", []int{0, 160}},
+	}
+	for _, test := range tests {
+		sendq := make(chan Send, 4)
+		s := &SendPktFeed{}
+		s.RegisterSender(sendq, make(chan Send, 4), &Stats{}, "eth1")
+		l := Listen{iname: "eth0", label: "eth0", linkType: layers.LinkTypeRaw, stats: &Stats{},
+			capture: Capture{snaplen: DEFAULT_SNAPLEN, defragger: ip4defrag.NewIPv4Defragmenter()}}
+
+		for i, offset := range test.offsets {
+			end := len(datagram)
+			for _, next := range test.offsets {
+				if next > offset && next < end {
+					end = next
+				}
+			}
+			data := fragment(offset, end)
+			p := gopacket.NewPacket(data, layers.LinkTypeRaw, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+			p.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: time.Now(), Length: len(data), CaptureLength: len(data)}
+			l.processPacket(s, p, layers.LinkTypeRaw)
+
+			snap := l.stats.Snapshot()
+			last := i == len(test.offsets)-1
+			if snap.Fragments != uint64(i+1) {
+				t.Errorf("%s: %d fragments after fragment %d", test.name, snap.Fragments, i+1)
+			}
+			if last != (snap.Received == 1) || last != (snap.Forwarded == 1) {
+				t.Errorf("%s: received %d and forwarded %d after fragment %d", test.name, snap.Received, snap.Forwarded, i+1)
+			}
+		}
+
+		select {
+		case sndpkt := <-sendq:
+			if !bytes.Equal(sndpkt.decoded.payload, payload) || sndpkt.linkType != layers.LinkTypeRaw {
+				t.Errorf("%s: forwarded a %s packet of %d bytes", test.name, sndpkt.linkType, len(sndpkt.decoded.payload))
+			}
+		default:
+			t.Errorf("%s: the reassembled datagram wasn't forwarded", test.name)
+		}
+		if len(sendq) != 0 {
+			t.Errorf("%s: forwarded %d more packets", test.name, len(sendq))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FORWARD_DELAY_MAX = 1000 * time.Millisecond // longest --forward-delay we allow
+	DELAY_BUFFER_SIZE = 10000                   // packets we hold for --forward-delay
+)
+
+// parseForwardDelay parses a --forward-delay of <msec> or <min>-<max> msec
+func parseForwardDelay(value string) (time.Duration, time.Duration, error) {
+	split := strings.SplitN(value, "-", 2)
+	if len(split) == 1 {
+		split = append(split, split[0])
+	}
+	min, err := strconv.ParseInt(split[0], 10, 64)
+	if err != nil || min < 0 {
+		return 0, 0, fmt.Errorf("%s is not a valid delay in msec", value)
+	}
+	max, err := strconv.ParseInt(split[1], 10, 64)
+	if err != nil || max < min {
+		return 0, 0, fmt.Errorf("%s is not a valid delay in msec", value)
+	}
+	if time.Duration(max)*time.Millisecond > FORWARD_DELAY_MAX {
+		return 0, 0, fmt.Errorf("%s exceeds the max delay of %s", value, FORWARD_DELAY_MAX)
+	}
+	return time.Duration(min) * time.Millisecond, time.Duration(max) * time.Millisecond, nil
+}
+
+// delayedSend is a packet waiting in our delayQueue
+type delayedSend struct {
+	send Send
+	due  time.Time
+}
+
+// delayQueue holds packets for a fixed or random delay before they are sent
+// so that the delay happens outside of handlePackets
+type delayQueue struct {
+	min   time.Duration
+	max   time.Duration
+	last  time.Time // due time of the last packet queued
+	queue chan delayedSend
+}
+
+func newDelayQueue(min, max time.Duration) *delayQueue {
+	return &delayQueue{
+		min:   min,
+		max:   max,
+		queue: make(chan delayedSend, DELAY_BUFFER_SIZE),
+	}
+}
+
+// Push queues the packet to be sent after our delay.  Packets are never
+// due before a packet queued ahead of them so we never reorder them.
+// Returns false without waiting if the queue is full.
+func (d *delayQueue) Push(s Send) bool {
+	delay := d.min
+	if d.max > d.min {
+		// #nosec G404 -- jitter doesn't need to be cryptographically secure
+		delay += time.Duration(rand.Int63n(int64(d.max - d.min + 1)))
+	}
+	due := time.Now().Add(delay)
+	if due.Before(d.last) {
+		due = d.last
+	}
+	select {
+	case d.queue <- delayedSend{send: s, due: due}:
+		d.last = due
+		return true
+	default:
+		return false
+	}
+}
+
+// Run sends each packet via send once it is due.  Returns once done is
+// closed, dropping any packets which are still queued.
+func (d *delayQueue) Run(send func(Send), done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case ds := <-d.queue:
+			if wait := time.Until(ds.due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-done:
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+			send(ds.send)
+		}
+	}
+}
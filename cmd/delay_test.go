@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDelayQueuePushFull(t *testing.T) {
+	d := newDelayQueue(time.Second, time.Second)
+	for i := 0; i < DELAY_BUFFER_SIZE; i++ {
+		if !d.Push(Send{}) {
+			t.Fatalf("Push %d failed before the queue was full", i)
+		}
+	}
+	// a full queue must never block the capture goroutine
+	if d.Push(Send{}) {
+		t.Errorf("Push succeeded with a full queue")
+	}
+}
+
+func TestDelayQueueRun(t *testing.T) {
+	d := newDelayQueue(0, 20*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		d.Push(Send{srcif: string(rune('a' + i))})
+	}
+
+	done := make(chan struct{})
+	sent := make(chan Send, 10)
+	exited := make(chan struct{})
+	start := time.Now()
+	go func() {
+		d.Run(func(s Send) { sent <- s }, done)
+		close(exited)
+	}()
+	for i := 0; i < 10; i++ {
+		s := <-sent
+		if want := string(rune('a' + i)); s.srcif != want {
+			t.Errorf("packet %d was %s, expected %s", i, s.srcif, want)
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("delay took %s", time.Since(start))
+	}
+
+	// packets still waiting are dropped once we shutdown
+	d.min, d.max = time.Hour, time.Hour
+	d.Push(Send{})
+	close(done)
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatalf("Run did not return after done was closed")
+	}
+	if len(sent) != 0 {
+		t.Errorf("sent a packet after done was closed")
+	}
+}
+
+func TestParseForwardDelay(t *testing.T) {
+	tests := []struct {
+		value string
+		err   string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"0", "", 0, 0},
+		{"50", "", 50 * time.Millisecond, 50 * time.Millisecond},
+		{"10-100", "", 10 * time.Millisecond, 100 * time.Millisecond},
+		{"1000", "", time.Second, time.Second},
+		{"0-1000", "", 0, time.Second},
+		{"1001", "exceeds the max delay of 1s", 0, 0},
+		{"10-2000", "exceeds the max delay of 1s", 0, 0},
+		{"-5", "is not a valid delay in msec", 0, 0},
+		{"100-10", "is not a valid delay in msec", 0, 0},
+		{"10-", "is not a valid delay in msec", 0, 0},
+		{"1s", "is not a valid delay in msec", 0, 0},
+	}
+	for _, test := range tests {
+		min, max, err := parseForwardDelay(test.value)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.value, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.value, err)
+		}
+		if min != test.min || max != test.max {
+			t.Errorf("%s: parsed %s-%s", test.value, min, max)
+		}
+	}
+}
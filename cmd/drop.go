@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	log "github.com/sirupsen/logrus"
+)
+
+// DropReason is why a packet was dropped instead of being forwarded
+type DropReason int
+
+// DropNone is the DropReason of a packet which isn't dropped
+const DropNone DropReason = -1
+
+// Reasons a packet is dropped instead of being forwarded.  New reasons must
+// be added before DROP_REASONS and to dropReasonNames.
+const (
+	DropNonIPv4     DropReason = iota // not an IPv4 packet
+	DropNonUDP                        // IPv4 packet which isn't UDP (or --udplite)
+	DropDecodeError                   // gopacket was unable to decode the packet
+	DropDefragError                   // unable to reassemble IPv4 fragments
+	DropUnicast                       // --broadcast-only and dst is a unicast IP
+	DropTruncated                     // packet is larger than --snaplen
+	DropUnscheduled                   // packet arrived outside of the --schedule
+	DropRepeat                        // --suppress-repeats and the payload hasn't changed
+	DropOwnAddress                    // --drop-own-broadcasts and src is one of our IPs
+	DropSrcOUI                        // src MAC isn't one of the --src-oui
+	DropHook                          // the PacketHook dropped the packet
+	DropRateLimit                     // over the --rate-limit-bytes
+	DropMcastGroup                    // not one of the --multicast-groups
+	DropChecksum                      // --verify-checksum and the checksum is wrong
+	DropDenied                        // payload matches a --deny-payload signature
+	DropPayloadLen                    // not one of the --payload-length(s)
+	DropQueueFull                     // the send queue is over the --high-watermark
+	DropMTU                           // packet is larger than the --mtu-override
+	DropNonIPv4Dst                    // destination isn't an IPv4 address
+	DropSendError                     // libpcap was unable to send the packet
+	DropNatFull                       // every --nat-port-range port is in use
+	DropNatUnknown                    // sent to a relay port we have no translation for
+	DropSrcPort                       // not from one of the --src-port(s)
+	DropRetryFailed                   // still failing to send after every --send-retries retry
+	DROP_REASONS                      // number of DropReasons
+)
+
+// The stable names of each DropReason used in our logs and stats
+var dropReasonNames = [DROP_REASONS]string{
+	DropNonIPv4:     "non-ipv4",
+	DropNonUDP:      "non-udp",
+	DropDecodeError: "decode-error",
+	DropDefragError: "defrag-error",
+	DropUnicast:     "unicast",
+	DropTruncated:   "truncated",
+	DropUnscheduled: "unscheduled",
+	DropRepeat:      "repeat",
+	DropOwnAddress:  "own-address",
+	DropSrcOUI:      "src-oui",
+	DropHook:        "hook",
+	DropRateLimit:   "rate-limit",
+	DropMcastGroup:  "mcast-group",
+	DropChecksum:    "checksum",
+	DropDenied:      "denied",
+	DropPayloadLen:  "payload-len",
+	DropQueueFull:   "queue-full",
+	DropMTU:         "mtu",
+	DropNonIPv4Dst:  "non-ipv4-dst",
+	DropSendError:   "send-error",
+	DropNatFull:     "nat-full",
+	DropNatUnknown:  "nat-unknown",
+	DropSrcPort:     "src-port",
+	DropRetryFailed: "retry-failed",
+}
+
+// String returns the stable name of the reason
+func (r DropReason) String() string {
+	if r == DropNone {
+		return "none"
+	}
+	if r < 0 || r >= DROP_REASONS {
+		return fmt.Sprintf("unknown-%d", int(r))
+	}
+	return dropReasonNames[r]
+}
+
+// dropError is an error which caused us to drop a packet for a reason
+type dropError struct {
+	reason DropReason
+	err    error
+}
+
+func (e dropError) Error() string {
+	return e.err.Error()
+}
+
+// dropReasonOf returns the reason a packet was dropped because of err,
+// which is a DropSendError unless it is a dropError
+func dropReasonOf(err error) DropReason {
+	if derr, ok := err.(dropError); ok {
+		return derr.reason
+	}
+	return DropSendError
+}
+
+// dropSampler logs 1-in-rate dropped packets at debug level
+type dropSampler struct {
+	rate  uint64 // log every Nth drop, 0 disables logging
+	count uint64 // number of drops we've seen
+}
+
+// dropLog is shared by all of our interfaces
+var dropLog = dropSampler{rate: 100}
+
+// SetRate changes how often we log dropped packets
+func (d *dropSampler) SetRate(rate uint64) {
+	atomic.StoreUint64(&d.rate, rate)
+}
+
+// Sample returns true if this drop should be logged
+func (d *dropSampler) Sample() bool {
+	rate := atomic.LoadUint64(&d.rate)
+	if rate == 0 {
+		return false
+	}
+	return atomic.AddUint64(&d.count, 1)%rate == 1%rate
+}
+
+// Log records a dropped packet, but only logs a sample of them to avoid
+// flooding the logs under load
+func (d *dropSampler) Log(iname string, reason DropReason, packet gopacket.Packet) {
+	if !d.Sample() {
+		return
+	}
+	log.Debugf("drop: iface=%s reason=%s packet=[%s]", iname, reason, packetSummary(packet))
+}
+
+// drop counts a packet we dropped for the reason and logs a sample of them
+func (l *Listen) drop(reason DropReason, packet gopacket.Packet) {
+	l.stats.CountDrop(reason)
+	dropLog.Log(l.label, reason, packet)
+}
+
+// packetSummary returns a short, single line description of a packet
+func packetSummary(packet gopacket.Packet) string {
+	if packet == nil {
+		return "nil"
+	}
+	src, dst := "?", "?"
+	if nl := packet.NetworkLayer(); nl != nil {
+		flow := nl.NetworkFlow()
+		src, dst = flow.Src().String(), flow.Dst().String()
+	}
+	proto := "?"
+	if tl := packet.TransportLayer(); tl != nil {
+		flow := tl.TransportFlow()
+		src = fmt.Sprintf("%s:%s", src, flow.Src().String())
+		dst = fmt.Sprintf("%s:%s", dst, flow.Dst().String())
+		proto = tl.LayerType().String()
+	} else if nl := packet.NetworkLayer(); nl != nil {
+		proto = nl.LayerType().String()
+	}
+	return fmt.Sprintf("%s %s -> %s len=%d", proto, src, dst, len(packet.Data()))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func TestDropReasonNames(t *testing.T) {
+	if len(dropReasonNames) != int(DROP_REASONS) {
+		t.Fatalf("%d names for %d reasons", len(dropReasonNames), DROP_REASONS)
+	}
+	seen := map[string]DropReason{}
+	for reason := DropReason(0); reason < DROP_REASONS; reason++ {
+		name := reason.String()
+		if name == "" {
+			t.Errorf("DropReason %d has no name", int(reason))
+		} else if other, ok := seen[name]; ok {
+			t.Errorf("DropReason %d and %d are both %s", int(other), int(reason), name)
+		}
+		seen[name] = reason
+	}
+	if DropNone.String() != "none" {
+		t.Errorf("DropNone is %s", DropNone)
+	}
+	if DropReason(100).String() != "unknown-100" || DropReason(-2).String() != "unknown--2" {
+		t.Errorf("unknown reasons are %s and %s", DropReason(100), DropReason(-2))
+	}
+}
+
+func TestDropSampler(t *testing.T) {
+	tests := []struct {
+		rate    uint64
+		sampled []bool
+	}{
+		{0, []bool{false, false, false}},
+		{1, []bool{true, true, true}},
+		{3, []bool{true, false, false, true, false, false, true}},
+	}
+	for _, test := range tests {
+		d := dropSampler{}
+		d.SetRate(test.rate)
+		for i, expected := range test.sampled {
+			if sampled := d.Sample(); sampled != expected {
+				t.Errorf("rate %d: drop %d sampled %v", test.rate, i+1, sampled)
+			}
+		}
+	}
+}
+
+// The counters by name must always agree with the drops by reason
+func TestStatsCountDrop(t *testing.T) {
+	legacy := map[DropReason]func(Stats) uint64{
+		DropNonIPv4:     func(s Stats) uint64 { return s.NonIPv4 },
+		DropNonUDP:      func(s Stats) uint64 { return s.NonUDP },
+		DropUnscheduled: func(s Stats) uint64 { return s.Unscheduled },
+		DropRepeat:      func(s Stats) uint64 { return s.Repeats },
+		DropQueueFull:   func(s Stats) uint64 { return s.QueueDrops },
+		DropRateLimit:   func(s Stats) uint64 { return s.RateLimited },
+		DropChecksum:    func(s Stats) uint64 { return s.BadChecksums },
+		DropDenied:      func(s Stats) uint64 { return s.Denied },
+		DropPayloadLen:  func(s Stats) uint64 { return s.PayloadLens },
+	}
+	for _, reason := range sendErrorReasons {
+		legacy[reason] = func(s Stats) uint64 { return s.SendErrors }
+	}
+	total := func(s Stats) uint64 {
+		return s.NonIPv4 + s.NonUDP + s.Unscheduled + s.Repeats + s.QueueDrops + s.RateLimited +
+			s.BadChecksums + s.Denied + s.PayloadLens + s.SendErrors
+	}
+
+	for reason := DropReason(0); reason < DROP_REASONS; reason++ {
+		s := &Stats{}
+		s.CountDrop(reason)
+		s.CountDrop(reason)
+		snap := s.Snapshot()
+		if len(snap.Drops) != 1 || snap.Drops[reason.String()] != 2 || s.Dropped(reason) != 2 {
+			t.Errorf("%s: drops are %v", reason, snap.Drops)
+		}
+		expected := uint64(0)
+		if counter, ok := legacy[reason]; ok {
+			expected = 2
+			if counter(snap) != 2 {
+				t.Errorf("%s: counted %d", reason, counter(snap))
+			}
+		}
+		if total(snap) != expected {
+			t.Errorf("%s: counted %d drops by name", reason, total(snap))
+		}
+	}
+
+	s := &Stats{}
+	s.CountDrop(DropNone)
+	s.CountDrop(DROP_REASONS)
+	if snap := s.Snapshot(); len(snap.Drops) != 0 || total(snap) != 0 {
+		t.Errorf("invalid reasons were counted: %+v", snap)
+	}
+}
+
+// Each packet processed by processPacket is dropped for the right reason
+func TestProcessPacketDrops(t *testing.T) {
+	Interfaces["drop0"] = pcap.Interface{Name: "drop0",
+		Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.1"), Netmask: net.CIDRMask(24, 32),
+			Broadaddr: net.ParseIP("10.0.0.255")}}}
+	defer delete(Interfaces, "drop0")
+
+	udp := func(src, dst string, srcPort uint16, payload string) []byte {
+		packet, _ := testPacket(t, src, dst, srcPort, 1900, []byte(payload))
+		return testFrame(t, layers.LinkTypeEthernet, packet.Data())
+	}
+	frame := func(etherType layers.EthernetType, ipv4 *layers.IPv4, payload []byte) []byte {
+		buffer := gopacket.NewSerializeBuffer()
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, DstMAC: layers.EthernetBroadcast,
+			EthernetType: etherType}
+		ls := []gopacket.SerializableLayer{eth}
+		if ipv4 != nil {
+			ls = append(ls, ipv4)
+		}
+		ls = append(ls, gopacket.Payload(payload))
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buffer, opts, ls...); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Bytes()
+	}
+	icmp := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolICMPv4,
+		SrcIP: net.ParseIP("10.0.0.5"), DstIP: net.ParseIP("10.0.0.255")}
+	badChecksum := udp("10.0.0.5", "10.0.0.255", 5000, "hello")
+	badChecksum[14+20+8] ^= 0xff // frames are padded, so corrupt the payload instead of the last byte
+
+	denylist, err := newPayloadDenylist([]string{"hex:dead"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched, err := parseSchedule("00:00-00:01", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, group, _ := net.ParseCIDR("239.255.255.250/32")
+	noon := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	repeats := newRepeatFilter(time.Minute)
+	if repeat, hash := repeats.Repeat("10.0.0.5:1900", []byte("hello"), noon); !repeat {
+		repeats.Record("10.0.0.5:1900", hash, noon)
+	}
+
+	tests := []struct {
+		data      []byte
+		truncated bool
+		policy    Policy
+		reason    DropReason
+	}{
+		{udp("10.0.0.5", "10.0.0.255", 5000, "hello"), true, Policy{}, DropTruncated},
+		{frame(layers.EthernetTypeARP, nil, make([]byte, 28)), false, Policy{}, DropNonIPv4},
+		{frame(layers.EthernetTypeIPv4, icmp, []byte("ping")), false, Policy{}, DropNonUDP},
+		{udp("10.0.0.5", "10.0.0.255", 5000, "hello")[:14+10], false, Policy{}, DropDecodeError},
+		{badChecksum, false, Policy{verifyCsum: true}, DropChecksum},
+		{udp("10.0.0.5", "10.0.0.255", 5000, "hello"), false, Policy{srcOUIs: [][]byte{{0, 0x11, 0x22}}}, DropSrcOUI},
+		{udp("10.0.0.1", "10.0.0.255", 5000, "hello"), false, Policy{ownAddrs: map[string]bool{"10.0.0.1": true}},
+			DropOwnAddress},
+		{udp("10.0.0.5", "10.0.0.9", 5000, "hello"), false, Policy{iname: "drop0", broadcastOnly: true}, DropUnicast},
+		{udp("10.0.0.5", "224.0.0.251", 5000, "hello"), false, Policy{mcastGroups: []*net.IPNet{group}}, DropMcastGroup},
+		{udp("10.0.0.5", "10.0.0.255", 5000, "hello"), false, Policy{srcPorts: map[uint16]bool{1900: true}}, DropSrcPort},
+		{udp("10.0.0.5", "10.0.0.255", 5000, "hello"), false, Policy{payloadLens: []lengthRange{{1, 2}}}, DropPayloadLen},
+		{udp("10.0.0.5", "10.0.0.255", 5000, "\xde\xad"), false, Policy{denylist: denylist}, DropDenied},
+		{udp("10.0.0.5", "10.0.0.255", 5000, "hello"), false, Policy{schedule: sched}, DropUnscheduled},
+		{udp("10.0.0.5", "10.0.0.255", 5000, "hello"), false, Policy{repeats: repeats}, DropRepeat},
+		{udp("10.0.0.5", "10.0.0.255", 5000, "hello"), false, Policy{byteLimit: newByteLimiter(10)}, DropRateLimit},
+	}
+	for _, test := range tests {
+		l := Listen{iname: "drop0", label: "drop0", linkType: layers.LinkTypeEthernet,
+			stats: &Stats{}, policy: test.policy, capture: Capture{snaplen: DEFAULT_SNAPLEN}}
+		packet := gopacket.NewPacket(test.data, layers.LinkTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		md := packet.Metadata()
+		md.Timestamp = noon.Add(time.Second)
+		md.CaptureLength = len(test.data)
+		md.Length = len(test.data)
+		if test.truncated {
+			md.Length += 100
+		}
+		l.processPacket(&SendPktFeed{}, packet, layers.LinkTypeEthernet)
+
+		snap := l.stats.Snapshot()
+		if len(snap.Drops) != 1 || snap.Drops[test.reason.String()] != 1 {
+			t.Errorf("%s: drops are %v", test.reason, snap.Drops)
+		}
+		if snap.Forwarded != 0 || snap.DroppedBytes == 0 && test.reason != DropTruncated {
+			t.Errorf("%s: forwarded %d, dropped %d bytes", test.reason, snap.Forwarded, snap.DroppedBytes)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	TEE_ENCAP_RAW    = "raw"    // the packet as it was sent
+	TEE_ENCAP_FRAMED = "framed" // our header followed by the packet
+)
+
+const (
+	FRAME_MAGIC       = 0x5550 // "UP"
+	FRAME_VERSION_1   = 1      // no source interface
+	FRAME_VERSION     = 2
+	FRAME_HEADER_SIZE = 8 // not including the v2 source interface
+	FRAME_MAX_SRCIF   = 255
+)
+
+// teeFrame is a packet we sent along with its link type and the interface
+// we received it on
+type teeFrame struct {
+	linkType layers.LinkType
+	srcif    string
+	packet   []byte
+}
+
+// Encapsulator wraps the packets we copy to a --tee peer so another
+// instance is able to unwrap them
+type Encapsulator interface {
+	Name() string
+	Encapsulate(frame teeFrame) []byte
+	Decapsulate(data []byte) (teeFrame, error)
+}
+
+// newEncapsulator returns the Encapsulator for a --tee-encap
+func newEncapsulator(name string) (Encapsulator, error) {
+	switch name {
+	case TEE_ENCAP_RAW:
+		return rawEncap{}, nil
+	case TEE_ENCAP_FRAMED:
+		return framedEncap{}, nil
+	}
+	return nil, fmt.Errorf("unsupported encapsulation: %s", name)
+}
+
+// rawEncap sends the packet unchanged.  The link type isn't sent, so the
+// receiver has to assume Ethernet.
+type rawEncap struct{}
+
+func (e rawEncap) Name() string {
+	return TEE_ENCAP_RAW
+}
+
+func (e rawEncap) Encapsulate(frame teeFrame) []byte {
+	return frame.packet
+}
+
+func (e rawEncap) Decapsulate(data []byte) (teeFrame, error) {
+	return teeFrame{linkType: layers.LinkTypeEthernet, packet: data}, nil
+}
+
+// framedEncap prefixes the packet with a header:
+//
+//	magic (2) | version (1) | reserved (1) | link type (2) | packet length (2) |
+//	source interface length (1) | source interface (0-255)
+//
+// All values are in network byte order.  Version 1 frames don't have the
+// source interface fields.
+type framedEncap struct{}
+
+func (e framedEncap) Name() string {
+	return TEE_ENCAP_FRAMED
+}
+
+func (e framedEncap) Encapsulate(frame teeFrame) []byte {
+	srcif := frame.srcif
+	if len(srcif) > FRAME_MAX_SRCIF {
+		srcif = srcif[:FRAME_MAX_SRCIF]
+	}
+	header := FRAME_HEADER_SIZE + 1 + len(srcif)
+	data := make([]byte, header+len(frame.packet))
+	binary.BigEndian.PutUint16(data[0:], FRAME_MAGIC)
+	data[2] = FRAME_VERSION
+	binary.BigEndian.PutUint16(data[4:], uint16(frame.linkType))
+	binary.BigEndian.PutUint16(data[6:], uint16(len(frame.packet)))
+	data[FRAME_HEADER_SIZE] = uint8(len(srcif))
+	copy(data[FRAME_HEADER_SIZE+1:], srcif)
+	copy(data[header:], frame.packet)
+	return data
+}
+
+func (e framedEncap) Decapsulate(data []byte) (teeFrame, error) {
+	if len(data) < FRAME_HEADER_SIZE {
+		return teeFrame{}, fmt.Errorf("frame is only %d bytes", len(data))
+	}
+	if magic := binary.BigEndian.Uint16(data[0:]); magic != FRAME_MAGIC {
+		return teeFrame{}, fmt.Errorf("invalid frame magic: 0x%04x", magic)
+	}
+	frame := teeFrame{
+		linkType: layers.LinkType(binary.BigEndian.Uint16(data[4:])),
+	}
+	header := FRAME_HEADER_SIZE
+	switch data[2] {
+	case FRAME_VERSION_1:
+	case FRAME_VERSION:
+		if len(data) < header+1 || len(data) < header+1+int(data[header]) {
+			return teeFrame{}, fmt.Errorf("frame is too short for the source interface")
+		}
+		frame.srcif = string(data[header+1 : header+1+int(data[header])])
+		header += 1 + int(data[header])
+	default:
+		return teeFrame{}, fmt.Errorf("unsupported frame version: %d", data[2])
+	}
+	length := int(binary.BigEndian.Uint16(data[6:]))
+	if len(data)-header != length {
+		return teeFrame{}, fmt.Errorf("frame length is %d, but header says %d", len(data)-header, length)
+	}
+	frame.packet = data[header:]
+	return frame, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestFramedEncapRoundTrip(t *testing.T) {
+	encap, err := newEncapsulator(TEE_ENCAP_FRAMED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		frame teeFrame
+		srcif string // expected after the round trip
+	}{
+		{"ethernet", teeFrame{layers.LinkTypeEthernet, "eth0", []byte("hello world")}, "eth0"},
+		{"raw", teeFrame{layers.LinkTypeRaw, "netns:c1:tun0", []byte{0x45, 0, 0, 20}}, "netns:c1:tun0"},
+		{"no srcif", teeFrame{layers.LinkTypeNull, "", []byte{2, 0, 0, 0}}, ""},
+		{"empty", teeFrame{layers.LinkTypeEthernet, "eth1", []byte{}}, "eth1"},
+		{"long srcif", teeFrame{layers.LinkTypeEthernet, strings.Repeat("x", 300), []byte("data")},
+			strings.Repeat("x", FRAME_MAX_SRCIF)},
+	}
+	for _, test := range tests {
+		data := encap.Encapsulate(test.frame)
+		if data[2] != FRAME_VERSION {
+			t.Errorf("%s: version %d", test.name, data[2])
+		}
+		if len(data) != FRAME_HEADER_SIZE+1+len(test.srcif)+len(test.frame.packet) {
+			t.Errorf("%s: frame is %d bytes", test.name, len(data))
+		}
+		frame, err := encap.Decapsulate(data)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if frame.linkType != test.frame.linkType || frame.srcif != test.srcif ||
+			!bytes.Equal(frame.packet, test.frame.packet) {
+			t.Errorf("%s: decoded %+v", test.name, frame)
+		}
+	}
+}
+
+// Frames from instances which don't send the source interface still decode
+func TestFramedEncapVersion1(t *testing.T) {
+	packet := []byte("hello world")
+	data := make([]byte, FRAME_HEADER_SIZE+len(packet))
+	binary.BigEndian.PutUint16(data[0:], FRAME_MAGIC)
+	data[2] = FRAME_VERSION_1
+	binary.BigEndian.PutUint16(data[4:], uint16(layers.LinkTypeEthernet))
+	binary.BigEndian.PutUint16(data[6:], uint16(len(packet)))
+	copy(data[FRAME_HEADER_SIZE:], packet)
+
+	frame, err := framedEncap{}.Decapsulate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.linkType != layers.LinkTypeEthernet || frame.srcif != "" || !bytes.Equal(frame.packet, packet) {
+		t.Errorf("decoded %+v", frame)
+	}
+}
+
+func TestFramedEncapInvalid(t *testing.T) {
+	valid := framedEncap{}.Encapsulate(teeFrame{layers.LinkTypeEthernet, "eth0", []byte("hello")})
+	modify := func(fn func([]byte) []byte) []byte {
+		data := make([]byte, len(valid))
+		copy(data, valid)
+		return fn(data)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"short", valid[:4], "frame is only 4 bytes"},
+		{"magic", modify(func(d []byte) []byte { d[0] = 0; return d }), "invalid frame magic"},
+		{"version", modify(func(d []byte) []byte { d[2] = 9; return d }), "unsupported frame version: 9"},
+		{"srcif", modify(func(d []byte) []byte { d[FRAME_HEADER_SIZE] = 200; return d }), "too short for the source interface"},
+		{"length", modify(func(d []byte) []byte { return d[:len(d)-1] }), "header says 5"},
+		{"v1 length", modify(func(d []byte) []byte { d[2] = FRAME_VERSION_1; return d }), "header says 5"},
+	}
+	for _, test := range tests {
+		_, err := framedEncap{}.Decapsulate(test.data)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestRawEncap(t *testing.T) {
+	packet := []byte("hello world")
+	encap, err := newEncapsulator(TEE_ENCAP_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := encap.Encapsulate(teeFrame{layers.LinkTypeRaw, "eth0", packet})
+	if !bytes.Equal(data, packet) {
+		t.Errorf("raw encapsulated %v", data)
+	}
+	frame, err := encap.Decapsulate(data)
+	if err != nil || frame.linkType != layers.LinkTypeEthernet || !bytes.Equal(frame.packet, packet) {
+		t.Errorf("decoded %+v, %v", frame, err)
+	}
+	if _, err := newEncapsulator("gre"); err == nil {
+		t.Errorf("gre should not be supported")
+	}
+}
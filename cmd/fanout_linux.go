@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/bpf"
+)
+
+// --fanout uses AF_PACKET sockets which we only have on Linux
+const AFPACKET_SUPPORTED = true
+
+const (
+	FANOUT_NUM_BLOCKS  = 32   // blocks in the ring buffer of each --fanout socket
+	FANOUT_BUFFER_SIZE = 1000 // captured packets waiting to be processed
+)
+
+// startFanout opens --fanout AF_PACKET sockets in the same PACKET_FANOUT
+// group on our device, each read by its own goroutine.  The kernel hashes
+// each flow to a single socket so packets from a source stay in order, and
+// every packet is still processed by our handlePackets goroutine so the
+// defrag/repeat/etc state isn't shared between goroutines.  Must be called
+// after setBPFFilter and in our network namespace.
+func (l *Listen) startFanout() error {
+	linkType := l.handle.LinkType()
+	insns, err := pcap.CompileBPFFilter(linkType, l.capture.snaplen, l.bpfFilter(linkType))
+	if err != nil {
+		return err
+	}
+	filter := make([]bpf.RawInstruction, len(insns))
+	for i, insn := range insns {
+		filter[i] = bpf.RawInstruction{Op: insn.Code, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}
+	}
+
+	// frames must fit a --snaplen packet and evenly divide our blocks
+	frameSize := afpacket.DefaultFrameSize
+	for frameSize < l.capture.snaplen+afpacket.DefaultFrameSize/16 {
+		frameSize *= 2
+	}
+	group := l.capture.fanoutGroup
+	l.capture.fanoutPkts = make(chan gopacket.Packet, FANOUT_BUFFER_SIZE)
+	for i := 0; i < l.capture.fanout; i++ {
+		tp, err := afpacket.NewTPacket(
+			afpacket.OptInterface(l.device),
+			afpacket.OptFrameSize(frameSize),
+			afpacket.OptBlockSize(frameSize*16),
+			afpacket.OptNumBlocks(FANOUT_NUM_BLOCKS),
+			afpacket.OptPollTimeout(l.timeout),
+		)
+		if err != nil {
+			return fmt.Errorf("unable to open AF_PACKET socket: %s", err)
+		}
+		if err = tp.SetBPF(filter); err != nil {
+			return fmt.Errorf("unable to apply BPF filter: %s", err)
+		}
+		if err = tp.SetFanout(afpacket.FanoutHash, group); err != nil {
+			return fmt.Errorf("unable to join PACKET_FANOUT group %d (pick another via --fanout-group): %s", group, err)
+		}
+		go l.readFanout(tp, linkType)
+	}
+
+	// our pcap handle is now only used to send packets
+	if err = l.handle.SetBPFFilter("less 1"); err != nil {
+		return err
+	}
+	log.Infof("%s: capturing via %d PACKET_FANOUT sockets", l.label, l.capture.fanout)
+	return nil
+}
+
+// readFanout reads packets from one of our --fanout sockets
+func (l *Listen) readFanout(tp *afpacket.TPacket, linkType layers.LinkType) {
+	opts := gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	for {
+		data, ci, err := tp.ReadPacketData()
+		switch err {
+		case nil:
+		case afpacket.ErrTimeout:
+			continue
+		default:
+			rateLog.Warnf("read:"+l.iname, "%s: Unable to read packet: %s", l.label, err)
+			time.Sleep(ZERO_COPY_RETRY)
+			continue
+		}
+		packet := gopacket.NewPacket(data, linkType, opts)
+		packet.Metadata().CaptureInfo = ci
+		l.capture.fanoutPkts <- packet
+	}
+}
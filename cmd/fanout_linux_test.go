@@ -0,0 +1,112 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+const BENCH_FANOUT_PORT = 47999
+
+var benchFanoutRuns int
+
+// benchmarkCapture sends b.N UDP packets to ourselves via lo and reports how
+// many were captured by libpcap or our --fanout sockets.  Requires root.
+func benchmarkCapture(b *testing.B, fanout int) {
+	if os.Geteuid() != 0 {
+		b.Skip("capturing packets requires root")
+	}
+	netif, err := net.InterfaceByName("lo")
+	if err != nil {
+		b.Skip(err)
+	}
+	Interfaces["lo"] = pcap.Interface{Name: "lo",
+		Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("127.0.0.1"), Netmask: net.CIDRMask(8, 32)}}}
+	l := newListener(netif, false, []int32{BENCH_FANOUT_PORT}, 10*time.Millisecond, []string{})
+	if l.handle, err = l.openCapture(); err != nil {
+		b.Skip(err)
+	}
+	defer l.handle.Close()
+	l.linkType = l.handle.LinkType()
+	if err = l.handle.SetBPFFilter(l.bpfFilter(l.linkType)); err != nil {
+		b.Fatal(err)
+	}
+
+	var packets chan gopacket.Packet
+	if fanout > 0 {
+		// sockets of earlier runs are never closed, so each run needs its
+		// own group
+		benchFanoutRuns++
+		l.capture.fanout = fanout
+		l.capture.fanoutGroup = fanoutGroup(0, os.Getpid(), benchFanoutRuns)
+		if err = l.startFanout(); err != nil {
+			b.Fatal(err)
+		}
+		packets = l.capture.fanoutPkts
+	} else {
+		packets = l.capturePackets()
+	}
+
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: BENCH_FANOUT_PORT})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	// AF_PACKET sockets also see our outbound copy, so count each sequence
+	// number once
+	seen := make([]bool, b.N)
+	captured := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for captured < b.N {
+			select {
+			case packet, ok := <-packets:
+				if !ok {
+					return
+				}
+				app := packet.ApplicationLayer()
+				if app == nil || len(app.Payload()) < 4 {
+					continue
+				}
+				seq := binary.BigEndian.Uint32(app.Payload())
+				if int(seq) < b.N && !seen[seq] {
+					seen[seq] = true
+					captured++
+				}
+			case <-time.After(time.Second):
+				return
+			}
+		}
+	}()
+
+	payload := make([]byte, 512)
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		binary.BigEndian.PutUint32(payload, uint32(i))
+		if _, err = conn.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-done
+	b.StopTimer()
+	b.ReportMetric(float64(captured)*100/float64(b.N), "%captured")
+}
+
+func BenchmarkCapturePcap(b *testing.B) {
+	benchmarkCapture(b, 0)
+}
+
+func BenchmarkCaptureFanout(b *testing.B) {
+	benchmarkCapture(b, 4)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+// --fanout uses AF_PACKET sockets which we only have on Linux
+const AFPACKET_SUPPORTED = false
+
+// startFanout is only supported on Linux
+func (l *Listen) startFanout() error {
+	return fmt.Errorf("--fanout is only supported on Linux")
+}
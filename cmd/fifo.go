@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	FIFO_FORMAT_PCAPNG = "pcapng" // a pcapng stream with an interface per link type we send out
+	FIFO_FORMAT_FRAMED = "framed" // the same frames as --tee-encap framed
+	FIFO_BUFFER_SIZE   = 1000     // max number of packets waiting to be written
+	FIFO_RETRY         = 1 * time.Second
+)
+
+// errFifoHangup is returned by stream once the reader of our FIFO goes away
+var errFifoHangup = errors.New("reader hung up")
+
+// fifoPacket is a packet we sent out dstif along with when we captured it
+type fifoPacket struct {
+	frame teeFrame
+	dstif string
+	ts    time.Time
+}
+
+// fifoWriter streams forwarded packets to a named pipe (FIFO) for another
+// process to consume without ever blocking the caller.  Packets are dropped
+// while there is no reader or if the reader can't keep up.
+type fifoWriter struct {
+	path      string
+	format    string
+	queue     chan fifoPacket
+	dropped   uint64 // packets dropped because our queue was full
+	connected int32  // set while a reader has the FIFO open
+}
+
+// checkFifo returns an error unless path is a FIFO we can write format to
+func checkFifo(path string, format string) error {
+	switch format {
+	case FIFO_FORMAT_PCAPNG, FIFO_FORMAT_FRAMED:
+	default:
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("%s is not a named pipe.  Create it via mkfifo", path)
+	}
+	return nil
+}
+
+// newFifoWriter starts writing packets to the FIFO at path.  Create it via
+// mkfifo first, since we want to fail if someone gives us a regular file.
+func newFifoWriter(path string, format string) (*fifoWriter, error) {
+	if err := checkFifo(path, format); err != nil {
+		return nil, err
+	}
+	f := &fifoWriter{
+		path:   path,
+		format: format,
+		queue:  make(chan fifoPacket, FIFO_BUFFER_SIZE),
+	}
+	go f.run()
+	return f, nil
+}
+
+// Write queues a copy of a packet we sent out dstif for the FIFO
+func (f *fifoWriter) Write(dstif string, linkType layers.LinkType, srcif string, data []byte, ts time.Time) {
+	select {
+	case f.queue <- fifoPacket{frame: teeFrame{linkType: linkType, srcif: srcif, packet: data}, dstif: dstif, ts: ts}:
+	default:
+		dropped := atomic.AddUint64(&f.dropped, 1)
+		rateLog.Warnf("fifo", "Dropping packets for --fifo %s without a reader which keeps up (%d dropped)",
+			f.path, dropped)
+	}
+}
+
+// run waits for a reader to open the FIFO and streams our packets to it until
+// it goes away, then waits for the next reader.  We close the FIFO as soon as
+// the reader goes away, since a new reader which opens it before we do would
+// get the rest of the old stream.
+func (f *fifoWriter) run() {
+	for {
+		// blocks until there is a reader
+		file, err := os.OpenFile(f.path, os.O_WRONLY, 0)
+		if err != nil {
+			rateLog.Warnf("fifo", "Unable to open --fifo %s: %s", f.path, err)
+			time.Sleep(FIFO_RETRY)
+			continue
+		}
+
+		// the reader only wants what we send from now on
+		for len(f.queue) > 0 {
+			<-f.queue
+		}
+		log.Infof("--fifo %s reader connected", f.path)
+		atomic.StoreInt32(&f.connected, 1)
+		err = f.stream(file, watchHangup(file))
+		file.Close()
+		atomic.StoreInt32(&f.connected, 0)
+		log.Infof("--fifo %s reader disconnected: %s", f.path, err)
+	}
+}
+
+// stream writes our queued packets to w until a write fails or the reader
+// hangs up
+func (f *fifoWriter) stream(w io.Writer, hangup <-chan struct{}) error {
+	if f.format == FIFO_FORMAT_FRAMED {
+		encap := framedEncap{}
+		for {
+			select {
+			case <-hangup:
+				return errFifoHangup
+			case p := <-f.queue:
+				if _, err := w.Write(encap.Encapsulate(p.frame)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// every interface & link type we send out is a pcapng interface
+	var ng *pcapgo.NgWriter
+	interfaces := map[string]int{}
+	for {
+		var p fifoPacket
+		select {
+		case <-hangup:
+			return errFifoHangup
+		case p = <-f.queue:
+		}
+		key := fmt.Sprintf("%s/%s", p.dstif, p.frame.linkType)
+		id, ok := interfaces[key]
+		if !ok {
+			var err error
+			intf := pcapgo.DefaultNgInterface
+			intf.Name = interfaceLabel(p.dstif)
+			intf.LinkType = p.frame.linkType
+			if ng == nil {
+				ng, err = pcapgo.NewNgWriterInterface(w, intf, pcapgo.DefaultNgWriterOptions)
+			} else {
+				id, err = ng.AddInterface(intf)
+			}
+			if err != nil {
+				return err
+			}
+			interfaces[key] = id
+		}
+
+		ci := gopacket.CaptureInfo{
+			Timestamp:      p.ts,
+			CaptureLength:  len(p.frame.packet),
+			Length:         len(p.frame.packet),
+			InterfaceIndex: id,
+		}
+		if err := ng.WritePacket(ci, p.frame.packet); err != nil {
+			return err
+		}
+		// NgWriter is buffered, so flush once we've caught up
+		if len(f.queue) == 0 {
+			if err := ng.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
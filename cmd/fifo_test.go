@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// --validate checks the --fifo without opening it
+func TestCheckFifo(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		format string
+		err    string
+	}{
+		{file, "pcap", "unsupported format: pcap"},
+		{filepath.Join(dir, "missing"), FIFO_FORMAT_PCAPNG, "missing"},
+		{file, FIFO_FORMAT_FRAMED, "is not a named pipe.  Create it via mkfifo"},
+		{dir, FIFO_FORMAT_PCAPNG, "is not a named pipe"},
+	}
+	for _, test := range tests {
+		err := checkFifo(test.path, test.format)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s %s: expected %q, got %v", test.path, test.format, test.err, err)
+		}
+	}
+}
+
+// Writing never blocks, even without a reader
+func TestFifoWriterFull(t *testing.T) {
+	f := &fifoWriter{path: "full.fifo", format: FIFO_FORMAT_FRAMED, queue: make(chan fifoPacket, 2)}
+	written := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			f.Write("eth1", layers.LinkTypeRaw, "eth0", []byte("hello"), time.Now())
+		}
+		written <- true
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("writing to a full --fifo blocked")
+	}
+	if len(f.queue) != 2 || f.dropped != 3 {
+		t.Errorf("queued %d and dropped %d packets", len(f.queue), f.dropped)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchHangup returns a channel which is closed once the reader of the FIFO
+// we opened for writing goes away
+func watchHangup(file *os.File) <-chan struct{} {
+	hangup := make(chan struct{})
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return hangup
+	}
+	go func() {
+		defer close(hangup)
+		conn.Control(func(fd uintptr) {
+			// POLLERR & POLLHUP are always returned, so we don't ask for any events
+			fds := []unix.PollFd{{Fd: int32(fd)}}
+			for {
+				if _, err := unix.Poll(fds, -1); err != unix.EINTR {
+					return
+				}
+			}
+		})
+	}()
+	return hangup
+}
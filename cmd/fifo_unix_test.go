@@ -0,0 +1,132 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// fifoReader returns the srcif, dstif and packet of the next packet in our
+// --fifo stream
+type fifoReader func() (string, string, []byte, error)
+
+// readFramed reads the framed stream from r
+func readFramed(r io.Reader) fifoReader {
+	return func() (string, string, []byte, error) {
+		header := make([]byte, FRAME_HEADER_SIZE+1)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return "", "", nil, err
+		}
+		data := make([]byte, int(header[FRAME_HEADER_SIZE])+int(binary.BigEndian.Uint16(header[6:])))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return "", "", nil, err
+		}
+		frame, err := framedEncap{}.Decapsulate(append(header, data...))
+		return frame.srcif, "", frame.packet, err
+	}
+}
+
+// readPcapng reads the pcapng stream from r
+func readPcapng(r io.Reader) fifoReader {
+	var ng *pcapgo.NgReader
+	return func() (string, string, []byte, error) {
+		var err error
+		if ng == nil {
+			if ng, err = pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions); err != nil {
+				return "", "", nil, err
+			}
+		}
+		data, ci, err := ng.ReadPacketData()
+		if err != nil {
+			return "", "", nil, err
+		}
+		intf, err := ng.Interface(ci.InterfaceIndex)
+		return "", intf.Name, data, err
+	}
+}
+
+// A reader of the FIFO gets the packets we send while it is connected and a
+// new reader gets a new stream once the last one went away
+func TestFifoWriter(t *testing.T) {
+	tests := []struct {
+		format string
+		read   func(io.Reader) fifoReader
+		srcif  string
+		dstif  string
+	}{
+		{FIFO_FORMAT_FRAMED, readFramed, "eth0", ""},
+		{FIFO_FORMAT_PCAPNG, readPcapng, "", "eth1"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "relay.fifo")
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			t.Skip(err)
+		}
+		f, err := newFifoWriter(path, test.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// we send packets until the reader has read enough of them
+		sent := 0
+		send := func(stop chan struct{}, stopped chan struct{}) {
+			defer close(stopped)
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(5 * time.Millisecond):
+					f.Write("eth1", layers.LinkTypeRaw, "eth0", []byte(fmt.Sprintf("packet %d", sent)), time.Now())
+					sent++
+				}
+			}
+		}
+
+		last := -1
+		for reader := 1; reader <= 2; reader++ {
+			file, err := os.OpenFile(path, os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stop, stopped := make(chan struct{}), make(chan struct{})
+			go send(stop, stopped)
+			read := test.read(file)
+			for i := 0; i < 3; i++ {
+				srcif, dstif, data, err := read()
+				if err != nil {
+					t.Fatalf("%s reader %d: %s", test.format, reader, err)
+				}
+				n := -1
+				if _, err := fmt.Sscanf(string(data), "packet %d", &n); err != nil || n <= last {
+					t.Errorf("%s reader %d: read %q after packet %d", test.format, reader, data, last)
+				}
+				last = n
+				if srcif != test.srcif || dstif != test.dstif {
+					t.Errorf("%s reader %d: read %s from %q to %q", test.format, reader, data, srcif, dstif)
+				}
+			}
+			close(stop)
+			<-stopped
+			file.Close()
+
+			// even without any packets to write we notice the reader went away
+			for start := time.Now(); atomic.LoadInt32(&f.connected) == 1; time.Sleep(time.Millisecond) {
+				if time.Since(start) > 5*time.Second {
+					t.Fatalf("%s reader %d: still connected", test.format, reader)
+				}
+			}
+		}
+	}
+}
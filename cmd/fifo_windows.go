@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// watchHangup is not supported on Windows, so we only notice the reader went
+// away once writing to it fails
+func watchHangup(file *os.File) <-chan struct{} {
+	return make(chan struct{})
+}
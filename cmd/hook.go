@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// HookDecision tells us what to do with a packet after a PacketHook
+type HookDecision int
+
+const (
+	HookForward HookDecision = iota // forward the packet
+	HookDrop                        // drop the packet
+)
+
+// HookPacket is a packet we are about to forward passed to a PacketHook.
+// The headers are copies, but Payload is shared with every destination and
+// must not be modified in place.
+type HookPacket struct {
+	SrcIf   string // interface the packet arrived on
+	DstIf   string // interface we are sending the packet out
+	IPv4    layers.IPv4
+	UDP     layers.UDP
+	Payload []byte
+}
+
+// PacketHook inspects each packet before we send it out an interface and
+// returns if it should be forwarded along with an optional new payload.
+// A nil payload forwards the original payload.  Hooks are called from the
+// goroutine of each destination interface so they must be safe to call
+// concurrently.
+type PacketHook interface {
+	Process(pkt HookPacket) (HookDecision, []byte)
+}
+
+// noopHook forwards every packet unchanged
+type noopHook struct{}
+
+func (noopHook) Process(pkt HookPacket) (HookDecision, []byte) {
+	return HookForward, nil
+}
+
+// packetHook is called for every packet we forward
+var packetHook PacketHook = noopHook{}
+
+// RegisterPacketHook replaces the PacketHook called for every packet.  Must
+// be called before we start processing packets.  A nil hook restores the
+// default which forwards every packet unchanged.
+func RegisterPacketHook(hook PacketHook) {
+	if hook == nil {
+		hook = noopHook{}
+	}
+	packetHook = hook
+}
+
+// runPacketHook passes the packet to our PacketHook and returns the packet to
+// send out this interface and false if it should be dropped
+func (l *Listen) runPacketHook(sndpkt Send) (Send, bool) {
+	if _, ok := packetHook.(noopHook); ok {
+		return sndpkt, true
+	}
+
+	d := sndpkt.decoded
+	decision, payload := packetHook.Process(HookPacket{
+		SrcIf:   sndpkt.srcif,
+		DstIf:   l.iname,
+		IPv4:    d.ip4,
+		UDP:     d.udp,
+		Payload: d.payload,
+	})
+	if decision == HookDrop {
+		l.drop(DropHook, sndpkt.packet)
+		return sndpkt, false
+	}
+	if payload == nil {
+		return sndpkt, true
+	}
+
+	// the UDP header & length are only in the first fragment
+	if isFragment(&d.ip4) {
+		rateLog.Warnf("hook:"+l.iname, "%s: Unable to change the payload of a fragmented packet", l.label)
+		return sndpkt, true
+	}
+
+	// other interfaces share our Decoded, so give this one its own copy
+	modified := *d
+	modified.payload = gopacket.Payload(payload)
+	modified.ip4.Length = uint16(int(d.ip4.IHL)*4 + 8 + len(payload))
+	sndpkt.decoded = &modified
+	log.Debugf("%s: packet hook changed the payload from %d to %d bytes", l.label, len(d.payload), len(payload))
+	return sndpkt, true
+}
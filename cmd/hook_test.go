@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testHook rewrites the payloads sent out eth1 and drops the packets
+// whose payload is "drop"
+type testHook struct{}
+
+func (testHook) Process(pkt HookPacket) (HookDecision, []byte) {
+	if string(pkt.Payload) == "drop" {
+		return HookDrop, nil
+	}
+	if pkt.DstIf != "eth1" {
+		return HookForward, nil
+	}
+	return HookForward, append(bytes.ToUpper(pkt.Payload), []byte(" via "+pkt.SrcIf)...)
+}
+
+func TestRunPacketHook(t *testing.T) {
+	RegisterPacketHook(testHook{})
+	defer RegisterPacketHook(nil)
+
+	tests := []struct {
+		dstif   string
+		payload string
+		forward bool
+		sent    string
+	}{
+		{"eth1", "hello", true, "HELLO via eth0"},
+		{"eth2", "hello", true, "hello"},
+		{"eth1", "drop", false, ""},
+	}
+	for _, test := range tests {
+		packet, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte(test.payload))
+		l := Listen{iname: test.dstif, label: test.dstif, linkType: layers.LinkTypeRaw, stats: &Stats{},
+			rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}}}
+		sndpkt, forward := l.runPacketHook(Send{packet: packet, srcif: "eth0", decoded: d})
+		if forward != test.forward {
+			t.Errorf("%s %q: forward is %v", test.dstif, test.payload, forward)
+		}
+		if !forward {
+			if l.stats.Dropped(DropHook) != 1 {
+				t.Errorf("%s %q: not dropped by the hook", test.dstif, test.payload)
+			}
+			continue
+		}
+		// the other interfaces still send the original payload
+		if string(d.payload) != test.payload {
+			t.Errorf("%s: original payload changed to %q", test.dstif, d.payload)
+		}
+
+		out, err := l.buildPacket(gopacket.NewSerializeBuffer(), sndpkt, net.ParseIP("192.168.1.255").To4(),
+			sndpkt.decoded.payload, sndpkt.decoded.ip4.Length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent, err := decodePacket(out.data, layers.LinkTypeRaw)
+		if err != nil {
+			t.Fatalf("%s: unable to decode the packet we built: %s", test.dstif, err)
+		}
+		if string(sent.payload) != test.sent {
+			t.Errorf("%s: sent %q, expected %q", test.dstif, sent.payload, test.sent)
+		}
+		if int(sent.ip4.Length) != len(out.data) || int(sent.udp.Length) != 8+len(test.sent) || !sent.checksumsValid() {
+			t.Errorf("%s: IPv4 length %d, UDP length %d of %d bytes", test.dstif, sent.ip4.Length,
+				sent.udp.Length, len(out.data))
+		}
+	}
+}
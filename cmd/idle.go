@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How often we check for --max-idle interfaces
+const MAX_IDLE_CHECK = time.Second
+
+// idleInterfaces returns the labels of the listeners which haven't captured
+// a packet within maxIdle of now
+func idleInterfaces(listeners []Listen, maxIdle time.Duration, now time.Time) []string {
+	idle := []string{}
+	for i := range listeners {
+		l := &listeners[i]
+		last := time.Unix(0, int64(atomic.LoadUint64(&l.stats.LastPacket)))
+		if now.Sub(last) > maxIdle {
+			idle = append(idle, l.label)
+		}
+	}
+	return idle
+}
+
+// watchIdle calls fatal once any (or all) of the listeners haven't captured a
+// packet for maxIdle at one of the ticks so a supervisor can restart us after
+// a capture stall
+func watchIdle(listeners []Listen, maxIdle time.Duration, all bool, ticks <-chan time.Time,
+	fatal func(format string, args ...interface{})) {
+	now := uint64(time.Now().UnixNano())
+	for i := range listeners {
+		atomic.StoreUint64(&listeners[i].stats.LastPacket, now)
+	}
+
+	for tick := range ticks {
+		idle := idleInterfaces(listeners, maxIdle, tick)
+		if len(idle) == 0 || (all && len(idle) < len(listeners)) {
+			continue
+		}
+		fatal("No packets captured for --max-idle %s on: %s", maxIdle, strings.Join(idle, ", "))
+		return
+	}
+}
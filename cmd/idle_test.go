@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// --max-idle exits once any (or with --max-idle-all every) interface stops
+// capturing packets
+func TestWatchIdle(t *testing.T) {
+	tests := []struct {
+		name   string
+		all    bool
+		active []bool // the listeners which capture a packet before each tick
+		exit   string
+	}{
+		{"both active", false, []bool{true, true}, ""},
+		{"one idle", false, []bool{true, false}, "No packets captured for --max-idle 1m0s on: idle1"},
+		{"both idle", false, []bool{false, false}, "No packets captured for --max-idle 1m0s on: idle0, idle1"},
+		{"one idle of all", true, []bool{true, false}, ""},
+		{"all idle", true, []bool{false, false}, "No packets captured for --max-idle 1m0s on: idle0, idle1"},
+	}
+	for _, test := range tests {
+		listeners := []Listen{
+			{iname: "idle0", label: "idle0", stats: &Stats{}},
+			{iname: "idle1", label: "idle1", stats: &Stats{}},
+		}
+		ticks := make(chan time.Time)
+		exited := make(chan string, 1)
+		done := make(chan struct{})
+		go func() {
+			watchIdle(listeners, time.Minute, test.all, ticks, func(format string, args ...interface{}) {
+				exited <- fmt.Sprintf(format, args...)
+			})
+			close(done)
+		}()
+
+		// every tick is 40s apart, so each listener without a packet is idle by the second one
+		now := time.Now()
+	ticking:
+		for i := 1; i <= 3; i++ {
+			now = now.Add(40 * time.Second)
+			for j, active := range test.active {
+				if active {
+					packet, _ := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+					p := gopacket.NewPacket(packet.Data(), layers.LinkTypeRaw, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+					p.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: now, CaptureLength: len(packet.Data()),
+						Length: len(packet.Data())}
+					listeners[j].processPacket(&SendPktFeed{}, p, layers.LinkTypeRaw)
+				}
+			}
+			select {
+			case ticks <- now:
+			case <-done:
+				break ticking
+			}
+		}
+		close(ticks)
+		<-done
+
+		exit := ""
+		if len(exited) > 0 {
+			exit = <-exited
+		}
+		if exit != test.exit {
+			t.Errorf("%s: exited with %q, expected %q", test.name, exit, test.exit)
+		}
+	}
+}
@@ -2,7 +2,14 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	log "github.com/sirupsen/logrus"
 )
@@ -10,72 +17,269 @@ import (
 // Interfaces is a map between interface name and pcap data structure
 var Interfaces = map[string]pcap.Interface{}
 
+// have we loaded Interfaces from libpcap yet?
+var interfacesLoaded bool
+
+// InterfaceAliases is a map between a friendly alias and the interface name
+var InterfaceAliases = map[string]string{}
+
+// InterfaceLabels is a map between the interface name and the label we log it as
+var InterfaceLabels = map[string]string{}
+
+// initializeInterface opens our pcap handle.  Interfaces must already be
+// loaded since this is called in the network namespace of the interface.
 func initializeInterface(l *Listen) {
-	// find our interface via libpcap
-	getConfiguredInterfaces()
 	if len(Interfaces[l.iname].Addresses) == 0 {
-		log.Fatalf("%s is not configured", l.iname)
+		log.Fatalf("%s is not configured", l.label)
+	}
+
+	var err error
+	if l.handle, err = l.openCapture(); err != nil {
+		log.Fatalf("%s: %s", l.label, err)
 	}
 
+	l.linkType = l.handle.LinkType()
+	if l.monitor && l.linkType != layers.LinkTypeIEEE80211Radio {
+		log.Fatalf("%s: --wifi requires a monitor mode interface with a radiotap link type, not %s",
+			l.label, l.linkType.String())
+	} else if !l.monitor && !isValidLayerType(l.linkType) {
+		log.Fatalf("%s: has an invalid layer type: %s", l.label, l.linkType.String())
+	}
+
+	log.Debugf("Opened pcap handle on %s", l.label)
+}
+
+// validate checks our interface for --validate without activating a pcap
+// handle.  Our BPF filter is compiled for the link type libpcap would most
+// likely give us.
+func (l *Listen) validate() []error {
+	errs := []error{}
+	if len(Interfaces[l.iname].Addresses) == 0 {
+		errs = append(errs, fmt.Errorf("%s is not configured", l.label))
+	}
+	l.linkType = guessLinkType(l.netif, l.monitor)
+	if l.bcast.remote != nil && l.bcast.gatewayMAC == nil && l.linkType == layers.LinkTypeEthernet {
+		errs = append(errs, fmt.Errorf("--remote-broadcast on Ethernet interface %s requires a --gateway-mac", l.label))
+	}
+	if len(l.egressName) > 0 {
+		err := inNetns(l.netns, func() error {
+			_, err := net.InterfaceByName(l.egressName)
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: Unable to find --egress-interface %s: %s", l.label, l.egressName, err))
+		}
+	}
+	return errs
+}
+
+// guessLinkType returns the link type libpcap most likely captures packets
+// on netif with
+func guessLinkType(netif *net.Interface, monitor bool) layers.LinkType {
+	switch {
+	case monitor:
+		return layers.LinkTypeIEEE80211Radio
+	case netif.Flags&net.FlagLoopback != 0 && runtime.GOOS != "linux":
+		// BSD loopback devices use a 4 byte address family header
+		return layers.LinkTypeNull
+	case len(netif.HardwareAddr) == 0 && netif.Flags&net.FlagLoopback == 0:
+		// tun & other point-to-point devices capture bare IP packets
+		return layers.LinkTypeRaw
+	default:
+		return layers.LinkTypeEthernet
+	}
+}
+
+// openCapture opens the pcap handle we capture packets on
+func (l *Listen) openCapture() (*pcap.Handle, error) {
+	// activate libpcap handle
+	handle, err := l.openPromisc(func(promisc bool) (*pcap.Handle, error) {
+		return openHandle(l, promisc)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// just inbound packets
+	if err = handle.SetDirection(pcap.DirectionIn); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return handle, nil
+}
+
+// openPromisc opens a handle via open in promiscuous mode if we want it.
+// Some virtual interfaces don't support promiscuous mode, so unless
+// --require-promisc we fall back to capturing without it.
+func (l *Listen) openPromisc(open func(promisc bool) (*pcap.Handle, error)) (*pcap.Handle, error) {
+	handle, err := open(l.promisc)
+	if err == nil || !l.promisc || l.reqPromisc {
+		return handle, err
+	}
+	if handle, perr := open(false); perr == nil {
+		log.Warnf("%s: unable to enable promiscuous mode, continuing without it: %s", l.label, err)
+		return handle, nil
+	}
+	return nil, err
+}
+
+// openHandle opens and activates a libpcap handle for our interface
+func openHandle(l *Listen, promisc bool) (*pcap.Handle, error) {
+	return openDevice(l.device, l.timeout, promisc, l.capture.snaplen)
+}
+
+// openDevice opens a libpcap handle on device with our timeout, promiscuous
+// mode and snaplen
+func openDevice(device string, timeout time.Duration, promisc bool, snaplen int) (*pcap.Handle, error) {
 	// configure libpcap listener
-	inactive, err := pcap.NewInactiveHandle(l.iname)
+	inactive, err := pcap.NewInactiveHandle(device)
 	if err != nil {
-		log.Fatalf("%s: %s", l.iname, err)
+		return nil, err
 	}
 	defer inactive.CleanUp()
 
+	if err = configureHandle(inactive, timeout, promisc, snaplen); err != nil {
+		return nil, err
+	}
+	return inactive.Activate()
+}
+
+// inactiveHandle is the part of a pcap.InactiveHandle we configure
+type inactiveHandle interface {
+	SetTimeout(timeout time.Duration) error
+	SetPromisc(promisc bool) error
+	SetSnapLen(snaplen int) error
+}
+
+// configureHandle sets our timeout, promiscuous mode and snaplen on a
+// handle before it is activated
+func configureHandle(inactive inactiveHandle, timeout time.Duration, promisc bool, snaplen int) error {
 	// set our timeout
-	err = inactive.SetTimeout(l.timeout)
-	if err != nil {
-		log.Fatalf("%s: %s", l.iname, err)
+	if err := inactive.SetTimeout(timeout); err != nil {
+		return err
 	}
 	// Promiscuous mode on/off
-	err = inactive.SetPromisc(l.promisc)
-	if err != nil {
-		log.Fatalf("%s: %s", l.iname, err)
+	if err := inactive.SetPromisc(promisc); err != nil {
+		return err
 	}
 	// Get the entire packet
-	err = inactive.SetSnapLen(9000)
-	if err != nil {
-		log.Fatalf("%s: %s", l.iname, err)
+	return inactive.SetSnapLen(snaplen)
+}
+
+// checkLinkType returns the current link type of our handle.  A driver change
+// or reopening the handle may give us a different link type than the one we
+// initialized with, in which case we warn and decode using the new one.
+func (l *Listen) checkLinkType() layers.LinkType {
+	return l.setLinkType(l.handle.LinkType())
+}
+
+// setLinkType decodes the packets we capture as linkType from now on
+func (l *Listen) setLinkType(linkType layers.LinkType) layers.LinkType {
+	if linkType == l.linkType {
+		return linkType
 	}
 
-	// activate libpcap handle
-	if l.handle, err = inactive.Activate(); err != nil {
-		log.Fatalf("%s: %s", l.iname, err)
+	if isValidLayerType(linkType) {
+		log.Warnf("%s: link type changed from %s to %s", l.label, l.linkType.String(), linkType.String())
+	} else {
+		log.Errorf("%s: link type changed from %s to unsupported %s", l.label, l.linkType.String(), linkType.String())
 	}
+	l.linkType = linkType
+	return linkType
+}
 
-	if !isValidLayerType(l.handle.LinkType()) {
-		log.Fatalf("%s: has an invalid layer type: %s", l.iname, l.handle.LinkType().String())
+// Returns the BPF filter for the interface when captured with linkType
+func (l *Listen) bpfFilter(linkType layers.LinkType) string {
+	bpf_filter := buildBPFFilter(l.ports, Interfaces[l.iname].Addresses, l.promisc, l.capture.defragger != nil, l.capture.udplite, l.capture.filter)
+	if l.rewrite.nat != nil {
+		bpf_filter = l.rewrite.nat.BPFFilter(bpf_filter, Interfaces[l.iname].Addresses)
 	}
+	if linkType == layers.LinkTypeEthernet {
+		bpf_filter = restrictEtherTypes(bpf_filter, l.capture.etherTypes)
+	}
+	return bpf_filter
+}
 
-	// set our BPF filter
-	bpf_filter := buildBPFFilter(l.ports, Interfaces[l.iname].Addresses, l.promisc)
-	log.Debugf("%s: applying BPF Filter: %s", l.iname, bpf_filter)
-	err = l.handle.SetBPFFilter(bpf_filter)
-	if err != nil {
-		log.Fatalf("%s: %s", l.iname, err)
+// checkBPFFilters compiles the BPF filter of each Listen for its link type
+// and returns an error for every filter which is invalid
+func checkBPFFilters(listeners []Listen) []error {
+	errs := []error{}
+	for i := range listeners {
+		l := &listeners[i]
+		linkType := l.linkType
+		if err := validateBPFFilter(linkType, l.capture.snaplen, l.bpfFilter(linkType)); err != nil {
+			hint := ""
+			if linkType != layers.LinkTypeEthernet && len(l.capture.filter) > 0 {
+				hint = fmt.Sprintf(".  Your --filter may use headers (like ether or vlan) which %s interfaces don't have", linkType)
+			}
+			errs = append(errs, fmt.Errorf("%s (%s): %s%s", l.label, linkType, err, hint))
+		}
 	}
+	return errs
+}
 
-	// just inbound packets
-	err = l.handle.SetDirection(pcap.DirectionIn)
+// setBPFFilter applies the BPF filter to our pcap handle
+func setBPFFilter(l *Listen) {
+	bpf_filter := l.bpfFilter(l.linkType)
+	log.Debugf("%s: applying BPF Filter: %s", l.label, bpf_filter)
+	if err := l.handle.SetBPFFilter(bpf_filter); err != nil {
+		log.Fatalf("%s: %s", l.label, err)
+	}
+}
+
+// initializeEgress opens a pcap handle used only to send packets out a
+// different device (like a member port of a Linux bridge) than the one we
+// capture on and take our IP & MAC address from.  The device must be in the
+// network namespace of our interface.
+func initializeEgress(l *Listen) {
+	err := inNetns(l.netns, func() error {
+		var err error
+		l.egress, err = pcap.OpenLive(l.egressName, int32(l.capture.snaplen), false, l.timeout)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("%s: %s", l.iname, err)
+		log.Fatalf("%s: %s", l.egressName, err)
+	}
+
+	if err = checkEgressLinkType(l.handle.LinkType(), l.egress.LinkType()); err != nil {
+		log.Fatalf("%s: egress interface %s %s", l.label, l.egressName, err)
 	}
 
-	log.Debugf("Opened pcap handle on %s", l.iname)
+	// we never read packets from this handle, so have the kernel discard them
+	if err = l.egress.SetBPFFilter("less 1"); err != nil {
+		log.Fatalf("%s: %s", l.egressName, err)
+	}
+	log.Debugf("%s: sending packets out %s", l.label, l.egressName)
+}
+
+// checkEgressLinkType returns an error unless packets built for the link type
+// of our capture handle can be sent out the egress handle
+func checkEgressLinkType(capture layers.LinkType, egress layers.LinkType) error {
+	if egress != capture {
+		return fmt.Errorf("link type %s does not match %s", egress.String(), capture.String())
+	}
+	return nil
 }
 
 // Uses libpcap to get a list of configured interfaces
-// and populate the Interfaces.
+// and populate the Interfaces.  Must be called in our own network namespace
+// since what libpcap finds depends on the namespace of the calling thread.
 func getConfiguredInterfaces() {
-	if len(Interfaces) > 0 {
+	if interfacesLoaded {
 		return
 	}
 	ifs, err := pcap.FindAllDevs()
 	if err != nil {
 		log.Fatal(err)
 	}
+	loadInterfaces(ifs)
+}
+
+// loadInterfaces adds the configured devices of our network namespace to
+// Interfaces.  Interfaces in other namespaces are named netns:<ns>:<device>
+// so they never collide with ours.
+func loadInterfaces(ifs []pcap.Interface) {
+	interfacesLoaded = true
 	for _, i := range ifs {
 		if len(i.Addresses) == 0 {
 			continue
@@ -84,11 +288,68 @@ func getConfiguredInterfaces() {
 	}
 }
 
+// addNetnsInterface adds the libpcap device of an interface in another
+// network namespace to Interfaces as name.  Must be called in the namespace.
+func addNetnsInterface(name string, device string) error {
+	ifs, err := pcap.FindAllDevs()
+	if err != nil {
+		return err
+	}
+	return addNetnsDevice(name, device, ifs)
+}
+
+// addNetnsDevice adds device of the devices libpcap found in another network
+// namespace to Interfaces as name
+func addNetnsDevice(name string, device string, ifs []pcap.Interface) error {
+	for _, i := range ifs {
+		if i.Name == device && len(i.Addresses) > 0 {
+			Interfaces[name] = i
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not configured", name)
+}
+
+// splitNetnsInterface splits an interface name of netns:<namespace>:<device>
+// into its network namespace and device.  Other names are in our namespace.
+func splitNetnsInterface(name string) (string, string, error) {
+	if !strings.HasPrefix(name, "netns:") {
+		return "", name, nil
+	}
+	split := strings.Split(name, ":")
+	if len(split) != 3 || len(split[1]) == 0 || len(split[2]) == 0 || strings.Contains(split[1], "/") {
+		return "", "", fmt.Errorf("%s is not in the format of netns:<namespace>:<interface>", name)
+	}
+	return split[1], split[2], nil
+}
+
+// addrs returns the addresses of our interface, which have to be looked up
+// in its network namespace
+func (l *Listen) addrs() ([]net.Addr, error) {
+	var addrs []net.Addr
+	err := inNetns(l.netns, func() error {
+		var err error
+		addrs, err = l.netif.Addrs()
+		return err
+	})
+	return addrs, err
+}
+
 // Print out a list of all the interfaces that libpcap sees
 func listInterfaces() {
 	getConfiguredInterfaces()
+	aliases := map[string][]string{}
+	for alias, name := range InterfaceAliases {
+		aliases[name] = append(aliases[name], alias)
+	}
 	for k, v := range Interfaces {
 		fmt.Printf("Interface: %s\n", k)
+		if len(v.Description) > 0 {
+			fmt.Printf("\t- Description: %s\n", v.Description)
+		}
+		if len(aliases[k]) > 0 {
+			fmt.Printf("\t- Alias: %s\n", strings.Join(aliases[k], ", "))
+		}
 		for _, a := range v.Addresses {
 			ones, _ := a.Netmask.Size()
 			if a.Broadaddr != nil {
@@ -104,3 +365,263 @@ func listInterfaces() {
 		fmt.Printf("\n")
 	}
 }
+
+// parseAliases parses a list of --alias <alias>@<interface>
+func parseAliases(values []string) (map[string]string, error) {
+	aliases := map[string]string{}
+	for _, value := range values {
+		alias, iface, err := splitInterfaceArg(value)
+		if err != nil {
+			return nil, err
+		}
+		aliases[alias] = iface
+	}
+	return aliases, nil
+}
+
+// Returns the interface name for the given alias or the name unchanged
+// if it isn't an alias
+func resolveInterface(name string) string {
+	if iface, ok := InterfaceAliases[name]; ok {
+		return iface
+	}
+	return name
+}
+
+// Returns the label to log for the given interface name
+func interfaceLabel(name string) string {
+	if label, ok := InterfaceLabels[name]; ok {
+		return label
+	}
+	return name
+}
+
+// Resolves all the aliases in the list of interface names
+func resolveInterfaces(names []string) []string {
+	ret := []string{}
+	for _, name := range names {
+		ret = append(ret, resolveInterface(name))
+	}
+	return ret
+}
+
+// Returns true if the interface name contains glob wildcard characters
+func isInterfacePattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// Returns true if the interface name matches any of the given names/patterns
+func interfaceMatches(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if p == name {
+			return true
+		}
+		if matched, _ := path.Match(p, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// expandInterfaces replaces any glob patterns (eth0.*) with the matching
+// system interface names and then removes any interfaces matching the
+// exclude list.  Exclusions apply to explicitly named interfaces as well.
+func expandInterfaces(ifaces []string, excludes []string, available []string) ([]string, error) {
+	for _, p := range append(append([]string{}, ifaces...), excludes...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return []string{}, fmt.Errorf("invalid interface pattern: %s", p)
+		}
+	}
+
+	sort.Strings(available)
+	expanded := []string{}
+	for _, iface := range ifaces {
+		if !isInterfacePattern(iface) {
+			if !stringInSlice(iface, expanded) {
+				expanded = append(expanded, iface)
+			}
+			continue
+		}
+
+		found := false
+		for _, name := range available {
+			if matched, _ := path.Match(iface, name); matched {
+				found = true
+				if !stringInSlice(name, expanded) {
+					expanded = append(expanded, name)
+				}
+			}
+		}
+		if !found {
+			return []string{}, fmt.Errorf("no interfaces match %s", iface)
+		}
+	}
+
+	ret := []string{}
+	for _, iface := range expanded {
+		if interfaceMatches(iface, excludes) {
+			log.Debugf("Excluding interface %s", iface)
+			continue
+		}
+		ret = append(ret, iface)
+	}
+	return ret, nil
+}
+
+// Returns the names of all the network interfaces on the system
+func systemInterfaceNames() []string {
+	names := []string{}
+	ifs, err := net.Interfaces()
+	if err != nil {
+		log.WithError(err).Fatalf("Unable to list network interfaces")
+	}
+	for _, i := range ifs {
+		names = append(names, i.Name)
+	}
+	return names
+}
+
+// ifaceAddrs is a network interface and the addresses configured on it
+type ifaceAddrs struct {
+	name  string
+	flags net.Flags
+	addrs []net.Addr
+}
+
+// Returns all the network interfaces on the system and their addresses
+func systemInterfaces() []ifaceAddrs {
+	ret := []ifaceAddrs{}
+	ifs, err := net.Interfaces()
+	if err != nil {
+		log.WithError(err).Fatalf("Unable to list network interfaces")
+	}
+	for _, i := range ifs {
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		ret = append(ret, ifaceAddrs{name: i.Name, flags: i.Flags, addrs: addrs})
+	}
+	return ret
+}
+
+// Returns the interfaces --auto-mesh uses: every interface which is up,
+// supports broadcast, isn't a loopback and has an IPv4 address
+func autoMeshInterfaces(available []ifaceAddrs) []string {
+	names := []string{}
+	for _, i := range available {
+		if i.flags&net.FlagUp == 0 || i.flags&net.FlagLoopback != 0 || i.flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		for _, addr := range i.addrs {
+			if ip, _, err := net.ParseCIDR(addr.String()); err == nil && ip.To4() != nil {
+				names = append(names, i.name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// Returns the addresses of each of the listeners interfaces, looked up in
+// their network namespace
+func listenerAddrs(listeners []Listen) []ifaceAddrs {
+	ret := []ifaceAddrs{}
+	for i := range listeners {
+		addrs, err := listeners[i].addrs()
+		if err != nil {
+			continue
+		}
+		ret = append(ret, ifaceAddrs{name: listeners[i].iname, flags: listeners[i].netif.Flags, addrs: addrs})
+	}
+	return ret
+}
+
+// Returns a description of every IPv4 address which is configured on more
+// than one of the interfaces
+func duplicateIPs(ifaces []ifaceAddrs) []string {
+	owners := map[string][]string{}
+	ips := []string{}
+	for _, iface := range ifaces {
+		for _, addr := range iface.addrs {
+			ip, _, err := net.ParseCIDR(addr.String())
+			if err != nil || ip.To4() == nil {
+				continue
+			}
+			if _, ok := owners[ip.String()]; !ok {
+				ips = append(ips, ip.String())
+			}
+			owners[ip.String()] = append(owners[ip.String()], iface.name)
+		}
+	}
+
+	dups := []string{}
+	for _, ip := range ips {
+		if len(owners[ip]) > 1 {
+			dups = append(dups, fmt.Sprintf("%s is configured on %s", ip, strings.Join(owners[ip], ", ")))
+		}
+	}
+	return dups
+}
+
+// subnetOverlap is a pair of interfaces with overlapping IPv4 networks
+type subnetOverlap struct {
+	a    string
+	b    string
+	desc string
+}
+
+// Returns every pair of interfaces which have overlapping IPv4 networks
+// configured on them
+func overlappingSubnets(ifaces []ifaceAddrs) []subnetOverlap {
+	networks := make([][]*net.IPNet, len(ifaces))
+	for i, iface := range ifaces {
+		for _, addr := range iface.addrs {
+			ip, network, err := net.ParseCIDR(addr.String())
+			if err != nil || ip.To4() == nil {
+				continue
+			}
+			networks[i] = append(networks[i], network)
+		}
+	}
+
+	overlaps := []subnetOverlap{}
+	for i := range ifaces {
+		for j := i + 1; j < len(ifaces); j++ {
+			for _, n := range networks[i] {
+				if o := overlappingNetwork(n, networks[j]); o != nil {
+					overlaps = append(overlaps, subnetOverlap{
+						a:    ifaces[i].name,
+						b:    ifaces[j].name,
+						desc: fmt.Sprintf("%s on %s overlaps %s on %s", n, ifaces[i].name, o, ifaces[j].name),
+					})
+					break
+				}
+			}
+		}
+	}
+	return overlaps
+}
+
+// Returns the first of the networks which overlaps n or nil
+func overlappingNetwork(n *net.IPNet, networks []*net.IPNet) *net.IPNet {
+	for _, o := range networks {
+		if n.Contains(o.IP) || o.Contains(n.IP) {
+			return o
+		}
+	}
+	return nil
+}
+
+// Returns the set of IPv4 addresses configured on any of the interfaces
+func ownAddresses(ifaces []ifaceAddrs) map[string]bool {
+	ret := map[string]bool{}
+	for _, iface := range ifaces {
+		for _, addr := range iface.addrs {
+			if ip, _, err := net.ParseCIDR(addr.String()); err == nil && ip.To4() != nil {
+				ret[ip.String()] = true
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCheckEgressLinkType(t *testing.T) {
+	tests := []struct {
+		capture layers.LinkType
+		egress  layers.LinkType
+		ok      bool
+	}{
+		{layers.LinkTypeEthernet, layers.LinkTypeEthernet, true},
+		{layers.LinkTypeRaw, layers.LinkTypeRaw, true},
+		{layers.LinkTypeEthernet, layers.LinkTypeRaw, false},
+		{layers.LinkTypeNull, layers.LinkTypeEthernet, false},
+	}
+	for _, test := range tests {
+		err := checkEgressLinkType(test.capture, test.egress)
+		if (err == nil) != test.ok {
+			t.Errorf("checkEgressLinkType(%s, %s) = %v", test.capture, test.egress, err)
+		}
+	}
+}
+
+// A bridge captures and provides our IP & MAC while packets are sent out
+// the --egress-interface member port
+func TestSendHandleEgress(t *testing.T) {
+	// we only compare the handles, so they don't need to be opened
+	bridge, member := &pcap.Handle{}, &pcap.Handle{}
+	l := Listen{handle: bridge}
+	if l.sendHandle() != bridge {
+		t.Errorf("without an egress we must send out the capture handle")
+	}
+	l.egress = member
+	if l.sendHandle() != member {
+		t.Errorf("with an egress we must send out the member port")
+	}
+}
+
+// A netns:<namespace>:<device> interface listed before the interfaces of our
+// own namespace must not stop them from being loaded
+func TestNetnsInterfaceFirst(t *testing.T) {
+	saved, savedLoaded := Interfaces, interfacesLoaded
+	defer func() { Interfaces, interfacesLoaded = saved, savedLoaded }()
+	Interfaces, interfacesLoaded = map[string]pcap.Interface{}, false
+
+	addr := func(ip string) []pcap.InterfaceAddress {
+		return []pcap.InterfaceAddress{{IP: net.ParseIP(ip), Netmask: net.CIDRMask(24, 32)}}
+	}
+	host := []pcap.Interface{
+		{Name: "eth0", Addresses: addr("192.168.1.1")},
+		{Name: "eth1", Addresses: addr("192.168.2.1")},
+		{Name: "down0"},
+	}
+	container := []pcap.Interface{
+		{Name: "eth0", Addresses: addr("172.17.0.2")},
+	}
+
+	// main loads our namespace before entering the container's
+	loadInterfaces(host)
+	if err := addNetnsDevice("netns:c1:eth0", "eth0", container); err != nil {
+		t.Fatal(err)
+	}
+	if err := addNetnsDevice("netns:c1:eth1", "eth1", container); err == nil {
+		t.Errorf("netns:c1:eth1 should not be configured")
+	}
+	getConfiguredInterfaces() // already loaded, must not call libpcap
+
+	tests := []struct {
+		name string
+		ip   string
+	}{
+		{"netns:c1:eth0", "172.17.0.2"},
+		{"eth0", "192.168.1.1"},
+		{"eth1", "192.168.2.1"},
+	}
+	for _, test := range tests {
+		i, ok := Interfaces[test.name]
+		if !ok || len(i.Addresses) == 0 || !i.Addresses[0].IP.Equal(net.ParseIP(test.ip)) {
+			t.Errorf("%s: expected %s, got %+v", test.name, test.ip, i)
+		}
+	}
+	if _, ok := Interfaces["down0"]; ok {
+		t.Errorf("down0 has no addresses and should not be loaded")
+	}
+}
+
+// testAddrs returns the interface addresses of each ip/prefix
+func testAddrs(t *testing.T, cidrs ...string) []net.Addr {
+	addrs := []net.Addr{}
+	for _, cidr := range cidrs {
+		ip, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, &net.IPNet{IP: ip, Mask: network.Mask})
+	}
+	return addrs
+}
+
+func TestAutoMeshInterfaces(t *testing.T) {
+	up := net.FlagUp | net.FlagBroadcast | net.FlagMulticast
+	available := []ifaceAddrs{
+		{"lo", net.FlagUp | net.FlagLoopback, testAddrs(t, "127.0.0.1/8")},
+		{"eth0", up, testAddrs(t, "192.168.1.1/24", "fe80::1/64")},
+		{"eth1", net.FlagBroadcast | net.FlagMulticast, testAddrs(t, "192.168.2.1/24")}, // down
+		{"eth2", up, testAddrs(t, "fe80::2/64")},                                        // no IPv4
+		{"eth3", up, nil},
+		{"tun0", net.FlagUp | net.FlagPointToPoint, testAddrs(t, "10.8.0.1/24")}, // no broadcast
+		{"wlan0", up, testAddrs(t, "10.0.0.1/24")},
+	}
+	tests := []struct {
+		name      string
+		available []ifaceAddrs
+		expected  []string
+	}{
+		{"all", available, []string{"eth0", "wlan0"}},
+		{"some", available[:4], []string{"eth0"}},
+		{"no interfaces", nil, []string{}},
+	}
+	for _, test := range tests {
+		names := autoMeshInterfaces(test.available)
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: meshing %v, expected %v", test.name, names, test.expected)
+		}
+	}
+}
+
+func TestExpandInterfaces(t *testing.T) {
+	available := []string{"eth0.99", "eth0", "eth0.10", "eth0.20", "eth1", "wlan0"}
+	tests := []struct {
+		name     string
+		ifaces   []string
+		excludes []string
+		expected []string
+		err      string
+	}{
+		{"names", []string{"eth1", "eth0"}, nil, []string{"eth1", "eth0"}, ""},
+		{"glob", []string{"eth0.*"}, nil, []string{"eth0.10", "eth0.20", "eth0.99"}, ""},
+		{"glob minus exclude", []string{"eth0.*"}, []string{"eth0.99"}, []string{"eth0.10", "eth0.20"}, ""},
+		{"exclude pattern", []string{"eth*", "wlan0"}, []string{"eth0.?0"}, []string{"eth0", "eth0.99", "eth1", "wlan0"}, ""},
+		{"exclude a name", []string{"eth0", "eth1"}, []string{"eth1"}, []string{"eth0"}, ""},
+		{"exclude everything", []string{"eth0.*"}, []string{"*"}, []string{}, ""},
+		{"class", []string{"eth[01]"}, nil, []string{"eth0", "eth1"}, ""},
+		{"duplicate names", []string{"eth0", "eth0", "eth1"}, nil, []string{"eth0", "eth1"}, ""},
+		{"named and matched", []string{"eth0.10", "eth0.*"}, nil, []string{"eth0.10", "eth0.20", "eth0.99"}, ""},
+		{"overlapping globs", []string{"eth0.*", "eth0.?0"}, nil, []string{"eth0.10", "eth0.20", "eth0.99"}, ""},
+		// names don't have to exist yet, like netns:<namespace>:<device>
+		{"unknown name", []string{"eth9"}, nil, []string{"eth9"}, ""},
+		{"no matches", []string{"eth0", "br*"}, nil, nil, "no interfaces match br*"},
+		{"bad pattern", []string{"eth["}, nil, nil, "invalid interface pattern: eth["},
+		{"bad exclude", []string{"eth0"}, []string{"eth["}, nil, "invalid interface pattern: eth["},
+	}
+	for _, test := range tests {
+		ifaces, err := expandInterfaces(test.ifaces, test.excludes, available)
+		if len(test.err) > 0 {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if strings.Join(ifaces, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expanded to %v, expected %v", test.name, ifaces, test.expected)
+		}
+	}
+}
+
+func TestDuplicateIPs(t *testing.T) {
+	up := net.FlagUp | net.FlagBroadcast
+	tests := []struct {
+		name     string
+		ifaces   []ifaceAddrs
+		expected []string
+	}{
+		{"unique", []ifaceAddrs{
+			{"eth0", up, testAddrs(t, "192.168.1.1/24")},
+			{"eth1", up, testAddrs(t, "192.168.2.1/24")},
+		}, []string{}},
+		{"shared", []ifaceAddrs{
+			{"eth0", up, testAddrs(t, "192.168.1.1/24", "10.0.0.1/24")},
+			{"eth1", up, testAddrs(t, "192.168.2.1/24", "10.0.0.1/16")},
+		}, []string{"10.0.0.1 is configured on eth0, eth1"}},
+		{"three interfaces", []ifaceAddrs{
+			{"eth0", up, testAddrs(t, "10.0.0.1/24")},
+			{"eth1", up, testAddrs(t, "10.0.0.1/24")},
+			{"eth2", up, testAddrs(t, "10.0.0.1/24", "192.168.2.1/24")},
+			{"eth3", up, testAddrs(t, "192.168.2.1/24")},
+		}, []string{"10.0.0.1 is configured on eth0, eth1, eth2", "192.168.2.1 is configured on eth2, eth3"}},
+		// we only forward IPv4, so only check IPv4 addresses
+		{"ipv6", []ifaceAddrs{
+			{"eth0", up, testAddrs(t, "fe80::1/64")},
+			{"eth1", up, testAddrs(t, "fe80::1/64")},
+		}, []string{}},
+	}
+	for _, test := range tests {
+		dups := duplicateIPs(test.ifaces)
+		if strings.Join(dups, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("%s: duplicates are %q, expected %q", test.name, dups, test.expected)
+		}
+	}
+}
+
+func TestOverlappingSubnets(t *testing.T) {
+	up := net.FlagUp | net.FlagBroadcast
+	tests := []struct {
+		name     string
+		ifaces   []ifaceAddrs
+		expected []string
+	}{
+		{"disjoint", []ifaceAddrs{
+			{"eth0", up, testAddrs(t, "192.168.1.1/24")},
+			{"eth1", up, testAddrs(t, "192.168.2.1/24")},
+		}, []string{}},
+		{"identical", []ifaceAddrs{
+			{"eth0", up, testAddrs(t, "192.168.1.1/24")},
+			{"eth1", up, testAddrs(t, "192.168.1.2/24")},
+		}, []string{"eth0|eth1|192.168.1.0/24 on eth0 overlaps 192.168.1.0/24 on eth1"}},
+		{"nested", []ifaceAddrs{
+			{"eth0", up, testAddrs(t, "10.1.2.1/24")},
+			{"eth1", up, testAddrs(t, "10.0.0.1/8")},
+		}, []string{"eth0|eth1|10.1.2.0/24 on eth0 overlaps 10.0.0.0/8 on eth1"}},
+		{"second network", []ifaceAddrs{
+			{"eth0", up, testAddrs(t, "192.168.1.1/24", "10.0.0.1/16")},
+			{"eth1", up, testAddrs(t, "192.168.2.1/24", "10.0.5.1/24")},
+			{"eth2", up, testAddrs(t, "172.16.0.1/12")},
+		}, []string{"eth0|eth1|10.0.0.0/16 on eth0 overlaps 10.0.5.0/24 on eth1"}},
+		{"adjacent", []ifaceAddrs{
+			{"eth0", up, testAddrs(t, "10.0.0.1/25")},
+			{"eth1", up, testAddrs(t, "10.0.0.129/25")},
+		}, []string{}},
+		{"ipv6", []ifaceAddrs{
+			{"eth0", up, testAddrs(t, "fe80::1/64")},
+			{"eth1", up, testAddrs(t, "fe80::2/64")},
+		}, []string{}},
+	}
+	for _, test := range tests {
+		overlaps := []string{}
+		for _, o := range overlappingSubnets(test.ifaces) {
+			overlaps = append(overlaps, o.a+"|"+o.b+"|"+o.desc)
+		}
+		if strings.Join(overlaps, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: overlaps are %q, expected %q", test.name, overlaps, test.expected)
+		}
+	}
+}
+
+func TestOverlappingNetwork(t *testing.T) {
+	network := func(cidr string) *net.IPNet {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	networks := []*net.IPNet{network("10.0.0.0/8"), network("192.168.1.0/24")}
+	tests := []struct {
+		network  string
+		expected string
+	}{
+		{"10.1.0.0/16", "10.0.0.0/8"},
+		{"0.0.0.0/0", "10.0.0.0/8"},
+		{"192.168.1.128/25", "192.168.1.0/24"},
+		{"192.168.1.0/24", "192.168.1.0/24"},
+		{"192.168.0.0/24", ""},
+		{"172.16.0.0/12", ""},
+	}
+	for _, test := range tests {
+		o := overlappingNetwork(network(test.network), networks)
+		if (o == nil && len(test.expected) > 0) || (o != nil && o.String() != test.expected) {
+			t.Errorf("%s overlaps %v, expected %q", test.network, o, test.expected)
+		}
+	}
+}
+
+// A packet we relayed which is captured again on another of our interfaces
+// is dropped instead of forwarded again
+func TestOwnAddresses(t *testing.T) {
+	up := net.FlagUp | net.FlagBroadcast
+	own := ownAddresses([]ifaceAddrs{
+		{"eth0", up, testAddrs(t, "192.168.1.1/24", "fe80::1/64")},
+		{"eth1", up, testAddrs(t, "192.168.2.1/24", "10.0.0.1/8")},
+	})
+	if len(own) != 3 || !own["192.168.1.1"] || !own["192.168.2.1"] || !own["10.0.0.1"] {
+		t.Fatalf("own addresses are %v", own)
+	}
+
+	tests := []struct {
+		src    string
+		reason DropReason
+	}{
+		{"192.168.2.1", DropOwnAddress},
+		{"10.0.0.1", DropOwnAddress},
+		{"192.168.1.5", DropNone},
+		{"10.0.0.2", DropNone},
+	}
+	for _, test := range tests {
+		packet, _ := testPacket(t, test.src, "192.168.1.255", 5000, 1900, []byte("hello"))
+		l := Listen{iname: "eth0", label: "eth0", linkType: layers.LinkTypeRaw, stats: &Stats{},
+			capture: Capture{snaplen: DEFAULT_SNAPLEN}, policy: Policy{ownAddrs: own}}
+		p := gopacket.NewPacket(packet.Data(), layers.LinkTypeRaw, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		p.Metadata().CaptureInfo = gopacket.CaptureInfo{Length: len(packet.Data()), CaptureLength: len(packet.Data())}
+		l.processPacket(&SendPktFeed{}, p, layers.LinkTypeRaw)
+
+		snap := l.stats.Snapshot()
+		if test.reason == DropOwnAddress && (snap.Forwarded != 0 || l.stats.Dropped(DropOwnAddress) != 1) {
+			t.Errorf("%s: forwarded our own packet", test.src)
+		} else if test.reason == DropNone && snap.Forwarded != 1 {
+			t.Errorf("%s: dropped %v", test.src, snap.Drops)
+		}
+	}
+}
+
+// --alias names can be used anywhere we take an interface
+func TestParseAliases(t *testing.T) {
+	aliases, err := parseAliases([]string{"lan@eth0", "iot@eth0.10", "vpn@netns:c1:tun0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved map[string]string) { InterfaceAliases = saved }(InterfaceAliases)
+	InterfaceAliases = aliases
+
+	tests := []struct {
+		name  string
+		iface string
+	}{
+		{"lan", "eth0"},
+		{"iot", "eth0.10"},
+		{"vpn", "netns:c1:tun0"},
+		{"eth1", "eth1"},
+		{"eth0", "eth0"},
+	}
+	for _, test := range tests {
+		if iface := resolveInterface(test.name); iface != test.iface {
+			t.Errorf("%s: resolved to %s instead of %s", test.name, iface, test.iface)
+		}
+	}
+	if ifaces := resolveInterfaces([]string{"lan", "eth1", "iot"}); strings.Join(ifaces, ",") != "eth0,eth1,eth0.10" {
+		t.Errorf("resolved to %v", ifaces)
+	}
+
+	// and in the flags which configure each interface
+	cli := CLI{Interface: resolveInterfaces([]string{"lan", "iot"}), MtuOverride: []string{"lan@1400", "eth0.10@1300"}}
+	o, errs := parseInterfaceOptions(&cli)
+	if len(errs) != 0 || o.mtus["eth0"] != 1400 || o.mtus["eth0.10"] != 1300 {
+		t.Errorf("MTUs are %v: %v", o.mtus, errs)
+	}
+
+	for _, value := range []string{"lan", "lan@", "@eth0"} {
+		if _, err := parseAliases([]string{value}); err == nil ||
+			!strings.Contains(err.Error(), "is not in the correct format of <interface>@<value>") {
+			t.Errorf("%s: expected an error, got %v", value, err)
+		}
+	}
+}
+
+// A --filter which uses Ethernet headers only compiles for Ethernet interfaces
+func TestCheckBPFFilters(t *testing.T) {
+	if err := validateBPFFilter(layers.LinkTypeEthernet, DEFAULT_SNAPLEN, "udp"); err != nil {
+		t.Skipf("unable to compile BPF filters: %s", err)
+	}
+	Interfaces["bpf0"] = pcap.Interface{Name: "bpf0",
+		Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.1"), Netmask: net.CIDRMask(24, 32)}}}
+	defer delete(Interfaces, "bpf0")
+	listener := func(label string, linkType layers.LinkType, filter string) Listen {
+		return Listen{iname: "bpf0", label: label, linkType: linkType, ports: []int32{1900}, promisc: true,
+			capture: Capture{snaplen: DEFAULT_SNAPLEN, filter: filter}}
+	}
+	madeUp := layers.LinkType(147) // DLT_USER0
+	listeners := []Listen{
+		listener("ethernet", layers.LinkTypeEthernet, "ether src 02:00:00:00:00:01"),
+		listener("raw", layers.LinkTypeRaw, "src net 10.0.0.0/8"),
+		listener("made up", madeUp, "ether src 02:00:00:00:00:01"),
+		listener("made up without a filter", madeUp, ""),
+		listener("typo", layers.LinkTypeEthernet, "src hots 10.0.0.1"),
+	}
+	found := map[string]string{}
+	for _, err := range checkBPFFilters(listeners) {
+		label := strings.SplitN(err.Error(), " (", 2)[0]
+		found[label] = err.Error()
+	}
+	hint := "Your --filter may use headers (like ether or vlan) which " + madeUp.String() + " interfaces don't have"
+	if err := found["made up"]; !strings.Contains(err, "made up ("+madeUp.String()+"): invalid BPF filter") ||
+		!strings.Contains(err, hint) {
+		t.Errorf("made up link type: %q", err)
+	}
+	// we can't blame a --filter which we don't have
+	if err := found["made up without a filter"]; strings.Contains(err, "--filter") {
+		t.Errorf("made up link type without a filter: %q", err)
+	}
+	if err := found["typo"]; !strings.Contains(err, "typo (Ethernet): invalid BPF filter") || strings.Contains(err, "--filter") {
+		t.Errorf("typo: %q", err)
+	}
+	for _, label := range []string{"ethernet", "raw"} {
+		if err, ok := found[label]; ok {
+			t.Errorf("%s: valid filter was rejected: %s", label, err)
+		}
+	}
+}
+
+// Once a reopened handle reports a new link type we decode using it
+func TestSetLinkType(t *testing.T) {
+	tests := []struct {
+		linkType layers.LinkType
+		warning  string
+	}{
+		{layers.LinkTypeEthernet, ""},
+		{layers.LinkTypeRaw, "link0: link type changed from Ethernet to Raw"},
+		{layers.LinkTypeNull, "link0: link type changed from Ethernet to Null"},
+		{layers.LinkTypeFDDI, "link0: link type changed from Ethernet to unsupported FDDI"},
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	for _, test := range tests {
+		buf.Reset()
+		sendq := make(chan Send, 1)
+		s := &SendPktFeed{}
+		s.RegisterSender(sendq, make(chan Send, 1), &Stats{}, "eth1")
+		l := Listen{iname: "link0", label: "link0", linkType: layers.LinkTypeEthernet, stats: &Stats{},
+			capture: Capture{snaplen: DEFAULT_SNAPLEN}}
+
+		linkType := l.setLinkType(test.linkType)
+		if linkType != test.linkType || l.linkType != test.linkType {
+			t.Errorf("%s: link type is %s", test.linkType, l.linkType)
+		}
+		if test.warning == "" && buf.Len() > 0 || !strings.Contains(buf.String(), test.warning) {
+			t.Errorf("%s: logged %q", test.linkType, buf.String())
+		}
+		if test.linkType == layers.LinkTypeFDDI {
+			continue
+		}
+
+		// a frame of the new link type is decoded and forwarded
+		ip, _ := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+		data := testFrame(t, linkType, ip.Data())
+		packet := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		packet.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+		l.processPacket(s, packet, linkType)
+		if len(sendq) != 1 {
+			t.Fatalf("%s: forwarded %d packets, drops are %v", linkType, len(sendq), l.stats.Snapshot().Drops)
+		}
+		if sndpkt := <-sendq; sndpkt.linkType != linkType || string(sndpkt.decoded.payload) != "hello" {
+			t.Errorf("%s: forwarded %s %q", linkType, sndpkt.linkType, sndpkt.decoded.payload)
+		}
+	}
+}
+
+// promiscErrHandle is an interface which doesn't support promiscuous mode
+type promiscErrHandle struct{}
+
+func (h *promiscErrHandle) SetTimeout(timeout time.Duration) error { return nil }
+func (h *promiscErrHandle) SetSnapLen(snaplen int) error           { return nil }
+
+func (h *promiscErrHandle) SetPromisc(promisc bool) error {
+	if promisc {
+		return fmt.Errorf("promiscuous mode not supported")
+	}
+	return nil
+}
+
+// Unless --require-promisc we capture without promiscuous mode when an
+// interface doesn't support it
+func TestOpenPromisc(t *testing.T) {
+	tests := []struct {
+		promisc    bool
+		reqPromisc bool
+		opened     []bool // the promisc mode of each attempt to open
+		err        string
+		warning    string
+	}{
+		{false, false, []bool{false}, "", ""},
+		{true, false, []bool{true, false}, "", "promisc0: unable to enable promiscuous mode, continuing without it"},
+		{true, true, []bool{true}, "promiscuous mode not supported", ""},
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	for _, test := range tests {
+		buf.Reset()
+		l := Listen{iname: "promisc0", label: "promisc0", promisc: test.promisc, reqPromisc: test.reqPromisc}
+		opened := []bool{}
+		_, err := l.openPromisc(func(promisc bool) (*pcap.Handle, error) {
+			opened = append(opened, promisc)
+			return nil, configureHandle(&promiscErrHandle{}, time.Second, promisc, DEFAULT_SNAPLEN)
+		})
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("promisc %v, --require-promisc %v: expected %q, got %v", test.promisc, test.reqPromisc, test.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("promisc %v: %s", test.promisc, err)
+		}
+		if fmt.Sprint(opened) != fmt.Sprint(test.opened) {
+			t.Errorf("promisc %v, --require-promisc %v: opened %v", test.promisc, test.reqPromisc, opened)
+		}
+		if !strings.Contains(buf.String(), test.warning) || len(test.warning) == 0 && buf.Len() > 0 {
+			t.Errorf("promisc %v: logged %q", test.promisc, buf.String())
+		}
+	}
+
+	// we return the original error if we still can't open it
+	l := Listen{iname: "promisc0", label: "promisc0", promisc: true}
+	_, err := l.openPromisc(func(promisc bool) (*pcap.Handle, error) {
+		if promisc {
+			return nil, fmt.Errorf("promiscuous mode not supported")
+		}
+		return nil, fmt.Errorf("no such device")
+	})
+	if err == nil || err.Error() != "promiscuous mode not supported" {
+		t.Errorf("expected the promiscuous mode error, got %v", err)
+	}
+}
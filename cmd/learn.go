@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+)
+
+// learnPort is the broadcast & multicast traffic we saw to a UDP port
+type learnPort struct {
+	port    uint16
+	packets uint64
+	dsts    map[string]bool // destination IPs
+	ifaces  map[string]bool // interfaces we saw the traffic on
+}
+
+// learnTally counts the broadcast & multicast UDP traffic seen by --learn
+type learnTally struct {
+	lock  sync.Mutex
+	ports map[uint16]*learnPort
+}
+
+func newLearnTally() *learnTally {
+	return &learnTally{
+		ports: map[uint16]*learnPort{},
+	}
+}
+
+// Add counts the packet if it is broadcast or multicast UDP
+func (t *learnTally) Add(iname string, d *Decoded, addresses []pcap.InterfaceAddress) {
+	if !d.IsIPv4UDP() || !isBroadcastOrMulticast(d.ip4.DstIP, addresses) {
+		return
+	}
+	port := uint16(d.udp.DstPort)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p, ok := t.ports[port]
+	if !ok {
+		p = &learnPort{
+			port:   port,
+			dsts:   map[string]bool{},
+			ifaces: map[string]bool{},
+		}
+		t.ports[port] = p
+	}
+	p.packets++
+	p.dsts[d.ip4.DstIP.String()] = true
+	p.ifaces[iname] = true
+}
+
+// Ports returns the UDP ports we saw traffic to in order
+func (t *learnTally) Ports() []uint16 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ports := []uint16{}
+	for port := range t.ports {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// Filter returns a BPF filter matching the traffic we saw
+func (t *learnTally) Filter() string {
+	filters := []string{}
+	for _, port := range t.Ports() {
+		filters = append(filters, fmt.Sprintf("udp port %d", port))
+	}
+	return strings.Join(filters, " or ")
+}
+
+// Print writes our summary table and the suggested flags
+func (t *learnTally) Print(w io.Writer) {
+	ports := t.Ports()
+	if len(ports) == 0 {
+		fmt.Fprintf(w, "No broadcast or multicast UDP traffic seen\n")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "PORT\tPACKETS\tDESTINATIONS\tINTERFACES\n")
+	args := []string{}
+	t.lock.Lock()
+	for _, port := range ports {
+		p := t.ports[port]
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\n", p.port, p.packets, sortedKeys(p.dsts), sortedKeys(p.ifaces))
+		args = append(args, fmt.Sprintf("--port %d", port))
+	}
+	t.lock.Unlock()
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nSuggested BPF filter: %s\n", t.Filter())
+	fmt.Fprintf(w, "Suggested flags: %s\n", strings.Join(args, " "))
+}
+
+// sortedKeys returns the keys of the set as a sorted, comma separated list
+func sortedKeys(set map[string]bool) string {
+	keys := []string{}
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// learnTraffic captures UDP traffic on the interfaces for the duration
+// without forwarding anything and prints which ports we should forward
+func learnTraffic(interfaces []string, duration time.Duration, snaplen int, timeout time.Duration) {
+	getConfiguredInterfaces()
+	tally := newLearnTally()
+	handles := []*pcap.Handle{}
+	var wg sync.WaitGroup
+	for _, iname := range interfaces {
+		handle, err := pcap.OpenLive(iname, int32(snaplen), false, timeout)
+		if err != nil {
+			log.Fatalf("%s: %s", interfaceLabel(iname), err)
+		}
+		if err = handle.SetBPFFilter("udp"); err != nil {
+			log.Fatalf("%s: %s", interfaceLabel(iname), err)
+		}
+		handles = append(handles, handle)
+
+		wg.Add(1)
+		go func(iname string, handle *pcap.Handle, addresses []pcap.InterfaceAddress) {
+			defer wg.Done()
+			end := time.Now().Add(duration)
+			for time.Now().Before(end) {
+				data, _, err := handle.ReadPacketData()
+				if err != nil {
+					continue // timeout
+				}
+				if d, err := decodePacket(data, handle.LinkType()); err == nil {
+					tally.Add(iname, d, addresses)
+				}
+			}
+		}(iname, handle, Interfaces[iname].Addresses)
+	}
+
+	log.Infof("Learning which UDP ports to forward on %d interfaces for %s", len(interfaces), duration)
+	wg.Wait()
+	for _, handle := range handles {
+		handle.Close()
+	}
+	tally.Print(os.Stdout)
+}
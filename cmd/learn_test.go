@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// --learn suggests the ports of the broadcast & multicast traffic it saw
+func TestLearnTally(t *testing.T) {
+	addresses := []pcap.InterfaceAddress{
+		{IP: net.ParseIP("192.168.1.1"), Netmask: net.CIDRMask(24, 32), Broadaddr: net.ParseIP("192.168.1.255")},
+	}
+	packets := []struct {
+		iname   string
+		dst     string
+		dstPort uint16
+	}{
+		{"eth0", "239.255.255.250", 1900}, // SSDP
+		{"eth0", "224.0.0.251", 5353},     // mDNS
+		{"eth1", "224.0.0.251", 5353},
+		{"eth0", "192.168.1.255", 9003}, // directed broadcast
+		{"eth1", "255.255.255.255", 9003},
+		{"eth0", "192.168.1.5", 8000}, // unicast is ignored
+	}
+	tally := newLearnTally()
+	for _, p := range packets {
+		packet, _ := testPacket(t, "192.168.1.5", p.dst, 5000, p.dstPort, []byte("canned"))
+		d, err := decodePacket(testFrame(t, layers.LinkTypeEthernet, packet.Data()), layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tally.Add(p.iname, d, addresses)
+	}
+	// as is anything which isn't UDP
+	other, _ := testPacket(t, "192.168.1.5", "192.168.1.255", 5000, 7000, []byte("other"))
+	d, _ := decodePacket(other.Data(), layers.LinkTypeRaw)
+	d.layers = []gopacket.LayerType{layers.LayerTypeIPv4}
+	tally.Add("eth0", d, addresses)
+
+	expected := "udp port 1900 or udp port 5353 or udp port 9003"
+	if filter := tally.Filter(); filter != expected {
+		t.Errorf("filter is %s", filter)
+	}
+
+	var buf bytes.Buffer
+	tally.Print(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	rows := []string{
+		"PORT  PACKETS  DESTINATIONS                   INTERFACES",
+		"1900  1        239.255.255.250                eth0",
+		"5353  2        224.0.0.251                    eth0,eth1",
+		"9003  2        192.168.1.255,255.255.255.255  eth0,eth1",
+		"",
+		"Suggested BPF filter: " + expected,
+		"Suggested flags: --port 1900 --port 5353 --port 9003",
+	}
+	if len(lines) != len(rows) {
+		t.Fatalf("printed:\n%s", buf.String())
+	}
+	for i, row := range rows {
+		if strings.TrimRight(lines[i], " ") != row {
+			t.Errorf("line %d is %q, expected %q", i+1, lines[i], row)
+		}
+	}
+
+	buf.Reset()
+	newLearnTally().Print(&buf)
+	if buf.String() != "No broadcast or multicast UDP traffic seen\n" {
+		t.Errorf("printed %q", buf.String())
+	}
+}
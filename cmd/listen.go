@@ -4,40 +4,114 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/pcapgo"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	SEND_BUFFER_SIZE = 100
 	MAX_PACKET_SIZE  = 8192
+	DEFAULT_SNAPLEN  = 9000 // large enough for jumbo frames
+	MIN_SNAPLEN      = 96   // enough for L2 + IPv4 w/ options + UDP headers
+	MIN_IPV4_MTU     = 68   // every IPv4 link must support this (RFC 791)
+	MAX_IPV4_MTU     = 65535
+	MAX_FANOUT       = 16 // max --fanout sockets per interface
 )
 
 // Struct containing everything for an interface
 type Listen struct {
-	iname     string               // interface to use
-	netif     *net.Interface       // interface descriptor
-	ports     []int32              // port(s) we listen for packets
-	ipaddr    string               // dstip we send packets to
-	promisc   bool                 // do we enable promisc on this interface?
-	handle    *pcap.Handle         // gopacket.pcap handle
-	writer    *pcapgo.Writer       // in and outbound write packet handle
-	inwriter  *pcapgo.Writer       // inbound write packet handle
-	outwriter *pcapgo.Writer       // outbound write packet handle
-	timeout   time.Duration        // timeout for loop
-	clientTTL time.Duration        // ttl for client cache
-	sendpkt   chan Send            // channel used to receive packets we need to send
-	clients   map[string]time.Time // keep track of clients for non-promisc interfaces
+	iname        string               // interface to use
+	label        string               // name of the interface in our logs
+	netif        *net.Interface       // interface descriptor
+	ports        []int32              // port(s) we listen for packets
+	ipaddr       string               // dstip we send packets to
+	promisc      bool                 // do we enable promisc on this interface?
+	reqPromisc   bool                 // exit if we can't enable promisc
+	handle       *pcap.Handle         // gopacket.pcap handle
+	writer       *pcapWriter          // in and outbound write packet handle
+	inwriter     *pcapWriter          // inbound write packet handle
+	outwriter    *pcapWriter          // outbound write packet handle
+	timeout      time.Duration        // timeout for loop
+	clientTTL    time.Duration        // ttl for client cache
+	policy       Policy               // decides which packets we forward
+	capture      Capture              // how we capture packets
+	rewrite      Rewrite              // how we rewrite the packets we send
+	bcast        Broadcast            // where we send broadcasts
+	taps         Taps                 // copies & reports of the packets we forward
+	sendpkt      chan Send            // channel used to receive packets we need to send
+	prioritypkt  chan Send            // channel used to receive high priority packets we need to send
+	clients      map[string]time.Time // keep track of clients for non-promisc interfaces
+	stats        *Stats               // packet counters
+	egressName   string               // optional device to send packets out of
+	egress       *pcap.Handle         // gopacket.pcap handle for egressName
+	delay        *delayQueue          // optionally delay packets before we send them
+	lock         *sync.Mutex          // protects clients, pcap writers & sends from other goroutines
+	sendRetries  int                  // retries for transient send errors
+	retries      chan retrySend       // packets retrySends is retrying to send
+	familyWarned uint32               // set once we've warned about a non-IPv4 destination
+	linkType     layers.LinkType      // link type of our handle we decode packets for
+	mtu          int                  // --mtu-override or 0 to let the OS decide
+	monitor      bool                 // 802.11 monitor mode interface we only receive on
+	netns        string               // network namespace of the interface, empty for ours
+	device       string               // name of the interface in its network namespace
+	queueAlert   int                  // warn when this many packets are waiting to be sent
+}
+
+// Capture is how a Listen captures & decodes packets
+type Capture struct {
+	snaplen       int                         // max bytes of each packet we capture
+	filter        string                      // user provided BPF filter
+	etherTypes    []uint16                    // only capture these EtherTypes on Ethernet
+	udplite       bool                        // forward UDP-Lite packets as well
+	defragger     *ip4defrag.IPv4Defragmenter // reassemble IPv4 fragments if enabled
+	forwardErrors bool                        // forward packets with decode errors if we found the IPv4/UDP headers
+	zeroCopy      bool                        // read packets via ZeroCopyReadPacketData
+	reopenEvery   time.Duration               // --reopen-interval of our pcap handle, 0 to never reopen
+	fanout        int                         // number of PACKET_FANOUT sockets to capture with
+	fanoutGroup   uint16                      // PACKET_FANOUT group ID of our --fanout sockets
+	fanoutPkts    chan gopacket.Packet        // packets captured by our --fanout sockets
+}
+
+// Rewrite is how a Listen rewrites the packets it sends
+type Rewrite struct {
+	checksums  checksumPolicy    // compute, zero or preserve the UDP checksum of each destination
+	vlanTags   map[string]uint16 // 802.1Q VLAN ID to tag packets with by source interface
+	truncate   int               // max UDP payload bytes to forward, 0 for unlimited
+	scopeTTLs  scopeTTLs         // TTL of packets sent to each multicast scope
+	srcPorts   *srcPortRange     // optionally rewrite the UDP source port
+	nat        *natTable         // optionally translate replies back to the requester
+	masquerade bool              // send the requests we forward from a nat relay port
+	portMap    map[uint16]uint16 // rewrite the UDP destination port of packets we send
+	clearDF    bool              // clear the Don't Fragment flag of packets we send
+	profile    string            // name of our --interface-profile
+}
+
+// Broadcast is where a Listen sends the broadcasts it forwards
+type Broadcast struct {
+	remote      net.IP           // --remote-broadcast we send to instead of our own
+	gatewayMAC  net.HardwareAddr // router which delivers our --remote-broadcast
+	allSubnets  bool             // send to the broadcast of every IPv4 network on the interface
+	aliasFanout bool             // forward broadcasts to our other IPv4 networks
+}
+
+// Taps are the optional copies & reports of the packets a Listen forwards
+type Taps struct {
+	tee     *teeWriter     // copy sent packets to a UDP collector
+	fifo    *fifoWriter    // stream sent packets to a named pipe
+	flows   *flowCache     // export NetFlow records of what we send
+	mirror  *mirror        // mirror captured packets to another device
+	talkers *topTalkers    // report the sources we forward the most packets from
+	spike   *spikeDetector // alert on forwarding spikes
 }
 
 // List of LayerTypes we support in sendPacket()
@@ -49,6 +123,40 @@ var validLinkTypes = []layers.LinkType{
 }
 
 // Creates a Listen struct for the given interface, promisc mode, udp sniff ports and timeout
+// broadcastAddress returns the directed broadcast address of the last IPv4
+// network in addrs, or "" if there is none
+func broadcastAddress(iname string, addrs []net.Addr) string {
+	var bcastaddr string = ""
+	var hostOnly bool
+	for _, addr := range addrs {
+		log.Debugf("%s network: %s\t\tstring: %s", iname, addr.Network(), addr.String())
+
+		_, ipNet, err := net.ParseCIDR(addr.String())
+		if err != nil {
+			log.Debugf("%s: Unable to parse CIDR: %s (%s)", iname, addr.String(), addr.Network())
+			continue
+		}
+		if ipNet.IP.To4() == nil {
+			continue // Skip non-IPv4 addresses
+		}
+		if isHostMask(ipNet.Mask) {
+			hostOnly = true
+			continue // a /32 has no broadcast address
+		}
+		// calc broadcast
+		ip := make(net.IP, len(ipNet.IP.To4()))
+		bcastbin := binary.BigEndian.Uint32(ipNet.IP.To4()) | ^binary.BigEndian.Uint32(net.IP(ipNet.Mask).To4())
+		binary.BigEndian.PutUint32(ip, bcastbin)
+		bcastaddr = ip.String()
+	}
+	// with only /32 addresses, all we can do is the limited broadcast
+	if len(bcastaddr) == 0 && hostOnly {
+		log.Warnf("%s only has /32 IPv4 addresses.  Sending to %s", iname, net.IPv4bcast)
+		bcastaddr = net.IPv4bcast.String()
+	}
+	return bcastaddr
+}
+
 func newListener(netif *net.Interface, promisc bool, ports []int32, to time.Duration, fixed_ip []string) Listen {
 	log.Debugf("%s: ifIndex: %d", netif.Name, netif.Index)
 	addrs, err := netif.Addrs()
@@ -59,45 +167,44 @@ func newListener(netif *net.Interface, promisc bool, ports []int32, to time.Dura
 	// only calc the broadcast address on promiscuous interfaces
 	// for non-promisc, we use our clients
 	if !promisc {
-		for _, addr := range addrs {
-			log.Debugf("%s network: %s\t\tstring: %s", netif.Name, addr.Network(), addr.String())
-
-			_, ipNet, err := net.ParseCIDR(addr.String())
-			if err != nil {
-				log.Debugf("%s: Unable to parse CIDR: %s (%s)", netif.Name, addr.String(), addr.Network())
-				continue
-			}
-			if ipNet.IP.To4() == nil {
-				continue // Skip non-IPv4 addresses
-			}
-			// calc broadcast
-			ip := make(net.IP, len(ipNet.IP.To4()))
-			bcastbin := binary.BigEndian.Uint32(ipNet.IP.To4()) | ^binary.BigEndian.Uint32(net.IP(ipNet.Mask).To4())
-			binary.BigEndian.PutUint32(ip, bcastbin)
-			bcastaddr = ip.String()
-		}
-		// promisc interfaces should have a bcast/ipv4 config
-		if len(bcastaddr) == 0 && promisc {
-			log.Fatalf("%s does not have a valid IPv4 configuration", netif.Name)
+		bcastaddr = broadcastAddress(netif.Name, addrs)
+		// broadcast interfaces must have an IPv4 config to send to
+		if len(bcastaddr) == 0 {
+			log.Fatalf("%s does not have a valid IPv4 configuration.  Only IPv4 is supported", netif.Name)
 		}
 	}
 
 	// fixed ip clients
 	clients := make(map[string]time.Time)
 	for _, ip := range fixed_ip {
+		if isBroadcastKeyword(ip) {
+			bcast, err := resolveBroadcastKeyword(ip, addrs)
+			if err != nil {
+				log.WithError(err).Fatalf("%s: Unable to resolve --fixed-ip %s", netif.Name, ip)
+			}
+			log.Debugf("%s: --fixed-ip %s is %s", netif.Name, ip, bcast)
+			ip = bcast
+		}
 		clients[ip] = time.Time{} // zero value
 	}
 
 	new := Listen{
-		iname:   netif.Name,
-		netif:   netif,
-		ports:   ports,
-		ipaddr:  bcastaddr,
-		timeout: to,
-		promisc: promisc,
-		handle:  nil,
-		sendpkt: make(chan Send, SEND_BUFFER_SIZE),
-		clients: clients,
+		iname:       netif.Name,
+		device:      netif.Name,
+		label:       interfaceLabel(netif.Name),
+		netif:       netif,
+		ports:       ports,
+		ipaddr:      bcastaddr,
+		timeout:     to,
+		promisc:     promisc,
+		handle:      nil,
+		sendpkt:     make(chan Send, SEND_BUFFER_SIZE),
+		prioritypkt: make(chan Send, SEND_BUFFER_SIZE),
+		clients:     clients,
+		stats:       &Stats{},
+		policy:      Policy{iname: netif.Name},
+		lock:        &sync.Mutex{},
+		capture:     Capture{snaplen: DEFAULT_SNAPLEN},
 	}
 	log.Debugf("Listen: %s", spew.Sdump(new))
 	return new
@@ -112,166 +219,538 @@ const (
 )
 
 // OpenWrite will open the write file pcap handle
-func (l *Listen) OpenWriter(path string, dir Direction) (string, error) {
-	var err error
+func (l *Listen) OpenWriter(path string, dir Direction, rotate pcapRotation) (string, error) {
 	fName := fmt.Sprintf("udp-proxy-%s-%s.pcap", dir, l.iname)
 	filePath := filepath.Join(path, fName)
-	f, err := os.Create(filePath)
+	w, err := newPcapWriter(filePath, l.linkType, rotate)
 	if err != nil {
 		return fName, err
 	}
 	switch dir {
 	case "in":
-		l.inwriter = pcapgo.NewWriter(f)
-		return fName, l.inwriter.WriteFileHeader(65536, l.handle.LinkType())
+		l.inwriter = w
 	case "out":
-		l.outwriter = pcapgo.NewWriter(f)
-		return fName, l.outwriter.WriteFileHeader(65536, l.handle.LinkType())
+		l.outwriter = w
 	case "inout":
-		l.writer = pcapgo.NewWriter(f)
-		return fName, l.writer.WriteFileHeader(65536, l.handle.LinkType())
+		l.writer = w
+	default:
+		w.Close()
+		return fName, fmt.Errorf("Invalid direction: %s", dir)
+	}
+	return fName, nil
+}
+
+// closeWriters flushes and closes our pcap files
+func (l *Listen) closeWriters() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, w := range []*pcapWriter{l.writer, l.inwriter, l.outwriter} {
+		if w == nil {
+			continue
+		}
+		if err := w.Close(); err != nil {
+			log.WithError(err).Warnf("%s: Unable to close pcap file %s", l.label, w.fileName)
+		}
+	}
+}
+
+// setRemoteBroadcast sends packets to the directed broadcast address of a
+// subnet which isn't on this interface via the router with the gateway MAC
+func (l *Listen) setRemoteBroadcast(ip net.IP, gateway net.HardwareAddr) {
+	addrs, err := l.netif.Addrs()
+	if err != nil {
+		log.Fatalf("Unable to obtain addresses for %s", l.label)
+	}
+	onLink := false
+	for _, addr := range addrs {
+		if _, ipNet, err := net.ParseCIDR(addr.String()); err == nil && ipNet.Contains(ip) {
+			onLink = true
+		}
+	}
+	if onLink {
+		log.Warnf("%s: --remote-broadcast %s is on-link, --fixed-ip is simpler", l.label, ip)
+	} else {
+		log.Warnf("%s: sending to off-link broadcast %s instead of %s.  The router must forward directed broadcasts",
+			l.label, ip, l.ipaddr)
 	}
-	return fName, fmt.Errorf("Invalid direction: %s", dir)
+	l.ipaddr = ip.String()
+	l.bcast.remote = ip
+	l.bcast.gatewayMAC = gateway
 }
 
-// Our goroutine for processing packets
-func (l *Listen) handlePackets(s *SendPktFeed, wg *sync.WaitGroup) {
-	// add ourself as a sender
-	s.RegisterSender(l.sendpkt, l.iname)
+// Our goroutine for processing packets.  Returns once done is closed.
+func (l *Listen) handlePackets(s *SendPktFeed, wg *sync.WaitGroup, done <-chan struct{}) {
+	// add ourself as a sender.  We can't send out monitor mode interfaces.
+	if !l.monitor {
+		s.RegisterSender(l.sendpkt, l.prioritypkt, l.stats, l.iname)
+	}
 
 	// get packets from libpcap
-	packetSource := gopacket.NewPacketSource(l.handle, l.handle.LinkType())
-	packets := packetSource.Packets()
+	var packets chan gopacket.Packet
+	if l.capture.fanoutPkts != nil {
+		packets = l.capture.fanoutPkts
+	} else if l.capture.zeroCopy {
+		go l.readZeroCopy(s)
+	} else {
+		packets = l.capturePackets()
+	}
+
+	// as are the retries of packets we failed to send
+	if l.retries != nil {
+		go l.retrySends(done)
+	}
+
+	// delayed packets are sent by their own goroutine
+	if l.delay != nil {
+		go l.delay.Run(l.sendQueued, done)
+	}
 
 	// This timer is nice for debugging
 	d, _ := time.ParseDuration("5s")
 	ticker := time.Tick(d)
+	reopenAt := time.Now().Add(l.capture.reopenEvery)
 
-	// loop forever and ever and ever
+	// loop until we are shutdown
 	for {
+		// always send high priority packets first
+		if sndpkt, ok := nextQueued(l.prioritypkt, l.sendpkt); ok {
+			l.queuePackets(sndpkt)
+			continue
+		}
+
 		select {
+		case s := <-l.prioritypkt: // high priority packet arrived from another interface
+			l.queuePackets(s)
 		case s := <-l.sendpkt: // packet arrived from another interface
-			l.sendPackets(s)
+			l.queuePackets(s)
 		case packet := <-packets: // packet arrived on this interfaces
-			// is it legit?
-			if packet.NetworkLayer() == nil || packet.TransportLayer() == nil || packet.TransportLayer().LayerType() != layers.LayerTypeUDP {
-				log.Warnf("%s: Invalid packet", l.iname)
-				continue
-			} else if errx := packet.ErrorLayer(); errx != nil {
-				log.Errorf("%s: Unable to decode: %s", l.iname, errx.Error())
-			}
-
-			// if our interface is non-promisc, learn the client IP
-			if l.promisc {
-				l.learnClientIP(packet)
-			}
+			l.receivePacket(s, packet)
 
-			log.Debugf("%s: received packet and fowarding onto other interfaces", l.iname)
-			s.Send(packet, l.iname, l.handle.LinkType())
-
-			// write to pcap?
-			if l.inwriter != nil {
-				md := packet.Metadata()
-				ci := gopacket.CaptureInfo{
-					Timestamp:      md.Timestamp,
-					CaptureLength:  md.CaptureLength,
-					Length:         md.Length,
-					InterfaceIndex: md.InterfaceIndex,
-					AncillaryData:  md.AncillaryData,
-				}
-				if err := l.inwriter.WritePacket(ci, packet.Data()); err != nil {
-					log.WithError(err).Warnf("Unable to write packet to pcap file")
-				}
-				if err := l.writer.WritePacket(ci, packet.Data()); err != nil {
-					log.WithError(err).Warnf("Unable to write packet to pcap file")
-				}
-			}
+		case <-done: // time to shutdown
+			log.Debugf("%s: shutting down", l.label)
+			l.closeWriters()
+			wg.Done()
+			return
 
 		case <-ticker: // our timer
-			log.Debugf("handlePackets(%s) ticker", l.iname)
+			depth := l.sampleQueue()
+			log.Debugf("handlePackets(%s) ticker: %s", l.label, l.stats.Snapshot().Summary())
+			packets, reopenAt = l.scheduledReopen(packets, depth, time.Now(), reopenAt, l.reopenHandle)
+			if l.taps.spike != nil {
+				l.taps.spike.Check(l.label, l.stats, time.Now())
+			}
+			if l.capture.defragger != nil {
+				l.capture.defragger.DiscardOlderThan(time.Now().Add(-DEFRAG_TIMEOUT))
+			}
+			if l.policy.repeats != nil {
+				l.policy.repeats.Expire(time.Now())
+			}
+			if l.rewrite.nat != nil {
+				l.rewrite.nat.Expire(time.Now())
+			}
+			if l.taps.talkers != nil {
+				l.taps.talkers.Report(l.label, time.Now())
+			}
 			// clean client cache
+			l.lock.Lock()
 			for k, v := range l.clients {
 				// zero is hard code values
 				if !v.IsZero() && v.Before(time.Now()) {
-					log.Debugf("%s removing %s after %dsec", l.iname, k, l.clientTTL)
+					log.Debugf("%s removing %s after %dsec", l.label, k, l.clientTTL)
 					delete(l.clients, k)
 				}
 			}
+			l.lock.Unlock()
 		}
 	}
 }
 
-// Does the heavy lifting of editing & sending the packet onwards
-func (l *Listen) sendPackets(sndpkt Send) {
-	var eth layers.Ethernet
-	var loop layers.Loopback // BSD NULL/Loopback used for OpenVPN tunnels/etc
-	var ip4 layers.IPv4      // we only support v4
-	var udp layers.UDP
-	var payload gopacket.Payload
-	var parser *gopacket.DecodingLayerParser
+// sampleQueue records and returns how many packets are waiting to be sent
+// out this interface, warning if it is over our --queue-depth-alert
+func (l *Listen) sampleQueue() int {
+	depth := len(l.sendpkt) + len(l.prioritypkt)
+	if l.stats.SampleQueue(depth, l.queueAlert) {
+		rateLog.Warnf("queuedepth:"+l.iname, "%s: %d packets are waiting to be sent, we may not be keeping up",
+			l.label, depth)
+	}
+	return depth
+}
 
-	log.Debugf("processing packet from %s on %s", sndpkt.srcif, l.iname)
+// receivePacket processes a packet which arrived on this interface and forwards
+// it to the other interfaces
+func (l *Listen) receivePacket(s *SendPktFeed, packet gopacket.Packet) {
+	l.processPacket(s, packet, l.checkLinkType())
+}
 
-	switch sndpkt.linkType.String() {
-	case layers.LinkTypeNull.String(), layers.LinkTypeLoop.String():
-		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeLoopback, &loop, &ip4, &udp, &payload)
-	case layers.LinkTypeEthernet.String():
-		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip4, &udp, &payload)
-	case layers.LinkTypeRaw.String():
-		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ip4, &udp, &payload)
-	default:
-		log.Fatalf("Unsupported source linktype: %s", sndpkt.linkType.String())
+// processPacket decides whether to drop or forward a packet of linkType which
+// arrived on this interface.  It never touches our pcap handle.
+func (l *Listen) processPacket(s *SendPktFeed, packet gopacket.Packet, linkType layers.LinkType) {
+	owned := !l.capture.zeroCopy // can we keep a reference to the packet data?
+	atomic.StoreUint64(&l.stats.LastPacket, uint64(packet.Metadata().Timestamp.UnixNano()))
+
+	// write to pcap?  We record every fragment as it was captured
+	if l.inwriter != nil {
+		md := packet.Metadata()
+		ci := gopacket.CaptureInfo{
+			Timestamp:      md.Timestamp,
+			CaptureLength:  md.CaptureLength,
+			Length:         md.Length,
+			InterfaceIndex: md.InterfaceIndex,
+			AncillaryData:  md.AncillaryData,
+		}
+		l.lock.Lock()
+		if err := l.inwriter.WritePacket(ci, packet.Data()); err != nil {
+			log.WithError(err).Warnf("Unable to write packet to pcap file")
+		}
+		if err := l.writer.WritePacket(ci, packet.Data()); err != nil {
+			log.WithError(err).Warnf("Unable to write packet to pcap file")
+		}
+		l.lock.Unlock()
+	}
+
+	if l.taps.mirror != nil {
+		l.taps.mirror.Write(l.iname, linkType, packet.Data())
 	}
 
-	// try decoding our packet
-	decoded := []gopacket.LayerType{}
-	if err := parser.DecodeLayers(sndpkt.packet.Data(), &decoded); err != nil {
-		log.Warnf("Unable to decode packet from %s: %s", sndpkt.srcif, err)
+	// we forward what we capture, so never forward a partial packet
+	if md := packet.Metadata(); md.CaptureLength < md.Length {
+		rateLog.Warnf("truncated:"+l.iname, "%s: Dropping %d byte packet truncated to --snaplen %d",
+			l.label, md.Length, l.capture.snaplen)
+		l.drop(DropTruncated, packet)
 		return
 	}
 
-	// was packet decoded?  In theory, this should never happen because our BPF filter...
-	found_udp := false
-	found_ipv4 := false
-	for _, layerType := range decoded {
-		switch layerType {
-		case layers.LayerTypeUDP:
-			found_udp = true
-		case layers.LayerTypeIPv4:
-			found_ipv4 = true
+	d, err := decodePacket(packet.Data(), linkType)
+	var srcMAC net.HardwareAddr // reassembled packets don't have an Ethernet header
+	if d.Has(layers.LayerTypeEthernet) {
+		srcMAC = d.eth.SrcMAC
+	}
+
+	// reassemble fragments before we count or validate the packet
+	if l.capture.defragger != nil && d.Has(layers.LayerTypeIPv4) && isFragment(&d.ip4) {
+		if !owned {
+			// the defragmenter holds onto fragments
+			packet, d, err = copyPacket(packet, linkType)
+		}
+		owned = true // reassembled packets are always a new buffer
+		var complete bool
+		if packet, linkType, complete = l.defragPacket(packet, linkType, &d.ip4); !complete {
+			return
 		}
+		d, err = decodePacket(packet.Data(), linkType)
 	}
-	if !found_udp || !found_ipv4 {
-		log.Warnf("Packet from %s did not contain a IPv4/UDP packet", sndpkt.srcif)
+	atomic.AddUint64(&l.stats.Received, 1)
+	size := uint64(len(packet.Data()))
+	atomic.AddUint64(&l.stats.ReceivedBytes, size)
+	forwarded := false
+	defer func() {
+		if !forwarded {
+			atomic.AddUint64(&l.stats.DroppedBytes, size)
+		}
+	}()
+
+	// is it legit?
+	if err != nil {
+		atomic.AddUint64(&l.stats.DecodeErrors, 1)
+		if !l.capture.forwardErrors || !l.isForwardable(d) {
+			rateLog.Warnf("decode:"+l.iname, "%s: Unable to decode packet: %s", l.label, err)
+			l.drop(DropDecodeError, packet)
+			return
+		}
+		rateLog.Warnf("decode:"+l.iname, "%s: Forwarding packet with decode error: %s", l.label, err)
+	} else if !d.Has(layers.LayerTypeIPv4) {
+		// a broad --filter or --ethertypes can match these, so not a warning
+		if d.IsIPv6() {
+			rateLog.Logf(log.DebugLevel, "nonipv4:"+l.iname, "%s: Dropping IPv6 packet.  Only IPv4 is supported", l.label)
+		} else {
+			rateLog.Logf(log.DebugLevel, "nonipv4:"+l.iname, "%s: Dropping non-IPv4 packet", l.label)
+		}
+		l.drop(DropNonIPv4, packet)
+		return
+	} else if !l.isForwardable(d) {
+		rateLog.Logf(log.DebugLevel, "nonudp:"+l.iname, "%s: Dropping IPv4 %s packet", l.label, d.ip4.Protocol)
+		l.drop(DropNonUDP, packet)
 		return
 	}
 
-	if !l.promisc {
-		// send one packet to broadcast IP
-		dstip := net.ParseIP(l.ipaddr).To4()
-		if err, bytes := l.sendPacket(sndpkt, dstip, eth, loop, ip4, udp, payload); err != nil {
-			log.Warnf("Unable to send %d bytes from %s out %s: %s",
-				bytes, sndpkt.srcif, l.iname, err)
+	// replies to the requests we forwarded go back to the requester
+	if l.rewrite.nat != nil {
+		if reply, sent := l.natReply(s, packet, linkType, d, owned); reply {
+			if sent {
+				atomic.AddUint64(&l.stats.Forwarded, 1)
+				atomic.AddUint64(&l.stats.ForwardedBytes, size)
+				forwarded = true
+			}
+			return
+		}
+	}
+
+	// do we want to forward it?
+	info := PacketInfo{decoded: d, srcMAC: srcMAC, size: len(packet.Data()), ts: packet.Metadata().Timestamp}
+	if forward, reason := l.policy.Decide(info); !forward {
+		switch reason {
+		case DropChecksum:
+			rateLog.Warnf("checksum:"+l.iname, "%s: Dropping packet with an invalid checksum", l.label)
+		case DropRateLimit:
+			rateLog.Warnf("ratelimit:"+l.iname, "%s: Dropping packets over --rate-limit-bytes", l.label)
 		}
+		l.drop(reason, packet)
+		return
+	}
+
+	// if our interface is non-promisc, learn the client IP
+	if l.promisc && !l.monitor {
+		l.learnClientIP(d.ip4.SrcIP)
+	}
+
+	// other interfaces send the packet after our next read
+	if !owned {
+		packet, d, err = copyPacket(packet, linkType)
+	}
+
+	log.Debugf("%s: received packet and fowarding onto other interfaces", l.label)
+	s.Send(packet, l.iname, linkType, d)
+	if l.bcast.aliasFanout {
+		l.queuePackets(Send{packet: packet, srcif: l.iname, linkType: linkType, decoded: d,
+			ts: packet.Metadata().Timestamp, aliases: true})
+	}
+	atomic.AddUint64(&l.stats.Forwarded, 1)
+	atomic.AddUint64(&l.stats.ForwardedBytes, size)
+	forwarded = true
+	if l.taps.spike != nil {
+		l.taps.spike.Add(d.ip4.SrcIP.String(), time.Now())
+	}
+	if l.taps.talkers != nil {
+		l.taps.talkers.sources.Add(d.ip4.SrcIP.String())
+	}
+}
+
+// Sends the packet now, or once our --forward-delay has passed
+func (l *Listen) queuePackets(sndpkt Send) {
+	if l.delay == nil {
+		l.sendQueued(sndpkt)
+	} else if !l.delay.Push(sndpkt) {
+		rateLog.Warnf("delay:"+l.iname, "%s: --forward-delay queue is full, dropping packets", l.label)
+		l.drop(DropQueueFull, sndpkt.packet)
+	}
+}
+
+// sendQueued sends a packet from another interface, or one of ours to our IP aliases
+func (l *Listen) sendQueued(sndpkt Send) {
+	if sndpkt.aliases {
+		l.sendAliases(sndpkt)
 	} else {
-		// sent packet to every client
-		if len(l.clients) == 0 {
-			log.Debugf("%s: Unable to send packet; no discovered clients", l.iname)
+		l.sendPackets(sndpkt)
+	}
+}
+
+// isForwardable returns true if the decoded packet is one we can forward:
+// IPv4 UDP or, with --udplite, an unfragmented IPv4 UDP-Lite packet
+func (l *Listen) isForwardable(d *Decoded) bool {
+	if d.IsIPv4UDP() {
+		return true
+	}
+	if !l.capture.udplite || !d.IsIPv4UDPLite() {
+		return false
+	}
+	// we can't recompute the checksum of a partial datagram
+	if isFragment(&d.ip4) {
+		rateLog.Warnf("udplite:"+l.iname, "%s: Unable to forward fragmented UDP-Lite packets without --defrag", l.label)
+		return false
+	}
+	return true
+}
+
+// Does the heavy lifting of editing & sending the packet onwards
+func (l *Listen) sendPackets(sndpkt Send) {
+	log.Debugf("processing packet from %s on %s", interfaceLabel(sndpkt.srcif), l.label)
+
+	var forward bool
+	if sndpkt, forward = l.runPacketHook(sndpkt); !forward {
+		return
+	}
+
+	if sndpkt.dstip != nil {
+		if err, bytes := l.sendPacket(sndpkt, sndpkt.dstip); err != nil {
+			l.sendFailed(sndpkt, err, bytes)
+		}
+	} else if !l.promisc {
+		for _, dstip := range l.broadcastIPs() {
+			if err, bytes := l.sendPacket(sndpkt, dstip); err != nil {
+				l.sendFailed(sndpkt, err, bytes)
+			}
 		}
+	} else {
+		// sent packet to every client
+		l.lock.Lock()
+		clients := make([]string, 0, len(l.clients))
 		for ip := range l.clients {
+			clients = append(clients, ip)
+		}
+		l.lock.Unlock()
+		if len(clients) == 0 {
+			log.Debugf("%s: Unable to send packet; no discovered clients", l.label)
+		}
+		for _, ip := range clients {
 			dstip := net.ParseIP(ip).To4()
-			if err, bytes := l.sendPacket(sndpkt, dstip, eth, loop, ip4, udp, payload); err != nil {
-				log.Warnf("Unable to send %d bytes from %s out %s: %s",
-					bytes, sndpkt.srcif, l.iname, err)
+			if err, bytes := l.sendPacket(sndpkt, dstip); err != nil {
+				l.sendFailed(sndpkt, err, bytes)
 			}
 		}
 	}
 }
 
-func (l *Listen) sendPacket(sndpkt Send, dstip net.IP, eth layers.Ethernet, loop layers.Loopback,
-	ip4 layers.IPv4, udp layers.UDP, payload gopacket.Payload) (error, int) {
+// broadcastIPs returns our broadcast IP, or with --all-subnets the broadcast
+// of each of our networks
+func (l *Listen) broadcastIPs() []net.IP {
+	if l.bcast.allSubnets && l.bcast.remote == nil {
+		if subnets := subnetBroadcasts(Interfaces[l.iname].Addresses); len(subnets) > 0 {
+			return subnets
+		}
+	}
+	return []net.IP{net.ParseIP(l.ipaddr).To4()}
+}
+
+// sendFailed counts & logs a packet we were unable to send
+func (l *Listen) sendFailed(sndpkt Send, err error, bytes int) {
+	rateLog.Warnf("send:"+l.iname, "Unable to send %d bytes from %s out %s: %s",
+		bytes, interfaceLabel(sndpkt.srcif), l.label, err)
+	l.drop(dropReasonOf(err), sndpkt.packet)
+}
+
+// Sends a broadcast which arrived on this interface out to the broadcast
+// address of our other IPv4 networks (IP aliases) on the same interface
+func (l *Listen) sendAliases(sndpkt Send) {
+	ip4 := sndpkt.decoded.ip4
+	dstips := aliasBroadcasts(ip4.SrcIP, ip4.DstIP, Interfaces[l.iname].Addresses)
+	if len(dstips) == 0 {
+		return
+	}
+
+	var forward bool
+	if sndpkt, forward = l.runPacketHook(sndpkt); !forward {
+		return
+	}
+	for _, dstip := range dstips {
+		log.Debugf("%s: forwarding broadcast from %s to alias network %s", l.label, ip4.SrcIP, dstip)
+		if err, bytes := l.sendPacket(sndpkt, dstip); err != nil {
+			l.sendFailed(sndpkt, err, bytes)
+		}
+	}
+}
+
+// truncatePayload returns the payload of the decoded packet to send and its
+// IPv4 length, which only forwards the start of payloads over --truncate.
+// We can't shorten a fragment since the UDP header is in the first fragment.
+func (l *Listen) truncatePayload(d *Decoded) (gopacket.Payload, uint16) {
+	if l.rewrite.truncate > 0 && len(d.payload) > l.rewrite.truncate && !isFragment(&d.ip4) {
+		atomic.AddUint64(&l.stats.Truncated, 1)
+		payload := d.payload[:l.rewrite.truncate]
+		return payload, uint16(int(d.ip4.IHL)*4 + 8 + len(payload))
+	}
+	return d.payload, d.ip4.Length
+}
+
+// checkMTU returns a DropMTU error if an IPv4 packet of length is larger than
+// our --mtu-override.  We don't fragment, so anything larger than the MTU
+// would be dropped by the OS or the tunnel anyways.
+func (l *Listen) checkMTU(length uint16) error {
+	if l.mtu > 0 && int(length) > l.mtu {
+		err := fmt.Errorf("%d byte packet is larger than the --mtu-override %d", length, l.mtu)
+		return dropError{DropMTU, err}
+	}
+	return nil
+}
+
+func (l *Listen) sendPacket(sndpkt Send, dstip net.IP) (error, int) {
+	if dstip.To4() == nil {
+		if atomic.CompareAndSwapUint32(&l.familyWarned, 0, 1) {
+			log.Warnf("%s: Unable to forward IPv4 packets to non-IPv4 destination %s", l.label, dstip)
+		}
+		return dropError{DropNonIPv4Dst, fmt.Errorf("%s is not an IPv4 address", dstip)}, 0
+	}
+
+	payload, length := l.truncatePayload(sndpkt.decoded)
+
+	if err := l.checkMTU(length); err != nil {
+		return err, int(length)
+	}
+
 	// Build our packet to send
-	buffer := gopacket.NewSerializeBuffer()
+	buffer := getSerializeBuffer()
+	defer putSerializeBuffer(buffer)
+	out, err := l.buildPacket(buffer, sndpkt, dstip, payload, length)
+	if err != nil {
+		return err, int(length)
+	}
+	outgoingPacket := out.data
+	log.Debugf("%s => %s: packet len: %d", l.label, dstip.String(), len(outgoingPacket))
+
+	if l.outwriter != nil {
+		l.writeSentPcap(sndpkt, outgoingPacket)
+	}
+
+	err = l.writePacket(sndpkt, outgoingPacket)
+	if err == errRetrying {
+		// retrySends counts it once it is sent or dropped
+		return nil, len(outgoingPacket)
+	} else if err == nil {
+		atomic.AddUint64(&l.stats.SentBytes, uint64(len(outgoingPacket)))
+		if l.taps.tee != nil || l.taps.fifo != nil {
+			// these send it later, after our buffer is reused
+			data := make([]byte, len(outgoingPacket))
+			copy(data, outgoingPacket)
+			if l.taps.tee != nil {
+				l.taps.tee.Write(l.linkType, sndpkt.srcif, data)
+			}
+			if l.taps.fifo != nil {
+				l.taps.fifo.Write(l.iname, l.linkType, sndpkt.srcif, data, sndpkt.ts)
+			}
+		}
+		if l.taps.flows != nil {
+			l.taps.flows.Add(sndpkt.srcif, l.iname, out.ip4.SrcIP, dstip, uint16(out.srcPort), uint16(out.dstPort),
+				uint8(out.ip4.Protocol), int(length), time.Now())
+		}
+	}
+	return err, len(outgoingPacket)
+}
+
+// writeSentPcap writes a packet we sent to our pcap files with the original
+// capture time, not when we sent it
+func (l *Listen) writeSentPcap(sndpkt Send, data []byte) {
+	md := sndpkt.packet.Metadata()
+	ci := gopacket.CaptureInfo{
+		Timestamp:      sndpkt.ts,
+		CaptureLength:  len(data),
+		Length:         len(data),
+		InterfaceIndex: md.InterfaceIndex,
+		AncillaryData:  md.AncillaryData,
+	}
+	l.lock.Lock()
+	if err := l.outwriter.WritePacket(ci, data); err != nil {
+		log.WithError(err).Warnf("Unable to write packet to pcap file")
+	}
+	if err := l.writer.WritePacket(ci, data); err != nil {
+		log.WithError(err).Warnf("Unable to write packet to pcap file")
+	}
+	l.lock.Unlock()
+}
+
+// builtPacket is a packet buildPacket built for us to send
+type builtPacket struct {
+	data    []byte         // the entire frame, valid until the buffer is reused
+	ip4     layers.IPv4    // IPv4 header of the frame
+	srcPort layers.UDPPort // after any --src-port-range or --nat-port-range
+	dstPort layers.UDPPort // after any port map of our --interface-profile
+}
+
+// buildPacket serializes the frame to send the payload of the packet
+// to dstip out our interface into buffer.  length is the IPv4 length of the
+// (possibly --truncate'd) payload.
+func (l *Listen) buildPacket(buffer gopacket.SerializeBuffer, sndpkt Send, dstip net.IP,
+	payload gopacket.Payload, length uint16) (builtPacket, error) {
+	ip4 := sndpkt.decoded.ip4
+	udp := sndpkt.decoded.udp
 	csum_opts := gopacket.SerializeOptions{
 		FixLengths:       false,
 		ComputeChecksums: true, // only works for IPv4
@@ -286,18 +765,18 @@ func (l *Listen) sendPacket(sndpkt Send, dstip net.IP, eth layers.Ethernet, loop
 		log.Fatalf("can't serialize payload: %s", spew.Sdump(payload))
 	}
 
-	// UDP checksums can't be calculated via SerializeOptions
-	// because it requires the IP pseudo-header:
-	// https://en.wikipedia.org/wiki/User_Datagram_Protocol#IPv4_pseudo_header
-	new_udp := layers.UDP{
-		SrcPort:  udp.SrcPort,
-		DstPort:  udp.DstPort,
-		Checksum: 0, // but 0 is always valid for UDP
-		Length:   uint16(8 + len(payload)),
+	srcip, srcPort := ip4.SrcIP, udp.SrcPort
+	if l.rewrite.srcPorts != nil {
+		srcPort = layers.UDPPort(l.rewrite.srcPorts.Port(ip4.SrcIP))
+	} else if l.rewrite.masquerade || sndpkt.dstip != nil {
+		var err error
+		if srcip, srcPort, err = l.natSource(sndpkt, dstip); err != nil {
+			return builtPacket{}, err
+		}
 	}
-
-	if err := new_udp.SerializeTo(buffer, opts); err != nil {
-		log.Fatalf("can't serialize UDP header: %s", spew.Sdump(udp))
+	dstPort := udp.DstPort
+	if port, ok := l.rewrite.portMap[uint16(dstPort)]; ok && sndpkt.dstip == nil {
+		dstPort = layers.UDPPort(port)
 	}
 
 	// IPv4 header
@@ -305,37 +784,91 @@ func (l *Listen) sendPacket(sndpkt Send, dstip net.IP, eth layers.Ethernet, loop
 		Version:    ip4.Version,
 		IHL:        ip4.IHL,
 		TOS:        ip4.TOS,
-		Length:     ip4.Length,
+		Length:     length,
 		Id:         ip4.Id,
-		Flags:      ip4.Flags,
+		Flags:      l.ipv4Flags(ip4.Flags),
 		FragOffset: ip4.FragOffset,
-		TTL:        ip4.TTL,
+		TTL:        l.rewrite.scopeTTLs.TTL(dstip, ip4.TTL),
 		Protocol:   ip4.Protocol,
 		Checksum:   0, // reset to calc checksums
-		SrcIP:      ip4.SrcIP,
+		SrcIP:      srcip,
 		DstIP:      dstip,
 		Options:    ip4.Options,
 	}
+
+	// UDP checksums require the IP pseudo-header:
+	// https://en.wikipedia.org/wiki/User_Datagram_Protocol#IPv4_pseudo_header
+	// which has changed since we rewrote the DstIP and SrcPort.  The checksum
+	// covers the entire datagram, so fragments always get 0 which is valid for IPv4.
+	new_udp := layers.UDP{
+		SrcPort:  srcPort,
+		DstPort:  dstPort,
+		Checksum: 0,
+		Length:   uint16(8 + len(payload)),
+	}
+	csumMode := l.rewrite.checksums.Mode(dstip)
+	udp_opts := opts
+	if csumMode == CSUM_COMPUTE && !isFragment(&ip4) {
+		if err := new_udp.SetNetworkLayerForChecksum(&new_ip4); err != nil {
+			log.Fatalf("can't set UDP pseudo-header: %s", err)
+		}
+		udp_opts = csum_opts
+	}
+
+	if sndpkt.decoded.Has(layers.LayerTypeUDPLite) {
+		// udp.Length is the checksum coverage for UDP-Lite
+		if err := serializeUDPLite(buffer, &new_ip4, srcPort, dstPort, udp.Length); err != nil {
+			log.Fatalf("can't serialize UDP-Lite header: %s", err)
+		}
+	} else {
+		if err := new_udp.SerializeTo(buffer, udp_opts); err != nil {
+			log.Fatalf("can't serialize UDP header: %s", spew.Sdump(udp))
+		}
+		if udp_opts.ComputeChecksums && new_udp.Checksum == 0 {
+			// a computed checksum of 0 is sent as all ones
+			binary.BigEndian.PutUint16(buffer.Bytes()[6:], 0xffff)
+		} else if csumMode == CSUM_PRESERVE {
+			// only valid if the receiver ignores the pseudo-header we changed
+			binary.BigEndian.PutUint16(buffer.Bytes()[6:], udp.Checksum)
+		}
+	}
+
+	// We inject the entire frame via libpcap, so the kernel never fills in
+	// the IPv4 header checksum for us and we must always compute it.
 	if err := new_ip4.SerializeTo(buffer, csum_opts); err != nil {
 		log.Fatalf("can't serialize IP header: %s", spew.Sdump(new_ip4))
 	}
 
 	// Add our L2 header to the buffer
-	switch l.handle.LinkType().String() {
+	switch l.linkType.String() {
 	case layers.LinkTypeNull.String(), layers.LinkTypeLoop.String():
-		loop := layers.Loopback{
-			Family: layers.ProtocolFamilyIPv4,
-		}
-		if err := loop.SerializeTo(buffer, opts); err != nil {
-			log.Fatalf("can't serialize Loop header: %s", spew.Sdump(loop))
+		if err := serializeLoopback(buffer, l.linkType, layers.ProtocolFamilyIPv4); err != nil {
+			log.Fatalf("can't serialize Loop header: %s", err)
 		}
 	case layers.LinkTypeEthernet.String():
+		ethType := layers.EthernetTypeIPv4
+		// tag with the VLAN of the source interface?
+		if vlan, ok := l.rewrite.vlanTags[sndpkt.srcif]; ok {
+			dot1q := layers.Dot1Q{
+				VLANIdentifier: vlan,
+				Type:           layers.EthernetTypeIPv4,
+			}
+			if err := dot1q.SerializeTo(buffer, opts); err != nil {
+				log.Fatalf("can't serialize Dot1Q header: %s", spew.Sdump(dot1q))
+			}
+			ethType = layers.EthernetTypeDot1Q
+		}
+
 		// build a new ethernet header
 		new_eth := layers.Ethernet{
 			BaseLayer:    layers.BaseLayer{},
 			DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
 			SrcMAC:       l.netif.HardwareAddr,
-			EthernetType: layers.EthernetTypeIPv4,
+			EthernetType: ethType,
+		}
+		// the router turns the directed broadcast into an L2 broadcast
+		if l.bcast.gatewayMAC != nil && dstip.Equal(l.bcast.remote) {
+			new_eth.DstMAC = l.bcast.gatewayMAC
 		}
 		if err := new_eth.SerializeTo(buffer, opts); err != nil {
 			log.Fatalf("can't serialize Eth header: %s", spew.Sdump(new_eth))
@@ -343,72 +876,39 @@ func (l *Listen) sendPacket(sndpkt Send, dstip net.IP, eth layers.Ethernet, loop
 	case layers.LinkTypeRaw.String():
 		// no L2 header
 	default:
-		log.Warnf("Unsupported linktype: %s", l.handle.LinkType().String())
-	}
-
-	outgoingPacket := buffer.Bytes()
-	log.Debugf("%s => %s: packet len: %d", l.iname, dstip.String(), len(outgoingPacket))
-
-	// write to pcap?
-	if l.outwriter != nil {
-		md := sndpkt.packet.Metadata()
-		ci := gopacket.CaptureInfo{
-			Timestamp:      md.Timestamp,
-			CaptureLength:  len(outgoingPacket),
-			Length:         len(outgoingPacket),
-			InterfaceIndex: md.InterfaceIndex,
-			AncillaryData:  md.AncillaryData,
-		}
-		if err := l.outwriter.WritePacket(ci, outgoingPacket); err != nil {
-			log.WithError(err).Warnf("Unable to write packet to pcap file")
-		}
-		if err := l.writer.WritePacket(ci, outgoingPacket); err != nil {
-			log.WithError(err).Warnf("Unable to write packet to pcap file")
-		}
+		rateLog.Warnf("linktype:"+l.iname, "Unsupported linktype: %s", l.linkType.String())
 	}
 
-	return l.handle.WritePacketData(outgoingPacket), len(outgoingPacket)
+	return builtPacket{data: buffer.Bytes(), ip4: new_ip4, srcPort: srcPort, dstPort: dstPort}, nil
 }
 
-func (l *Listen) learnClientIP(packet gopacket.Packet) {
-	var eth layers.Ethernet
-	var loop layers.Loopback
-	var ip4 layers.IPv4
-	var udp layers.UDP
-	var payload gopacket.Payload
-	var parser *gopacket.DecodingLayerParser
-
-	switch l.handle.LinkType().String() {
-	case layers.LinkTypeNull.String(), layers.LinkTypeLoop.String():
-		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeLoopback, &loop, &ip4, &udp, &payload)
-	case layers.LinkTypeEthernet.String():
-		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip4, &udp, &payload)
-	case layers.LinkTypeRaw.String():
-		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ip4, &udp, &payload)
-	default:
-		log.Fatalf("Unsupported source linktype: %s", l.handle.LinkType().String())
-	}
-
-	decoded := []gopacket.LayerType{}
-	if err := parser.DecodeLayers(packet.Data(), &decoded); err != nil {
-		log.Debugf("Unable to decoded client IP on %s: %s", l.iname, err)
+// ipv4Flags returns the IPv4 flags for a packet we send.  We always clear
+// the reserved (evil) bit, keep More Fragments so fragments stay valid and
+// keep Don't Fragment unless --clear-df.
+func (l *Listen) ipv4Flags(flags layers.IPv4Flag) layers.IPv4Flag {
+	flags &= layers.IPv4DontFragment | layers.IPv4MoreFragments
+	if l.rewrite.clearDF {
+		flags &^= layers.IPv4DontFragment
 	}
+	return flags
+}
 
-	found_ipv4 := false
-	for _, layerType := range decoded {
-		switch layerType {
-		case layers.LayerTypeIPv4:
-			// found our v4 header
-			found_ipv4 = true
-		}
+// Returns the pcap handle we send packets with
+func (l *Listen) sendHandle() *pcap.Handle {
+	if l.egress != nil {
+		return l.egress
 	}
+	return l.handle
+}
 
-	if found_ipv4 {
-		val, exists := l.clients[ip4.SrcIP.String()]
-		if !exists || !val.IsZero() {
-			l.clients[ip4.SrcIP.String()] = time.Now().Add(l.clientTTL)
-			log.Debugf("%s: Learned client IP: %s", l.iname, ip4.SrcIP.String())
-		}
+// learn the IP of a client on a non-promisc interface
+func (l *Listen) learnClientIP(srcip net.IP) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	val, exists := l.clients[srcip.String()]
+	if !exists || !val.IsZero() {
+		l.clients[srcip.String()] = time.Now().Add(l.clientTTL)
+		log.Debugf("%s: Learned client IP: %s", l.label, srcip.String())
 	}
 }
 
@@ -422,14 +922,14 @@ func isValidLayerType(layertype layers.LinkType) bool {
 	return false
 }
 
-// SinkUdpPackets opens a UDP socket for broadcast packets and sends them to /dev/null
-// creates a go-routine for each interface/port combo so we don't block
-func (l *Listen) SinkUdpPackets() error {
-	addrs, err := l.netif.Addrs()
+// sinkAddresses returns the IPv4 addresses SinkUdpPackets listens on
+func (l *Listen) sinkAddresses() ([]string, error) {
+	addrs, err := l.addrs()
 	if err != nil {
-		return err
+		return []string{}, err
 	}
 
+	ret := []string{}
 	for _, addr := range addrs {
 		addrs := addr.String()
 
@@ -437,16 +937,45 @@ func (l *Listen) SinkUdpPackets() error {
 		if addrs == "0.0.0.0" || addrs == "" || strings.Contains(addrs, ":") {
 			continue
 		}
-		ipport := strings.Split(addrs, "/")
-		for _, port := range l.ports {
+		ret = append(ret, strings.Split(addrs, "/")[0])
+	}
+	return ret, nil
+}
+
+// sinkPorts returns the UDP ports SinkUdpPackets listens on: our --port(s)
+// and the --nat-port-range, since replies to our relay ports are captured
+// via libpcap and the kernel would answer each with an ICMP port unreachable
+func (l *Listen) sinkPorts() []int32 {
+	ports := append([]int32{}, l.ports...)
+	if l.rewrite.nat != nil {
+		for port := uint32(l.rewrite.nat.min); port <= uint32(l.rewrite.nat.max); port++ {
+			if !int32InSlice(int32(port), ports) {
+				ports = append(ports, int32(port))
+			}
+		}
+	}
+	return ports
+}
+
+// SinkUdpPackets opens a UDP socket for broadcast packets and sends them to /dev/null
+// creates a go-routine for each interface/port combo so we don't block
+func (l *Listen) SinkUdpPackets() error {
+	addrs, err := l.sinkAddresses()
+	if err != nil {
+		return err
+	}
+
+	ports := l.sinkPorts()
+	for _, ip := range addrs {
+		for _, port := range ports {
 			udp := net.UDPAddr{
-				IP:   net.ParseIP(ipport[0]),
+				IP:   net.ParseIP(ip),
 				Port: int(port),
 			}
 
 			conn, err := net.ListenUDP("udp4", &udp)
 			if err != nil {
-				return fmt.Errorf("%s:%d: %s", ipport[0], port, err.Error())
+				return fmt.Errorf("%s:%d: %s", ip, port, err.Error())
 			}
 
 			if err := conn.SetReadBuffer(MAX_PACKET_SIZE); err != nil {
@@ -458,7 +987,7 @@ func (l *Listen) SinkUdpPackets() error {
 				for {
 					_, _, err := conn.ReadFromUDP(buff)
 					if err != nil {
-						log.WithError(err).Warnf("Unable to read broadcast packet")
+						rateLog.Warnf("sink:"+l.iname, "Unable to read broadcast packet: %s", err)
 					}
 					// do nothing with the data
 				}
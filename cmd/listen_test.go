@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// testPacket returns a raw IPv4 UDP packet with valid checksums and the
+// layers we decoded from it
+func testPacket(t testing.TB, src string, dst string, srcPort uint16, dstPort uint16, payload []byte) (gopacket.Packet, *Decoded) {
+	t.Helper()
+	ip4 := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Flags:    layers.IPv4DontFragment,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP(dst).To4(),
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	if err := udp.SetNetworkLayerForChecksum(ip4); err != nil {
+		t.Fatal(err)
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, opts, ip4, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	d, err := decodePacket(packet.Data(), layers.LinkTypeRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet, d
+}
+
+// Every frame we send is injected via libpcap, so we always compute the IPv4
+// header checksum ourselves after rewriting the header
+func TestBuildPacketChecksums(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	tests := []struct {
+		name     string
+		linkType layers.LinkType
+		l        Listen
+	}{
+		{"ethernet", layers.LinkTypeEthernet, Listen{}},
+		{"vlan", layers.LinkTypeEthernet, Listen{rewrite: Rewrite{vlanTags: map[string]uint16{"eth0": 100}}}},
+		{"raw", layers.LinkTypeRaw, Listen{}},
+		{"null", layers.LinkTypeNull, Listen{}},
+		{"rewrites", layers.LinkTypeEthernet, Listen{rewrite: Rewrite{clearDF: true, scopeTTLs: scopeTTLs{SCOPE_GLOBAL: 8},
+			srcPorts: &srcPortRange{min: 40000, max: 40010}}}},
+	}
+	for _, test := range tests {
+		_, d := testPacket(t, "10.0.0.5", "255.255.255.255", 5000, 9003, []byte("hello world"))
+		l := test.l
+		l.linkType = test.linkType
+		l.netif = &net.Interface{HardwareAddr: mac}
+		l.rewrite.checksums = checksumPolicy{mode: CSUM_COMPUTE}
+		for _, dstip := range []string{"192.168.1.255", "233.252.0.1"} {
+			buffer := gopacket.NewSerializeBuffer()
+			sndpkt := Send{srcif: "eth0", decoded: d}
+			out, err := l.buildPacket(buffer, sndpkt, net.ParseIP(dstip).To4(), d.payload, d.ip4.Length)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+
+			sent, err := decodePacket(out.data, test.linkType)
+			if err != nil {
+				t.Fatalf("%s: unable to decode the packet we built: %s", test.name, err)
+			}
+			if family := nativeEndian.Uint32(out.data[:4]); test.linkType == layers.LinkTypeNull &&
+				family != uint32(layers.ProtocolFamilyIPv4) {
+				t.Errorf("%s: address family is %d, not AF_INET", test.name, family)
+			}
+			if !sent.ip4.DstIP.Equal(net.ParseIP(dstip)) {
+				t.Errorf("%s: sent to %s instead of %s", test.name, sent.ip4.DstIP, dstip)
+			}
+			if header := binary.BigEndian.Uint16(sent.ip4.Contents[10:]); header == 0 {
+				t.Errorf("%s: IPv4 header checksum is zero", test.name)
+			}
+			if !sent.checksumsValid() {
+				t.Errorf("%s: invalid IPv4 or UDP checksum sending to %s", test.name, dstip)
+			}
+			if sent.udp.Checksum == 0 {
+				t.Errorf("%s: UDP checksum wasn't computed", test.name)
+			}
+		}
+	}
+}
+
+// --src-port-range sends from a port within the range, always the same
+// port for a source with --src-port-mode hash
+func TestBuildPacketSrcPortRange(t *testing.T) {
+	srcPort := func(l *Listen, src string) uint16 {
+		_, d := testPacket(t, src, "255.255.255.255", 5000, 9003, []byte("hello world"))
+		out, err := l.buildPacket(gopacket.NewSerializeBuffer(), Send{srcif: "eth0", decoded: d},
+			net.ParseIP("192.168.1.255").To4(), d.payload, d.ip4.Length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent, err := decodePacket(out.data, layers.LinkTypeRaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sent.checksumsValid() {
+			t.Errorf("invalid checksum from port %d", sent.udp.SrcPort)
+		}
+		return uint16(sent.udp.SrcPort)
+	}
+	sources := []string{"10.0.0.5", "10.0.0.6", "10.0.0.7", "172.16.1.1", "192.168.2.9"}
+
+	for _, mode := range []string{"round-robin", "hash"} {
+		ports, err := parseSrcPortRange("40000-40002", mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := Listen{linkType: layers.LinkTypeRaw,
+			rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}, srcPorts: ports}}
+		first := map[string]uint16{}
+		used := map[uint16]bool{}
+		for i := 0; i < 3; i++ {
+			for _, src := range sources {
+				port := srcPort(&l, src)
+				if port < 40000 || port > 40002 {
+					t.Errorf("%s: %s sent from port %d", mode, src, port)
+				}
+				used[port] = true
+				if i == 0 {
+					first[src] = port
+				} else if mode == "hash" && port != first[src] {
+					t.Errorf("%s: %s sent from port %d and %d", mode, src, first[src], port)
+				}
+			}
+		}
+		if mode == "round-robin" && len(used) != 3 {
+			t.Errorf("%s: only used ports %v", mode, used)
+		}
+	}
+
+	// a range of one port
+	l := Listen{linkType: layers.LinkTypeRaw,
+		rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}, srcPorts: &srcPortRange{min: 65535, max: 65535}}}
+	if port := srcPort(&l, "10.0.0.5"); port != 65535 {
+		t.Errorf("sent from port %d", port)
+	}
+}
+
+func TestParseSrcPortRange(t *testing.T) {
+	tests := []struct {
+		value string
+		mode  string
+		err   string
+		min   uint16
+		max   uint16
+	}{
+		{"40000-40010", "", "", 40000, 40010},
+		{"1-65535", "hash", "", 1, 65535},
+		{"40000-40000", "", "", 40000, 40000},
+		{"40000", "", "is not in the format of <min>-<max>", 0, 0},
+		{"0-10", "", "is not a valid port range", 0, 0},
+		{"40010-40000", "", "is not a valid port range", 0, 0},
+		{"40000-65536", "", "is not a valid port range", 0, 0},
+		{"a-b", "", "is not a valid port range", 0, 0},
+	}
+	for _, test := range tests {
+		ports, err := parseSrcPortRange(test.value, test.mode)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.value, test.err, err)
+			}
+			continue
+		}
+		if err != nil || ports.min != test.min || ports.max != test.max || ports.hash != (test.mode == "hash") {
+			t.Errorf("%s: parsed %+v: %v", test.value, ports, err)
+		}
+	}
+}
+
+// --truncate only forwards the start of large payloads with the lengths and
+// checksums of what we send
+func TestBuildPacketTruncate(t *testing.T) {
+	tests := []struct {
+		name     string
+		truncate int
+		payload  string
+		sent     string
+	}{
+		{"unlimited", 0, "hello world", "hello world"},
+		{"short", 32, "hello world", "hello world"},
+		{"exact", 11, "hello world", "hello world"},
+		{"truncated", 5, "hello world", "hello"},
+		{"one byte", 1, "hello world", "h"},
+	}
+	for _, test := range tests {
+		_, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 9003, []byte(test.payload))
+		l := Listen{linkType: layers.LinkTypeRaw, stats: &Stats{},
+			rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}, truncate: test.truncate}}
+		payload, length := l.truncatePayload(d)
+		out, err := l.buildPacket(gopacket.NewSerializeBuffer(), Send{decoded: d},
+			net.ParseIP("192.168.1.255").To4(), payload, length)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		sent, err := decodePacket(out.data, layers.LinkTypeRaw)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if string(sent.payload) != test.sent {
+			t.Errorf("%s: sent %q", test.name, sent.payload)
+		}
+		if int(sent.ip4.Length) != 28+len(test.sent) || int(sent.udp.Length) != 8+len(test.sent) ||
+			len(out.data) != int(sent.ip4.Length) {
+			t.Errorf("%s: IPv4 length %d, UDP length %d in a %d byte packet", test.name,
+				sent.ip4.Length, sent.udp.Length, len(out.data))
+		}
+		if !sent.checksumsValid() || sent.udp.Checksum == 0 {
+			t.Errorf("%s: invalid checksum", test.name)
+		}
+		if truncated := l.stats.Snapshot().Truncated; truncated != 0 != (test.sent != test.payload) {
+			t.Errorf("%s: counted %d truncated packets", test.name, truncated)
+		}
+	}
+
+	// fragments are never truncated
+	_, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 9003, []byte("hello world"))
+	d.ip4.Flags = layers.IPv4MoreFragments
+	l := Listen{stats: &Stats{}, rewrite: Rewrite{truncate: 5}}
+	if payload, length := l.truncatePayload(d); string(payload) != "hello world" || length != d.ip4.Length {
+		t.Errorf("truncated a fragment to %q", payload)
+	}
+}
+
+func TestBuildPacketZeroChecksum(t *testing.T) {
+	_, d := testPacket(t, "10.0.0.5", "255.255.255.255", 5000, 9003, []byte("hello world"))
+	l := Listen{linkType: layers.LinkTypeRaw, rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_ZERO}}}
+	buffer := gopacket.NewSerializeBuffer()
+	out, err := l.buildPacket(buffer, Send{decoded: d}, net.ParseIP("192.168.1.255").To4(), d.payload, d.ip4.Length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, err := decodePacket(out.data, layers.LinkTypeRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the IPv4 header checksum is required even without a UDP checksum
+	if sent.udp.Checksum != 0 || !sent.checksumsValid() {
+		t.Errorf("expected a zero UDP checksum and valid IPv4 header checksum")
+	}
+}
+
+// Packets which fail to decode are counted and dropped unless
+// --forward-decode-errors and we found the IPv4 & UDP headers
+func TestProcessPacketDecodeErrors(t *testing.T) {
+	packet, _ := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+	badUDPLength := append([]byte{}, packet.Data()...)
+	badUDPLength[25] = 3 // shorter than the UDP header
+	tests := []struct {
+		name          string
+		data          []byte
+		forwardErrors bool
+		decodeErrors  uint64
+		forwarded     uint64
+	}{
+		{"valid", packet.Data(), false, 0, 1},
+		{"bad udp length", badUDPLength, false, 1, 0},
+		{"no udp header to forward", badUDPLength, true, 1, 0},
+		{"truncated ipv4 header", packet.Data()[:12], true, 1, 0},
+	}
+	for _, test := range tests {
+		l := Listen{iname: "raw0", label: "raw0", linkType: layers.LinkTypeRaw, stats: &Stats{},
+			capture: Capture{snaplen: DEFAULT_SNAPLEN, forwardErrors: test.forwardErrors}}
+		p := gopacket.NewPacket(test.data, layers.LinkTypeRaw, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		p.Metadata().CaptureInfo = gopacket.CaptureInfo{Length: len(test.data), CaptureLength: len(test.data)}
+		l.processPacket(&SendPktFeed{}, p, layers.LinkTypeRaw)
+
+		snap := l.stats.Snapshot()
+		if snap.DecodeErrors != test.decodeErrors || snap.Forwarded != test.forwarded {
+			t.Errorf("%s: %d decode errors, forwarded %d", test.name, snap.DecodeErrors, snap.Forwarded)
+		}
+		if dropped := l.stats.Dropped(DropDecodeError); dropped != test.decodeErrors {
+			t.Errorf("%s: dropped %d", test.name, dropped)
+		}
+	}
+}
+
+// Only --alias-fanout sends a broadcast back out the interface it arrived on,
+// and only to our other networks
+func TestProcessPacketAliasFanout(t *testing.T) {
+	Interfaces["alias0"] = pcap.Interface{Name: "alias0", Addresses: []pcap.InterfaceAddress{
+		{IP: net.ParseIP("192.168.1.1"), Netmask: net.CIDRMask(24, 32), Broadaddr: net.ParseIP("192.168.1.255")},
+		{IP: net.ParseIP("10.0.0.1"), Netmask: net.CIDRMask(24, 32), Broadaddr: net.ParseIP("10.0.0.255")},
+	}}
+	defer delete(Interfaces, "alias0")
+
+	for _, fanout := range []bool{false, true} {
+		own, other := make(chan Send, 1), make(chan Send, 1)
+		s := &SendPktFeed{}
+		s.RegisterSender(own, make(chan Send, 1), &Stats{}, "alias0")
+		s.RegisterSender(other, make(chan Send, 1), &Stats{}, "eth1")
+		// our --forward-delay queue holds what we'd send to our aliases
+		l := Listen{iname: "alias0", label: "alias0", linkType: layers.LinkTypeRaw, stats: &Stats{},
+			capture: Capture{snaplen: DEFAULT_SNAPLEN}, delay: newDelayQueue(time.Hour, time.Hour)}
+		l.bcast.aliasFanout = fanout
+
+		packet, _ := testPacket(t, "192.168.1.5", "192.168.1.255", 5000, 1900, []byte("hello"))
+		l.processPacket(s, packet, layers.LinkTypeRaw)
+		if len(own) != 0 || len(other) != 1 {
+			t.Errorf("fanout %v: sent %d packets to alias0 and %d to eth1", fanout, len(own), len(other))
+		}
+		if !fanout {
+			if len(l.delay.queue) != 0 {
+				t.Errorf("sent to our aliases without --alias-fanout")
+			}
+			continue
+		}
+		if len(l.delay.queue) != 1 {
+			t.Fatalf("queued %d packets for our aliases", len(l.delay.queue))
+		}
+		sndpkt := (<-l.delay.queue).send
+		if !sndpkt.aliases || sndpkt.srcif != "alias0" {
+			t.Errorf("queued %+v", sndpkt)
+		}
+		ip4 := sndpkt.decoded.ip4
+		if dstips := aliasBroadcasts(ip4.SrcIP, ip4.DstIP, Interfaces["alias0"].Addresses); fmt.Sprint(dstips) != "[10.0.0.255]" {
+			t.Errorf("sending to aliases %v", dstips)
+		}
+	}
+}
+
+// The packets we write to our pcap files keep the time they were captured,
+// not the time we received or sent them
+func TestPcapTimestamps(t *testing.T) {
+	captured := time.Date(2020, 1, 2, 3, 4, 5, 678901000, time.UTC)
+	open := func(iname string) *Listen {
+		l := &Listen{iname: iname, label: iname, linkType: layers.LinkTypeRaw, stats: &Stats{}, lock: &sync.Mutex{},
+			capture: Capture{snaplen: DEFAULT_SNAPLEN},
+			rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}}}
+		for _, dir := range []Direction{In, Out, InOut} {
+			if _, err := l.OpenWriter(t.TempDir(), dir, pcapRotation{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return l
+	}
+	in, out := open("ts0"), open("ts1")
+
+	sendq := make(chan Send, 1)
+	s := &SendPktFeed{}
+	s.RegisterSender(sendq, make(chan Send, 1), &Stats{}, "ts1")
+	packet, _ := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+	packet.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: captured, Length: len(packet.Data()),
+		CaptureLength: len(packet.Data())}
+	in.processPacket(s, packet, layers.LinkTypeRaw)
+	sndpkt := <-sendq
+	if !sndpkt.ts.Equal(captured) {
+		t.Fatalf("sending a packet captured at %s", sndpkt.ts)
+	}
+
+	// we send it a while later
+	time.Sleep(10 * time.Millisecond)
+	built, err := out.buildPacket(gopacket.NewSerializeBuffer(), sndpkt, net.ParseIP("192.168.1.255").To4(),
+		sndpkt.decoded.payload, sndpkt.decoded.ip4.Length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.writeSentPcap(sndpkt, built.data)
+	in.closeWriters()
+	out.closeWriters()
+
+	for _, w := range []*pcapWriter{in.inwriter, in.writer, out.outwriter, out.writer} {
+		f, err := os.Open(w.fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := pcapgo.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("%s: %s", w.fileName, err)
+		}
+		if !ci.Timestamp.Equal(captured) {
+			t.Errorf("%s: packet written at %s instead of %s", w.fileName, ci.Timestamp.UTC(), captured)
+		}
+		f.Close()
+	}
+}
+
+// We drop packets larger than the --mtu-override instead of the OS
+func TestMTUOverride(t *testing.T) {
+	tests := []struct {
+		value string
+		mtu   int
+		err   string
+	}{
+		{"eth0@68", 68, ""},
+		{"eth0@1400", 1400, ""},
+		{"eth0@65535", 65535, ""},
+		{"eth0@67", 0, "MTU must be between 68 and 65535"},
+		{"eth0@65536", 0, "MTU must be between 68 and 65535"},
+		{"eth0@jumbo", 0, "MTU must be between 68 and 65535"},
+	}
+	for _, test := range tests {
+		cli := CLI{Interface: []string{"eth0"}, MtuOverride: []string{test.value}}
+		o, errs := parseInterfaceOptions(&cli)
+		if len(test.err) > 0 {
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.value, test.err, errs)
+			}
+		} else if len(errs) != 0 || o.mtus["eth0"] != test.mtu {
+			t.Errorf("%s: MTU is %d: %v", test.value, o.mtus["eth0"], errs)
+		}
+	}
+
+	_, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, make([]byte, 1400))
+	sizes := []struct {
+		mtu      int
+		truncate int
+		dropped  bool
+	}{
+		{0, 0, false},
+		{1500, 0, false},
+		{1428, 0, false},
+		{1427, 0, true},
+		{1300, 0, true},
+		{1300, 1000, false}, // we check the --truncate'd length
+	}
+	for _, size := range sizes {
+		l := Listen{iname: "mtu0", label: "mtu0", mtu: size.mtu, stats: &Stats{}}
+		l.rewrite.truncate = size.truncate
+		_, length := l.truncatePayload(d)
+		err := l.checkMTU(length)
+		if dropped := err != nil; dropped != size.dropped || dropped && dropReasonOf(err) != DropMTU {
+			t.Errorf("%d MTU, %d length: %v", size.mtu, length, err)
+		}
+		if !size.dropped {
+			continue
+		}
+		// sendPacket drops it before building the packet
+		err, bytes := l.sendPacket(Send{srcif: "eth1", decoded: d}, net.ParseIP("192.168.1.255"))
+		if dropReasonOf(err) != DropMTU || bytes != 1428 ||
+			!strings.Contains(err.Error(), fmt.Sprintf("1428 byte packet is larger than the --mtu-override %d", size.mtu)) {
+			t.Errorf("%d MTU: sent %d bytes: %v", size.mtu, bytes, err)
+		}
+	}
+}
+
+// Point-to-point and /32 addresses have no broadcast address, so we only
+// select the networks which do and allow packets from the P2P peer
+func TestHostAndPointToPointAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []pcap.InterfaceAddress
+		bcast     string // broadcastAddress
+		subnets   string // subnetBroadcasts
+		aliases   string // aliasBroadcasts of a broadcast from the first address
+		networks  string // the networks we capture from
+		fixedErr  string // resolving --fixed-ip broadcast
+	}{
+		{"point-to-point", []pcap.InterfaceAddress{
+			{IP: net.ParseIP("10.8.0.1"), Netmask: net.CIDRMask(32, 32), P2P: net.ParseIP("10.8.0.2")},
+		}, "255.255.255.255", "[10.8.0.2]", "[]", "(src host 10.8.0.2)", "no IPv4 network with a broadcast address"},
+		{"host", []pcap.InterfaceAddress{
+			{IP: net.ParseIP("192.0.2.1"), Netmask: net.CIDRMask(32, 32)},
+		}, "255.255.255.255", "[]", "[]", "", "no IPv4 network with a broadcast address"},
+		{"host and subnet", []pcap.InterfaceAddress{
+			{IP: net.ParseIP("192.0.2.1"), Netmask: net.CIDRMask(32, 32)},
+			{IP: net.ParseIP("10.0.0.1"), Netmask: net.CIDRMask(24, 32), Broadaddr: net.ParseIP("10.0.0.255")},
+		}, "10.0.0.255", "[10.0.0.255]", "[10.0.0.255]", "(src net 10.0.0.0/24)", ""},
+	}
+	for _, test := range tests {
+		addrs := []net.Addr{}
+		for _, addr := range test.addresses {
+			addrs = append(addrs, &net.IPNet{IP: addr.IP, Mask: addr.Netmask})
+		}
+		if bcast := broadcastAddress("p2p0", addrs); bcast != test.bcast {
+			t.Errorf("%s: broadcast is %s", test.name, bcast)
+		}
+		if subnets := subnetBroadcasts(test.addresses); fmt.Sprint(subnets) != test.subnets {
+			t.Errorf("%s: subnets are %v", test.name, subnets)
+		}
+		srcip := test.addresses[0].IP
+		if aliases := aliasBroadcasts(srcip, net.IPv4bcast, test.addresses); fmt.Sprint(aliases) != test.aliases {
+			t.Errorf("%s: aliases are %v", test.name, aliases)
+		}
+
+		filter := buildBPFFilter([]int32{1900}, test.addresses, false, false, false, "")
+		if len(test.networks) > 0 && !strings.Contains(filter, test.networks) ||
+			len(test.networks) == 0 && strings.Contains(filter, "src ") {
+			t.Errorf("%s: filter is %s", test.name, filter)
+		}
+		if strings.Contains(filter, "/32") {
+			t.Errorf("%s: capturing from a /32: %s", test.name, filter)
+		}
+
+		_, err := resolveBroadcastKeyword(FIXED_IP_BROADCAST, addrs)
+		if len(test.fixedErr) > 0 && (err == nil || !strings.Contains(err.Error(), test.fixedErr)) ||
+			len(test.fixedErr) == 0 && err != nil {
+			t.Errorf("%s: --fixed-ip broadcast: %v", test.name, err)
+		}
+	}
+	if bcast := broadcastAddress("p2p0", []net.Addr{}); bcast != "" {
+		t.Errorf("broadcast without addresses is %s", bcast)
+	}
+}
+
+// We always clear the reserved bit of the packets we send and only clear
+// Don't Fragment with --clear-df
+func TestIPv4Flags(t *testing.T) {
+	tests := []struct {
+		flags   layers.IPv4Flag
+		clearDF bool
+		sent    layers.IPv4Flag
+	}{
+		{0, false, 0},
+		{layers.IPv4DontFragment, false, layers.IPv4DontFragment},
+		{layers.IPv4DontFragment, true, 0},
+		{layers.IPv4EvilBit, false, 0},
+		{layers.IPv4EvilBit | layers.IPv4DontFragment, false, layers.IPv4DontFragment},
+		{layers.IPv4EvilBit | layers.IPv4DontFragment, true, 0},
+		{layers.IPv4MoreFragments, true, layers.IPv4MoreFragments},
+		{layers.IPv4EvilBit | layers.IPv4MoreFragments, false, layers.IPv4MoreFragments},
+	}
+	for _, test := range tests {
+		l := Listen{iname: "flags0", label: "flags0", linkType: layers.LinkTypeRaw, ports: []int32{1900},
+			rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}, clearDF: test.clearDF}}
+		if flags := l.ipv4Flags(test.flags); flags != test.sent {
+			t.Errorf("%s with --clear-df=%v: flags are %s", test.flags, test.clearDF, flags)
+		}
+
+		_, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+		d.ip4.Flags = test.flags
+		built, err := l.buildPacket(gopacket.NewSerializeBuffer(), Send{srcif: "eth0", decoded: d},
+			net.ParseIP("192.168.1.255").To4(), d.payload, d.ip4.Length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the flags are the top 3 bits after the IPv4 id
+		if flags := layers.IPv4Flag(built.data[6] >> 5); flags != test.sent {
+			t.Errorf("%s with --clear-df=%v: sent %s", test.flags, test.clearDF, flags)
+		}
+	}
+
+	cli := CLI{}
+	if _, err := newParser(&cli).Parse([]string{"--clear-df"}); err != nil || !cli.ClearDF {
+		t.Errorf("--clear-df is %v: %v", cli.ClearDF, err)
+	}
+}
+
+// --remote-broadcast sends to the directed broadcast of a subnet behind a
+// router, which isn't on any of our networks
+func TestRemoteBroadcast(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	lo.HardwareAddr = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02} // so we can build Ethernet frames
+	Interfaces["lo"] = pcap.Interface{Name: "lo",
+		Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("127.0.0.1"), Netmask: net.CIDRMask(8, 32)}}}
+	defer delete(Interfaces, "lo")
+	gateway := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+
+	tests := []struct {
+		ip      string
+		gateway net.HardwareAddr
+		warning string
+		dstMAC  net.HardwareAddr
+	}{
+		{"10.20.30.255", gateway, "lo: sending to off-link broadcast 10.20.30.255 instead of 127.255.255.255", gateway},
+		{"10.20.30.255", nil, "lo: sending to off-link broadcast 10.20.30.255", layers.EthernetBroadcast},
+		{"127.255.255.255", gateway, "lo: --remote-broadcast 127.255.255.255 is on-link", gateway},
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	for _, test := range tests {
+		buf.Reset()
+		l := Listen{iname: "lo", label: "lo", netif: lo, linkType: layers.LinkTypeEthernet, ports: []int32{1900},
+			ipaddr: "127.255.255.255", rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}}}
+		l.bcast.allSubnets = true
+		l.setRemoteBroadcast(net.ParseIP(test.ip).To4(), test.gateway)
+		if !strings.Contains(buf.String(), test.warning) {
+			t.Errorf("%s: logged %q", test.ip, buf.String())
+		}
+
+		// we only send to the remote broadcast, even with --all-subnets
+		dstips := l.broadcastIPs()
+		if fmt.Sprint(dstips) != "["+test.ip+"]" || l.destinations()[0] != test.ip {
+			t.Fatalf("%s: sending to %v", test.ip, dstips)
+		}
+		_, d := testPacket(t, "192.168.1.5", "192.168.1.255", 5000, 1900, []byte("hello"))
+		built, err := l.buildPacket(gopacket.NewSerializeBuffer(), Send{srcif: "eth1", decoded: d}, dstips[0],
+			d.payload, d.ip4.Length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent := gopacket.NewPacket(built.data, layers.LinkTypeEthernet, gopacket.Default)
+		eth, _ := sent.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		ip4, _ := sent.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if eth == nil || ip4 == nil {
+			t.Fatalf("%s: sent %v", test.ip, sent)
+		}
+		if eth.DstMAC.String() != test.dstMAC.String() || !ip4.DstIP.Equal(net.ParseIP(test.ip)) {
+			t.Errorf("%s: sent to %s via %s", test.ip, ip4.DstIP, eth.DstMAC)
+		}
+	}
+}
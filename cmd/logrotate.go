@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is an io.Writer for our --logfile which rotates the file
+// log style once it reaches maxSize bytes
+type rotatingFile struct {
+	lock     sync.Mutex
+	fileName string
+	maxSize  int64 // 0 never rotates
+	keep     int   // number of rotated files to keep
+	file     *os.File
+	size     int64
+}
+
+// openRotatingFile opens fileName for appending
+func openRotatingFile(fileName string, maxSize int64, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		fileName: fileName,
+		maxSize:  maxSize,
+		keep:     keep,
+	}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.fileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// Write writes p to the current file, rotating it first if p would make it
+// larger than maxSize
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to close %s: %s\n", r.fileName, err)
+	}
+	if err := shiftRotatedFiles(r.fileName, r.keep); err != nil {
+		// we can't log this to the file we are rotating
+		fmt.Fprintf(os.Stderr, "Unable to rotate %s: %s\n", r.fileName, err)
+	}
+	if r.keep == 0 {
+		// nothing to keep, so start over
+		if err := os.Truncate(r.fileName, 0); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return r.open()
+}
+
+// shiftRotatedFiles renames fileName to <fileName>.1, <fileName>.1 to
+// <fileName>.2 and so on, removing the files after the keep newest.  Must
+// not log since it rotates our --logfile.
+func shiftRotatedFiles(fileName string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", fileName, keep))
+	for n := keep - 1; n > 0; n-- {
+		from := fmt.Sprintf("%s.%d", fileName, n)
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", fileName, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(fileName, fileName+".1")
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Our --logfile is rotated once the next log line would make it too big
+func TestRotatingFile(t *testing.T) {
+	const LINE = int64(len("level=info msg=0\n"))
+	tests := []struct {
+		name    string
+		maxSize int64
+		keep    int
+		lines   []string // contents of the file, file.1, file.2, ...
+	}{
+		{"never", 0, 5, []string{"0123456789", ""}},
+		{"at the size", 3 * LINE, 5, []string{"9", "678", "345", "012", ""}},
+		{"under the size", 3*LINE - 1, 5, []string{"89", "67", "45", "23", "01", ""}},
+		{"prune", LINE, 2, []string{"9", "8", "7", ""}},
+		{"keep none", LINE, 0, []string{"9", ""}},
+	}
+	for _, test := range tests {
+		fileName := filepath.Join(t.TempDir(), "udp-proxy-2020.log")
+		file, err := openRotatingFile(fileName, test.maxSize, test.keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger := log.New()
+		logger.SetOutput(file)
+		logger.SetFormatter(&log.TextFormatter{DisableTimestamp: true})
+		for i := 0; i < 10; i++ {
+			logger.Infof("%d", i)
+		}
+		file.file.Close()
+
+		for n, expected := range test.lines {
+			name := fileName
+			if n > 0 {
+				name = fmt.Sprintf("%s.%d", fileName, n)
+			}
+			data, err := os.ReadFile(name)
+			if len(expected) == 0 {
+				if !os.IsNotExist(err) {
+					t.Errorf("%s: %s should not exist", test.name, filepath.Base(name))
+				}
+				continue
+			}
+			lines := ""
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				lines += strings.TrimPrefix(line, "level=info msg=")
+			}
+			if lines != expected {
+				t.Errorf("%s: %s has %q, expected %q", test.name, filepath.Base(name), lines, expected)
+			}
+		}
+	}
+}
+
+// Reopening our --logfile appends to it and counts what is already there
+func TestRotatingFileReopen(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "udp-proxy-2020.log")
+	if err := os.WriteFile(fileName, []byte("before\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := openRotatingFile(fileName, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.size != 7 {
+		t.Errorf("size is %d", file.size)
+	}
+	if _, err := file.Write([]byte("after\n")); err != nil {
+		t.Fatal(err)
+	}
+	file.file.Close()
+	if data, _ := os.ReadFile(fileName + ".1"); string(data) != "before\n" {
+		t.Errorf("rotated %q", data)
+	}
+	if data, _ := os.ReadFile(fileName); string(data) != "after\n" {
+		t.Errorf("wrote %q", data)
+	}
+}
+
+func TestSetupLogOutput(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	fileName := filepath.Join(t.TempDir(), "udp-proxy-2020.log")
+	tests := []struct {
+		cli CLI
+		err string
+	}{
+		{CLI{Logfile: "stderr", LogMaxSize: -1}, ""},
+		{CLI{Logfile: fileName, LogMaxSize: -1}, "--logfile-max-size and --logfile-keep must be >= 0"},
+		{CLI{Logfile: fileName, LogKeep: -1}, "--logfile-max-size and --logfile-keep must be >= 0"},
+		{CLI{Logfile: filepath.Join(fileName, "missing")}, "Unable to open log file"},
+		{CLI{Logfile: fileName, LogMaxSize: 1, LogKeep: 5}, ""},
+	}
+	for _, test := range tests {
+		err := setupLogOutput(&test.cli)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.cli.Logfile, test.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", test.cli.Logfile, err)
+		}
+	}
+
+	log.Infof("written to the --logfile")
+	if file, ok := log.StandardLogger().Out.(*rotatingFile); ok {
+		file.file.Close()
+	} else {
+		t.Errorf("logging to %T", log.StandardLogger().Out)
+	}
+	log.SetOutput(os.Stderr)
+	if data, _ := os.ReadFile(fileName); !strings.Contains(string(data), "written to the --logfile") {
+		t.Errorf("log file has %q", data)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/binary"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// nativeEndian is the byte order of this host
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	var i uint16 = 0x0102
+	if (*[2]byte)(unsafe.Pointer(&i))[0] == 0x01 { // #nosec G103
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}()
+
+// serializeLoopback prepends the 4 byte address family header used by
+// BSD NULL/Loopback interfaces (tun devices for OpenVPN/etc).
+// LinkTypeNull uses host byte order while LinkTypeLoop (OpenBSD) always
+// uses network byte order.  gopacket's Loopback layer always writes little
+// endian which is wrong for both on big endian hosts (MIPS64).
+func serializeLoopback(buffer gopacket.SerializeBuffer, linkType layers.LinkType, family layers.ProtocolFamily) error {
+	bytes, err := buffer.PrependBytes(4)
+	if err != nil {
+		return err
+	}
+	if linkType == layers.LinkTypeLoop {
+		binary.BigEndian.PutUint32(bytes, uint32(family))
+	} else {
+		nativeEndian.PutUint32(bytes, uint32(family))
+	}
+	return nil
+}
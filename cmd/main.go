@@ -4,11 +4,12 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,20 +19,115 @@ var Tag = "NO-TAG"
 var CommitID = "unknown"
 var Delta = ""
 
+// Default --port for --auto-mesh: SSDP & mDNS
+var AUTO_MESH_PORTS = []int32{1900, 5353}
+
 type CLI struct {
-	Interface      []string `kong:"short='i',help='Two or more interfaces to use'"`
-	FixedIp        []string `kong:"short='I',help='IPs to always send to iface@ip'"`
-	Port           []int32  `kong:"short='p',help='One or more UDP ports to process'"`
-	Timeout        int64    `kong:"short='t',default=250,help='Timeout in msec'"`
+	Interface      []string `kong:"short='i',env='UDPPROXY_INTERFACES',help='Two or more interfaces to use (supports wildcards)'"`
+	AutoMesh       bool     `kong:"help='Forward between every interface which is up and has an IPv4 broadcast address'"`
+	MaxInterfaces  int      `kong:"default=64,help='Max number of interfaces to use'"`
+	ExcludeIface   []string `kong:"name='exclude-interface',short='X',help='Interfaces or wildcards to never use'"`
+	Alias          []string `kong:"help='Define alias@interface as a friendly name for an interface'"`
+	Label          []string `kong:"help='Log iface@label as label instead of the interface name'"`
+	FixedIp        []string `kong:"short='I',env='UDPPROXY_FIXED_IP',help='IPs to always send to iface@ip'"`
+	Pair           []string `kong:"env='UDPPROXY_PAIR',help='Only forward between iface1[@ip1]:iface2[@ip2]'"`
+	SrcRoute       []string `kong:"help='Only forward packets from iface@cidr out iface'"`
+	PortRoute      []string `kong:"help='Only forward packets to iface@port out iface'"`
+	PortRouteDflt  []string `kong:"name='port-route-default',help='Interfaces to forward packets to ports without a --port-route'"`
+	Port           []int32  `kong:"short='p',env='UDPPROXY_PORTS',help='One or more UDP ports to process'"`
+	Filter         []string `kong:"short='f',sep='none',env='UDPPROXY_FILTER',help='Additional BPF filter.  Repeated filters are OR-ed together'"`
+	FilterFile     []string `kong:"type='existingfile',help='Read an additional BPF filter from a file'"`
+	PayloadLength  []string `kong:"help='Only forward packets with a UDP payload of these lengths or min-max ranges'"`
+	SrcPort        []uint16 `kong:"help='Only forward packets from these UDP source ports (default is any port)'"`
+	DenyPayload    []string `kong:"sep='none',help='Drop packets whose payload matches hex:<bytes> or re:<regexp>'"`
+	DenyFile       []string `kong:"name='deny-payload-file',type='existingfile',help='Read --deny-payload signatures from a file'"`
+	EtherTypes     []string `kong:"name='ethertypes',help='Only capture these EtherTypes on Ethernet interfaces [ipv4|ipv6|arp|0xNNNN]'"`
+	SendRetries    int      `kong:"default=0,help='Retry sending a packet up to N times on transient errors (max 5)'"`
+	HighWatermark  int      `kong:"help='Drop packets when an interface has N packets queued (0 drops them once the queue is full)'"`
+	QueueAlert     int      `kong:"name='queue-depth-alert',default=75,help='Warn when an interface has N packets queued to send (0 disables)'"`
+	ByteRate       int64    `kong:"name='rate-limit-bytes',help='Drop packets received on an interface over N bytes/sec (0 disables)'"`
+	PriorityPort   []uint16 `kong:"help='Send packets to these UDP ports before all others'"`
+	SrcPortRange   string   `kong:"help='Rewrite the UDP source port to one in the range min-max'"`
+	SrcPortMode    string   `kong:"default='round-robin',enum='round-robin,hash',help='How to pick the --src-port-range port [round-robin|hash]'"`
+	NatPortRange   string   `kong:"help='Send from our IP with a port in the range min-max and translate replies back to the requester'"`
+	NatTimeout     int64    `kong:"default=30,help='Seconds until an idle --nat-port-range translation expires'"`
+	Truncate       int      `kong:"help='Only forward the first N bytes of each UDP payload (0 disables)'"`
+	Snaplen        int      `kong:"default=9000,help='Max bytes of each packet to capture. Larger packets are dropped'"`
+	Timeout        int64    `kong:"short='t',default=250,env='UDPPROXY_TIMEOUT',help='Timeout in msec'"`
+	IfaceTimeout   []string `kong:"name='interface-timeout',help='Override --timeout for iface@msec'"`
+	MtuOverride    []string `kong:"help='Drop packets larger than iface@mtu instead of the interface MTU'"`
 	CacheTTL       int64    `kong:"short='T',default=180,help='Client IP cache TTL in minutes'"`
-	Level          string   `kong:"short='L',default='info',enum='trace,debug,info,warn,error',help='Log level [trace|debug|info|warn|error]'"`
+	Level          string   `kong:"short='L',default='info',enum='trace,debug,info,warn,error',env='UDPPROXY_LEVEL',help='Log level [trace|debug|info|warn|error]'"`
+	Quiet          bool     `kong:"short='q',help='Only log errors (same as --level error)'"`
 	LogLines       bool     `kong:"help='Print line number in logs'"`
-	Logfile        string   `kong:"default='stderr',help='Write logs to filename'"`
+	Logfile        string   `kong:"default='stderr',env='UDPPROXY_LOGFILE',help='Write logs to filename'"`
+	LogMaxSize     int64    `kong:"name='logfile-max-size',help='Rotate --logfile once it reaches N MB (0 disables)'"`
+	LogKeep        int      `kong:"name='logfile-keep',default=5,help='Number of rotated --logfile files to keep'"`
+	Syslog         string   `kong:"help='Also send logs to syslog [local|udp://host:port|tcp://host:port]'"`
 	Pcap           bool     `kong:"short='P',help='Generate pcap files for debugging'"`
 	PcapPath       string   `kong:"short='d',default='/root',help='Directory to write debug pcap files'"`
+	PcapMaxSize    int64    `kong:"help='Rotate --pcap files once they reach N MB (0 disables)'"`
+	PcapMaxAge     int64    `kong:"help='Rotate --pcap files after N seconds (0 disables)'"`
+	PcapKeep       int      `kong:"default=5,help='Number of rotated --pcap files to keep'"`
+	MaxRuntime     string   `kong:"help='Exit after running for this long (like 30s or 2h)'"`
+	MaxIdle        string   `kong:"help='Exit with an error when an interface captures no packets for this long (like 10m)'"`
+	MaxIdleAll     bool     `kong:"help='Only exit for --max-idle once all of the interfaces are idle'"`
 	ListInterfaces bool     `kong:"short='l',help='List available interfaces and exit'"`
+	Bench          string   `kong:"help='Benchmark forwarding from the first to the second --interface for this long (like 80s) and exit'"`
+	BenchRate      int      `kong:"default=1000,help='Starting packets/sec for --bench which doubles every step'"`
+	Learn          string   `kong:"help='Capture for this long (like 60s) and suggest which --port(s) to forward'"`
+	Validate       bool     `kong:"help='Check the configuration and BPF filters and exit without forwarding'"`
 	Version        bool     `kong:"short='v',help='Print version information'"`
+	VersionJson    bool     `kong:"name='version-json',help='Print version information and supported features as JSON'"`
 	NoListen       bool     `kong:"help='Do not actively listen on UDP port(s)'"`
+	DropLogRate    uint64   `kong:"default=100,help='Log 1 in N dropped packets at debug level (0 disables)'"`
+	ForwardErrors  bool     `kong:"name='forward-decode-errors',help='Forward packets with decode errors if the IPv4 & UDP headers are valid'"`
+	ZeroCopy       bool     `kong:"help='Read packets without allocating a buffer for each one'"`
+	Fanout         int      `kong:"help='Capture on each interface with N PACKET_FANOUT sockets (Linux only, 0 disables)'"`
+	FanoutGroup    uint16   `kong:"help='PACKET_FANOUT group ID of the first --interface, incremented for each one after it (default is our PID)'"`
+	Repeats        int64    `kong:"name='suppress-repeats',help='Only forward a repeated payload from a source every N seconds (0 disables)'"`
+	Defrag         bool     `kong:"help='Reassemble fragmented IPv4 packets before forwarding'"`
+	NoUdpChecksum  bool     `kong:"help='Send IPv4 UDP packets with a zero checksum to save CPU'"`
+	CsumPolicy     []string `kong:"name='checksum-policy',help='Set the UDP checksum of packets sent to an iface@mode or ip@mode [compute|zero|preserve]'"`
+	Profile        []string `kong:"sep='none',help='Define a rewrite profile name@key=value[,key=value...] [masquerade|ttl|checksum|port|broadcast]'"`
+	IfaceProfile   []string `kong:"name='interface-profile',help='Rewrite the packets sent out iface@profile with the --profile'"`
+	ClearDF        bool     `kong:"name='clear-df',help='Clear the Do Not Fragment flag of forwarded packets'"`
+	AllowOverlap   bool     `kong:"help='Forward between interfaces with overlapping IPv4 subnets'"`
+	ScopeTTL       []string `kong:"help='Send packets to multicast groups in a scope@ttl [link|site|org|global] with ttl'"`
+	RequirePromisc bool     `kong:"help='Exit if promiscuous mode can not be enabled instead of capturing without it'"`
+	VerifyCsum     bool     `kong:"name='verify-checksum',help='Drop received packets with an invalid IPv4 or UDP checksum'"`
+	UdpLite        bool     `kong:"name='udplite',help='Also forward UDP-Lite (IP protocol 136) packets on the --port(s)'"`
+	VlanTag        []string `kong:"help='Add a 802.1Q tag to packets from iface@vlan-id'"`
+	DropOwn        bool     `kong:"name='drop-own-broadcasts',help='Never forward packets sent from the IP of one of our interfaces'"`
+	McastGroups    []string `kong:"name='multicast-groups',help='Only forward multicast packets sent to these groups or CIDRs'"`
+	SrcOUI         []string `kong:"name='src-oui',help='Only forward packets from MAC addresses with these OUIs (aa:bb:cc)'"`
+	OUINonEther    bool     `kong:"name='src-oui-non-ethernet',help='Forward packets without a MAC address (tun/loopback) when --src-oui is used'"`
+	BroadcastOnly  bool     `kong:"help='Only forward broadcast and multicast packets'"`
+	SpikePps       uint64   `kong:"help='Warn when an interface forwards more than N packets/sec (0 disables)'"`
+	TopTalkers     int      `kong:"help='Periodically log the N source IPs we forward the most packets from (0 disables)'"`
+	TopInterval    int64    `kong:"name='top-talkers-interval',default=300,help='Seconds between --top-talkers reports'"`
+	SpikeWindow    int64    `kong:"default=10,help='Number of seconds --spike-pps must be exceeded'"`
+	ReopenInterval string   `kong:"help='Reopen the pcap handle of each interface this often to recover from driver stalls like 6h'"`
+	ForwardDelay   string   `kong:"help='Delay forwarded packets by msec or a random min-max msec (max 1000)'"`
+	Wifi           []string `kong:"help='Only receive on these 802.11 monitor mode interfaces'"`
+	AllSubnets     bool     `kong:"help='Send to the broadcast address of every IPv4 network on broadcast interfaces'"`
+	RemoteBcast    []string `kong:"name='remote-broadcast',help='Send to the directed broadcast iface@ip of a subnet behind a router'"`
+	GatewayMac     []string `kong:"help='Send --remote-broadcast packets to the router with iface@mac'"`
+	AliasFanout    []string `kong:"help='Forward broadcasts between the IPv4 networks (IP aliases) on these interfaces'"`
+	Strict         bool     `kong:"help='Exit on configuration problems we would otherwise warn about'"`
+	Schedule       []string `kong:"sep='none',help='Only forward packets from iface@HH:MM-HH:MM[,HH:MM-HH:MM...]'"`
+	Timezone       string   `kong:"default='Local',help='Timezone for --schedule (like America/Los_Angeles)'"`
+	Tee            string   `kong:"help='Copy every packet we send to the UDP collector at host:port'"`
+	TeeEncap       string   `kong:"default='raw',enum='raw,framed',help='How --tee packets are encapsulated [raw|framed]'"`
+	Fifo           string   `kong:"help='Stream every packet we send to this named pipe (FIFO)'"`
+	FifoFormat     string   `kong:"default='pcapng',enum='pcapng,framed',help='Format of the --fifo stream [pcapng|framed]'"`
+	Netflow        string   `kong:"help='Export NetFlow v5 records of forwarded flows to the collector at host:port'"`
+	FlowActive     int64    `kong:"name='netflow-active-timeout',default=60,help='Export --netflow flows active for N seconds'"`
+	FlowInactive   int64    `kong:"name='netflow-inactive-timeout',default=15,help='Export --netflow flows idle for N seconds'"`
+	StatusAddr     string   `kong:"help='Serve status information via HTTP on host:port (like 127.0.0.1:8020)'"`
+	PprofAddr      string   `kong:"help='Serve Go pprof profiles via HTTP on [host]:port (default host is 127.0.0.1)'"`
+	MirrorTo       string   `kong:"help='Send an unchanged copy of every captured packet out this device'"`
+	Egress         []string `kong:"name='egress-interface',help='Send packets for iface@device out device (like a bridge member)'"`
 }
 
 func init() {
@@ -43,44 +139,33 @@ func init() {
 	log.SetOutput(os.Stderr)
 }
 
-func main() {
-	cli := CLI{}
-	parser := kong.Must(
-		&cli,
+// newParser returns the parser of our command line flags into cli
+func newParser(cli *CLI) *kong.Kong {
+	return kong.Must(
+		cli,
 		kong.Name("udp-proxy-2020"),
 		kong.Description("A crappy UDP proxy for the year 2020 and beyond!"),
 		kong.UsageOnError(),
 	)
+}
+
+func main() {
+	cli := CLI{}
+	parser := newParser(&cli)
 	_, err := parser.Parse(os.Args[1:])
 	parser.FatalIfErrorf(err)
 
-	if cli.Version {
-		delta := ""
-		if len(Delta) > 0 {
-			delta = fmt.Sprintf(" [%s delta]", Delta)
-			Tag = "Unknown"
+	if cli.Version || cli.VersionJson {
+		if err := printVersion(os.Stdout, cli.VersionJson); err != nil {
+			log.WithError(err).Fatalf("Unable to print version")
 		}
-		fmt.Printf("udp-proxy-2020 Version %s -- Copyright 2020-2022 Aaron Turner\n", Version)
-		fmt.Printf("%s (%s)%s built at %s\n", CommitID, Tag, delta, Buildinfos)
 		os.Exit(0)
 	}
 
-	// Setup Logging
-	switch cli.Level {
-	case "trace":
-		log.SetLevel(log.TraceLevel)
-	case "debug":
-		log.SetLevel(log.DebugLevel)
-	case "warn":
-		log.SetLevel(log.WarnLevel)
-	case "info":
-		log.SetLevel(log.InfoLevel)
-	case "error":
-		log.SetLevel(log.ErrorLevel)
-	}
+	setupLogging(&cli)
 
-	if cli.LogLines {
-		log.SetReportCaller(true)
+	if InterfaceAliases, err = parseAliases(cli.Alias); err != nil {
+		log.WithError(err).Fatalf("Invalid --alias")
 	}
 
 	if cli.ListInterfaces {
@@ -88,71 +173,475 @@ func main() {
 		os.Exit(0)
 	}
 
+	// --pair adds the interfaces it forwards between
+	peers, err := parsePairs(&cli)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cli.AutoMesh {
+		cli.Interface = append(cli.Interface, autoMeshInterfaces(systemInterfaces())...)
+		if len(cli.Port) == 0 {
+			cli.Port = AUTO_MESH_PORTS
+			log.Infof("--auto-mesh is forwarding the default ports: %v", cli.Port)
+		}
+	}
+
+	interfaces, err := expandInterfaces(resolveInterfaces(cli.Interface),
+		resolveInterfaces(cli.ExcludeIface), systemInterfaceNames())
+	if err != nil {
+		log.WithError(err).Fatalf("Unable to process --interface")
+	}
+	cli.Interface = interfaces
+
+	if len(cli.Learn) > 0 {
+		duration, err := time.ParseDuration(cli.Learn)
+		if err != nil || duration <= 0 {
+			log.Fatalf("--learn %s must be a positive duration like 60s or 5m", cli.Learn)
+		}
+		if len(cli.Interface) < 1 {
+			log.Fatalf("Please specify one or more --interface")
+		}
+		learnTraffic(cli.Interface, duration, cli.Snaplen, time.Duration(cli.Timeout)*time.Millisecond)
+		return
+	}
+
+	// find every problem with our configuration before we give up
+	errs := configErrors{}
 	if len(cli.Interface) < 2 {
-		log.Fatalf("Please specify two or more --interface")
+		errs.Addf("Please specify two or more --interface")
+	}
+	if len(cli.Interface) > cli.MaxInterfaces {
+		errs.Addf("%d interfaces exceeds --max-interfaces %d", len(cli.Interface), cli.MaxInterfaces)
 	}
 	if len(cli.Port) < 1 {
-		log.Fatalf("Please specify one or more --port")
+		errs.Addf("Please specify one or more --port")
 	}
 
-	if cli.Logfile != "stderr" {
-		file, err := os.OpenFile(cli.Logfile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err := setupLogOutput(&cli); err != nil {
+		log.Fatal(err)
+	}
+	if len(cli.PprofAddr) > 0 && !cli.Validate {
+		addr, err := pprofAddr(cli.PprofAddr)
 		if err != nil {
-			log.WithError(err).Fatalf("Unable to open log file: %s", cli.Logfile)
+			log.WithError(err).Fatalf("Invalid --pprof-addr")
 		}
-		log.SetOutput(file)
+		startPprofServer(addr)
 	}
 
 	// handle our timeout
 	to := parseTimeout(cli.Timeout)
 
-	var fixed_ip = map[string][]string{}
-	for _, fip := range cli.FixedIp {
-		split := strings.Split(fip, "@")
-		if len(split) != 2 {
-			log.Fatalf("--fixed-ip %s is not in the correct format of <interface>@<ip>", fip)
+	if cli.SendRetries < 0 || cli.SendRetries > MAX_SEND_RETRIES {
+		errs.Addf("--send-retries must be between 0 and %d", MAX_SEND_RETRIES)
+	}
+	if cli.Truncate < 0 {
+		errs.Addf("--truncate must be zero or more bytes")
+	}
+	if cli.Snaplen < MIN_SNAPLEN {
+		errs.Addf("--snaplen must be at least %d bytes", MIN_SNAPLEN)
+	}
+
+	opts, optErrs := parseInterfaceOptions(&cli)
+	errs = append(errs, optErrs...)
+
+	for _, fileName := range cli.FilterFile {
+		f, err := readBPFFilterFile(fileName)
+		if err != nil {
+			errs.Addf("Invalid --filter-file: %s", err)
+			continue
+		}
+		cli.Filter = append(cli.Filter, f)
+	}
+	filter := combineBPFFilters(cli.Filter)
+
+	for _, fileName := range cli.DenyFile {
+		signatures, err := readPayloadSignatures(fileName)
+		if err != nil {
+			errs.Addf("Invalid --deny-payload-file: %s", err)
+			continue
+		}
+		cli.DenyPayload = append(cli.DenyPayload, signatures...)
+	}
+	payloadLens, err := parseLengthRanges(cli.PayloadLength)
+	if err != nil {
+		errs.Addf("Invalid --payload-length: %s", err)
+	}
+	allowedSrcPorts, srcPortErrs := parseSrcPorts(cli.SrcPort)
+	errs = append(errs, srcPortErrs...)
+
+	scopeTTLs, err := parseScopeTTLs(cli.ScopeTTL)
+	if err != nil {
+		errs.Addf("Invalid --scope-ttl: %s", err)
+	}
+
+	var denylist *payloadDenylist
+	if len(cli.DenyPayload) > 0 {
+		if denylist, err = newPayloadDenylist(cli.DenyPayload); err != nil {
+			errs.Addf("Invalid --deny-payload: %s", err)
+		}
+	}
+	if len(filter) > 0 {
+		if err := validateBPFFilter(layers.LinkTypeEthernet, cli.Snaplen, filter); err != nil {
+			errs.Addf("Invalid --filter: %s", err)
+		}
+	}
+
+	etherTypes, err := parseEtherTypes(cli.EtherTypes)
+	if err != nil {
+		errs.Addf("Invalid --ethertypes: %s", err)
+	}
+
+	var delayMin, delayMax time.Duration
+	if len(cli.ForwardDelay) > 0 {
+		if delayMin, delayMax, err = parseForwardDelay(cli.ForwardDelay); err != nil {
+			errs.Addf("Invalid --forward-delay: %s", err)
+		}
+	}
+
+	// --fanout, --zero-copy and --forward-delay use our pcap handle outside
+	// of handlePackets, so we can't replace it
+	var reopenEvery time.Duration
+	if len(cli.ReopenInterval) > 0 {
+		if reopenEvery, err = time.ParseDuration(cli.ReopenInterval); err != nil || reopenEvery < time.Minute {
+			errs.Addf("--reopen-interval %s must be a duration of at least 1m", cli.ReopenInterval)
+		}
+		if cli.Fanout > 0 || cli.ZeroCopy || len(cli.ForwardDelay) > 0 {
+			errs.Addf("--reopen-interval can not be used with --fanout, --zero-copy or --forward-delay")
+		}
+	}
+
+	var flows *flowCache
+	if len(cli.Netflow) > 0 {
+		if cli.FlowActive < 1 || cli.FlowInactive < 1 {
+			errs.Addf("--netflow-active-timeout and --netflow-inactive-timeout must be >= 1")
+		}
+		// --validate doesn't open any sockets
+		if cli.Validate {
+			_, err = net.ResolveUDPAddr("udp", cli.Netflow)
+		} else {
+			flows, err = newFlowCache(cli.Netflow, time.Duration(cli.FlowActive)*time.Second,
+				time.Duration(cli.FlowInactive)*time.Second)
+		}
+		if err != nil {
+			errs.Addf("Invalid --netflow: %s", err)
+		}
+	}
+
+	var tee *teeWriter
+	if len(cli.Tee) > 0 {
+		encap, err := newEncapsulator(cli.TeeEncap)
+		if err != nil {
+			errs.Addf("Invalid --tee-encap: %s", err)
+		} else if cli.Validate {
+			if _, err = net.ResolveUDPAddr("udp", cli.Tee); err != nil {
+				errs.Addf("Invalid --tee: %s", err)
+			}
+		} else if tee, err = newTeeWriter(cli.Tee, encap); err != nil {
+			errs.Addf("Invalid --tee: %s", err)
+		}
+	}
+
+	var fifo *fifoWriter
+	if len(cli.Fifo) > 0 {
+		if cli.Validate {
+			err = checkFifo(cli.Fifo, cli.FifoFormat)
+		} else {
+			fifo, err = newFifoWriter(cli.Fifo, cli.FifoFormat)
+		}
+		if err != nil {
+			errs.Addf("Invalid --fifo: %s", err)
+		}
+	}
+
+	srcOUIs, err := parseOUIs(cli.SrcOUI)
+	if err != nil {
+		errs.Addf("Invalid --src-oui: %s", err)
+	}
+
+	mcastGroups, err := parseMulticastGroups(cli.McastGroups)
+	if err != nil {
+		errs.Addf("Invalid --multicast-groups: %s", err)
+	}
+
+	if cli.ByteRate < 0 {
+		errs.Addf("--rate-limit-bytes must be >= 0")
+	}
+
+	var srcPorts *srcPortRange
+	if len(cli.SrcPortRange) > 0 {
+		if srcPorts, err = parseSrcPortRange(cli.SrcPortRange, cli.SrcPortMode); err != nil {
+			errs.Addf("Invalid --src-port-range: %s", err)
+		}
+	}
+
+	var nat *natTable
+	if len(cli.NatPortRange) > 0 {
+		if len(cli.SrcPortRange) > 0 {
+			errs.Addf("--nat-port-range can not be used with --src-port-range")
 		}
-		if net.ParseIP(split[1]) == nil {
-			log.Fatalf("--fixed-ip %s IP address is not a valid IPv4 address", fip)
+		if cli.NatTimeout < 1 {
+			errs.Addf("--nat-timeout must be >= 1")
 		}
-		if !stringInSlice(split[0], cli.Interface) {
-			log.Fatalf("--fixed-ip %s interface must be specified via --interface", fip)
+		natPorts, err := parseNatPortRange(cli.NatPortRange)
+		if err != nil {
+			errs.Addf("Invalid --nat-port-range: %s", err)
+		} else {
+			nat = newNatTable(natPorts, time.Duration(cli.NatTimeout)*time.Second)
+		}
+	}
+
+	var mirrorTo *mirror
+	if len(cli.MirrorTo) > 0 {
+		cli.MirrorTo = resolveInterface(cli.MirrorTo)
+		// we'd capture our own mirrored packets
+		if err := checkMirrorTo(cli.MirrorTo, cli.Interface); err != nil {
+			errs.Add(err)
+		} else if !cli.Validate {
+			mirrorTo = openMirror(cli.MirrorTo, cli.Snaplen, to)
+			defer mirrorTo.Close()
 		}
-		fixed_ip[split[0]] = append(fixed_ip[split[0]], split[1])
 	}
 
+	// load the interfaces of our own network namespace before we enter any
+	// other namespace for a netns:<namespace>:<device> interface
+	getConfiguredInterfaces()
+
 	// create our Listeners
 	var seenInterfaces = []string{}
 	var listeners = []Listen{}
 	for _, iface := range cli.Interface {
 		// check for duplicates
 		if stringPrefixInSlice(iface, seenInterfaces) {
-			log.Fatalf("Can't specify the same interface (%s) multiple times", iface)
+			errs.Addf("Can't specify the same interface (%s) multiple times", iface)
+			continue
 		}
 		seenInterfaces = append(seenInterfaces, iface)
 
-		netif, err := net.InterfaceByName(iface)
+		netns, device, err := splitNetnsInterface(iface)
 		if err != nil {
-			log.Fatalf("Unable to find interface: %s: %s", iface, err)
+			errs.Addf("Invalid --interface: %s", err)
+			continue
+		}
+		var netif *net.Interface
+		err = inNetns(netns, func() error {
+			var err error
+			if netif, err = net.InterfaceByName(device); err != nil {
+				return err
+			}
+			if len(netns) > 0 {
+				return addNetnsInterface(iface, device)
+			}
+			return nil
+		})
+		if err != nil {
+			errs.Addf("Unable to find interface: %s: %s", iface, err)
+			continue
 		}
 
 		var promisc bool = (netif.Flags & net.FlagBroadcast) == 0
-		l := newListener(netif, promisc, cli.Port, to, fixed_ip[iface])
+		// monitor mode interfaces have no IPv4 config to broadcast to
+		monitor := stringInSlice(iface, opts.wifi)
+		if monitor {
+			promisc = true
+		}
+		var l Listen
+		_ = inNetns(netns, func() error {
+			l = newListener(netif, promisc, cli.Port, opts.timeout(iface, to), opts.fixedIPs[iface])
+			return nil
+		})
+		if len(netns) > 0 {
+			l.iname = iface
+			l.policy.iname = iface
+			l.label = interfaceLabel(iface)
+			l.netns = netns
+		}
+		if cli.Defrag {
+			l.capture.defragger = ip4defrag.NewIPv4Defragmenter()
+		}
+		l.rewrite.checksums = checksumPolicy{mode: opts.csumModes[iface], dsts: opts.csumDsts}
+		l.capture.udplite = cli.UdpLite
+		l.queueAlert = cli.QueueAlert
+		l.capture.fanout = cli.Fanout
+		l.capture.fanoutGroup = fanoutGroup(cli.FanoutGroup, os.Getpid(), len(listeners))
+		l.rewrite.clearDF = cli.ClearDF
+		l.policy.verifyCsum = cli.VerifyCsum
+		l.reqPromisc = cli.RequirePromisc
+		l.rewrite.vlanTags = opts.vlanTags
+		l.capture.filter = filter
+		l.policy.broadcastOnly = cli.BroadcastOnly
+		l.egressName = opts.egress[iface]
+		l.capture.etherTypes = etherTypes
+		l.capture.snaplen = cli.Snaplen
+		l.rewrite.truncate = cli.Truncate
+		l.sendRetries = cli.SendRetries
+		if cli.SendRetries > 0 {
+			l.retries = make(chan retrySend, RETRY_BUFFER_SIZE)
+		}
+		l.capture.forwardErrors = cli.ForwardErrors
+		l.policy.schedule = opts.schedules[iface]
+		l.taps.tee = tee
+		l.taps.fifo = fifo
+		if flows != nil {
+			l.taps.flows = flows
+			flows.SetIfIndex(l.iname, netif.Index)
+		}
+		l.capture.zeroCopy = cli.ZeroCopy
+		l.taps.mirror = mirrorTo
+		if cli.TopTalkers > 0 {
+			l.taps.talkers = newTopTalkers(cli.TopTalkers, time.Duration(cli.TopInterval)*time.Second)
+		}
+		l.policy.srcOUIs = srcOUIs
+		l.rewrite.srcPorts = srcPorts
+		l.rewrite.nat = nat
+		l.rewrite.masquerade = nat != nil
+		l.policy.mcastGroups = mcastGroups
+		l.policy.denylist = denylist
+		l.policy.payloadLens = payloadLens
+		l.policy.srcPorts = allowedSrcPorts
+		l.rewrite.scopeTTLs = scopeTTLs
+		l.capture.reopenEvery = reopenEvery
+		if cli.ByteRate > 0 {
+			l.policy.byteLimit = newByteLimiter(cli.ByteRate)
+		}
+		l.policy.ouiNonEther = cli.OUINonEther
+		if cli.Repeats > 0 {
+			l.policy.repeats = newRepeatFilter(time.Duration(cli.Repeats) * time.Second)
+		}
+		if stringInSlice(iface, opts.aliasFanout) {
+			if promisc {
+				errs.Addf("--alias-fanout %s must be a broadcast interface", iface)
+			}
+			l.bcast.aliasFanout = true
+		}
+		if p, ok := opts.profiles[iface]; ok {
+			if err := p.Apply(&l.rewrite, nat); err != nil {
+				errs.Addf("Invalid --interface-profile: %s", err)
+			}
+		}
+		l.bcast.allSubnets = cli.AllSubnets
+		l.monitor = monitor
+		l.mtu = opts.mtus[iface]
+		if ip, ok := opts.remoteBcast[iface]; ok {
+			if promisc {
+				errs.Addf("--remote-broadcast %s must be a broadcast interface", iface)
+			}
+			_ = inNetns(l.netns, func() error {
+				l.setRemoteBroadcast(ip, opts.gatewayMacs[iface])
+				return nil
+			})
+		}
+		if cli.SpikePps > 0 {
+			l.taps.spike = newSpikeDetector(cli.SpikePps, time.Duration(cli.SpikeWindow)*time.Second)
+		}
+		if delayMax > 0 {
+			l.delay = newDelayQueue(delayMin, delayMax)
+		}
 		listeners = append(listeners, l)
 	}
 
+	addrs := listenerAddrs(listeners)
+	for _, dup := range duplicateIPs(addrs) {
+		if cli.Strict {
+			errs.Addf("Duplicate IP address: %s", dup)
+		}
+		log.Warnf("Duplicate IP address: %s", dup)
+	}
+
+	if cli.DropOwn {
+		own := ownAddresses(addrs)
+		for i := range listeners {
+			listeners[i].policy.ownAddrs = own
+		}
+	}
+
+	if !cli.Validate {
+		checkResources(listeners, cli.Pcap, !cli.NoListen)
+	}
+
+	if cli.Fanout < 0 || cli.Fanout > MAX_FANOUT {
+		errs.Addf("--fanout must be between 0 and %d", MAX_FANOUT)
+	} else if cli.Fanout > 0 && cli.ZeroCopy {
+		errs.Addf("--fanout and --zero-copy can not be used together")
+	}
+
+	var benchTime time.Duration
+	if len(cli.Bench) > 0 {
+		var err error
+		if benchTime, err = time.ParseDuration(cli.Bench); err != nil || benchTime <= 0 {
+			errs.Addf("--bench %s must be a positive duration like 80s", cli.Bench)
+		}
+		if cli.BenchRate < 1 {
+			errs.Addf("--bench-rate must be at least 1")
+		}
+	}
+
+	var maxIdle time.Duration
+	if len(cli.MaxIdle) > 0 {
+		var err error
+		if maxIdle, err = time.ParseDuration(cli.MaxIdle); err != nil || maxIdle < MAX_IDLE_CHECK {
+			errs.Addf("--max-idle %s must be a duration of at least %s", cli.MaxIdle, MAX_IDLE_CHECK)
+		}
+	}
+
+	var maxRuntime time.Duration
+	if len(cli.MaxRuntime) > 0 {
+		var err error
+		if maxRuntime, err = time.ParseDuration(cli.MaxRuntime); err != nil || maxRuntime <= 0 {
+			errs.Addf("--max-runtime %s must be a positive duration like 30s or 2h", cli.MaxRuntime)
+		}
+	}
+
+	spf, feedErrs := newSendPktFeed(&cli, peers, listeners)
+	errs = append(errs, feedErrs...)
+
 	// init each listener
 	ttl, _ := time.ParseDuration(fmt.Sprintf("%dm", cli.CacheTTL))
+	if cli.PcapMaxSize < 0 || cli.PcapMaxAge < 0 || cli.PcapKeep < 0 {
+		errs.Addf("--pcap-max-size, --pcap-max-age and --pcap-keep must be >= 0")
+	}
+	rotate := pcapRotation{
+		maxSize: cli.PcapMaxSize * 1024 * 1024,
+		maxAge:  time.Duration(cli.PcapMaxAge) * time.Second,
+		keep:    cli.PcapKeep,
+	}
+
+	// --validate never activates a pcap handle
+	if cli.Validate {
+		for i := range listeners {
+			errs = append(errs, listeners[i].validate()...)
+		}
+		errs = append(errs, checkBPFFilters(listeners)...)
+		errs.Fatal()
+		log.Infof("Configuration for %d interfaces is valid", len(listeners))
+		return
+	}
+	errs.Fatal()
+
 	for i := range listeners {
-		initializeInterface(&listeners[i])
+		// our pcap handle stays in the namespace it was opened in
+		if err := inNetns(listeners[i].netns, func() error {
+			initializeInterface(&listeners[i])
+			return nil
+		}); err != nil {
+			log.WithError(err).Fatalf("Unable to open %s", listeners[i].label)
+		}
+		if listeners[i].bcast.remote != nil && listeners[i].bcast.gatewayMAC == nil &&
+			listeners[i].linkType == layers.LinkTypeEthernet {
+			log.Fatalf("--remote-broadcast on Ethernet interface %s requires a --gateway-mac", listeners[i].label)
+		}
+		if len(listeners[i].egressName) > 0 {
+			initializeEgress(&listeners[i])
+			defer listeners[i].egress.Close()
+		}
 		if cli.Pcap {
-			if fName, err := listeners[i].OpenWriter(cli.PcapPath, In); err != nil {
+			if fName, err := listeners[i].OpenWriter(cli.PcapPath, In, rotate); err != nil {
 				log.Fatalf("Unable to open pcap file %s: %s", fName, err.Error())
 			}
-			if fName, err := listeners[i].OpenWriter(cli.PcapPath, Out); err != nil {
+			if fName, err := listeners[i].OpenWriter(cli.PcapPath, Out, rotate); err != nil {
 				log.Fatalf("Unable to open pcap file %s: %s", fName, err.Error())
 			}
-			if fName, err := listeners[i].OpenWriter(cli.PcapPath, InOut); err != nil {
+			if fName, err := listeners[i].OpenWriter(cli.PcapPath, InOut, rotate); err != nil {
 				log.Fatalf("Unable to open pcap file %s: %s", fName, err.Error())
 			}
 		}
@@ -160,10 +649,27 @@ func main() {
 		defer listeners[i].handle.Close()
 	}
 
+	// make sure every BPF filter compiles before we apply any of them
+	if errs := checkBPFFilters(listeners); len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		log.Fatalf("Unable to apply the BPF filter to %d interface(s)", len(errs))
+	}
+	for i := range listeners {
+		setBPFFilter(&listeners[i])
+		if listeners[i].capture.fanout > 0 {
+			if err := inNetns(listeners[i].netns, listeners[i].startFanout); err != nil {
+				log.WithError(err).Fatalf("%s: Unable to use --fanout", listeners[i].label)
+			}
+		}
+	}
+	logStartupSummary(listeners)
+
 	// Sink broadcast messages
 	if !cli.NoListen {
 		for _, l := range listeners {
-			if err := l.SinkUdpPackets(); err != nil {
+			if err := inNetns(l.netns, l.SinkUdpPackets); err != nil {
 				log.WithError(err).Fatalf("Unable to init SinkUdpPackets")
 			}
 		}
@@ -171,11 +677,45 @@ func main() {
 
 	// start handling packets
 	var wg sync.WaitGroup
-	spf := SendPktFeed{}
+	done := make(chan struct{})
+	var shutdownOnce sync.Once
+	shutdown := func() {
+		shutdownOnce.Do(func() { close(done) })
+	}
 	log.Debug("Initialization complete!")
+	if maxIdle > 0 {
+		go watchIdle(listeners, maxIdle, cli.MaxIdleAll, time.Tick(MAX_IDLE_CHECK), log.Fatalf)
+	}
 	for i := range listeners {
 		wg.Add(1)
-		go listeners[i].handlePackets(&spf, &wg)
+		go listeners[i].handlePackets(spf, &wg, done)
+	}
+	if maxRuntime > 0 {
+		shutdownAfter(maxRuntime, shutdown)
+	}
+	if benchTime > 0 {
+		go func() {
+			if err := runBench(&listeners[0], &listeners[1], cli.Port[0], benchTime, cli.BenchRate); err != nil {
+				log.WithError(err).Errorf("Unable to --bench")
+			}
+			shutdown()
+		}()
+	}
+	if flows != nil {
+		go flows.Run()
 	}
+	if len(cli.StatusAddr) > 0 {
+		startStatusServer(cli.StatusAddr, listeners, spf)
+	}
+	logStatsOnSignal(listeners)
 	wg.Wait()
+	logStats(listeners)
+}
+
+// shutdownAfter calls shutdown once we have run for --max-runtime
+func shutdownAfter(maxRuntime time.Duration, shutdown func()) *time.Timer {
+	return time.AfterFunc(maxRuntime, func() {
+		log.Infof("Shutting down after --max-runtime %s", maxRuntime)
+		shutdown()
+	})
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// --max-runtime shuts down each listener, which closes its pcap files
+func TestShutdownAfter(t *testing.T) {
+	dir := t.TempDir()
+	l := Listen{iname: "run0", label: "run0", linkType: layers.LinkTypeRaw, stats: &Stats{}, lock: &sync.Mutex{},
+		capture: Capture{snaplen: DEFAULT_SNAPLEN, fanoutPkts: make(chan gopacket.Packet)},
+		sendpkt: make(chan Send), prioritypkt: make(chan Send)}
+	for _, dir := range []Direction{In, InOut} {
+		if _, err := l.OpenWriter(t.TempDir(), dir, pcapRotation{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileName, err := l.OpenWriter(dir, Out, pcapRotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, _ := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(packet.Data()), Length: len(packet.Data())}
+	if err := l.outwriter.WritePacket(ci, packet.Data()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		maxRuntime time.Duration
+	}{
+		{50 * time.Millisecond},
+		{200 * time.Millisecond},
+	}
+	for _, test := range tests {
+		var wg sync.WaitGroup
+		done := make(chan struct{})
+		wg.Add(1)
+		start := time.Now()
+		go l.handlePackets(&SendPktFeed{}, &wg, done)
+		shutdownAfter(test.maxRuntime, func() { close(done) })
+
+		stopped := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(test.maxRuntime + 5*time.Second):
+			t.Fatalf("%s: still running", test.maxRuntime)
+		}
+		if ran := time.Since(start); ran < test.maxRuntime {
+			t.Errorf("%s: shut down after %s", test.maxRuntime, ran)
+		}
+	}
+
+	// every writer was closed after what we wrote was flushed to the file
+	for _, w := range []*pcapWriter{l.writer, l.inwriter, l.outwriter} {
+		if !w.closed {
+			t.Errorf("%s is still open", w.fileName)
+		}
+	}
+	if err := l.outwriter.WritePacket(ci, packet.Data()); err != nil {
+		t.Errorf("writing after shutdown: %s", err)
+	}
+	f, err := os.Open(filepath.Join(dir, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := r.ReadPacketData(); err != nil || len(data) != len(packet.Data()) {
+		t.Errorf("read %d bytes: %v", len(data), err)
+	}
+	if _, _, err := r.ReadPacketData(); err == nil {
+		t.Errorf("packets were written after shutdown")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// packetDataWriter is the part of a pcap.Handle we mirror packets out of
+type packetDataWriter interface {
+	WritePacketData(data []byte) error
+	Close()
+}
+
+// mirror sends a verbatim copy of every packet we capture out another device
+// like a software port mirror
+type mirror struct {
+	name     string
+	handle   packetDataWriter
+	linkType layers.LinkType // of the device we mirror to
+	lock     sync.Mutex      // all our Listeners share one mirror
+}
+
+// checkMirrorTo returns an error if we would capture the packets we mirror
+// out the device and mirror them again
+func checkMirrorTo(name string, interfaces []string) error {
+	if stringInSlice(name, interfaces) {
+		return fmt.Errorf("--mirror-to %s can not also be an --interface", name)
+	}
+	return nil
+}
+
+// openMirror opens a pcap handle on the device we mirror packets to, which
+// may be a netns:<namespace>:<device>, with our --snaplen
+func openMirror(name string, snaplen int, timeout time.Duration) *mirror {
+	netns, device, err := splitNetnsInterface(name)
+	if err != nil {
+		log.Fatalf("Invalid --mirror-to: %s", err)
+	}
+	m := &mirror{name: name}
+	err = inNetns(netns, func() error {
+		handle, err := openDevice(device, timeout, false, snaplen)
+		if err != nil {
+			return err
+		}
+		m.handle = handle
+		m.linkType = handle.LinkType()
+		// we never read packets from this handle, so have the kernel discard them
+		return handle.SetBPFFilter("less 1")
+	})
+	if err != nil {
+		log.Fatalf("%s: %s", name, err)
+	}
+	log.Debugf("mirroring packets out %s", name)
+	return m
+}
+
+// Write sends the captured packet out our mirror device unchanged.  Packets
+// captured on an interface with a different link type can't be mirrored.
+func (m *mirror) Write(iname string, linkType layers.LinkType, data []byte) {
+	if linkType != m.linkType {
+		rateLog.Warnf("mirror:"+iname, "Unable to mirror %s packets from %s to %s which is %s",
+			linkType, interfaceLabel(iname), m.name, m.linkType)
+		return
+	}
+	m.lock.Lock()
+	err := m.handle.WritePacketData(data)
+	m.lock.Unlock()
+	if err != nil {
+		rateLog.Warnf("mirror:"+iname, "Unable to mirror packet to %s: %s", m.name, err)
+	}
+}
+
+// Close closes our pcap handle
+func (m *mirror) Close() {
+	m.handle.Close()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testMirror records the packets we mirror
+type testMirror struct {
+	packets [][]byte
+}
+
+func (m *testMirror) WritePacketData(data []byte) error {
+	m.packets = append(m.packets, append([]byte{}, data...))
+	return nil
+}
+
+func (m *testMirror) Close() {}
+
+func TestCheckMirrorTo(t *testing.T) {
+	tests := []struct {
+		mirrorTo   string
+		interfaces []string
+		ok         bool
+	}{
+		{"eth2", []string{"eth0", "eth1"}, true},
+		{"eth1", []string{"eth0", "eth1"}, false},
+		{"netns:lab:eth1", []string{"eth1"}, true},
+		{"netns:lab:eth1", []string{"eth0", "netns:lab:eth1"}, false},
+	}
+	for _, test := range tests {
+		if err := checkMirrorTo(test.mirrorTo, test.interfaces); (err == nil) != test.ok {
+			t.Errorf("%s with %v: %v", test.mirrorTo, test.interfaces, err)
+		}
+	}
+}
+
+// We mirror exactly what we captured, even the packets we drop
+func TestMirrorWrite(t *testing.T) {
+	out := &testMirror{}
+	m := &mirror{name: "mirror0", handle: out, linkType: layers.LinkTypeEthernet}
+	packet, _ := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+	captured := testFrame(t, layers.LinkTypeEthernet, packet.Data())
+	short := testFrame(t, layers.LinkTypeEthernet, packet.Data())[:14+10]
+
+	for _, data := range [][]byte{captured, short} {
+		l := Listen{iname: "eth0", label: "eth0", linkType: layers.LinkTypeEthernet, stats: &Stats{},
+			capture: Capture{snaplen: DEFAULT_SNAPLEN}, taps: Taps{mirror: m}}
+		p := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		p.Metadata().CaptureInfo = gopacket.CaptureInfo{Length: len(data), CaptureLength: len(data)}
+		l.processPacket(&SendPktFeed{}, p, layers.LinkTypeEthernet)
+	}
+	if len(out.packets) != 2 || !bytes.Equal(out.packets[0], captured) || !bytes.Equal(out.packets[1], short) {
+		t.Errorf("mirrored %x, expected %x and %x", out.packets, captured, short)
+	}
+
+	// we can't mirror packets of another link type
+	m.Write("tun0", layers.LinkTypeRaw, packet.Data())
+	if len(out.packets) != 2 {
+		t.Errorf("mirrored a %s packet to %s", layers.LinkTypeRaw, layers.LinkTypeEthernet)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+)
+
+// MAX_NAT_PORTS is the most relay ports a --nat-port-range may have, since
+// SinkUdpPackets opens a socket for each of them on every address
+const MAX_NAT_PORTS = 1024
+
+// natKey is a relay port on the interface we forwarded a request out of
+type natKey struct {
+	iname string
+	port  uint16
+}
+
+// natEntry is the requester we translate replies to a relay port back to
+type natEntry struct {
+	srcif   string    // interface the request arrived on
+	ip      net.IP    // original source IP of the request
+	port    uint16    // original source port of the request
+	relay   string    // key of the entry in natTable.relays
+	expires time.Time // when we forget about the requester
+}
+
+// natTable records the relay source port of each request we forward so
+// replies sent to it can be translated back to the original requester.
+// It is shared by all of our interfaces.
+type natTable struct {
+	lock    sync.Mutex
+	min     uint16
+	max     uint16
+	timeout time.Duration
+	next    map[string]uint16    // next relay port to try on each interface
+	entries map[natKey]*natEntry // requesters by our relay port
+	relays  map[string]uint16    // relay port of each interface & requester
+}
+
+// newNatTable creates a natTable using the relay ports of a --nat-port-range
+func newNatTable(ports *srcPortRange, timeout time.Duration) *natTable {
+	return &natTable{
+		min:     ports.min,
+		max:     ports.max,
+		timeout: timeout,
+		next:    map[string]uint16{},
+		entries: map[natKey]*natEntry{},
+		relays:  map[string]uint16{},
+	}
+}
+
+// parseNatPortRange parses a --nat-port-range of <min>-<max>
+func parseNatPortRange(value string) (*srcPortRange, error) {
+	ports, err := parseSrcPortRange(value, "")
+	if err != nil {
+		return nil, err
+	}
+	if size := int(ports.max-ports.min) + 1; size > MAX_NAT_PORTS {
+		return nil, fmt.Errorf("%s has %d ports, but the max is %d", value, size, MAX_NAT_PORTS)
+	}
+	return ports, nil
+}
+
+// InRange returns true if port is one of our relay ports
+func (t *natTable) InRange(port uint16) bool {
+	return port >= t.min && port <= t.max
+}
+
+// Forward returns the relay port to send a request from srcip:srcport which
+// arrived on srcif out dstif with.  Requesters keep their relay port until
+// they have been idle for our timeout.
+func (t *natTable) Forward(dstif string, srcif string, srcip net.IP, srcport uint16, now time.Time) (uint16, error) {
+	relay := fmt.Sprintf("%s|%s|%s:%d", dstif, srcif, srcip, srcport)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if port, ok := t.relays[relay]; ok {
+		t.entries[natKey{dstif, port}].expires = now.Add(t.timeout)
+		return port, nil
+	}
+
+	size := uint32(t.max-t.min) + 1
+	next, ok := t.next[dstif]
+	if !ok {
+		next = t.min
+	}
+	for i := uint32(0); i < size; i++ {
+		port := t.min + uint16((uint32(next-t.min)+i)%size)
+		key := natKey{dstif, port}
+		if entry, used := t.entries[key]; used && entry.expires.After(now) {
+			continue
+		} else if used {
+			delete(t.relays, entry.relay)
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, srcip.To4())
+		t.entries[key] = &natEntry{
+			srcif:   srcif,
+			ip:      ip,
+			port:    srcport,
+			relay:   relay,
+			expires: now.Add(t.timeout),
+		}
+		t.relays[relay] = port
+		t.next[dstif] = t.min + uint16((uint32(port-t.min)+1)%size)
+		log.Debugf("nat: %s:%d on %s is %d on %s", srcip, srcport, interfaceLabel(srcif),
+			port, interfaceLabel(dstif))
+		return port, nil
+	}
+	return 0, dropError{DropNatFull, fmt.Errorf("all %d --nat-port-range ports are in use", size)}
+}
+
+// Reply returns the requester of a reply which arrived on iname for the relay port
+func (t *natTable) Reply(iname string, port uint16, now time.Time) (natEntry, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	entry, ok := t.entries[natKey{iname, port}]
+	if !ok || !entry.expires.After(now) {
+		return natEntry{}, false
+	}
+	entry.expires = now.Add(t.timeout)
+	return *entry, true
+}
+
+// Expire forgets about the requesters which have been idle for our timeout
+func (t *natTable) Expire(now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for key, entry := range t.entries {
+		if !entry.expires.After(now) {
+			delete(t.relays, entry.relay)
+			delete(t.entries, key)
+		}
+	}
+}
+
+// BPFFilter extends filter to also capture replies sent to one of our relay
+// ports at one of the addresses, which aren't on our --port(s)
+func (t *natTable) BPFFilter(filter string, addresses []pcap.InterfaceAddress) string {
+	hosts := []string{}
+	for _, addr := range addresses {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			hosts = append(hosts, fmt.Sprintf("dst host %s", ip4))
+		}
+	}
+	if len(hosts) == 0 {
+		return filter
+	}
+	return fmt.Sprintf("(%s) or (udp dst portrange %d-%d and (%s))", filter, t.min, t.max,
+		strings.Join(hosts, " or "))
+}
+
+// natAddress returns our IPv4 address on the same network as dstip, or our
+// first IPv4 address when there isn't one.  Returns nil if we have none.
+func natAddress(addresses []pcap.InterfaceAddress, dstip net.IP) net.IP {
+	var first net.IP
+	for _, addr := range addresses {
+		ip4 := addr.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		if first == nil {
+			first = ip4
+		}
+		mask := addr.Netmask
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		if len(mask) == net.IPv4len && ip4.Mask(mask).Equal(dstip.Mask(mask)) {
+			return ip4
+		}
+	}
+	return first
+}
+
+// natSource returns the source IP and port of a packet we send to dstip.
+// Requests are sent from our address with a relay port and replies are
+// sent from our address with the port they came from.
+func (l *Listen) natSource(sndpkt Send, dstip net.IP) (net.IP, layers.UDPPort, error) {
+	srcip := natAddress(Interfaces[l.iname].Addresses, dstip)
+	if srcip == nil {
+		return nil, 0, fmt.Errorf("%s has no IPv4 address for --nat-port-range", l.label)
+	}
+	udp := sndpkt.decoded.udp
+	if sndpkt.dstip != nil {
+		return srcip, udp.SrcPort, nil
+	}
+	port, err := l.rewrite.nat.Forward(l.iname, sndpkt.srcif, sndpkt.decoded.ip4.SrcIP, uint16(udp.SrcPort), time.Now())
+	return srcip, layers.UDPPort(port), err
+}
+
+// natReply sends a reply to one of our relay ports back to the requester via
+// the interface the request arrived on.  Returns false if the packet isn't
+// sent to one of our relay ports and true along with if it was queued when
+// it is.
+func (l *Listen) natReply(s *SendPktFeed, packet gopacket.Packet, linkType layers.LinkType, d *Decoded, owned bool) (bool, bool) {
+	port := uint16(d.udp.DstPort)
+	if !l.rewrite.nat.InRange(port) || !l.isOwnIP(d.ip4.DstIP) {
+		return false, false
+	}
+	entry, ok := l.rewrite.nat.Reply(l.iname, port, time.Now())
+	if !ok {
+		// unicast to one of our --port(s) is forwarded like before
+		if int32InSlice(int32(port), l.ports) {
+			return false, false
+		}
+		l.drop(DropNatUnknown, packet)
+		return true, false
+	}
+
+	// the other interface sends the packet after our next read
+	if !owned {
+		packet, d, _ = copyPacket(packet, linkType)
+	}
+	d.udp.DstPort = layers.UDPPort(entry.port)
+	log.Debugf("%s: nat reply from %s:%d to %s:%d on %s", l.label, d.ip4.SrcIP, d.udp.SrcPort,
+		entry.ip, entry.port, interfaceLabel(entry.srcif))
+	sndpkt := Send{packet: packet, srcif: l.iname, linkType: linkType, decoded: d,
+		ts: packet.Metadata().Timestamp, dstip: entry.ip}
+	if !s.SendTo(entry.srcif, sndpkt) {
+		return true, false
+	}
+	atomic.AddUint64(&l.stats.NatReplies, 1)
+	return true, true
+}
+
+// isOwnIP returns true if ip is one of the IPv4 addresses of our interface
+func (l *Listen) isOwnIP(ip net.IP) bool {
+	for _, addr := range Interfaces[l.iname].Addresses {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func testNatTable(min, max uint16) *natTable {
+	return newNatTable(&srcPortRange{min: min, max: max}, 30*time.Second)
+}
+
+func TestNatForwardReply(t *testing.T) {
+	nat := testNatTable(40000, 40009)
+	now := time.Now()
+	requester := net.ParseIP("10.0.0.5")
+
+	port, err := nat.Forward("eth1", "eth0", requester, 5000, now)
+	if err != nil || !nat.InRange(port) {
+		t.Fatalf("relay port %d: %v", port, err)
+	}
+	// requesters keep their relay port
+	if again, _ := nat.Forward("eth1", "eth0", requester, 5000, now.Add(time.Second)); again != port {
+		t.Errorf("relay port changed from %d to %d", port, again)
+	}
+	other, _ := nat.Forward("eth1", "eth0", requester, 5001, now)
+	if other == port {
+		t.Errorf("two requesters share relay port %d", port)
+	}
+	// relay ports are per interface
+	if _, err = nat.Forward("eth2", "eth0", requester, 5000, now); err != nil {
+		t.Error(err)
+	}
+
+	entry, ok := nat.Reply("eth1", port, now.Add(2*time.Second))
+	if !ok || entry.srcif != "eth0" || !entry.ip.Equal(requester) || entry.port != 5000 {
+		t.Errorf("reply to %d is for %+v %v", port, entry, ok)
+	}
+	// the requester is copied, not referenced
+	requester[15] = 9
+	if entry, _ = nat.Reply("eth1", port, now); !entry.ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("requester changed to %s", entry.ip)
+	}
+	if _, ok = nat.Reply("eth0", port, now); ok {
+		t.Errorf("replies are only translated on the interface we sent the request out")
+	}
+	if _, ok = nat.Reply("eth1", 40009, now); ok {
+		t.Errorf("unused relay port was translated")
+	}
+}
+
+func TestNatFull(t *testing.T) {
+	nat := testNatTable(40000, 40001)
+	now := time.Now()
+	for port := uint16(5000); port < 5002; port++ {
+		if _, err := nat.Forward("eth1", "eth0", net.ParseIP("10.0.0.5"), port, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := nat.Forward("eth1", "eth0", net.ParseIP("10.0.0.5"), 5002, now)
+	var derr dropError
+	if !errors.As(err, &derr) || derr.reason != DropNatFull || dropReasonOf(err) != DropNatFull {
+		t.Fatalf("expected DropNatFull, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "all 2 --nat-port-range ports are in use") {
+		t.Errorf("error is %s", err)
+	}
+
+	// expired relay ports are reused
+	later := now.Add(31 * time.Second)
+	port, err := nat.Forward("eth1", "eth0", net.ParseIP("10.0.0.5"), 5002, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := nat.Reply("eth1", port, later); !ok || entry.port != 5002 {
+		t.Errorf("reused relay port %d is for %+v", port, entry)
+	}
+	// and the requester which had it gets a new one
+	if _, err = nat.Forward("eth1", "eth0", net.ParseIP("10.0.0.5"), 5000, later); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNatExpire(t *testing.T) {
+	nat := testNatTable(40000, 40009)
+	now := time.Now()
+	idle, _ := nat.Forward("eth1", "eth0", net.ParseIP("10.0.0.5"), 5000, now)
+	active, _ := nat.Forward("eth1", "eth0", net.ParseIP("10.0.0.6"), 5000, now)
+
+	// replies keep a translation from expiring
+	if _, ok := nat.Reply("eth1", active, now.Add(20*time.Second)); !ok {
+		t.Fatalf("no translation for %d", active)
+	}
+	if _, ok := nat.Reply("eth1", idle, now.Add(30*time.Second)); ok {
+		t.Errorf("expired translation for %d was used", idle)
+	}
+
+	nat.Expire(now.Add(40 * time.Second))
+	if len(nat.entries) != 1 || len(nat.relays) != 1 {
+		t.Errorf("%d entries and %d relays after Expire", len(nat.entries), len(nat.relays))
+	}
+	if _, ok := nat.Reply("eth1", active, now.Add(40*time.Second)); !ok {
+		t.Errorf("active translation for %d expired", active)
+	}
+	nat.Expire(now.Add(time.Hour))
+	if len(nat.entries) != 0 || len(nat.relays) != 0 {
+		t.Errorf("%d entries and %d relays after Expire", len(nat.entries), len(nat.relays))
+	}
+}
+
+func TestNatBPFFilter(t *testing.T) {
+	nat := testNatTable(40000, 40099)
+	addresses := []pcap.InterfaceAddress{
+		{IP: net.ParseIP("10.0.0.1"), Netmask: net.CIDRMask(24, 32)},
+		{IP: net.ParseIP("fe80::1"), Netmask: net.CIDRMask(64, 128)},
+		{IP: net.ParseIP("192.168.1.1"), Netmask: net.CIDRMask(24, 32)},
+	}
+	expected := "(udp port 1900) or (udp dst portrange 40000-40099 and (dst host 10.0.0.1 or dst host 192.168.1.1))"
+	if filter := nat.BPFFilter("udp port 1900", addresses); filter != expected {
+		t.Errorf("filter is %s", filter)
+	}
+	// we can't receive replies without an IPv4 address
+	if filter := nat.BPFFilter("udp port 1900", addresses[1:2]); filter != "udp port 1900" {
+		t.Errorf("filter is %s", filter)
+	}
+	l := Listen{iname: "nat0", ports: []int32{1900}, promisc: true, rewrite: Rewrite{nat: nat}}
+	Interfaces["nat0"] = pcap.Interface{Name: "nat0", Addresses: addresses[:1]}
+	defer delete(Interfaces, "nat0")
+	if filter := l.bpfFilter(layers.LinkTypeRaw); !strings.Contains(filter, "udp dst portrange 40000-40099") {
+		t.Errorf("filter is %s", filter)
+	}
+}
+
+func TestNatAddress(t *testing.T) {
+	addresses := []pcap.InterfaceAddress{
+		{IP: net.ParseIP("fe80::1"), Netmask: net.CIDRMask(64, 128)},
+		{IP: net.ParseIP("10.0.0.1"), Netmask: net.CIDRMask(24, 32)},
+		{IP: net.ParseIP("192.168.1.1"), Netmask: net.IPMask(net.ParseIP("255.255.255.0"))}, // 16 byte mask
+	}
+	tests := []struct {
+		dst string
+		ip  string
+	}{
+		{"10.0.0.5", "10.0.0.1"},
+		{"192.168.1.5", "192.168.1.1"},
+		{"172.16.0.5", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		if ip := natAddress(addresses, net.ParseIP(test.dst).To4()); !ip.Equal(net.ParseIP(test.ip)) {
+			t.Errorf("%s: expected %s, got %s", test.dst, test.ip, ip)
+		}
+	}
+	if ip := natAddress(addresses[:1], net.ParseIP("10.0.0.5").To4()); ip != nil {
+		t.Errorf("expected no address, got %s", ip)
+	}
+}
+
+// Replies to our relay ports are sent back to the requester via the
+// interface the request arrived on
+func TestNatReply(t *testing.T) {
+	Interfaces["nat1"] = pcap.Interface{Name: "nat1",
+		Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("192.168.1.1"), Netmask: net.CIDRMask(24, 32)}}}
+	defer delete(Interfaces, "nat1")
+	nat := testNatTable(40000, 40009)
+	now := time.Now()
+	relay, _ := nat.Forward("nat1", "nat0", net.ParseIP("10.0.0.5"), 5000, now)
+
+	sendq := make(chan Send, 1)
+	s := &SendPktFeed{senders: map[string]chan Send{"nat0": sendq}, stats: map[string]*Stats{"nat0": {}}}
+	l := Listen{iname: "nat1", label: "nat1", ports: []int32{1900}, stats: &Stats{}, rewrite: Rewrite{nat: nat}}
+
+	tests := []struct {
+		name    string
+		dst     string
+		dstPort uint16
+		reply   bool
+		sent    bool
+		reason  DropReason
+	}{
+		{"reply", "192.168.1.1", relay, true, true, DropNone},
+		{"not our ip", "192.168.1.2", relay, false, false, DropNone},
+		{"not a relay port", "192.168.1.1", 1900, false, false, DropNone},
+		{"unknown relay port", "192.168.1.1", 40009, true, false, DropNatUnknown},
+	}
+	for _, test := range tests {
+		packet, d := testPacket(t, "192.168.1.5", test.dst, 1900, test.dstPort, []byte("reply"))
+		reply, sent := l.natReply(s, packet, layers.LinkTypeRaw, d, false)
+		if reply != test.reply || sent != test.sent {
+			t.Errorf("%s: reply %v sent %v", test.name, reply, sent)
+		}
+		if test.reason != DropNone && l.stats.Dropped(test.reason) != 1 {
+			t.Errorf("%s: not dropped as %s", test.name, test.reason)
+		}
+	}
+
+	sndpkt := <-sendq
+	if sndpkt.srcif != "nat1" || !sndpkt.dstip.Equal(net.ParseIP("10.0.0.5")) || sndpkt.decoded.udp.DstPort != 5000 {
+		t.Errorf("reply sent to %s:%d from %s", sndpkt.dstip, sndpkt.decoded.udp.DstPort, sndpkt.srcif)
+	}
+	if l.stats.Snapshot().NatReplies != 1 {
+		t.Errorf("%d replies", l.stats.Snapshot().NatReplies)
+	}
+}
+
+func TestSinkPorts(t *testing.T) {
+	l := Listen{ports: []int32{1900, 40001}}
+	if ports := l.sinkPorts(); len(ports) != 2 {
+		t.Errorf("sinking %v", ports)
+	}
+	l.rewrite.nat = testNatTable(40000, 40002)
+	expected := []int32{1900, 40001, 40000, 40002}
+	ports := l.sinkPorts()
+	if len(ports) != len(expected) {
+		t.Fatalf("sinking %v", ports)
+	}
+	for i := range ports {
+		if ports[i] != expected[i] {
+			t.Errorf("sinking %v, expected %v", ports, expected)
+			break
+		}
+	}
+	// the top of the port range doesn't wrap around
+	l.rewrite.nat = testNatTable(65534, 65535)
+	if ports = l.sinkPorts(); len(ports) != 4 {
+		t.Errorf("sinking %v", ports)
+	}
+}
+
+func TestParseNatPortRange(t *testing.T) {
+	tests := []struct {
+		value string
+		err   string
+	}{
+		{"40000-40009", ""},
+		{"40000-41023", ""},
+		{"40000-40000", ""},
+		{"40000-41024", "40000-41024 has 1025 ports, but the max is 1024"},
+		{"1024-65535", "1024-65535 has 64512 ports, but the max is 1024"},
+		{"40009-40000", "is not a valid port range"},
+		{"40000", "is not in the format of <min>-<max>"},
+	}
+	for _, test := range tests {
+		ports, err := parseNatPortRange(test.value)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.value, test.err, err)
+			}
+		} else if err != nil || ports.hash {
+			t.Errorf("%s: parsed %+v: %v", test.value, ports, err)
+		}
+	}
+}
+
+// checkResources counts a socket for each --nat-port-range port
+func TestNatResources(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	l := Listen{iname: "lo", netif: lo, ports: []int32{1900}}
+	addrs, err := l.sinkAddresses()
+	if err != nil || len(addrs) == 0 {
+		t.Skipf("lo has no IPv4 addresses: %v", err)
+	}
+	without := l.resources(false, true)
+	l.rewrite.nat = testNatTable(40000, 40009)
+	with := l.resources(false, true)
+	if with.Fds-without.Fds != 10*len(addrs) || with.Goroutines-without.Goroutines != 10*len(addrs) {
+		t.Errorf("%d addresses: %+v without and %+v with a --nat-port-range", len(addrs), without, with)
+	}
+	if none := l.resources(false, false); none.Fds != 1 {
+		t.Errorf("counted %d fds with --no-listen", none.Fds)
+	}
+}
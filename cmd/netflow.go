@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	NETFLOW_VERSION     = 5
+	NETFLOW_HEADER_SIZE = 24
+	NETFLOW_RECORD_SIZE = 48
+	NETFLOW_MAX_RECORDS = 30 // per export packet
+	NETFLOW_INTERVAL    = time.Second
+)
+
+// flowKey identifies a forwarded flow
+type flowKey struct {
+	src     [4]byte
+	dst     [4]byte
+	srcPort uint16
+	dstPort uint16
+	proto   uint8
+	input   uint16 // ifIndex we received the packets on
+	output  uint16 // ifIndex we sent the packets out
+}
+
+// flowRecord counts the packets of a flow
+type flowRecord struct {
+	key     flowKey
+	packets uint32
+	bytes   uint32 // IPv4 bytes
+	first   time.Time
+	last    time.Time
+}
+
+// flowCache aggregates the packets we forward into flows which are exported
+// to a NetFlow v5 collector once they are inactive for the inactive timeout
+// or have been active for the active timeout
+type flowCache struct {
+	lock     sync.Mutex
+	flows    map[flowKey]*flowRecord
+	active   time.Duration
+	inactive time.Duration
+	ifIndex  map[string]uint16 // ifIndex of each interface name
+	boot     time.Time         // for the SysUptime values
+	sequence uint32            // total flows exported
+	conn     *net.UDPConn
+}
+
+// newFlowCache connects to the NetFlow collector at addr and starts
+// exporting to it
+func newFlowCache(addr string, active time.Duration, inactive time.Duration) (*flowCache, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	f := &flowCache{
+		flows:    map[flowKey]*flowRecord{},
+		active:   active,
+		inactive: inactive,
+		ifIndex:  map[string]uint16{},
+		boot:     time.Now(),
+		conn:     conn,
+	}
+	return f, nil
+}
+
+// SetIfIndex records the ifIndex to export for the interface
+func (f *flowCache) SetIfIndex(iname string, index int) {
+	f.lock.Lock()
+	f.ifIndex[iname] = uint16(index)
+	f.lock.Unlock()
+}
+
+// Add counts a packet we sent from srcif out dstif
+func (f *flowCache) Add(srcif string, dstif string, src net.IP, dst net.IP, srcPort uint16, dstPort uint16,
+	proto uint8, length int, now time.Time) {
+	key := flowKey{
+		srcPort: srcPort,
+		dstPort: dstPort,
+		proto:   proto,
+	}
+	copy(key.src[:], src.To4())
+	copy(key.dst[:], dst.To4())
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key.input, key.output = f.ifIndex[srcif], f.ifIndex[dstif]
+	flow, ok := f.flows[key]
+	if !ok {
+		flow = &flowRecord{key: key, first: now}
+		f.flows[key] = flow
+	}
+	flow.packets++
+	flow.bytes += uint32(length)
+	flow.last = now
+}
+
+// Expire removes and returns the flows which are ready to be exported
+func (f *flowCache) Expire(now time.Time) []flowRecord {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	expired := []flowRecord{}
+	for key, flow := range f.flows {
+		if now.Sub(flow.last) >= f.inactive || now.Sub(flow.first) >= f.active {
+			expired = append(expired, *flow)
+			delete(f.flows, key)
+		}
+	}
+	return expired
+}
+
+// Export encodes the flows as NetFlow v5 packets
+func (f *flowCache) Export(flows []flowRecord, now time.Time) [][]byte {
+	packets := [][]byte{}
+	for len(flows) > 0 {
+		count := len(flows)
+		if count > NETFLOW_MAX_RECORDS {
+			count = NETFLOW_MAX_RECORDS
+		}
+		data := make([]byte, NETFLOW_HEADER_SIZE+count*NETFLOW_RECORD_SIZE)
+		binary.BigEndian.PutUint16(data[0:], NETFLOW_VERSION)
+		binary.BigEndian.PutUint16(data[2:], uint16(count))
+		binary.BigEndian.PutUint32(data[4:], f.uptime(now))
+		binary.BigEndian.PutUint32(data[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(data[12:], uint32(now.Nanosecond()))
+		binary.BigEndian.PutUint32(data[16:], f.sequence)
+		// engine type/id and sampling interval are all zero
+
+		for i, flow := range flows[:count] {
+			r := data[NETFLOW_HEADER_SIZE+i*NETFLOW_RECORD_SIZE:]
+			copy(r[0:], flow.key.src[:])
+			copy(r[4:], flow.key.dst[:])
+			// next hop is zero
+			binary.BigEndian.PutUint16(r[12:], flow.key.input)
+			binary.BigEndian.PutUint16(r[14:], flow.key.output)
+			binary.BigEndian.PutUint32(r[16:], flow.packets)
+			binary.BigEndian.PutUint32(r[20:], flow.bytes)
+			binary.BigEndian.PutUint32(r[24:], f.uptime(flow.first))
+			binary.BigEndian.PutUint32(r[28:], f.uptime(flow.last))
+			binary.BigEndian.PutUint16(r[32:], flow.key.srcPort)
+			binary.BigEndian.PutUint16(r[34:], flow.key.dstPort)
+			r[38] = flow.key.proto
+			// TOS, AS numbers and masks are zero
+		}
+		f.sequence += uint32(count)
+		packets = append(packets, data)
+		flows = flows[count:]
+	}
+	return packets
+}
+
+// uptime returns the SysUptime in msec of the given time
+func (f *flowCache) uptime(t time.Time) uint32 {
+	return uint32(t.Sub(f.boot) / time.Millisecond)
+}
+
+// Run periodically exports our expired flows.  Never returns.
+func (f *flowCache) Run() {
+	ticker := time.NewTicker(NETFLOW_INTERVAL)
+	for now := range ticker.C {
+		for _, data := range f.Export(f.Expire(now), now) {
+			if _, err := f.conn.Write(data); err != nil {
+				rateLog.Warnf("netflow", "Unable to send NetFlow to %s: %s", f.conn.RemoteAddr(), err)
+			}
+		}
+		log.Tracef("netflow: %d active flows", f.Len())
+	}
+}
+
+// Len returns the number of flows in our cache
+func (f *flowCache) Len() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.flows)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFlowCacheExport(t *testing.T) {
+	boot := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	f := &flowCache{flows: map[flowKey]*flowRecord{}, active: time.Minute, inactive: 15 * time.Second,
+		ifIndex: map[string]uint16{}, boot: boot}
+	f.SetIfIndex("eth0", 2)
+	f.SetIfIndex("eth1", 3)
+	first := boot.Add(10 * time.Second)
+	f.Add("eth0", "eth1", net.ParseIP("10.0.0.5"), net.ParseIP("10.1.0.255"), 5000, 1900, 17, 100, first)
+	f.Add("eth0", "eth1", net.ParseIP("10.0.0.5"), net.ParseIP("10.1.0.255"), 5000, 1900, 17, 200, first.Add(time.Second))
+
+	now := boot.Add(time.Minute + 500*time.Millisecond)
+	packets := f.Export(f.Expire(now), now)
+	if len(packets) != 1 || len(packets[0]) != NETFLOW_HEADER_SIZE+NETFLOW_RECORD_SIZE || f.Len() != 0 {
+		t.Fatalf("exported %d packets, %d flows left", len(packets), f.Len())
+	}
+	data := packets[0]
+	u16 := func(offset int) uint16 { return binary.BigEndian.Uint16(data[offset:]) }
+	u32 := func(offset int) uint32 { return binary.BigEndian.Uint32(data[offset:]) }
+
+	header := []struct {
+		name   string
+		value  uint32
+		expect uint32
+	}{
+		{"version", uint32(u16(0)), NETFLOW_VERSION},
+		{"count", uint32(u16(2)), 1},
+		{"sys uptime", u32(4), 60500},
+		{"unix secs", u32(8), uint32(now.Unix())},
+		{"unix nsecs", u32(12), 500000000},
+		{"flow sequence", u32(16), 0},
+		{"engine & sampling", u32(20), 0},
+	}
+	for _, field := range header {
+		if field.value != field.expect {
+			t.Errorf("header %s is %d, expected %d", field.name, field.value, field.expect)
+		}
+	}
+
+	r := NETFLOW_HEADER_SIZE
+	record := []struct {
+		name   string
+		value  uint32
+		expect uint32
+	}{
+		{"src addr", u32(r + 0), binary.BigEndian.Uint32(net.ParseIP("10.0.0.5").To4())},
+		{"dst addr", u32(r + 4), binary.BigEndian.Uint32(net.ParseIP("10.1.0.255").To4())},
+		{"next hop", u32(r + 8), 0},
+		{"input", uint32(u16(r + 12)), 2},
+		{"output", uint32(u16(r + 14)), 3},
+		{"packets", u32(r + 16), 2},
+		{"octets", u32(r + 20), 300},
+		{"first", u32(r + 24), 10000},
+		{"last", u32(r + 28), 11000},
+		{"src port", uint32(u16(r + 32)), 5000},
+		{"dst port", uint32(u16(r + 34)), 1900},
+		{"pad1", uint32(data[r+36]), 0},
+		{"tcp flags", uint32(data[r+37]), 0},
+		{"proto", uint32(data[r+38]), 17},
+		{"tos", uint32(data[r+39]), 0},
+		{"as & masks", u32(r + 40), 0},
+		{"pad2", uint32(u16(r + 46)), 0},
+	}
+	for _, field := range record {
+		if field.value != field.expect {
+			t.Errorf("record %s is %d, expected %d", field.name, field.value, field.expect)
+		}
+	}
+}
+
+// Each export packet has at most NETFLOW_MAX_RECORDS records and the
+// sequence is the number of flows exported before it
+func TestFlowCacheExportSplit(t *testing.T) {
+	f := &flowCache{boot: time.Now()}
+	flows := make([]flowRecord, NETFLOW_MAX_RECORDS*2+5)
+	for i := range flows {
+		flows[i].key.srcPort = uint16(i)
+	}
+	packets := f.Export(flows, time.Now())
+	expected := []int{NETFLOW_MAX_RECORDS, NETFLOW_MAX_RECORDS, 5}
+	if len(packets) != len(expected) {
+		t.Fatalf("exported %d packets", len(packets))
+	}
+	sequence := 0
+	for i, data := range packets {
+		count := int(binary.BigEndian.Uint16(data[2:]))
+		if count != expected[i] || len(data) != NETFLOW_HEADER_SIZE+count*NETFLOW_RECORD_SIZE {
+			t.Errorf("packet %d has %d records in %d bytes", i, count, len(data))
+		}
+		if seq := int(binary.BigEndian.Uint32(data[16:])); seq != sequence {
+			t.Errorf("packet %d has sequence %d, expected %d", i, seq, sequence)
+		}
+		if port := int(binary.BigEndian.Uint16(data[NETFLOW_HEADER_SIZE+32:])); port != sequence {
+			t.Errorf("packet %d starts with flow %d", i, port)
+		}
+		sequence += count
+	}
+	if f.sequence != uint32(len(flows)) {
+		t.Errorf("sequence is %d", f.sequence)
+	}
+	if packets = f.Export([]flowRecord{}, time.Now()); len(packets) != 0 {
+		t.Errorf("exported %d packets without any flows", len(packets))
+	}
+}
+
+func TestFlowCacheExpire(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	f := &flowCache{flows: map[flowKey]*flowRecord{}, active: time.Minute, inactive: 15 * time.Second,
+		ifIndex: map[string]uint16{}, boot: now}
+	src, dst := net.ParseIP("10.0.0.5"), net.ParseIP("10.1.0.255")
+	f.Add("eth0", "eth1", src, dst, 5000, 1900, 17, 100, now)                      // idle for too long
+	f.Add("eth0", "eth1", src, dst, 5001, 1900, 17, 100, now.Add(-50*time.Second)) // active for too long
+	for i := 0; i < 10; i++ {
+		f.Add("eth0", "eth1", src, dst, 5001, 1900, 17, 100, now.Add(time.Duration(i)*time.Second))
+	}
+	f.Add("eth0", "eth1", src, dst, 5002, 1900, 17, 100, now.Add(10*time.Second)) // neither
+
+	expired := f.Expire(now.Add(15 * time.Second))
+	if len(expired) != 2 || f.Len() != 1 {
+		t.Fatalf("expired %d flows, %d left", len(expired), f.Len())
+	}
+	for _, flow := range expired {
+		if flow.key.srcPort == 5001 && flow.packets != 11 {
+			t.Errorf("active flow has %d packets", flow.packets)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// netns:<namespace>:<device> interfaces are only supported on Linux
+const NETNS_SUPPORTED = true
+
+// Where `ip netns add` creates named network namespaces
+const NETNS_RUN_DIR = "/var/run/netns"
+
+// inNetns calls fn with the current OS thread in the named network namespace
+// so any sockets or pcap handles it opens belong to that namespace.  An empty
+// name calls fn in our own namespace.  Requires CAP_SYS_ADMIN.
+func inNetns(name string, fn func() error) error {
+	if len(name) == 0 {
+		return fn()
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		// setns only changes the namespace of this thread
+		runtime.LockOSThread()
+		orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- err
+			return
+		}
+		defer orig.Close()
+
+		target, err := os.Open(filepath.Join(NETNS_RUN_DIR, name))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("unable to open network namespace %s: %s", name, err)
+			return
+		}
+		defer target.Close()
+
+		if err := setns(target); err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("unable to enter network namespace %s: %s", name, err)
+			return
+		}
+
+		ferr := fn()
+		if err := setns(orig); err != nil {
+			// leave the thread locked so the runtime throws it away when
+			// this goroutine exits instead of reusing it
+			errc <- fmt.Errorf("unable to leave network namespace %s: %s", name, err)
+			return
+		}
+		runtime.UnlockOSThread()
+		errc <- ferr
+	}()
+	return <-errc
+}
+
+func setns(ns *os.File) error {
+	return unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET)
+}
@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInNetnsMissing(t *testing.T) {
+	called := false
+	err := inNetns("udp-proxy-2020-no-such-netns", func() error {
+		called = true
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "unable to open network namespace") {
+		t.Errorf("expected an error opening the namespace, got %v", err)
+	}
+	if called {
+		t.Errorf("fn should not be called outside of the namespace")
+	}
+}
+
+// Entering a namespace requires CAP_SYS_ADMIN and one created via `ip netns add`
+func TestInNetns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("entering a network namespace requires root")
+	}
+	namespaces, err := os.ReadDir(NETNS_RUN_DIR)
+	if err != nil || len(namespaces) == 0 {
+		t.Skipf("no network namespaces in %s", NETNS_RUN_DIR)
+	}
+	called := false
+	err = inNetns(namespaces[0].Name(), func() error {
+		called = true
+		return nil
+	})
+	if err != nil || !called {
+		t.Errorf("inNetns(%s) = %v, called = %v", namespaces[0].Name(), err, called)
+	}
+}
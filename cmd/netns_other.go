@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+// netns:<namespace>:<device> interfaces are only supported on Linux
+const NETNS_SUPPORTED = false
+
+// network namespaces are only supported on Linux
+func inNetns(name string, fn func() error) error {
+	if len(name) == 0 {
+		return fn()
+	}
+	return fmt.Errorf("network namespaces are only supported on Linux")
+}
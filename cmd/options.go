@@ -0,0 +1,445 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// interfaceOptions are the flags which configure each of our --interface(s)
+type interfaceOptions struct {
+	fixedIPs    map[string][]string         // --fixed-ip
+	timeouts    map[string]time.Duration    // --interface-timeout
+	mtus        map[string]int              // --mtu-override
+	vlanTags    map[string]uint16           // --vlan-tag
+	csumModes   map[string]string           // --checksum-policy of each interface
+	csumDsts    map[string]string           // --checksum-policy of each IP
+	schedules   map[string]*schedule        // --schedule
+	remoteBcast map[string]net.IP           // --remote-broadcast & profile broadcast
+	gatewayMacs map[string]net.HardwareAddr // --gateway-mac
+	egress      map[string]string           // --egress-interface
+	profiles    map[string]*Profile         // --interface-profile
+	wifi        []string                    // --wifi
+	aliasFanout []string                    // --alias-fanout
+	defined     map[string]*Profile         // --profile by name
+	location    *time.Location              // --timezone of our schedules
+}
+
+// configErrors collects every problem with our configuration so we can
+// report all of them at once
+type configErrors []error
+
+// Add adds err if it isn't nil
+func (e *configErrors) Add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// Addf adds an error formatted like fmt.Errorf
+func (e *configErrors) Addf(format string, args ...interface{}) {
+	*e = append(*e, fmt.Errorf(format, args...))
+}
+
+// Fatal logs each of our errors and exits if we have any
+func (e configErrors) Fatal() {
+	if len(e) == 0 {
+		return
+	}
+	for _, err := range e {
+		log.Error(err)
+	}
+	log.Fatalf("Found %d configuration error(s)", len(e))
+}
+
+// parsePerInterface calls parse with the interface & value of each
+// <interface>@<value> of a flag and returns an error for each one which
+// is invalid.  The interface may be an --alias and must be one of our
+// --interface(s).
+func (cli *CLI) parsePerInterface(values []string, parse func(iface, value string) error) []error {
+	errs := []error{}
+	for _, arg := range values {
+		iface, value, err := splitInterfaceArg(arg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		iface = resolveInterface(iface)
+		if !stringInSlice(iface, cli.Interface) {
+			errs = append(errs, fmt.Errorf("%s interface must be specified via --interface", arg))
+			continue
+		}
+		if err := parse(iface, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s", arg, err))
+		}
+	}
+	return errs
+}
+
+// resolveInterfaceList resolves a flag which is a list of interfaces, each
+// of which must be one of our --interface(s)
+func (cli *CLI) resolveInterfaceList(values []string) ([]string, error) {
+	ifaces := resolveInterfaces(values)
+	for _, iface := range ifaces {
+		if !stringInSlice(iface, cli.Interface) {
+			return nil, fmt.Errorf("%s interface must be specified via --interface", iface)
+		}
+	}
+	return ifaces, nil
+}
+
+// parseInterfaceOptions parses the flags which configure each interface
+// and returns every error it finds along the way
+func parseInterfaceOptions(cli *CLI) (*interfaceOptions, configErrors) {
+	o := &interfaceOptions{
+		fixedIPs:    map[string][]string{},
+		timeouts:    map[string]time.Duration{},
+		mtus:        map[string]int{},
+		vlanTags:    map[string]uint16{},
+		csumModes:   map[string]string{},
+		csumDsts:    map[string]string{},
+		schedules:   map[string]*schedule{},
+		remoteBcast: map[string]net.IP{},
+		gatewayMacs: map[string]net.HardwareAddr{},
+		egress:      map[string]string{},
+		profiles:    map[string]*Profile{},
+		defined:     map[string]*Profile{},
+	}
+	errs := configErrors{}
+	var err error
+	if o.location, err = time.LoadLocation(cli.Timezone); err != nil {
+		errs.Addf("Invalid --timezone: %s", err)
+		o.location = time.Local
+	}
+	for _, err := range o.parseChecksumPolicies(cli) {
+		errs.Addf("--checksum-policy %s", err)
+	}
+	for _, value := range cli.Profile {
+		p, err := parseProfile(value)
+		if err != nil {
+			errs.Addf("--profile %s", err)
+			continue
+		}
+		if _, ok := o.defined[p.name]; ok {
+			errs.Addf("--profile %s is defined more than once", p.name)
+		}
+		o.defined[p.name] = p
+	}
+
+	// order matters: profiles add to our remote broadcasts which must be
+	// known before their gateway
+	flags := []struct {
+		name   string
+		values []string
+		parse  func(iface, value string) error
+	}{
+		{"--fixed-ip", cli.FixedIp, o.addFixedIP},
+		{"--label", cli.Label, addLabel},
+		{"--schedule", cli.Schedule, o.addSchedule},
+		{"--interface-timeout", cli.IfaceTimeout, o.addTimeout},
+		{"--mtu-override", cli.MtuOverride, o.addMTU},
+		{"--vlan-tag", cli.VlanTag, o.addVlanTag},
+		{"--remote-broadcast", cli.RemoteBcast, o.addRemoteBcast},
+		{"--interface-profile", cli.IfaceProfile, o.addProfile},
+		{"--gateway-mac", cli.GatewayMac, o.addGatewayMAC},
+		{"--egress-interface", cli.Egress, o.addEgress},
+	}
+	for _, flag := range flags {
+		for _, err := range cli.parsePerInterface(flag.values, flag.parse) {
+			errs.Addf("%s %s", flag.name, err)
+		}
+	}
+
+	if o.wifi, err = cli.resolveInterfaceList(cli.Wifi); err != nil {
+		errs.Addf("--wifi %s", err)
+	} else if len(o.wifi) >= len(cli.Interface) {
+		errs.Addf("At least one --interface must not be a --wifi interface")
+	}
+	if o.aliasFanout, err = cli.resolveInterfaceList(cli.AliasFanout); err != nil {
+		errs.Addf("--alias-fanout %s", err)
+	}
+	return o, errs
+}
+
+// parseChecksumPolicies parses each --checksum-policy of an iface@mode or ip@mode
+func (o *interfaceOptions) parseChecksumPolicies(cli *CLI) []error {
+	errs := []error{}
+	csumMode := CSUM_COMPUTE
+	if cli.NoUdpChecksum {
+		csumMode = CSUM_ZERO
+	}
+	for _, iface := range cli.Interface {
+		o.csumModes[iface] = csumMode
+	}
+	for _, value := range cli.CsumPolicy {
+		target, mode, err := parseChecksumMode(value)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if net.ParseIP(target) != nil {
+			o.csumDsts[target] = mode
+			continue
+		}
+		target = resolveInterface(target)
+		if !stringInSlice(target, cli.Interface) {
+			errs = append(errs, fmt.Errorf("%s interface must be specified via --interface", value))
+			continue
+		}
+		o.csumModes[target] = mode
+	}
+	return errs
+}
+
+func (o *interfaceOptions) addFixedIP(iface, value string) error {
+	if ip := net.ParseIP(value); !isBroadcastKeyword(value) && (ip == nil || ip.To4() == nil) {
+		return fmt.Errorf("IP address is not a valid IPv4 address")
+	}
+	o.fixedIPs[iface] = append(o.fixedIPs[iface], value)
+	return nil
+}
+
+func addLabel(iface, label string) error {
+	InterfaceLabels[iface] = label
+	return nil
+}
+
+func (o *interfaceOptions) addSchedule(iface, value string) error {
+	s, err := parseSchedule(value, o.location)
+	if err != nil {
+		return err
+	}
+	if prev, ok := o.schedules[iface]; ok {
+		s.windows = append(prev.windows, s.windows...)
+	}
+	o.schedules[iface] = s
+	return nil
+}
+
+// timeout returns the --interface-timeout of iface or the --timeout
+func (o *interfaceOptions) timeout(iface string, timeout time.Duration) time.Duration {
+	if ifaceTo, ok := o.timeouts[iface]; ok {
+		return ifaceTo
+	}
+	return timeout
+}
+
+func (o *interfaceOptions) addTimeout(iface, value string) error {
+	msec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || msec < 0 {
+		return fmt.Errorf("timeout must be zero or more msec")
+	}
+	o.timeouts[iface] = parseTimeout(msec)
+	return nil
+}
+
+func (o *interfaceOptions) addMTU(iface, value string) error {
+	mtu, err := strconv.Atoi(value)
+	if err != nil || mtu < MIN_IPV4_MTU || mtu > MAX_IPV4_MTU {
+		return fmt.Errorf("MTU must be between %d and %d", MIN_IPV4_MTU, MAX_IPV4_MTU)
+	}
+	o.mtus[iface] = mtu
+	return nil
+}
+
+func (o *interfaceOptions) addVlanTag(iface, value string) error {
+	vlan, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || vlan < 1 || vlan > 4094 {
+		return fmt.Errorf("VLAN ID must be between 1 and 4094")
+	}
+	o.vlanTags[iface] = uint16(vlan)
+	return nil
+}
+
+func (o *interfaceOptions) addRemoteBcast(iface, value string) error {
+	ip := net.ParseIP(value)
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("IP address is not a valid IPv4 address")
+	}
+	o.remoteBcast[iface] = ip.To4()
+	return nil
+}
+
+func (o *interfaceOptions) addProfile(iface, name string) error {
+	p, ok := o.defined[name]
+	if !ok {
+		return fmt.Errorf("must be defined via --profile")
+	}
+	// the broadcast of a profile is just another --remote-broadcast
+	if p.broadcast != nil {
+		if _, ok := o.remoteBcast[iface]; ok {
+			return fmt.Errorf("can not be used with --remote-broadcast")
+		}
+		o.remoteBcast[iface] = p.broadcast
+	}
+	o.profiles[iface] = p
+	return nil
+}
+
+func (o *interfaceOptions) addGatewayMAC(iface, value string) error {
+	if _, ok := o.remoteBcast[iface]; !ok {
+		return fmt.Errorf("interface must be specified via --remote-broadcast")
+	}
+	mac, err := net.ParseMAC(value)
+	if err != nil || len(mac) != 6 {
+		return fmt.Errorf("is not a valid Ethernet MAC address")
+	}
+	o.gatewayMacs[iface] = mac
+	return nil
+}
+
+func (o *interfaceOptions) addEgress(iface, device string) error {
+	o.egress[iface] = resolveInterface(device)
+	return nil
+}
+
+// setupLogging configures our log level & where we send our logs
+func setupLogging(cli *CLI) {
+	switch cli.Level {
+	case "trace":
+		log.SetLevel(log.TraceLevel)
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	case "warn":
+		log.SetLevel(log.WarnLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	case "error":
+		log.SetLevel(log.ErrorLevel)
+	}
+	if cli.Quiet {
+		log.SetLevel(log.ErrorLevel)
+	}
+
+	if cli.LogLines {
+		log.SetReportCaller(true)
+	}
+	dropLog.SetRate(cli.DropLogRate)
+}
+
+// setupLogOutput sends our logs to the --logfile and --syslog
+func setupLogOutput(cli *CLI) error {
+	if cli.Logfile != "stderr" {
+		if cli.LogMaxSize < 0 || cli.LogKeep < 0 {
+			return fmt.Errorf("--logfile-max-size and --logfile-keep must be >= 0")
+		}
+		file, err := openRotatingFile(cli.Logfile, cli.LogMaxSize*1024*1024, cli.LogKeep)
+		if err != nil {
+			return fmt.Errorf("Unable to open log file: %s: %s", cli.Logfile, err)
+		}
+		log.SetOutput(file)
+	}
+	if len(cli.Syslog) > 0 {
+		if err := addSyslogHook(cli.Syslog); err != nil {
+			return fmt.Errorf("Invalid --syslog: %s", err)
+		}
+	}
+	return nil
+}
+
+// newSendPktFeed creates the SendPktFeed which decides where we forward
+// the packets of our listeners to and returns every error it finds
+func newSendPktFeed(cli *CLI, peers map[string]map[string]bool, listeners []Listen) (*SendPktFeed, configErrors) {
+	errs := configErrors{}
+	if cli.HighWatermark < 0 || cli.HighWatermark > SEND_BUFFER_SIZE {
+		errs.Addf("--high-watermark must be between 0 and %d", SEND_BUFFER_SIZE)
+	}
+	if cli.QueueAlert < 0 || cli.QueueAlert > 2*SEND_BUFFER_SIZE {
+		errs.Addf("--queue-depth-alert must be between 0 and %d", 2*SEND_BUFFER_SIZE)
+	}
+	spf := &SendPktFeed{
+		priorityPorts: map[uint16]bool{},
+		highWatermark: cli.HighWatermark,
+		peers:         peers,
+		overlaps:      map[string]map[string]bool{},
+		srcRoutes:     []srcRoute{},
+		portRoutes:    newPortRoutes(),
+	}
+	for _, o := range overlappingSubnets(listenerAddrs(listeners)) {
+		if cli.AllowOverlap {
+			log.Warnf("Overlapping subnets: %s", o.desc)
+			continue
+		}
+		log.Warnf("Overlapping subnets: %s.  Not forwarding between them without --allow-overlap", o.desc)
+		for _, p := range [][]string{{o.a, o.b}, {o.b, o.a}} {
+			if spf.overlaps[p[0]] == nil {
+				spf.overlaps[p[0]] = map[string]bool{}
+			}
+			spf.overlaps[p[0]][p[1]] = true
+		}
+	}
+	for _, r := range cli.SrcRoute {
+		route, err := parseSrcRoute(r)
+		if err != nil {
+			errs.Addf("--src-route %s", err)
+			continue
+		}
+		route.iface = resolveInterface(route.iface)
+		if !stringInSlice(route.iface, cli.Interface) {
+			errs.Addf("--src-route %s interface must be specified via --interface", r)
+			continue
+		}
+		spf.srcRoutes = append(spf.srcRoutes, route)
+	}
+	for _, r := range cli.PortRoute {
+		iface, port, err := parsePortRoute(r)
+		if err != nil {
+			errs.Addf("--port-route %s", err)
+			continue
+		}
+		iface = resolveInterface(iface)
+		if !stringInSlice(iface, cli.Interface) {
+			errs.Addf("--port-route %s interface must be specified via --interface", r)
+			continue
+		}
+		if !int32InSlice(int32(port), cli.Port) {
+			errs.Addf("--port-route %s port must be specified via --port", r)
+			continue
+		}
+		spf.portRoutes.Add(port, iface)
+	}
+	fallback, err := cli.resolveInterfaceList(cli.PortRouteDflt)
+	if err != nil {
+		errs.Addf("--port-route-default %s", err)
+	}
+	for _, iface := range fallback {
+		if spf.portRoutes.fallback == nil {
+			spf.portRoutes.fallback = map[string]bool{}
+		}
+		spf.portRoutes.fallback[iface] = true
+	}
+	for _, port := range cli.PriorityPort {
+		if !int32InSlice(int32(port), cli.Port) {
+			errs.Addf("--priority-port %d must be specified via --port", port)
+			continue
+		}
+		spf.priorityPorts[port] = true
+	}
+	return spf, errs
+}
+
+// parsePairs returns the peers of each --pair and adds their interfaces &
+// fixed IPs to our --interface(s) & --fixed-ip(s)
+func parsePairs(cli *CLI) (map[string]map[string]bool, error) {
+	peers := map[string]map[string]bool{}
+	for _, pair := range cli.Pair {
+		sides, err := parsePair(pair)
+		if err != nil {
+			return nil, fmt.Errorf("--pair %s", err)
+		}
+		for i := range sides {
+			sides[i].iface = resolveInterface(sides[i].iface)
+			if !stringInSlice(sides[i].iface, cli.Interface) {
+				cli.Interface = append(cli.Interface, sides[i].iface)
+			}
+			if len(sides[i].fixedIp) > 0 {
+				cli.FixedIp = append(cli.FixedIp, fmt.Sprintf("%s@%s", sides[i].iface, sides[i].fixedIp))
+			}
+		}
+		addPeers(peers, sides[0].iface, sides[1].iface)
+	}
+	return peers, nil
+}
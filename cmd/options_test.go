@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestParsePerInterface(t *testing.T) {
+	cli := CLI{Interface: []string{"eth0", "eth1"}}
+	tests := []struct {
+		values []string
+		err    string
+		parsed []string
+	}{
+		{[]string{"eth0@1", "eth1@2"}, "", []string{"eth0=1", "eth1=2"}},
+		{[]string{"eth0"}, "not in the correct format", nil},
+		{[]string{"eth0@"}, "not in the correct format", nil},
+		{[]string{"eth2@1"}, "eth2@1 interface must be specified via --interface", nil},
+		{[]string{"eth0@bad"}, "eth0@bad is bad", nil},
+	}
+	for _, test := range tests {
+		parsed := []string{}
+		errs := cli.parsePerInterface(test.values, func(iface, value string) error {
+			if value == "bad" {
+				return errors.New("is bad")
+			}
+			parsed = append(parsed, iface+"="+value)
+			return nil
+		})
+		if len(test.err) > 0 {
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), test.err) {
+				t.Errorf("%v: expected error %q, got %v", test.values, test.err, errs)
+			}
+			continue
+		}
+		if len(errs) > 0 {
+			t.Fatalf("%v: %v", test.values, errs)
+		}
+		if strings.Join(parsed, ",") != strings.Join(test.parsed, ",") {
+			t.Errorf("%v: parsed %v, expected %v", test.values, parsed, test.parsed)
+		}
+	}
+}
+
+func TestParseInterfaceOptions(t *testing.T) {
+	base := func() CLI {
+		return CLI{Interface: []string{"eth0", "eth1"}, Timezone: "UTC"}
+	}
+	tests := []struct {
+		name  string
+		setup func(*CLI)
+		err   string
+	}{
+		{"mtu", func(c *CLI) { c.MtuOverride = []string{"eth0@1400"} }, ""},
+		{"bad mtu", func(c *CLI) { c.MtuOverride = []string{"eth0@60"} }, "--mtu-override eth0@60 MTU must be between"},
+		{"vlan", func(c *CLI) { c.VlanTag = []string{"eth1@4095"} }, "--vlan-tag eth1@4095 VLAN ID"},
+		{"gateway first", func(c *CLI) { c.GatewayMac = []string{"eth0@02:00:00:00:00:01"} }, "via --remote-broadcast"},
+		{"gateway", func(c *CLI) {
+			c.RemoteBcast = []string{"eth0@10.1.2.255"}
+			c.GatewayMac = []string{"eth0@02:00:00:00:00:01"}
+		}, ""},
+		{"profile broadcast", func(c *CLI) {
+			c.Profile = []string{"remote@broadcast=10.1.2.255"}
+			c.IfaceProfile = []string{"eth0@remote"}
+			c.GatewayMac = []string{"eth0@02:00:00:00:00:01"}
+		}, ""},
+		{"undefined profile", func(c *CLI) { c.IfaceProfile = []string{"eth0@nope"} }, "must be defined via --profile"},
+		{"wifi", func(c *CLI) { c.Wifi = []string{"eth0", "eth1"} }, "must not be a --wifi interface"},
+		{"fixed ip", func(c *CLI) { c.FixedIp = []string{"eth0@10.0.0.300"} }, "--fixed-ip eth0@10.0.0.300 IP address"},
+	}
+	for _, test := range tests {
+		cli := base()
+		test.setup(&cli)
+		o, errs := parseInterfaceOptions(&cli)
+		if len(test.err) > 0 {
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, errs)
+			}
+			continue
+		}
+		if len(errs) > 0 {
+			t.Fatalf("%s: %v", test.name, errs)
+		}
+		if o.csumModes["eth0"] != CSUM_COMPUTE {
+			t.Errorf("%s: checksum mode %q", test.name, o.csumModes["eth0"])
+		}
+	}
+}
+
+func TestParseInterfaceOptionsReportsEveryError(t *testing.T) {
+	cli := CLI{
+		Interface:   []string{"eth0", "eth1"},
+		Timezone:    "Nowhere/Special",
+		MtuOverride: []string{"eth0@60", "eth1@70000", "eth1@1400"},
+		VlanTag:     []string{"eth2@10"},
+		CsumPolicy:  []string{"eth0@never"},
+		Profile:     []string{"bad"},
+		Wifi:        []string{"wlan0"},
+	}
+	o, errs := parseInterfaceOptions(&cli)
+	expected := []string{
+		"Invalid --timezone",
+		"--checksum-policy never is not a valid mode",
+		"--profile bad is not in the format",
+		"--mtu-override eth0@60 MTU",
+		"--mtu-override eth1@70000 MTU",
+		"--vlan-tag eth2@10 interface must be specified",
+		"--wifi wlan0 interface must be specified",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), expected[i]) {
+			t.Errorf("error %d: expected %q, got %q", i, expected[i], err)
+		}
+	}
+	// the valid options are still parsed
+	if o.mtus["eth1"] != 1400 {
+		t.Errorf("eth1 MTU is %d", o.mtus["eth1"])
+	}
+}
+
+func TestNewSendPktFeedReportsEveryError(t *testing.T) {
+	cli := CLI{
+		Interface:     []string{"eth0", "eth1"},
+		Port:          []int32{1900},
+		HighWatermark: -1,
+		SrcRoute:      []string{"eth0@10.0.0.0/8", "eth2@10.0.0.0/8", "eth1@nope"},
+		PortRoute:     []string{"eth0@1900", "eth1@5353"},
+		PriorityPort:  []uint16{1900, 5353},
+	}
+	spf, errs := newSendPktFeed(&cli, map[string]map[string]bool{}, []Listen{})
+	if len(errs) != 5 {
+		t.Fatalf("expected 5 errors, got %d: %v", len(errs), errs)
+	}
+	if len(spf.srcRoutes) != 1 || !spf.priorityPorts[1900] || !spf.portRoutes.Allows(1900, "eth0") {
+		t.Errorf("valid options were not applied: %+v", spf)
+	}
+}
+
+func TestGuessLinkType(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	loopback := layers.LinkTypeEthernet
+	if runtime.GOOS != "linux" {
+		loopback = layers.LinkTypeNull
+	}
+	tests := []struct {
+		name     string
+		netif    net.Interface
+		monitor  bool
+		linkType layers.LinkType
+	}{
+		{"ethernet", net.Interface{HardwareAddr: mac, Flags: net.FlagBroadcast}, false, layers.LinkTypeEthernet},
+		{"wifi", net.Interface{HardwareAddr: mac}, true, layers.LinkTypeIEEE80211Radio},
+		{"tun", net.Interface{Flags: net.FlagPointToPoint}, false, layers.LinkTypeRaw},
+		{"loopback", net.Interface{Flags: net.FlagLoopback}, false, loopback},
+	}
+	for _, test := range tests {
+		if linkType := guessLinkType(&test.netif, test.monitor); linkType != test.linkType {
+			t.Errorf("%s: expected %s, got %s", test.name, test.linkType, linkType)
+		}
+	}
+}
+
+func TestListenValidate(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	Interfaces["validate0"] = pcap.Interface{Name: "validate0",
+		Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.1"), Netmask: net.CIDRMask(24, 32)}}}
+	defer delete(Interfaces, "validate0")
+
+	tests := []struct {
+		name  string
+		l     Listen
+		count int
+	}{
+		{"valid", Listen{iname: "validate0", netif: &net.Interface{HardwareAddr: mac}}, 0},
+		{"not configured", Listen{iname: "validate1", netif: &net.Interface{HardwareAddr: mac}}, 1},
+		{"no gateway", Listen{iname: "validate0", netif: &net.Interface{HardwareAddr: mac},
+			bcast: Broadcast{remote: net.ParseIP("10.1.0.255")}}, 1},
+		{"no egress", Listen{iname: "validate1", netif: &net.Interface{HardwareAddr: mac},
+			bcast: Broadcast{remote: net.ParseIP("10.1.0.255")}, egressName: "no-such-device0"}, 3},
+	}
+	for _, test := range tests {
+		if errs := test.l.validate(); len(errs) != test.count {
+			t.Errorf("%s: expected %d errors, got %v", test.name, test.count, errs)
+		}
+	}
+}
+
+// fakeInactiveHandle records how we configure a pcap handle
+type fakeInactiveHandle struct {
+	timeout time.Duration
+	promisc bool
+	snaplen int
+}
+
+func (h *fakeInactiveHandle) SetTimeout(timeout time.Duration) error {
+	h.timeout = timeout
+	return nil
+}
+
+func (h *fakeInactiveHandle) SetPromisc(promisc bool) error {
+	h.promisc = promisc
+	return nil
+}
+
+func (h *fakeInactiveHandle) SetSnapLen(snaplen int) error {
+	h.snaplen = snaplen
+	return nil
+}
+
+// An --interface-timeout overrides the --timeout we give libpcap
+func TestInterfaceTimeout(t *testing.T) {
+	cli := CLI{Interface: []string{"eth0", "eth1", "eth2"}, IfaceTimeout: []string{"eth0@10", "eth2@0"}}
+	o, errs := parseInterfaceOptions(&cli)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	tests := []struct {
+		iface   string
+		timeout time.Duration
+	}{
+		{"eth0", 10 * time.Millisecond},
+		{"eth1", 250 * time.Millisecond},
+		{"eth2", 0},
+	}
+	for _, test := range tests {
+		l := Listen{iname: test.iface, timeout: o.timeout(test.iface, 250*time.Millisecond)}
+		h := &fakeInactiveHandle{}
+		if err := configureHandle(h, l.timeout, true, DEFAULT_SNAPLEN); err != nil {
+			t.Fatal(err)
+		}
+		if h.timeout != test.timeout || !h.promisc || h.snaplen != DEFAULT_SNAPLEN {
+			t.Errorf("%s: configured %+v, expected a %s timeout", test.iface, *h, test.timeout)
+		}
+	}
+
+	for _, value := range []string{"eth0@-1", "eth0@soon", "eth3@10"} {
+		cli.IfaceTimeout = []string{value}
+		if _, errs := parseInterfaceOptions(&cli); len(errs) != 1 ||
+			!strings.Contains(errs[0].Error(), "--interface-timeout "+value) {
+			t.Errorf("%s: expected an error, got %v", value, errs)
+		}
+	}
+}
+
+// We log the --label of an interface while keeping its name for our stats
+func TestLabel(t *testing.T) {
+	cli := CLI{Interface: []string{"label0.10", "label1"}, Label: []string{"label0.10@IoT-VLAN"}}
+	if _, errs := parseInterfaceOptions(&cli); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	defer delete(InterfaceLabels, "label0.10")
+	if label := interfaceLabel("label0.10"); label != "IoT-VLAN" {
+		t.Errorf("label0.10 is labeled %s", label)
+	}
+	if label := interfaceLabel("label1"); label != "label1" {
+		t.Errorf("label1 is labeled %s", label)
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	listeners := []Listen{
+		{iname: "label0.10", label: interfaceLabel("label0.10"), stats: &Stats{}},
+		{iname: "label1", label: interfaceLabel("label1"), stats: &Stats{}},
+	}
+	logStats(listeners)
+	listeners[1].sendFailed(Send{srcif: "label0.10"}, errors.New("no route"), 100)
+	for _, expected := range []string{"IoT-VLAN: received=", "label1: received=", "from IoT-VLAN out label1: no route"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in %q", expected, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "label0.10") {
+		t.Errorf("logged the interface instead of its label: %q", out.String())
+	}
+
+	s := &statusServer{listeners: listeners, spf: &SendPktFeed{}}
+	if topology := s.topology(); topology[0].Interface != "label0.10" || topology[0].Label != "IoT-VLAN" {
+		t.Errorf("topology is %+v", topology[0])
+	}
+}
+
+// Flags override their UDPPROXY_* environment variable, which overrides the default
+func TestEnvironment(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(cli CLI) bool
+	}{
+		{"defaults", map[string]string{}, []string{},
+			func(cli CLI) bool { return len(cli.Interface) == 0 && cli.Timeout == 250 && cli.Logfile == "stderr" }},
+		{"env only", map[string]string{
+			"UDPPROXY_INTERFACES": "eth0,eth1",
+			"UDPPROXY_PORTS":      "9,137",
+			"UDPPROXY_FILTER":     "udp and not src host 10.0.0.1",
+			"UDPPROXY_FIXED_IP":   "eth0@10.0.0.5,eth1@10.1.0.5",
+			"UDPPROXY_PAIR":       "eth0:eth1",
+			"UDPPROXY_TIMEOUT":    "100",
+			"UDPPROXY_LEVEL":      "debug",
+			"UDPPROXY_LOGFILE":    "/var/log/udp-proxy-2020.log",
+		}, []string{}, func(cli CLI) bool {
+			return fmt.Sprint(cli.Interface) == "[eth0 eth1]" && fmt.Sprint(cli.Port) == "[9 137]" &&
+				fmt.Sprint(cli.Filter) == "[udp and not src host 10.0.0.1]" &&
+				fmt.Sprint(cli.FixedIp) == "[eth0@10.0.0.5 eth1@10.1.0.5]" && fmt.Sprint(cli.Pair) == "[eth0:eth1]" &&
+				cli.Timeout == 100 && cli.Level == "debug" && cli.Logfile == "/var/log/udp-proxy-2020.log"
+		}},
+		{"flags override env", map[string]string{
+			"UDPPROXY_INTERFACES": "eth0,eth1",
+			"UDPPROXY_PORTS":      "9,137",
+			"UDPPROXY_TIMEOUT":    "100",
+			"UDPPROXY_LEVEL":      "debug",
+		}, []string{"-i", "eth2", "-i", "eth3", "--port", "1900", "--level", "warn"}, func(cli CLI) bool {
+			return fmt.Sprint(cli.Interface) == "[eth2 eth3]" && fmt.Sprint(cli.Port) == "[1900]" &&
+				cli.Timeout == 100 && cli.Level == "warn"
+		}},
+	}
+	for _, test := range tests {
+		for key, value := range test.env {
+			os.Setenv(key, value)
+		}
+		cli := CLI{}
+		_, err := newParser(&cli).Parse(test.args)
+		for key := range test.env {
+			os.Unsetenv(key)
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !test.check(cli) {
+			t.Errorf("%s: parsed --interface %v --port %v --filter %v --fixed-ip %v --pair %v --timeout %d --level %s --logfile %s",
+				test.name, cli.Interface, cli.Port, cli.Filter, cli.FixedIp, cli.Pair, cli.Timeout, cli.Level, cli.Logfile)
+		}
+	}
+}
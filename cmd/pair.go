@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// interfacePair is one side of a --pair
+type interfacePair struct {
+	iface   string
+	fixedIp string // optional IP to always send to
+}
+
+// parsePair parses a --pair of <iface1>[@ip1]:<iface2>[@ip2]
+func parsePair(pair string) ([]interfacePair, error) {
+	split := strings.Split(pair, ":")
+	if len(split) != 2 {
+		return nil, fmt.Errorf("%s is not in the format of <iface1>[@ip1]:<iface2>[@ip2]", pair)
+	}
+	ret := []interfacePair{}
+	for _, side := range split {
+		p := interfacePair{iface: side}
+		if strings.Contains(side, "@") {
+			iface, ip, err := splitInterfaceArg(side)
+			if err != nil {
+				return nil, err
+			}
+			p = interfacePair{iface: iface, fixedIp: ip}
+		}
+		if len(p.iface) == 0 {
+			return nil, fmt.Errorf("%s is missing an interface", pair)
+		}
+		ret = append(ret, p)
+	}
+	if ret[0].iface == ret[1].iface {
+		return nil, fmt.Errorf("%s must be two different interfaces", pair)
+	}
+	return ret, nil
+}
+
+// addPeers records that a & b only forward to each other and any other
+// interfaces they are paired with
+func addPeers(peers map[string]map[string]bool, a string, b string) {
+	for _, p := range [][]string{{a, b}, {b, a}} {
+		if peers[p[0]] == nil {
+			peers[p[0]] = map[string]bool{}
+		}
+		peers[p[0]][p[1]] = true
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePair(t *testing.T) {
+	tests := []struct {
+		pair  string
+		err   string
+		sides []interfacePair
+	}{
+		{"eth0:eth1", "", []interfacePair{{"eth0", ""}, {"eth1", ""}}},
+		{"eth0@10.0.0.5:eth1", "", []interfacePair{{"eth0", "10.0.0.5"}, {"eth1", ""}}},
+		{"eth0:eth1@10.1.0.255", "", []interfacePair{{"eth0", ""}, {"eth1", "10.1.0.255"}}},
+		{"eth0", "is not in the format of <iface1>[@ip1]:<iface2>[@ip2]", nil},
+		{"eth0:eth1:eth2", "is not in the format of <iface1>[@ip1]:<iface2>[@ip2]", nil},
+		{":eth1", "is missing an interface", nil},
+		{"eth0@:eth1", "not in the correct format", nil},
+		{"eth0:eth0@10.0.0.5", "must be two different interfaces", nil},
+	}
+	for _, test := range tests {
+		sides, err := parsePair(test.pair)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.pair, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.pair, err)
+		}
+		if len(sides) != 2 || sides[0] != test.sides[0] || sides[1] != test.sides[1] {
+			t.Errorf("%s: parsed %+v", test.pair, sides)
+		}
+	}
+}
+
+func TestAddPeers(t *testing.T) {
+	peers := map[string]map[string]bool{}
+	addPeers(peers, "eth0", "eth1")
+	addPeers(peers, "eth0", "eth2")
+	addPeers(peers, "eth1", "eth0")
+
+	expected := map[string][]string{
+		"eth0": {"eth1", "eth2"},
+		"eth1": {"eth0"},
+		"eth2": {"eth0"},
+	}
+	if len(peers) != len(expected) {
+		t.Fatalf("peers are %v", peers)
+	}
+	for iface, ifaces := range expected {
+		if len(peers[iface]) != len(ifaces) {
+			t.Errorf("%s: peers are %v", iface, peers[iface])
+		}
+		for _, peer := range ifaces {
+			if !peers[iface][peer] {
+				t.Errorf("%s: %s is not a peer", iface, peer)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	PAYLOAD_HEX    = "hex:"
+	PAYLOAD_REGEXP = "re:"
+)
+
+// payloadDenylist matches UDP payloads against our --deny-payload signatures
+// which are either hex:<bytes> which match anywhere in the payload or
+// re:<regexp>.  The regexps are combined into one so we only scan each
+// payload once for all of them.
+type payloadDenylist struct {
+	hex    [][]byte
+	regexp *regexp.Regexp
+}
+
+// newPayloadDenylist parses the signatures
+func newPayloadDenylist(signatures []string) (*payloadDenylist, error) {
+	p := &payloadDenylist{
+		hex: [][]byte{},
+	}
+	exprs := []string{}
+	for _, sig := range signatures {
+		switch {
+		case strings.HasPrefix(sig, PAYLOAD_HEX):
+			value := strings.NewReplacer(" ", "", ":", "").Replace(strings.TrimPrefix(sig, PAYLOAD_HEX))
+			b, err := hex.DecodeString(value)
+			if err != nil || len(b) == 0 {
+				return nil, fmt.Errorf("%s is not a valid hex signature", sig)
+			}
+			p.hex = append(p.hex, b)
+		case strings.HasPrefix(sig, PAYLOAD_REGEXP):
+			expr := strings.TrimPrefix(sig, PAYLOAD_REGEXP)
+			if _, err := regexp.Compile(expr); err != nil {
+				return nil, fmt.Errorf("%s is not a valid regexp: %s", sig, err)
+			}
+			exprs = append(exprs, "(?:"+expr+")")
+		default:
+			return nil, fmt.Errorf("%s must start with %s or %s", sig, PAYLOAD_HEX, PAYLOAD_REGEXP)
+		}
+	}
+	if len(exprs) > 0 {
+		p.regexp = regexp.MustCompile(strings.Join(exprs, "|"))
+	}
+	return p, nil
+}
+
+// Match returns true if the payload matches any of our signatures
+func (p *payloadDenylist) Match(payload []byte) bool {
+	for _, sig := range p.hex {
+		if bytes.Contains(payload, sig) {
+			return true
+		}
+	}
+	return p.regexp != nil && p.regexp.Match(payload)
+}
+
+// Reads --deny-payload signatures from a file, one per line.  Blank lines
+// and lines starting with a # are ignored.
+func readPayloadSignatures(fileName string) ([]string, error) {
+	data, err := os.ReadFile(fileName) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+	signatures := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		signatures = append(signatures, line)
+	}
+	return signatures, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPayloadDenylist(t *testing.T) {
+	p, err := newPayloadDenylist([]string{"hex:dead beef", "hex:01:02", `re:^M-SEARCH \* HTTP`, "re:(?i)roku"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		payload string
+		denied  bool
+	}{
+		{"\xde\xad\xbe\xef", true},
+		{"prefix\xde\xad\xbe\xefsuffix", true},
+		{"\xde\xad\xbe", false},
+		{"\x00\x01\x02\x03", true},
+		{"M-SEARCH * HTTP/1.1\r\n", true},
+		{"NOTIFY * HTTP/1.1\r\nM-SEARCH * HTTP", false},
+		{"Server: ROKU/9.0", true},
+		{"hello world", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if denied := p.Match([]byte(test.payload)); denied != test.denied {
+			t.Errorf("%q: denied is %v", test.payload, denied)
+		}
+	}
+
+	empty, err := newPayloadDenylist([]string{})
+	if err != nil || empty.Match([]byte("anything")) {
+		t.Errorf("empty denylist matched: %v", err)
+	}
+}
+
+func TestNewPayloadDenylistInvalid(t *testing.T) {
+	tests := []struct {
+		sig string
+		err string
+	}{
+		{"hex:", "is not a valid hex signature"},
+		{"hex:abc", "is not a valid hex signature"},
+		{"hex:zz", "is not a valid hex signature"},
+		{"re:(", "is not a valid regexp"},
+		{"deadbeef", "must start with hex: or re:"},
+	}
+	for _, test := range tests {
+		_, err := newPayloadDenylist([]string{test.sig})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected %q, got %v", test.sig, test.err, err)
+		}
+	}
+}
+
+func TestReadPayloadSignatures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	data := "# SSDP searches\nre:^M-SEARCH\n\n  hex:dead  \n#hex:beef\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signatures, err := readPayloadSignatures(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(signatures, ",") != "re:^M-SEARCH,hex:dead" {
+		t.Errorf("read %v", signatures)
+	}
+	if _, err := readPayloadSignatures(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Errorf("missing file should be an error")
+	}
+}
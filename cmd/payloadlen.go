@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// lengthRange is an inclusive range of UDP payload lengths
+type lengthRange struct {
+	min int
+	max int
+}
+
+// parseLengthRanges parses a --payload-length of <len>|<min>-<max> values
+func parseLengthRanges(values []string) ([]lengthRange, error) {
+	ranges := []lengthRange{}
+	for _, value := range values {
+		split := strings.SplitN(value, "-", 2)
+		min, err := strconv.ParseUint(split[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid length or <min>-<max> range", value)
+		}
+		max := min
+		if len(split) == 2 {
+			if max, err = strconv.ParseUint(split[1], 10, 16); err != nil || max < min {
+				return nil, fmt.Errorf("%s is not a valid length or <min>-<max> range", value)
+			}
+		}
+		ranges = append(ranges, lengthRange{min: int(min), max: int(max)})
+	}
+	return ranges, nil
+}
+
+// lengthInRanges returns true if the length is within any of the ranges
+func lengthInRanges(length int, ranges []lengthRange) bool {
+	for _, r := range ranges {
+		if length >= r.min && length <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// payloadLength returns the length of the UDP payload.  This is from the
+// UDP header, so it is the length of the entire datagram even if we only
+// have the first fragment.  UDP-Lite has no length field.
+func (d *Decoded) payloadLength() int {
+	if d.Has(layers.LayerTypeUDP) && d.udp.Length >= 8 {
+		return int(d.udp.Length) - 8
+	}
+	return len(d.payload)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLengthRanges(t *testing.T) {
+	tests := []struct {
+		values []string
+		err    string
+		ranges []lengthRange
+	}{
+		{[]string{"100"}, "", []lengthRange{{100, 100}}},
+		{[]string{"0-64", "512-1472"}, "", []lengthRange{{0, 64}, {512, 1472}}},
+		{[]string{"65535"}, "", []lengthRange{{65535, 65535}}},
+		{[]string{"65536"}, "is not a valid length", nil},
+		{[]string{"-5"}, "is not a valid length", nil},
+		{[]string{"64-32"}, "is not a valid length", nil},
+		{[]string{"64-"}, "is not a valid length", nil},
+		{[]string{"big"}, "is not a valid length", nil},
+	}
+	for _, test := range tests {
+		ranges, err := parseLengthRanges(test.values)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: expected %q, got %v", test.values, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %s", test.values, err)
+		}
+		if len(ranges) != len(test.ranges) {
+			t.Fatalf("%v: parsed %v", test.values, ranges)
+		}
+		for i := range ranges {
+			if ranges[i] != test.ranges[i] {
+				t.Errorf("%v: parsed %v", test.values, ranges)
+			}
+		}
+	}
+}
+
+func TestLengthInRanges(t *testing.T) {
+	ranges := []lengthRange{{0, 0}, {10, 20}, {100, 100}}
+	tests := []struct {
+		length int
+		in     bool
+	}{
+		{0, true}, {1, false}, {9, false}, {10, true}, {15, true}, {20, true}, {21, false}, {100, true}, {101, false},
+	}
+	for _, test := range tests {
+		if in := lengthInRanges(test.length, ranges); in != test.in {
+			t.Errorf("%d: in ranges is %v", test.length, in)
+		}
+	}
+	if lengthInRanges(10, nil) {
+		t.Errorf("no ranges should match no lengths")
+	}
+}
+
+// The UDP length of the first fragment of a datagram is for the entire datagram
+func TestPayloadLength(t *testing.T) {
+	_, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+	if length := d.payloadLength(); length != 5 {
+		t.Errorf("payload length is %d", length)
+	}
+	d.udp.Length = 1008
+	if length := d.payloadLength(); length != 1000 {
+		t.Errorf("payload length of a fragment is %d", length)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PCAP_SNAPLEN       = 65536
+	PCAP_HEADER_SIZE   = 24 // pcap file header
+	PCAP_RECORD_HEADER = 16 // per packet header
+)
+
+// pcapRotation controls when a pcapWriter starts a new file.  Zero values
+// disable rotating on that condition.
+type pcapRotation struct {
+	maxSize int64         // rotate once the file is at least this many bytes
+	maxAge  time.Duration // rotate files older than this
+	keep    int           // number of rotated files to keep
+}
+
+// pcapWriter writes packets to a pcap file which is rotated log style:
+// the current file is renamed to <file>.1, <file>.1 to <file>.2 and so on
+// with files past our keep count removed
+type pcapWriter struct {
+	fileName string
+	linkType layers.LinkType
+	rotate   pcapRotation
+	file     *os.File
+	writer   *pcapgo.Writer
+	size     int64     // bytes written to the current file
+	opened   time.Time // when the current file was created
+	closed   bool      // packets written after Close are ignored
+}
+
+// newPcapWriter creates the pcap file and writes the header
+func newPcapWriter(fileName string, linkType layers.LinkType, rotate pcapRotation) (*pcapWriter, error) {
+	w := &pcapWriter{
+		fileName: fileName,
+		linkType: linkType,
+		rotate:   rotate,
+	}
+	return w, w.open()
+}
+
+func (w *pcapWriter) open() error {
+	f, err := os.Create(w.fileName)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.writer = pcapgo.NewWriter(f)
+	w.size = PCAP_HEADER_SIZE
+	w.opened = time.Now()
+	return w.writer.WriteFileHeader(PCAP_SNAPLEN, w.linkType)
+}
+
+// WritePacket writes the packet to the current file, rotating it first if
+// it is too big or too old
+func (w *pcapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if w.closed {
+		return nil
+	}
+	if w.needsRotate(time.Now()) {
+		if err := w.rotateFiles(); err != nil {
+			return err
+		}
+	}
+	if err := w.writer.WritePacket(ci, data); err != nil {
+		return err
+	}
+	w.size += int64(PCAP_RECORD_HEADER + len(data))
+	return nil
+}
+
+// needsRotate returns true if the current file has packets and is over our
+// size or age limit
+func (w *pcapWriter) needsRotate(now time.Time) bool {
+	if w.size <= PCAP_HEADER_SIZE {
+		return false
+	}
+	if w.rotate.maxSize > 0 && w.size >= w.rotate.maxSize {
+		return true
+	}
+	return w.rotate.maxAge > 0 && now.Sub(w.opened) >= w.rotate.maxAge
+}
+
+// rotateFiles closes the current file, shifts the rotated files and opens
+// a new current file
+func (w *pcapWriter) rotateFiles() error {
+	if err := w.file.Close(); err != nil {
+		log.WithError(err).Warnf("Unable to close %s", w.fileName)
+	}
+
+	if err := shiftRotatedFiles(w.fileName, w.rotate.keep); err != nil {
+		log.WithError(err).Warnf("Unable to rotate %s", w.fileName)
+	}
+	log.Debugf("Rotated pcap file %s", w.fileName)
+	return w.open()
+}
+
+// Close closes the current file
+func (w *pcapWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.file.Close()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// countPackets returns the number of packets in the pcap file, or -1 if it
+// doesn't exist
+func countPackets(t *testing.T, fileName string) int {
+	t.Helper()
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return -1
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("%s: %s", fileName, err)
+	}
+	count := 0
+	for {
+		if _, _, err := r.ReadPacketData(); err != nil {
+			return count
+		}
+		count++
+	}
+}
+
+func TestPcapWriterRotate(t *testing.T) {
+	record := PCAP_RECORD_HEADER + 100
+	tests := []struct {
+		name    string
+		rotate  pcapRotation
+		packets int
+		old     bool  // the current file is over the max age before each write
+		counts  []int // packets in the file, file.1, file.2, ...
+	}{
+		{"no rotation", pcapRotation{keep: 5}, 5, false, []int{5, -1}},
+		{"at the size", pcapRotation{maxSize: int64(PCAP_HEADER_SIZE + 2*record), keep: 5}, 5, false, []int{1, 2, 2, -1}},
+		{"under the size", pcapRotation{maxSize: int64(PCAP_HEADER_SIZE + 2*record + 1), keep: 5}, 5, false, []int{2, 3, -1}},
+		{"prune", pcapRotation{maxSize: 1, keep: 2}, 5, false, []int{1, 1, 1, -1}},
+		{"keep none", pcapRotation{maxSize: 1}, 5, false, []int{1, -1}},
+		{"age", pcapRotation{maxAge: time.Minute, keep: 5}, 3, true, []int{1, 1, 1, -1}},
+	}
+	for _, test := range tests {
+		fileName := filepath.Join(t.TempDir(), "eth0-in.pcap")
+		w, err := newPcapWriter(fileName, layers.LinkTypeRaw, test.rotate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < test.packets; i++ {
+			if test.old {
+				w.opened = time.Now().Add(-time.Minute)
+			}
+			ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: 100, Length: 100}
+			if err := w.WritePacket(ci, make([]byte, 100)); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for n, expected := range test.counts {
+			name := fileName
+			if n > 0 {
+				name = fmt.Sprintf("%s.%d", fileName, n)
+			}
+			if count := countPackets(t, name); count != expected {
+				t.Errorf("%s: %s has %d packets, expected %d", test.name, filepath.Base(name), count, expected)
+			}
+		}
+	}
+}
+
+// Only files with packets are rotated
+func TestPcapWriterNeedsRotate(t *testing.T) {
+	w, err := newPcapWriter(filepath.Join(t.TempDir(), "eth0-out.pcap"), layers.LinkTypeEthernet,
+		pcapRotation{maxSize: PCAP_HEADER_SIZE, maxAge: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.needsRotate(w.opened.Add(time.Hour)) {
+		t.Errorf("rotating an empty file")
+	}
+	w.size++
+	if !w.needsRotate(w.opened) {
+		t.Errorf("not rotating at the max size")
+	}
+	w.rotate.maxSize = 0
+	if w.needsRotate(w.opened.Add(time.Minute-time.Second)) || !w.needsRotate(w.opened.Add(time.Minute)) {
+		t.Errorf("not rotating at the max age")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Policy decides which of the IPv4 UDP packets we receive on an interface
+// are forwarded.  Its rules are evaluated in order and the first rule which
+// rejects a packet decides the reason we drop it.
+type Policy struct {
+	iname         string           // interface we receive the packets on
+	verifyCsum    bool             // drop received packets with an invalid checksum
+	srcOUIs       [][]byte         // only forward packets from MACs with these OUIs
+	ouiNonEther   bool             // forward packets without a MAC if we have srcOUIs
+	ownAddrs      map[string]bool  // drop packets from the IPs of any of our interfaces
+	broadcastOnly bool             // only forward broadcast/multicast packets
+	mcastGroups   []*net.IPNet     // only forward multicast packets to these groups
+	srcPorts      map[uint16]bool  // only forward packets from these UDP ports, empty for any
+	payloadLens   []lengthRange    // only forward payloads of these lengths
+	denylist      *payloadDenylist // drop packets with these payloads
+	schedule      *schedule        // only forward packets received during these times
+	repeats       *repeatFilter    // optionally suppress repeated payloads
+	byteLimit     *byteLimiter     // optionally limit the bytes/sec we forward
+}
+
+// PacketInfo is what a Policy knows about a received packet
+type PacketInfo struct {
+	decoded *Decoded
+	srcMAC  net.HardwareAddr // nil for packets without an Ethernet header
+	size    int              // bytes we captured
+	ts      time.Time        // when we captured the packet
+}
+
+// Decide returns true and DropNone if the packet should be forwarded or false
+// along with the Drop* reason it should be dropped
+func (p *Policy) Decide(info PacketInfo) (bool, DropReason) {
+	d := info.decoded
+
+	// corrupted along the way?
+	if p.verifyCsum && !d.checksumsValid() {
+		return false, DropChecksum
+	}
+
+	// from a device we want?
+	if len(p.srcOUIs) > 0 {
+		if info.srcMAC == nil && !p.ouiNonEther || info.srcMAC != nil && !ouiMatches(info.srcMAC, p.srcOUIs) {
+			return false, DropSrcOUI
+		}
+	}
+
+	// sent by this host?
+	if p.ownAddrs != nil && p.ownAddrs[d.ip4.SrcIP.String()] {
+		return false, DropOwnAddress
+	}
+
+	// only forward broadcast & multicast?
+	if p.broadcastOnly && !isBroadcastOrMulticast(d.ip4.DstIP, Interfaces[p.iname].Addresses) {
+		return false, DropUnicast
+	}
+
+	// a multicast group we want?
+	if len(p.mcastGroups) > 0 && d.ip4.DstIP.IsMulticast() && !ipInNetworks(d.ip4.DstIP, p.mcastGroups) {
+		return false, DropMcastGroup
+	}
+
+	// from a source port we want?
+	if len(p.srcPorts) > 0 && !p.srcPorts[uint16(d.udp.SrcPort)] {
+		return false, DropSrcPort
+	}
+
+	// a payload length we want?
+	if len(p.payloadLens) > 0 && !lengthInRanges(d.payloadLength(), p.payloadLens) {
+		return false, DropPayloadLen
+	}
+
+	// a payload we never forward?
+	if p.denylist != nil && p.denylist.Match(d.payload) {
+		return false, DropDenied
+	}
+
+	// outside of our --schedule?
+	if p.schedule != nil && !p.schedule.Active(info.ts) {
+		return false, DropUnscheduled
+	}
+
+	// same payload as the last one from this source?  The rules from here
+	// on keep state, so they must be last and only record packets we forward.
+	var source string
+	var hash uint64
+	if p.repeats != nil {
+		// by destination port, see repeatFilter
+		source = fmt.Sprintf("%s:%d", d.ip4.SrcIP, d.udp.DstPort)
+		var repeat bool
+		if repeat, hash = p.repeats.Repeat(source, d.payload, info.ts); repeat {
+			return false, DropRepeat
+		}
+	}
+
+	// over our --rate-limit-bytes?
+	if p.byteLimit != nil && !p.byteLimit.Allow(info.size, info.ts) {
+		return false, DropRateLimit
+	}
+
+	if p.repeats != nil {
+		p.repeats.Record(source, hash, info.ts)
+	}
+	return true, DropNone
+}
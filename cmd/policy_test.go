@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+func TestPolicyDecide(t *testing.T) {
+	Interfaces["policy0"] = pcap.Interface{Name: "policy0",
+		Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.1"), Netmask: net.CIDRMask(24, 32),
+			Broadaddr: net.ParseIP("10.0.0.255")}}}
+	defer delete(Interfaces, "policy0")
+
+	denylist, err := newPayloadDenylist([]string{"hex:dead"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lengths, err := parseLengthRanges([]string{"1-16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched, err := parseSchedule("08:00-17:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, group, _ := net.ParseCIDR("239.255.255.250/32")
+	noon := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		dst     string
+		payload string
+		srcMAC  net.HardwareAddr
+		ts      time.Time
+		reason  DropReason
+	}{
+		{"empty", Policy{}, "10.0.0.255", "hello", nil, noon, DropNone},
+		{"src oui", Policy{srcOUIs: [][]byte{{0x00, 0x11, 0x22}}}, "10.0.0.255", "hello", mac, noon, DropSrcOUI},
+		{"src oui match", Policy{srcOUIs: [][]byte{{0x02, 0, 0}}}, "10.0.0.255", "hello", mac, noon, DropNone},
+		{"src oui no mac", Policy{srcOUIs: [][]byte{{0x02, 0, 0}}}, "10.0.0.255", "hello", nil, noon, DropSrcOUI},
+		{"src oui non-ether", Policy{srcOUIs: [][]byte{{0x02, 0, 0}}, ouiNonEther: true}, "10.0.0.255", "hello", nil, noon, DropNone},
+		{"own address", Policy{ownAddrs: map[string]bool{"10.0.0.5": true}}, "10.0.0.255", "hello", nil, noon, DropOwnAddress},
+		{"unicast", Policy{iname: "policy0", broadcastOnly: true}, "10.0.0.9", "hello", nil, noon, DropUnicast},
+		{"broadcast", Policy{iname: "policy0", broadcastOnly: true}, "10.0.0.255", "hello", nil, noon, DropNone},
+		{"mcast group", Policy{mcastGroups: []*net.IPNet{group}}, "224.0.0.251", "hello", nil, noon, DropMcastGroup},
+		{"mcast group match", Policy{mcastGroups: []*net.IPNet{group}}, "239.255.255.250", "hello", nil, noon, DropNone},
+		{"src port", Policy{srcPorts: map[uint16]bool{1900: true}}, "10.0.0.255", "hello", nil, noon, DropSrcPort},
+		{"src port match", Policy{srcPorts: map[uint16]bool{5000: true}}, "10.0.0.255", "hello", nil, noon, DropNone},
+		{"payload len", Policy{payloadLens: lengths}, "10.0.0.255", "a much longer payload", nil, noon, DropPayloadLen},
+		{"denied", Policy{denylist: denylist}, "10.0.0.255", "\xde\xad", nil, noon, DropDenied},
+		{"unscheduled", Policy{schedule: sched}, "10.0.0.255", "hello", nil, noon.Add(8 * time.Hour), DropUnscheduled},
+		{"scheduled", Policy{schedule: sched}, "10.0.0.255", "hello", nil, noon, DropNone},
+		{"rate limit", Policy{byteLimit: newByteLimiter(10)}, "10.0.0.255", "hello", nil, noon, DropRateLimit},
+		// the first rule which rejects the packet decides the reason
+		{"first rule", Policy{srcPorts: map[uint16]bool{1900: true}, denylist: denylist}, "10.0.0.255", "\xde\xad",
+			nil, noon, DropSrcPort},
+	}
+	for _, test := range tests {
+		_, d := testPacket(t, "10.0.0.5", test.dst, 5000, 9003, []byte(test.payload))
+		info := PacketInfo{decoded: d, srcMAC: test.srcMAC, size: 100, ts: test.ts}
+		forward, reason := test.policy.Decide(info)
+		if forward != (test.reason == DropNone) || reason != test.reason {
+			t.Errorf("%s: expected %s, got %v %s", test.name, test.reason, forward, reason)
+		}
+	}
+}
+
+// --src-port(s) are parsed from the command line and an empty list allows
+// packets from any source port
+func TestParseSrcPorts(t *testing.T) {
+	tests := []struct {
+		args    []string
+		allowed []uint16
+		denied  []uint16
+		errs    []string
+	}{
+		{[]string{}, []uint16{68, 123, 5000}, nil, nil},
+		{[]string{"--src-port=68,123"}, []uint16{68, 123}, []uint16{67, 5000}, nil},
+		{[]string{"--src-port=68", "--src-port=68"}, []uint16{68}, []uint16{123}, nil},
+		{[]string{"--src-port=0,123", "--src-port=0"}, []uint16{123}, []uint16{68},
+			[]string{"--src-port 0 must be between 1 and 65535", "--src-port 0 must be between 1 and 65535"}},
+	}
+	for _, test := range tests {
+		cli := CLI{}
+		if _, err := newParser(&cli).Parse(test.args); err != nil {
+			t.Fatalf("%v: %s", test.args, err)
+		}
+		allowed, errs := parseSrcPorts(cli.SrcPort)
+		if len(errs) != len(test.errs) {
+			t.Fatalf("%v: expected %d errors, got %v", test.args, len(test.errs), errs)
+		}
+		for i, err := range errs {
+			if !strings.Contains(err.Error(), test.errs[i]) {
+				t.Errorf("%v: error %d: expected %q, got %q", test.args, i, test.errs[i], err)
+			}
+		}
+
+		p := Policy{srcPorts: allowed}
+		for _, port := range test.allowed {
+			_, d := testPacket(t, "10.0.0.5", "10.0.0.255", port, 9003, []byte("hello"))
+			if forward, reason := p.Decide(PacketInfo{decoded: d}); !forward {
+				t.Errorf("%v: packet from port %d dropped as %s", test.args, port, reason)
+			}
+		}
+		for _, port := range test.denied {
+			_, d := testPacket(t, "10.0.0.5", "10.0.0.255", port, 9003, []byte("hello"))
+			if forward, reason := p.Decide(PacketInfo{decoded: d}); forward || reason != DropSrcPort {
+				t.Errorf("%v: packet from port %d: %v %s", test.args, port, forward, reason)
+			}
+		}
+	}
+
+	// kong rejects ports which aren't a uint16
+	for _, arg := range []string{"--src-port=65536", "--src-port=-1", "--src-port=dhcp"} {
+		cli := CLI{}
+		if _, err := newParser(&cli).Parse([]string{arg}); err == nil {
+			t.Errorf("%s: parsed %v", arg, cli.SrcPort)
+		}
+	}
+}
+
+func TestPolicyDecideChecksum(t *testing.T) {
+	_, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 9003, []byte("hello"))
+	p := Policy{verifyCsum: true}
+	if forward, reason := p.Decide(PacketInfo{decoded: d}); !forward || reason != DropNone {
+		t.Errorf("valid checksum: %v %s", forward, reason)
+	}
+	// corrupt the last byte of the payload
+	d.ip4.Payload[len(d.ip4.Payload)-1] ^= 0xff
+	if forward, reason := p.Decide(PacketInfo{decoded: d}); forward || reason != DropChecksum {
+		t.Errorf("invalid checksum: %v %s", forward, reason)
+	}
+}
+
+func TestPolicyDecideRepeats(t *testing.T) {
+	p := Policy{repeats: newRepeatFilter(10 * time.Second)}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	decide := func(src string, dstPort uint16, payload string, ts time.Time) DropReason {
+		_, d := testPacket(t, src, "10.0.0.255", 5000, dstPort, []byte(payload))
+		_, reason := p.Decide(PacketInfo{decoded: d, size: 100, ts: ts})
+		return reason
+	}
+
+	tests := []struct {
+		name    string
+		src     string
+		dstPort uint16
+		payload string
+		ts      time.Time
+		reason  DropReason
+	}{
+		{"first", "10.0.0.5", 1900, "hello", now, DropNone},
+		{"repeat", "10.0.0.5", 1900, "hello", now.Add(time.Second), DropRepeat},
+		{"other source", "10.0.0.6", 1900, "hello", now.Add(time.Second), DropNone},
+		{"other service", "10.0.0.5", 5353, "hello", now.Add(time.Second), DropNone},
+		{"changed", "10.0.0.5", 1900, "world", now.Add(2 * time.Second), DropNone},
+		{"changed back", "10.0.0.5", 1900, "hello", now.Add(3 * time.Second), DropNone},
+		{"refreshed", "10.0.0.5", 1900, "hello", now.Add(13 * time.Second), DropNone},
+	}
+	for _, test := range tests {
+		if reason := decide(test.src, test.dstPort, test.payload, test.ts); reason != test.reason {
+			t.Errorf("%s: expected %s, got %s", test.name, test.reason, reason)
+		}
+	}
+}
+
+// A packet dropped by a later rule must not count as forwarded for
+// --suppress-repeats, or its retransmission would be dropped as a repeat
+func TestPolicyDecideRepeatsRateLimited(t *testing.T) {
+	p := Policy{repeats: newRepeatFilter(10 * time.Second), byteLimit: newByteLimiter(150)}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	_, first := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+	_, second := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("world"))
+
+	if _, reason := p.Decide(PacketInfo{decoded: first, size: 100, ts: now}); reason != DropNone {
+		t.Fatalf("first: %s", reason)
+	}
+	if _, reason := p.Decide(PacketInfo{decoded: second, size: 100, ts: now}); reason != DropRateLimit {
+		t.Fatalf("second: %s", reason)
+	}
+	// the bucket has refilled and we never forwarded the second payload
+	if _, reason := p.Decide(PacketInfo{decoded: second, size: 100, ts: now.Add(time.Second)}); reason != DropNone {
+		t.Errorf("retransmitted: %s", reason)
+	}
+	if _, reason := p.Decide(PacketInfo{decoded: second, size: 100, ts: now.Add(2 * time.Second)}); reason != DropRepeat {
+		t.Errorf("repeat: %s", reason)
+	}
+}
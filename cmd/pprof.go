@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pprofAddr returns the address to serve --pprof-addr on.  We only listen
+// on localhost unless a host is given.
+func pprofAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if len(host) == 0 {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// startPprofServer serves the net/http/pprof profiles on addr
+func startPprofServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: STATUS_READ_TIMEOUT,
+	}
+	go func() {
+		log.Infof("Serving pprof on http://%s/debug/pprof/", addr)
+		if err := server.ListenAndServe(); err != nil {
+			log.WithError(err).Fatalf("Unable to serve --pprof-addr %s", addr)
+		}
+	}()
+}
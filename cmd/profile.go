@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Profile is a named set of rewrites for the packets we send out each
+// interface which uses it via --interface-profile
+type Profile struct {
+	name       string
+	masquerade string            // "on" or "off" to override --nat-port-range, "" to keep it
+	scopeTTLs  scopeTTLs         // TTL of packets sent to each multicast scope
+	checksum   string            // how we set the UDP checksum, "" to keep ours
+	portMap    map[uint16]uint16 // rewrite these UDP destination ports
+	broadcast  net.IP            // send to this broadcast address instead of ours
+}
+
+// parseProfile parses a --profile of <name>@<key>=<value>[,<key>=<value>...]
+func parseProfile(value string) (*Profile, error) {
+	name, settings, err := splitInterfaceArg(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not in the format of <name>@<key>=<value>[,<key>=<value>...]", value)
+	}
+	p := &Profile{
+		name:      name,
+		scopeTTLs: scopeTTLs{},
+		portMap:   map[uint16]uint16{},
+	}
+	seen := map[string]bool{}
+	for _, setting := range strings.Split(settings, ",") {
+		split := strings.SplitN(setting, "=", 2)
+		if len(split) != 2 || split[1] == "" {
+			return nil, fmt.Errorf("%s is not in the format of <key>=<value>", setting)
+		}
+		key, val := split[0], split[1]
+		// only ttl & port may be repeated
+		if seen[key] && key != "ttl" && key != "port" {
+			return nil, fmt.Errorf("%s may only be set once", key)
+		}
+		seen[key] = true
+		switch key {
+		case "masquerade":
+			if val != "on" && val != "off" {
+				return nil, fmt.Errorf("masquerade=%s must be on or off", val)
+			}
+			p.masquerade = val
+		case "ttl":
+			// <scope>/<ttl> since @ separates the name of our profile
+			ttls, err := parseScopeTTLs([]string{strings.Replace(val, "/", "@", 1)})
+			if err != nil {
+				return nil, fmt.Errorf("ttl=%s: %s", val, err)
+			}
+			for scope, ttl := range ttls {
+				if _, ok := p.scopeTTLs[scope]; ok {
+					return nil, fmt.Errorf("ttl=%s: the TTL of %s is already set", val, scope)
+				}
+				p.scopeTTLs[scope] = ttl
+			}
+		case "checksum":
+			switch val {
+			case CSUM_COMPUTE, CSUM_ZERO, CSUM_PRESERVE:
+			default:
+				return nil, fmt.Errorf("checksum=%s is not a valid mode [compute|zero|preserve]", val)
+			}
+			p.checksum = val
+		case "port":
+			from, to, err := parsePortMap(val)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.portMap[from]; ok {
+				return nil, fmt.Errorf("port=%s: port %d is already mapped", val, from)
+			}
+			p.portMap[from] = to
+		case "broadcast":
+			ip := net.ParseIP(val)
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("broadcast=%s is not a valid IPv4 address", val)
+			}
+			p.broadcast = ip.To4()
+		default:
+			return nil, fmt.Errorf("%s is not a valid key [masquerade|ttl|checksum|port|broadcast]", key)
+		}
+	}
+
+	// the received checksum would be for the port we rewrote
+	if p.checksum == CSUM_PRESERVE && len(p.portMap) > 0 {
+		return nil, fmt.Errorf("checksum=preserve can not be used with port")
+	}
+	return p, nil
+}
+
+// parsePortMap parses a port=<from>:<to> of a --profile
+func parsePortMap(value string) (uint16, uint16, error) {
+	split := strings.SplitN(value, ":", 2)
+	if len(split) != 2 {
+		return 0, 0, fmt.Errorf("port=%s is not in the format of <from>:<to>", value)
+	}
+	from, err := strconv.ParseUint(split[0], 10, 16)
+	if err != nil || from == 0 {
+		return 0, 0, fmt.Errorf("port=%s is not a valid UDP port", value)
+	}
+	to, err := strconv.ParseUint(split[1], 10, 16)
+	if err != nil || to == 0 {
+		return 0, 0, fmt.Errorf("port=%s is not a valid UDP port", value)
+	}
+	return uint16(from), uint16(to), nil
+}
+
+// Apply changes how r rewrites the packets it sends.  Settings we don't have
+// keep the value of their flag, except our TTLs override only their scope.
+// The broadcast address is applied via --remote-broadcast by the caller.
+// masquerade=off keeps the nat table so replies to the requests other
+// interfaces forwarded are still translated.
+func (p *Profile) Apply(r *Rewrite, nat *natTable) error {
+	switch p.masquerade {
+	case "on":
+		if nat == nil {
+			return fmt.Errorf("profile %s: masquerade=on requires --nat-port-range", p.name)
+		}
+		r.nat = nat
+		r.masquerade = true
+	case "off":
+		r.masquerade = false
+	}
+	if len(p.scopeTTLs) > 0 {
+		ttls := scopeTTLs{}
+		for scope, ttl := range r.scopeTTLs {
+			ttls[scope] = ttl
+		}
+		for scope, ttl := range p.scopeTTLs {
+			ttls[scope] = ttl
+		}
+		r.scopeTTLs = ttls
+	}
+	if len(p.checksum) > 0 {
+		r.checksums.mode = p.checksum
+	}
+	if len(p.portMap) > 0 {
+		r.portMap = p.portMap
+	}
+	if len(r.portMap) > 0 && r.checksums.Preserves() {
+		return fmt.Errorf("profile %s: port can not be used with --checksum-policy preserve", p.name)
+	}
+	r.profile = p.name
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func TestParseProfile(t *testing.T) {
+	p, err := parseProfile("lab@masquerade=off,ttl=site/8,ttl=link/1,checksum=zero,port=9003:9004,port=1900:1901,broadcast=10.1.2.255")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.name != "lab" || p.masquerade != "off" || p.checksum != CSUM_ZERO || !p.broadcast.Equal(net.ParseIP("10.1.2.255")) {
+		t.Errorf("parsed %+v", p)
+	}
+	if len(p.scopeTTLs) != 2 || p.scopeTTLs[SCOPE_SITE] != 8 || p.scopeTTLs[SCOPE_LINK] != 1 {
+		t.Errorf("TTLs are %v", p.scopeTTLs)
+	}
+	if len(p.portMap) != 2 || p.portMap[9003] != 9004 || p.portMap[1900] != 1901 {
+		t.Errorf("port map is %v", p.portMap)
+	}
+
+	tests := []struct {
+		value string
+		err   string
+	}{
+		{"lab", "is not in the format of <name>@"},
+		{"lab@ttl", "ttl is not in the format of <key>=<value>"},
+		{"lab@ttl=", "ttl= is not in the format of <key>=<value>"},
+		{"lab@masquerade=yes", "masquerade=yes must be on or off"},
+		{"lab@ttl=galaxy/8", "ttl=galaxy/8: galaxy is not a valid scope"},
+		{"lab@checksum=never", "checksum=never is not a valid mode"},
+		{"lab@port=9003", "port=9003 is not in the format of <from>:<to>"},
+		{"lab@port=0:9004", "port=0:9004 is not a valid UDP port"},
+		{"lab@port=9003:70000", "port=9003:70000 is not a valid UDP port"},
+		{"lab@broadcast=fe80::1", "broadcast=fe80::1 is not a valid IPv4 address"},
+		{"lab@vlan=10", "vlan is not a valid key"},
+		{"lab@masquerade=on,masquerade=off", "masquerade may only be set once"},
+		{"lab@checksum=zero,checksum=zero", "checksum may only be set once"},
+		{"lab@broadcast=10.1.2.255,broadcast=10.1.3.255", "broadcast may only be set once"},
+		{"lab@ttl=site/8,ttl=site/16", "the TTL of site is already set"},
+		{"lab@port=9003:9004,port=9003:9005", "port 9003 is already mapped"},
+		{"lab@checksum=preserve,port=9003:9004", "checksum=preserve can not be used with port"},
+		{"lab@port=9003:9004,checksum=preserve", "checksum=preserve can not be used with port"},
+	}
+	for _, test := range tests {
+		_, err := parseProfile(test.value)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected %q, got %v", test.value, test.err, err)
+		}
+	}
+}
+
+func TestProfileApply(t *testing.T) {
+	nat := newNatTable(&srcPortRange{min: 40000, max: 40009}, 0)
+	base := func() Rewrite {
+		return Rewrite{
+			checksums:  checksumPolicy{mode: CSUM_COMPUTE},
+			scopeTTLs:  scopeTTLs{SCOPE_SITE: 4, SCOPE_ORG: 16},
+			nat:        nat,
+			masquerade: true,
+		}
+	}
+	parse := func(value string) *Profile {
+		p, err := parseProfile(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// settings we don't have keep their value
+	r := base()
+	if err := parse("lab@ttl=site/8,port=9003:9004").Apply(&r, nat); err != nil {
+		t.Fatal(err)
+	}
+	if r.checksums.mode != CSUM_COMPUTE || r.nat != nat || !r.masquerade || r.profile != "lab" {
+		t.Errorf("applied %+v", r)
+	}
+	if len(r.scopeTTLs) != 2 || r.scopeTTLs[SCOPE_SITE] != 8 || r.scopeTTLs[SCOPE_ORG] != 16 {
+		t.Errorf("TTLs are %v", r.scopeTTLs)
+	}
+	if r.portMap[9003] != 9004 {
+		t.Errorf("port map is %v", r.portMap)
+	}
+
+	// masquerade=off still translates replies
+	r = base()
+	if err := parse("lab@masquerade=off,checksum=zero").Apply(&r, nat); err != nil {
+		t.Fatal(err)
+	}
+	if r.nat != nat || r.masquerade || r.checksums.mode != CSUM_ZERO {
+		t.Errorf("applied %+v", r)
+	}
+
+	r = Rewrite{}
+	if err := parse("lab@masquerade=on").Apply(&r, nat); err != nil || r.nat != nat || !r.masquerade {
+		t.Errorf("applied %+v: %v", r, err)
+	}
+	r = Rewrite{}
+	if err := parse("lab@masquerade=on").Apply(&r, nil); err == nil ||
+		!strings.Contains(err.Error(), "masquerade=on requires --nat-port-range") {
+		t.Errorf("expected an error without a --nat-port-range, got %v", err)
+	}
+
+	// our port map conflicts with preserving the checksum of --checksum-policy
+	for _, checksums := range []checksumPolicy{
+		{mode: CSUM_PRESERVE},
+		{mode: CSUM_COMPUTE, dsts: map[string]string{"10.0.0.5": CSUM_PRESERVE}},
+	} {
+		r = base()
+		r.checksums = checksums
+		if err := parse("lab@port=9003:9004").Apply(&r, nat); err == nil ||
+			!strings.Contains(err.Error(), "port can not be used with --checksum-policy preserve") {
+			t.Errorf("%+v: expected an error, got %v", checksums, err)
+		}
+	}
+	r = base()
+	r.checksums = checksumPolicy{mode: CSUM_PRESERVE}
+	if err := parse("lab@checksum=compute,port=9003:9004").Apply(&r, nat); err != nil {
+		t.Errorf("our checksum mode replaces preserve: %v", err)
+	}
+}
+
+// Packets sent out an interface with masquerade=off keep their source port
+// while the replies we translate are still sent from the port they came from
+func TestMasqueradeOff(t *testing.T) {
+	Interfaces["masq0"] = pcap.Interface{Name: "masq0",
+		Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("192.168.1.1"), Netmask: net.CIDRMask(24, 32)}}}
+	defer delete(Interfaces, "masq0")
+	nat := newNatTable(&srcPortRange{min: 40000, max: 40009}, 0)
+	dstip := net.ParseIP("192.168.1.255").To4()
+	_, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("request"))
+
+	srcPort := func(l *Listen, sndpkt Send) layers.UDPPort {
+		built, err := l.buildPacket(gopacket.NewSerializeBuffer(), sndpkt, dstip, d.payload, d.ip4.Length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent, err := decodePacket(built.data, layers.LinkTypeRaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sent.udp.SrcPort
+	}
+
+	l := Listen{iname: "masq0", label: "masq0", linkType: layers.LinkTypeRaw, ports: []int32{1900},
+		rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}, nat: nat, masquerade: true}}
+	if port := srcPort(&l, Send{srcif: "eth0", decoded: d}); !nat.InRange(uint16(port)) {
+		t.Errorf("masqueraded request sent from port %d", port)
+	}
+
+	if err := (&Profile{name: "lab", masquerade: "off"}).Apply(&l.rewrite, nat); err != nil {
+		t.Fatal(err)
+	}
+	if port := srcPort(&l, Send{srcif: "eth1", decoded: d}); port != 5000 {
+		t.Errorf("request sent from port %d", port)
+	}
+	if port := srcPort(&l, Send{srcif: "eth1", decoded: d, dstip: net.ParseIP("10.0.0.5").To4()}); port != 5000 {
+		t.Errorf("reply sent from port %d", port)
+	}
+	if filter := l.bpfFilter(layers.LinkTypeRaw); !strings.Contains(filter, "udp dst portrange 40000-40009") {
+		t.Errorf("replies to our relay ports are no longer captured: %s", filter)
+	}
+}
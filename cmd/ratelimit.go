@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often a rate limited log message may be logged
+const RATE_LIMIT_INTERVAL = 30 * time.Second
+
+// rateLimitedLog logs a message at most once per interval for each key and
+// reports how many similar messages were suppressed in between
+type rateLimitedLog struct {
+	lock       sync.Mutex
+	interval   time.Duration
+	last       map[string]time.Time // last time we logged each key
+	suppressed map[string]uint64    // messages suppressed since then
+}
+
+// rateLog is shared by all of our interfaces
+var rateLog = newRateLimitedLog(RATE_LIMIT_INTERVAL)
+
+func newRateLimitedLog(interval time.Duration) *rateLimitedLog {
+	return &rateLimitedLog{
+		interval:   interval,
+		last:       map[string]time.Time{},
+		suppressed: map[string]uint64{},
+	}
+}
+
+// Logf logs the message at the given level unless we've already logged a
+// message with the same key within our interval
+func (r *rateLimitedLog) Logf(level log.Level, key string, format string, args ...interface{}) {
+	if !log.IsLevelEnabled(level) {
+		return
+	}
+
+	r.lock.Lock()
+	now := time.Now()
+	if last, ok := r.last[key]; ok && now.Sub(last) < r.interval {
+		r.suppressed[key]++
+		r.lock.Unlock()
+		return
+	}
+	suppressed := r.suppressed[key]
+	r.last[key] = now
+	r.suppressed[key] = 0
+	r.lock.Unlock()
+
+	msg := fmt.Sprintf(format, args...)
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s (suppressed %d similar messages)", msg, suppressed)
+	}
+	log.StandardLogger().Log(level, msg)
+}
+
+// Warnf is a rate limited log.Warnf
+func (r *rateLimitedLog) Warnf(key string, format string, args ...interface{}) {
+	r.Logf(log.WarnLevel, key, format, args...)
+}
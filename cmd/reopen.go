@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+)
+
+// capturePackets returns the channel of packets captured by our pcap handle
+func (l *Listen) capturePackets() chan gopacket.Packet {
+	packetSource := gopacket.NewPacketSource(l.handle, l.handle.LinkType())
+	// we decode what we need ourselves in decodePacket()
+	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	return packetSource.Packets()
+}
+
+// reopenHandle replaces our pcap handle with a new one for --reopen-interval
+// to recover from NIC drivers which silently stop delivering packets to
+// libpcap.  Returns the channel of packets captured by the new handle.  Must
+// only be called by handlePackets since it is the only reader of our handle.
+func (l *Listen) reopenHandle() (chan gopacket.Packet, error) {
+	var handle *pcap.Handle
+	err := inNetns(l.netns, func() error {
+		var err error
+		handle, err = l.openCapture()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the delay & retry goroutines may be sending via our handle
+	l.lock.Lock()
+	old := l.handle
+	l.handle = handle
+	err = handle.SetBPFFilter(l.bpfFilter(handle.LinkType()))
+	if err != nil {
+		l.handle = old
+	}
+	l.lock.Unlock()
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	l.checkLinkType()
+
+	// closing the old handle also stops the goroutine reading its packets
+	old.Close()
+	log.Infof("%s: reopened pcap handle after --reopen-interval", l.label)
+	return l.capturePackets(), nil
+}
+
+// scheduledReopen calls reopen once our --reopen-interval has passed and we
+// have nothing queued to send, so we don't delay any packets.  Returns the
+// channel of packets to read and when we next reopen the handle.
+func (l *Listen) scheduledReopen(packets chan gopacket.Packet, depth int, now, reopenAt time.Time,
+	reopen func() (chan gopacket.Packet, error)) (chan gopacket.Packet, time.Time) {
+	if l.capture.reopenEvery <= 0 || depth > 0 || !now.After(reopenAt) {
+		return packets, reopenAt
+	}
+	p, err := reopen()
+	if err != nil {
+		rateLog.Warnf("reopen:"+l.iname, "%s: Unable to reopen pcap handle: %s", l.label, err)
+		return packets, now.Add(l.capture.reopenEvery)
+	}
+	// let the reader of the old handle exit
+	go func(old chan gopacket.Packet) {
+		for range old {
+		}
+	}(packets)
+	return p, now.Add(l.capture.reopenEvery)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	log "github.com/sirupsen/logrus"
+)
+
+// A scheduled reopen only happens once the interval has passed and our queues
+// are empty, and replaces the packets we read without blocking the old reader
+func TestScheduledReopen(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		every    time.Duration
+		depth    int
+		elapsed  time.Duration
+		err      error
+		reopened bool
+		next     time.Duration // when we next reopen after start
+		warning  string
+	}{
+		{"disabled", 0, 0, 24 * time.Hour, nil, false, time.Hour, ""},
+		{"too soon", time.Hour, 0, 30 * time.Minute, nil, false, time.Hour, ""},
+		{"packets queued", time.Hour, 3, 2 * time.Hour, nil, false, time.Hour, ""},
+		{"reopen", time.Hour, 0, 2 * time.Hour, nil, true, 3 * time.Hour, ""},
+		{"reopen failed", time.Hour, 0, 2 * time.Hour, errors.New("No such device exists"), true, 3 * time.Hour,
+			"reopen0: Unable to reopen pcap handle: No such device exists"},
+	}
+	for _, test := range tests {
+		buf := bytes.Buffer{}
+		log.SetOutput(&buf)
+		l := Listen{iname: "reopen0", label: "reopen0", capture: Capture{reopenEvery: test.every}}
+		rateLog = newRateLimitedLog(RATE_LIMIT_INTERVAL)
+		old := make(chan gopacket.Packet)
+		replaced := make(chan gopacket.Packet)
+		called := false
+		reopen := func() (chan gopacket.Packet, error) {
+			called = true
+			if test.err != nil {
+				return nil, test.err
+			}
+			return replaced, nil
+		}
+
+		packets, reopenAt := l.scheduledReopen(old, test.depth, start.Add(test.elapsed), start.Add(time.Hour), reopen)
+		log.SetOutput(os.Stderr)
+		if called != test.reopened {
+			t.Errorf("%s: reopened %v", test.name, called)
+		}
+		if expected := start.Add(test.next); !reopenAt.Equal(expected) {
+			t.Errorf("%s: next reopen at %s, expected %s", test.name, reopenAt, expected)
+		}
+		if test.reopened && test.err == nil {
+			if packets != replaced {
+				t.Errorf("%s: still reading the old handle", test.name)
+			}
+			// the goroutine reading the old handle must not block on the packets it still has
+			select {
+			case old <- nil:
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s: packets of the old handle aren't drained", test.name)
+			}
+			close(old)
+		} else if packets != old {
+			t.Errorf("%s: replaced the handle", test.name)
+		}
+		if len(test.warning) > 0 && !strings.Contains(buf.String(), test.warning) {
+			t.Errorf("%s: logged %s", test.name, buf.String())
+		}
+	}
+}
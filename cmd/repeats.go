@@ -0,0 +1,66 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// repeatEntry is the last payload we forwarded from a source
+type repeatEntry struct {
+	hash uint64
+	sent time.Time
+}
+
+// repeatFilter suppresses packets from a source which have the same payload
+// as the last packet we forwarded from it, until the refresh interval passes.
+// A source is the IP of the sender and the destination port, aka the
+// service, it sends to: clients send from ephemeral source ports and a host
+// sends unrelated payloads to each service.
+type repeatFilter struct {
+	lock    sync.Mutex
+	refresh time.Duration
+	last    map[string]repeatEntry // by source IP & destination port
+}
+
+func newRepeatFilter(refresh time.Duration) *repeatFilter {
+	return &repeatFilter{
+		refresh: refresh,
+		last:    map[string]repeatEntry{},
+	}
+}
+
+// Repeat returns true if the payload should be suppressed because it is
+// the same as the last one we forwarded from the source.  Otherwise it
+// returns the hash of the payload to pass to Record if we forward it.
+func (r *repeatFilter) Repeat(source string, payload []byte, now time.Time) (bool, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write(payload)
+	hash := h.Sum64()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if last, ok := r.last[source]; ok && last.hash == hash && now.Sub(last.sent) < r.refresh {
+		return true, hash
+	}
+	return false, hash
+}
+
+// Record remembers the hash of the payload we forwarded from the source
+func (r *repeatFilter) Record(source string, hash uint64, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.last[source] = repeatEntry{hash: hash, sent: now}
+}
+
+// Expire forgets any sources we haven't forwarded a packet for since
+// the refresh interval
+func (r *repeatFilter) Expire(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for source, last := range r.last {
+		if now.Sub(last.sent) >= r.refresh {
+			delete(r.last, source)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRepeatFilter(t *testing.T) {
+	r := newRepeatFilter(10 * time.Second)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		source  string
+		payload string
+		at      time.Duration // since now
+		record  bool          // forward the packet if it isn't a repeat
+		repeat  bool
+	}{
+		{"first", "10.0.0.5:1900", "hello", 0, true, false},
+		{"repeat", "10.0.0.5:1900", "hello", time.Second, true, true},
+		{"other source", "10.0.0.6:1900", "hello", time.Second, true, false},
+		{"not forwarded", "10.0.0.5:1900", "world", 2 * time.Second, false, false},
+		{"still the same", "10.0.0.5:1900", "hello", 3 * time.Second, true, true},
+		{"changed", "10.0.0.5:1900", "world", 4 * time.Second, true, false},
+		{"changed again", "10.0.0.5:1900", "world", 5 * time.Second, true, true},
+		{"refreshed", "10.0.0.5:1900", "world", 14 * time.Second, true, false},
+		{"empty", "10.0.0.7:1900", "", 14 * time.Second, true, false},
+		{"empty repeat", "10.0.0.7:1900", "", 15 * time.Second, true, true},
+	}
+	for _, test := range tests {
+		ts := now.Add(test.at)
+		repeat, hash := r.Repeat(test.source, []byte(test.payload), ts)
+		if repeat != test.repeat {
+			t.Errorf("%s: repeat is %v", test.name, repeat)
+		}
+		if !repeat && test.record {
+			r.Record(test.source, hash, ts)
+		}
+	}
+
+	// "changed" was forwarded 4s in.  "refreshed" 14s in.
+	r.Expire(now.Add(20 * time.Second))
+	if _, ok := r.last["10.0.0.6:1900"]; ok || len(r.last) != 2 {
+		t.Errorf("sources after Expire: %v", r.last)
+	}
+	r.Expire(now.Add(24 * time.Second))
+	if len(r.last) != 0 {
+		t.Errorf("sources after Expire: %v", r.last)
+	}
+}
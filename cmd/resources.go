@@ -0,0 +1,68 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// stdin/out/err + logfile
+const BASE_FDS = 4
+
+// Resources is an estimate of what our Listeners will allocate
+type Resources struct {
+	Fds        int // file descriptors
+	Goroutines int
+	Channels   int
+}
+
+// resources estimates the file descriptors, goroutines and channels used
+// by this Listen based on how it is configured
+func (l *Listen) resources(pcapFiles bool, listen bool) Resources {
+	r := Resources{
+		Fds:        1, // pcap handle
+		Goroutines: 1, // handlePackets
+		Channels:   2, // sendpkt & prioritypkt
+	}
+	if len(l.egressName) > 0 {
+		r.Fds++
+	}
+	if pcapFiles {
+		r.Fds += 3 // in, out & inout
+	}
+	if l.delay != nil {
+		r.Goroutines++
+		r.Channels++
+	}
+	if listen {
+		if addrs, err := l.sinkAddresses(); err == nil {
+			// one socket & goroutine per address/port
+			r.Fds += len(addrs) * len(l.sinkPorts())
+			r.Goroutines += len(addrs) * len(l.sinkPorts())
+		}
+	}
+	return r
+}
+
+// checkResources logs what our listeners will allocate and exits if we
+// would exceed the open file limit
+func checkResources(listeners []Listen, pcapFiles bool, listen bool) {
+	total := Resources{Fds: BASE_FDS}
+	for i := range listeners {
+		r := listeners[i].resources(pcapFiles, listen)
+		total.Fds += r.Fds
+		total.Goroutines += r.Goroutines
+		total.Channels += r.Channels
+	}
+	log.Infof("%d interfaces will use about %d file descriptors, %d goroutines and %d channels",
+		len(listeners), total.Fds, total.Goroutines, total.Channels)
+
+	limit, ok := fdLimit()
+	if !ok {
+		return
+	}
+	if uint64(total.Fds) > limit {
+		log.Fatalf("Need about %d file descriptors, but the limit is %d.  Raise it via `ulimit -n`",
+			total.Fds, limit)
+	} else if uint64(total.Fds) > limit*8/10 {
+		log.Warnf("Need about %d file descriptors, which is close to the limit of %d", total.Fds, limit)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	SEND_RETRY_BACKOFF = 1 * time.Millisecond // doubles after each retry
+	MAX_SEND_RETRIES   = 5
+	RETRY_BUFFER_SIZE  = 100 // packets waiting to be retried on each interface
+)
+
+// errnos of sends which may succeed if we retry them
+var transientSendErrors = []syscall.Errno{
+	syscall.ENOBUFS, // send buffer is full
+	syscall.EAGAIN,
+	syscall.EINTR,
+}
+
+// errRetrying is returned by writePacket when retrySends will retry the packet
+var errRetrying = errors.New("retrying send")
+
+// retrySend is a packet which failed to send with a transient error
+type retrySend struct {
+	data   []byte          // our copy of the packet we tried to send
+	srcif  string          // interface it came in on
+	packet gopacket.Packet // packet we received, for logging drops
+}
+
+// isTransientSendError returns true if retrying the send may succeed.
+// libpcap only gives us the strerror() text of the errno, so also match
+// the text of each errno.
+func isTransientSendError(err error) bool {
+	for _, errno := range transientSendErrors {
+		if errors.Is(err, errno) || strings.Contains(err.Error(), errno.Error()) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendData sends the packet out our send handle, which the delay & retry
+// goroutines share with handlePackets
+func (l *Listen) sendData(data []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.sendHandle().WritePacketData(data)
+}
+
+// writePacket sends the packet.  If the error is transient and we have
+// --send-retries, the packet is queued for retrySends and we return
+// errRetrying so we never wait in handlePackets.
+func (l *Listen) writePacket(sndpkt Send, data []byte) error {
+	err := l.sendData(data)
+	if err == nil || l.retries == nil || !isTransientSendError(err) {
+		return err
+	}
+
+	// our caller reuses data once we return
+	retry := retrySend{data: make([]byte, len(data)), srcif: sndpkt.srcif, packet: sndpkt.packet}
+	copy(retry.data, data)
+	select {
+	case l.retries <- retry:
+		return errRetrying
+	default:
+		return dropError{DropQueueFull, fmt.Errorf("retry queue is full: %s", err)}
+	}
+}
+
+// retrySends retries each packet in our retry queue up to sendRetries times
+// with a short backoff.  Packets which still fail are dropped.  Returns once
+// done is closed.
+func (l *Listen) retrySends(done <-chan struct{}) {
+	for {
+		var retry retrySend
+		select {
+		case <-done:
+			return
+		case retry = <-l.retries:
+		}
+
+		backoff := SEND_RETRY_BACKOFF
+		reason := DropRetryFailed
+		var err error
+		for i := 0; i < l.sendRetries; i++ {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			backoff *= 2
+			if err = l.sendData(retry.data); err == nil {
+				break
+			} else if !isTransientSendError(err) {
+				reason = DropSendError
+				break
+			}
+		}
+		if err == nil {
+			atomic.AddUint64(&l.stats.SentBytes, uint64(len(retry.data)))
+			continue
+		}
+		rateLog.Warnf("send:"+l.iname, "Unable to send %d bytes from %s out %s after %d retries: %s",
+			len(retry.data), interfaceLabel(retry.srcif), l.label, l.sendRetries, err)
+		l.drop(reason, retry.packet)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestIsTransientSendError(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{syscall.ENOBUFS, true},
+		{syscall.EAGAIN, true},
+		{syscall.EINTR, true},
+		{fmt.Errorf("send: %w", syscall.ENOBUFS), true},
+		// libpcap only gives us the strerror() text
+		{fmt.Errorf("send: %s", syscall.ENOBUFS.Error()), true},
+		{fmt.Errorf("send: %s", syscall.EAGAIN.Error()), true},
+		{syscall.ENETDOWN, false},
+		{errors.New("send: Message too long"), false},
+	}
+	for _, test := range tests {
+		if got := isTransientSendError(test.err); got != test.transient {
+			t.Errorf("isTransientSendError(%q) = %v, expected %v", test.err, got, test.transient)
+		}
+	}
+}
+
+func TestRetrySendsStops(t *testing.T) {
+	l := Listen{retries: make(chan retrySend, RETRY_BUFFER_SIZE), sendRetries: MAX_SEND_RETRIES}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		l.retrySends(done)
+		close(exited)
+	}()
+	close(done)
+	<-exited
+}
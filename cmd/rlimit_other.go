@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// fdLimit is only supported on Linux
+func fdLimit() (uint64, bool) {
+	return 0, false
+}
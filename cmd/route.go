@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// srcRoute sends packets from a source network out a single interface
+type srcRoute struct {
+	network *net.IPNet
+	iface   string
+}
+
+// parseSrcRoute parses a --src-route of <interface>@<cidr>
+func parseSrcRoute(route string) (srcRoute, error) {
+	iface, value, err := splitInterfaceArg(route)
+	if err != nil {
+		return srcRoute{}, err
+	}
+	cidr := value
+	if !strings.Contains(cidr, "/") {
+		cidr += "/32"
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil || ipNet.IP.To4() == nil {
+		return srcRoute{}, fmt.Errorf("%s is not a valid IPv4 address or CIDR", value)
+	}
+	return srcRoute{network: ipNet, iface: iface}, nil
+}
+
+// routeBySource returns the egress interface of the most specific --src-route
+// matching the source IP and false if there is no match
+func routeBySource(routes []srcRoute, srcip net.IP) (string, bool) {
+	best := -1
+	iface := ""
+	for _, r := range routes {
+		if !r.network.Contains(srcip) {
+			continue
+		}
+		if ones, _ := r.network.Mask.Size(); ones > best {
+			best = ones
+			iface = r.iface
+		}
+	}
+	return iface, best >= 0
+}
+
+// portRoutes sends packets to a UDP port out only certain interfaces
+type portRoutes struct {
+	routes   map[uint16]map[string]bool // --port-route interfaces of each port
+	fallback map[string]bool            // interfaces for other ports, nil for all of them
+}
+
+func newPortRoutes() portRoutes {
+	return portRoutes{
+		routes: map[uint16]map[string]bool{},
+	}
+}
+
+// parsePortRoute parses a --port-route of <interface>@<port>
+func parsePortRoute(route string) (string, uint16, error) {
+	iface, value, err := splitInterfaceArg(route)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("%s is not a valid UDP port", value)
+	}
+	return iface, uint16(port), nil
+}
+
+// Add sends packets to the port out the interface
+func (p portRoutes) Add(port uint16, iface string) {
+	if p.routes[port] == nil {
+		p.routes[port] = map[string]bool{}
+	}
+	p.routes[port][iface] = true
+}
+
+// Allows returns true if packets to the port may be sent out the interface
+func (p portRoutes) Allows(port uint16, iface string) bool {
+	if ifaces, ok := p.routes[port]; ok {
+		return ifaces[iface]
+	}
+	return p.fallback == nil || p.fallback[iface]
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseSrcRoute(t *testing.T) {
+	tests := []struct {
+		route   string
+		err     string
+		iface   string
+		network string
+	}{
+		{"eth0@10.0.0.0/8", "", "eth0", "10.0.0.0/8"},
+		{"eth0@10.1.2.3/16", "", "eth0", "10.1.0.0/16"},
+		{"eth1@192.168.1.5", "", "eth1", "192.168.1.5/32"},
+		{"eth0", "not in the correct format", "", ""},
+		{"eth0@10.0.0.0/33", "is not a valid IPv4 address or CIDR", "", ""},
+		{"eth0@fe80::/64", "is not a valid IPv4 address or CIDR", "", ""},
+		{"eth0@nope", "nope is not a valid IPv4 address or CIDR", "", ""},
+	}
+	for _, test := range tests {
+		route, err := parseSrcRoute(test.route)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.route, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.route, err)
+		}
+		if route.iface != test.iface || route.network.String() != test.network {
+			t.Errorf("%s: parsed %s@%s", test.route, route.iface, route.network)
+		}
+	}
+}
+
+func TestRouteBySource(t *testing.T) {
+	routes := []srcRoute{}
+	for _, r := range []string{"eth0@10.0.0.0/8", "eth1@10.1.0.0/16", "eth2@10.1.2.3", "eth3@0.0.0.0/0"} {
+		route, err := parseSrcRoute(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, route)
+	}
+
+	tests := []struct {
+		routes []srcRoute
+		src    string
+		iface  string
+		routed bool
+	}{
+		{routes, "10.2.0.1", "eth0", true},
+		{routes, "10.1.0.1", "eth1", true},
+		{routes, "10.1.2.3", "eth2", true},
+		{routes, "192.168.1.1", "eth3", true},
+		{routes[:3], "192.168.1.1", "", false},
+		{nil, "10.0.0.1", "", false},
+	}
+	for _, test := range tests {
+		iface, routed := routeBySource(test.routes, net.ParseIP(test.src))
+		if iface != test.iface || routed != test.routed {
+			t.Errorf("%s: routed %v out %q, expected %v out %q", test.src, routed, iface, test.routed, test.iface)
+		}
+	}
+}
+
+func TestPortRoutes(t *testing.T) {
+	tests := []struct {
+		name     string
+		routes   []string
+		fallback map[string]bool
+		port     uint16
+		iface    string
+		allowed  bool
+	}{
+		{"no routes", nil, nil, 1900, "eth0", true},
+		{"routed", []string{"eth0@1900"}, nil, 1900, "eth0", true},
+		{"routed elsewhere", []string{"eth0@1900"}, nil, 1900, "eth1", false},
+		{"two interfaces", []string{"eth0@1900", "eth1@1900"}, nil, 1900, "eth1", true},
+		{"other port", []string{"eth0@1900"}, nil, 5353, "eth1", true},
+		{"fallback", []string{"eth0@1900"}, map[string]bool{"eth2": true}, 5353, "eth2", true},
+		{"not the fallback", []string{"eth0@1900"}, map[string]bool{"eth2": true}, 5353, "eth1", false},
+		{"routed over fallback", []string{"eth1@5353"}, map[string]bool{"eth2": true}, 5353, "eth1", true},
+	}
+	for _, test := range tests {
+		p := newPortRoutes()
+		p.fallback = test.fallback
+		for _, r := range test.routes {
+			iface, port, err := parsePortRoute(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Add(port, iface)
+		}
+		if allowed := p.Allows(test.port, test.iface); allowed != test.allowed {
+			t.Errorf("%s: port %d out %s allowed %v", test.name, test.port, test.iface, allowed)
+		}
+	}
+
+	for _, route := range []string{"eth0", "eth0@0", "eth0@65536", "eth0@ssdp"} {
+		if _, _, err := parsePortRoute(route); err == nil {
+			t.Errorf("%s should be invalid", route)
+		}
+	}
+}
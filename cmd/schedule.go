@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeWindow is a daily window of time between start and end, measured as
+// the offset from midnight.  Windows where end < start span midnight.
+type timeWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// schedule is a list of possibly overlapping daily windows during which
+// an interface forwards packets
+type schedule struct {
+	windows  []timeWindow
+	location *time.Location
+}
+
+// parses HH:MM into the offset from midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid HH:MM time", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseSchedule parses a comma separated list of HH:MM-HH:MM windows
+func parseSchedule(value string, location *time.Location) (*schedule, error) {
+	s := &schedule{
+		windows:  []timeWindow{},
+		location: location,
+	}
+	for _, w := range strings.Split(value, ",") {
+		split := strings.SplitN(strings.TrimSpace(w), "-", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("%s is not in the format of HH:MM-HH:MM", w)
+		}
+		start, err := parseTimeOfDay(split[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(split[1])
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("%s is an empty window", w)
+		}
+		s.windows = append(s.windows, timeWindow{start: start, end: end})
+	}
+	return s, nil
+}
+
+// Active returns true if now is within any of our windows.  Windows
+// include their start time but not their end time.
+func (s *schedule) Active(now time.Time) bool {
+	now = now.In(s.location)
+	offset := time.Duration(now.Hour())*time.Hour +
+		time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if offset >= w.start && offset < w.end {
+				return true
+			}
+		} else if offset >= w.start || offset < w.end {
+			// spans midnight
+			return true
+		}
+	}
+	return false
+}
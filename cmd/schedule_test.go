@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		value   string
+		err     string
+		windows []timeWindow
+	}{
+		{"08:00-17:00", "", []timeWindow{{8 * time.Hour, 17 * time.Hour}}},
+		{"22:30-06:15", "", []timeWindow{{22*time.Hour + 30*time.Minute, 6*time.Hour + 15*time.Minute}}},
+		{"08:00-12:00, 13:00-17:00", "", []timeWindow{{8 * time.Hour, 12 * time.Hour}, {13 * time.Hour, 17 * time.Hour}}},
+		{"08:00", "is not in the format of HH:MM-HH:MM", nil},
+		{"08:00-25:00", "25:00 is not a valid HH:MM time", nil},
+		{"8am-5pm", "8am is not a valid HH:MM time", nil},
+		{"08:00-08:00", "is an empty window", nil},
+		{"08:00-17:00,", "is not in the format of HH:MM-HH:MM", nil},
+	}
+	for _, test := range tests {
+		s, err := parseSchedule(test.value, time.UTC)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.value, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.value, err)
+		}
+		if len(s.windows) != len(test.windows) {
+			t.Fatalf("%s: parsed %v", test.value, s.windows)
+		}
+		for i := range s.windows {
+			if s.windows[i] != test.windows[i] {
+				t.Errorf("%s: parsed %v", test.value, s.windows)
+			}
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	est := time.FixedZone("EST", -5*60*60)
+	tests := []struct {
+		value    string
+		location *time.Location
+		at       string // UTC
+		active   bool
+	}{
+		{"08:00-17:00", time.UTC, "08:00:00", true},
+		{"08:00-17:00", time.UTC, "12:30:00", true},
+		{"08:00-17:00", time.UTC, "16:59:59", true},
+		{"08:00-17:00", time.UTC, "17:00:00", false},
+		{"08:00-17:00", time.UTC, "07:59:59", false},
+		// spans midnight
+		{"22:00-06:00", time.UTC, "23:00:00", true},
+		{"22:00-06:00", time.UTC, "00:00:00", true},
+		{"22:00-06:00", time.UTC, "05:59:59", true},
+		{"22:00-06:00", time.UTC, "06:00:00", false},
+		{"22:00-06:00", time.UTC, "12:00:00", false},
+		// any window
+		{"08:00-09:00,17:00-18:00", time.UTC, "17:30:00", true},
+		{"08:00-09:00,17:00-18:00", time.UTC, "12:00:00", false},
+		// in our --timezone
+		{"08:00-17:00", est, "12:00:00", false},
+		{"08:00-17:00", est, "13:00:00", true},
+		{"08:00-17:00", est, "21:59:00", true},
+		{"08:00-17:00", est, "22:00:00", false},
+	}
+	for _, test := range tests {
+		s, err := parseSchedule(test.value, test.location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at, err := time.Parse("2006-01-02 15:04:05", "2020-01-01 "+test.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if active := s.Active(at); active != test.active {
+			t.Errorf("%s in %s at %s UTC: active is %v", test.value, test.location, test.at, active)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// IPv4 multicast scopes from RFC 2365 we can set the TTL for
+const (
+	SCOPE_LINK   = "link"   // 224.0.0.0/24 which routers never forward
+	SCOPE_SITE   = "site"   // 239.255.0.0/16 IPv4 local scope
+	SCOPE_ORG    = "org"    // 239.192.0.0/14 organization local scope
+	SCOPE_GLOBAL = "global" // all other multicast groups
+)
+
+var (
+	linkScope = net.IPNet{IP: net.IPv4(224, 0, 0, 0).To4(), Mask: net.CIDRMask(24, 32)}
+	siteScope = net.IPNet{IP: net.IPv4(239, 255, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+	orgScope  = net.IPNet{IP: net.IPv4(239, 192, 0, 0).To4(), Mask: net.CIDRMask(14, 32)}
+)
+
+// multicastScope returns the scope of a multicast group or "" if the IP
+// isn't multicast
+func multicastScope(ip net.IP) string {
+	switch {
+	case !ip.IsMulticast():
+		return ""
+	case linkScope.Contains(ip):
+		return SCOPE_LINK
+	case siteScope.Contains(ip):
+		return SCOPE_SITE
+	case orgScope.Contains(ip):
+		return SCOPE_ORG
+	}
+	return SCOPE_GLOBAL
+}
+
+// scopeTTLs is the TTL we send packets to each multicast scope with
+type scopeTTLs map[string]uint8
+
+// parseScopeTTLs parses a list of --scope-ttl <scope>@<ttl>
+func parseScopeTTLs(values []string) (scopeTTLs, error) {
+	ttls := scopeTTLs{}
+	for _, value := range values {
+		scope, t, err := splitInterfaceArg(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not in the format of <scope>@<ttl>", value)
+		}
+		switch scope {
+		case SCOPE_LINK, SCOPE_SITE, SCOPE_ORG, SCOPE_GLOBAL:
+		default:
+			return nil, fmt.Errorf("%s is not a valid scope [link|site|org|global]", scope)
+		}
+		ttl, err := strconv.ParseUint(t, 10, 8)
+		if err != nil || ttl == 0 {
+			return nil, fmt.Errorf("%s is not a valid TTL between 1 and 255", t)
+		}
+		ttls[scope] = uint8(ttl)
+	}
+	return ttls, nil
+}
+
+// TTL returns the TTL to send a packet to dstip with.  Destinations without a
+// --scope-ttl keep the ttl of the packet we received.
+func (s scopeTTLs) TTL(dstip net.IP, ttl uint8) uint8 {
+	if scopeTTL, ok := s[multicastScope(dstip)]; ok {
+		return scopeTTL
+	}
+	return ttl
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestParseScopeTTLs(t *testing.T) {
+	ttls, err := parseScopeTTLs([]string{"link@1", "site@8", "org@32", "global@255"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ttls) != 4 || ttls[SCOPE_LINK] != 1 || ttls[SCOPE_SITE] != 8 || ttls[SCOPE_ORG] != 32 ||
+		ttls[SCOPE_GLOBAL] != 255 {
+		t.Errorf("parsed %v", ttls)
+	}
+
+	tests := []struct {
+		value string
+		err   string
+	}{
+		{"link", "link is not in the format of <scope>@<ttl>"},
+		{"galaxy@8", "galaxy is not a valid scope"},
+		{"link@0", "0 is not a valid TTL between 1 and 255"},
+		{"link@256", "256 is not a valid TTL between 1 and 255"},
+		{"link@one", "one is not a valid TTL between 1 and 255"},
+	}
+	for _, test := range tests {
+		_, err := parseScopeTTLs([]string{test.value})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected %q, got %v", test.value, test.err, err)
+		}
+	}
+}
+
+// Packets are sent with the TTL of their destination's scope, so link-local
+// groups stay on the link
+func TestScopeTTL(t *testing.T) {
+	ttls, err := parseScopeTTLs([]string{"link@1", "site@8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Listen{iname: "scope0", label: "scope0", linkType: layers.LinkTypeRaw,
+		rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}, scopeTTLs: ttls}}
+	_, d := testPacket(t, "10.0.0.5", "224.0.0.251", 5353, 5353, []byte("query"))
+	d.ip4.TTL = 64
+
+	tests := []struct {
+		dst   string
+		scope string
+		ttl   uint8
+	}{
+		{"224.0.0.251", SCOPE_LINK, 1},
+		{"224.0.0.1", SCOPE_LINK, 1},
+		{"239.255.255.250", SCOPE_SITE, 8},
+		{"239.192.0.1", SCOPE_ORG, 64}, // no --scope-ttl org, so we keep the TTL
+		{"224.0.1.129", SCOPE_GLOBAL, 64},
+		{"10.0.0.255", "", 64},
+	}
+	for _, test := range tests {
+		dstip := net.ParseIP(test.dst).To4()
+		if scope := multicastScope(dstip); scope != test.scope {
+			t.Errorf("%s: scope is %q, expected %q", test.dst, scope, test.scope)
+		}
+		built, err := l.buildPacket(gopacket.NewSerializeBuffer(), Send{srcif: "eth0", decoded: d}, dstip,
+			d.payload, d.ip4.Length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent, err := decodePacket(built.data, layers.LinkTypeRaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent.ip4.TTL != test.ttl {
+			t.Errorf("%s: sent with TTL %d, expected %d", test.dst, sent.ip4.TTL, test.ttl)
+		}
+	}
+}
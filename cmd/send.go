@@ -1,8 +1,10 @@
 package main
 
 import (
-	"strings"
+	"net"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -14,33 +16,147 @@ type Send struct {
 	packet   gopacket.Packet // packet data
 	srcif    string          // interface it came in on
 	linkType layers.LinkType // pcap LinkType of source interface
+	decoded  *Decoded        // decoded layers of the packet
+	ts       time.Time       // when the packet was originally captured
+	dstip    net.IP          // only send to this IP, like a --nat-port-range reply
+	aliases  bool            // send to our IP aliases, see sendAliases
 }
 
 // SendPktFeed is a struct for collecting all channels to send packets
 type SendPktFeed struct {
-	lock    sync.Mutex           // lock
-	senders map[string]chan Send // list of channels to send packets on
+	lock          sync.Mutex                 // lock
+	senders       map[string]chan Send       // list of channels to send packets on
+	priority      map[string]chan Send       // list of channels to send high priority packets on
+	priorityPorts map[uint16]bool            // packets to these UDP ports are high priority
+	stats         map[string]*Stats          // counters of each interface we send to
+	highWatermark int                        // drop normal priority packets when a queue is this deep, 0 when it's full
+	peers         map[string]map[string]bool // --pair'd interfaces only send to their peers
+	overlaps      map[string]map[string]bool // interfaces with overlapping subnets we never forward between
+	srcRoutes     []srcRoute                 // send packets from these networks out a single interface
+	portRoutes    portRoutes                 // send packets to these ports out certain interfaces
+}
+
+// forwardsTo returns true if packets received on srcif are sent out dstif.
+// Interfaces in a --pair only exchange packets with their peers and
+// interfaces with overlapping subnets never do unless --allow-overlap.
+func (s *SendPktFeed) forwardsTo(srcif string, dstif string) bool {
+	if srcif == dstif || s.overlaps[srcif][dstif] {
+		return false
+	}
+	_, srcPaired := s.peers[srcif]
+	_, dstPaired := s.peers[dstif]
+	if srcPaired || dstPaired {
+		return s.peers[srcif][dstif]
+	}
+	return true
 }
 
 // Send is a function to send a packet out all the other interfaces other than srcif
-func (s *SendPktFeed) Send(p gopacket.Packet, srcif string, linkType layers.LinkType) {
+func (s *SendPktFeed) Send(p gopacket.Packet, srcif string, linkType layers.LinkType, d *Decoded) {
+	ts := p.Metadata().Timestamp
+	port := uint16(d.udp.DstPort)
+	priority := s.priorityPorts[port]
+	routedif, routed := routeBySource(s.srcRoutes, d.ip4.SrcIP)
+	queues := []sendQueue{}
 	s.lock.Lock()
 	for thisif, send := range s.senders {
-		if strings.Compare(thisif, srcif) == 0 {
+		if !s.forwardsTo(srcif, thisif) || (routed && thisif != routedif) || !s.portRoutes.Allows(port, thisif) {
 			continue
 		}
-		log.Debugf("%s: sending out because we're not %s", thisif, srcif)
-		send <- Send{packet: p, srcif: srcif, linkType: linkType}
+		q := sendQueue{iname: thisif, send: send, stats: s.stats[thisif], watermark: s.highWatermark}
+		if priority {
+			// --high-watermark only applies to normal priority packets
+			q.send = s.priority[thisif]
+			q.watermark = 0
+		}
+		queues = append(queues, q)
+	}
+	s.lock.Unlock()
+
+	// we don't hold the lock while queueing so one interface can't stall the others
+	sndpkt := Send{packet: p, srcif: srcif, linkType: linkType, decoded: d, ts: ts}
+	for _, q := range queues {
+		log.Debugf("%s: sending out because we're not %s", interfaceLabel(q.iname), interfaceLabel(srcif))
+		q.enqueue(sndpkt)
+	}
+}
+
+// SendTo queues a packet to send out just dstif, like a --nat-port-range
+// reply.  Returns false if the packet was dropped.
+func (s *SendPktFeed) SendTo(dstif string, sndpkt Send) bool {
+	s.lock.Lock()
+	send, ok := s.senders[dstif]
+	q := sendQueue{iname: dstif, send: send, stats: s.stats[dstif], watermark: s.highWatermark}
+	s.lock.Unlock()
+	return ok && q.enqueue(sndpkt)
+}
+
+// sendQueue is the queue of an interface we send a packet to
+type sendQueue struct {
+	iname     string    // interface we send out
+	send      chan Send // normal or high priority channel
+	stats     *Stats    // counters of the interface
+	watermark int       // drop packets when this many are queued, 0 when the channel is full
+}
+
+// enqueue queues sndpkt without ever blocking the capture goroutine.
+// Returns false if the queue is full and the packet was dropped.
+func (q sendQueue) enqueue(sndpkt Send) bool {
+	if q.watermark == 0 || len(q.send) < q.watermark {
+		select {
+		case q.send <- sndpkt:
+			return true
+		default:
+		}
+	}
+	// don't let one slow interface stall all the others
+	q.stats.CountDrop(DropQueueFull)
+	rateLog.Warnf("queue:"+q.iname, "%s: send queue is full, dropping packets (%d dropped)",
+		interfaceLabel(q.iname), q.stats.Dropped(DropQueueFull))
+	return false
+}
+
+// nextQueued returns the next packet queued to send out an interface,
+// high priority packets before all others.  Returns false if none are.
+func nextQueued(priority chan Send, normal chan Send) (Send, bool) {
+	select {
+	case sndpkt := <-priority:
+		return sndpkt, true
+	default:
+	}
+	select {
+	case sndpkt := <-normal:
+		return sndpkt, true
+	default:
+	}
+	return Send{}, false
+}
+
+// Destinations returns the sorted list of interfaces we send packets from srcif to
+func (s *SendPktFeed) Destinations(srcif string) []string {
+	ret := []string{}
+	s.lock.Lock()
+	for thisif := range s.senders {
+		if s.forwardsTo(srcif, thisif) {
+			ret = append(ret, thisif)
+		}
 	}
 	s.lock.Unlock()
+	sort.Strings(ret)
+	return ret
 }
 
-// RegisterSender registers a channel to receive packet data we want to send
-func (s *SendPktFeed) RegisterSender(send chan Send, iname string) {
+// RegisterSender registers the channels to receive normal and high priority
+// packet data we want to send
+func (s *SendPktFeed) RegisterSender(send chan Send, priority chan Send, stats *Stats, iname string) {
 	s.lock.Lock()
 	if s.senders == nil {
 		s.senders = make(map[string]chan Send)
+		s.priority = make(map[string]chan Send)
+		s.stats = make(map[string]*Stats)
 	}
 	s.senders[iname] = send
+	s.priority[iname] = priority
+	s.stats[iname] = stats
 	s.lock.Unlock()
 }
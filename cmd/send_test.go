@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// A full send queue drops packets instead of stalling the capture goroutine
+func TestSendQueueFull(t *testing.T) {
+	tests := []struct {
+		name      string
+		watermark int
+		slow      int // packets queued for the slow interface
+		fast      int // and the fast one
+	}{
+		{"full", 0, 4, 10},
+		{"high watermark", 2, 2, 2},
+		{"watermark over the size", 8, 4, 8},
+	}
+	for _, test := range tests {
+		slow := make(chan Send, 4)
+		fast := make(chan Send, 16)
+		s := &SendPktFeed{highWatermark: test.watermark}
+		s.RegisterSender(slow, make(chan Send, 4), &Stats{}, "slow0")
+		s.RegisterSender(fast, make(chan Send, 4), &Stats{}, "fast0")
+		packet, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+
+		sent := make(chan bool)
+		go func() {
+			for i := 0; i < 10; i++ {
+				s.Send(packet, "eth0", layers.LinkTypeRaw, d)
+			}
+			sent <- s.SendTo("slow0", Send{decoded: d})
+		}()
+		select {
+		case replied := <-sent:
+			if replied {
+				t.Errorf("%s: queued a reply to a full queue", test.name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: sending to a full queue blocked", test.name)
+		}
+
+		if len(slow) != test.slow || len(fast) != test.fast {
+			t.Errorf("%s: queued %d slow and %d fast packets", test.name, len(slow), len(fast))
+		}
+		if dropped := s.stats["slow0"].Dropped(DropQueueFull); dropped != uint64(11-test.slow) {
+			t.Errorf("%s: dropped %d packets", test.name, dropped)
+		}
+		if dropped := s.stats["fast0"].Dropped(DropQueueFull); dropped != uint64(10-test.fast) {
+			t.Errorf("%s: dropped %d fast packets", test.name, dropped)
+		}
+	}
+}
+
+// High priority packets ignore --high-watermark, are dropped once their own
+// queue is full and are sent before every normal priority packet
+func TestSendPriority(t *testing.T) {
+	normal := make(chan Send, 4)
+	priority := make(chan Send, 2)
+	s := &SendPktFeed{highWatermark: 1, priorityPorts: map[uint16]bool{1900: true}}
+	s.RegisterSender(normal, priority, &Stats{}, "eth1")
+	send := func(dstPort uint16, payload string) {
+		packet, d := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, dstPort, []byte(payload))
+		s.Send(packet, "eth0", layers.LinkTypeRaw, d)
+	}
+	send(5353, "normal")
+	send(1900, "priority 1")
+	send(5353, "over the watermark")
+	send(1900, "priority 2")
+	send(1900, "priority queue full")
+	if len(normal) != 1 || len(priority) != 2 || s.stats["eth1"].Dropped(DropQueueFull) != 2 {
+		t.Fatalf("queued %d normal and %d priority packets, dropped %d", len(normal), len(priority),
+			s.stats["eth1"].Dropped(DropQueueFull))
+	}
+
+	for _, expected := range []string{"priority 1", "priority 2", "normal"} {
+		sndpkt, ok := nextQueued(priority, normal)
+		if !ok {
+			t.Fatalf("nothing sent, expected %q", expected)
+		}
+		if string(sndpkt.decoded.payload) != expected {
+			t.Errorf("sent %q, expected %q", sndpkt.decoded.payload, expected)
+		}
+	}
+	if _, ok := nextQueued(priority, normal); ok {
+		t.Errorf("sent a packet which wasn't queued")
+	}
+}
+
+// Our queue depth gauge is the number of packets waiting in both queues
+func TestSampleQueue(t *testing.T) {
+	l := Listen{iname: "depth0", label: "depth0", stats: &Stats{}, queueAlert: 6,
+		sendpkt: make(chan Send, 10), prioritypkt: make(chan Send, 4)}
+	tests := []struct {
+		normal   int // packets to queue before sampling
+		priority int
+		sent     int // and to send
+		depth    int
+		alerts   uint64
+	}{
+		{0, 0, 0, 0, 0},
+		{3, 1, 0, 4, 0},
+		{2, 0, 0, 6, 1}, // at the --queue-depth-alert
+		{4, 3, 0, 13, 2},
+		{0, 0, 13, 0, 2},
+	}
+	for _, test := range tests {
+		for i := 0; i < test.normal; i++ {
+			l.sendpkt <- Send{}
+		}
+		for i := 0; i < test.priority; i++ {
+			l.prioritypkt <- Send{}
+		}
+		for i := 0; i < test.sent; i++ {
+			if _, ok := nextQueued(l.prioritypkt, l.sendpkt); !ok {
+				t.Fatalf("queues are empty")
+			}
+		}
+		if depth := l.sampleQueue(); depth != test.depth {
+			t.Errorf("depth is %d, expected %d", depth, test.depth)
+		}
+		snap := l.stats.Snapshot()
+		if snap.QueueDepth != uint64(test.depth) || snap.QueueAlerts != test.alerts {
+			t.Errorf("depth %d: gauge is %d with %d alerts", test.depth, snap.QueueDepth, snap.QueueAlerts)
+		}
+		expected := fmt.Sprintf("queue_depth=%d queue_alerts=%d", test.depth, test.alerts)
+		if summary := snap.Summary(); !strings.HasSuffix(summary, expected) {
+			t.Errorf("summary is %s", summary)
+		}
+	}
+}
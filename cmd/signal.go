@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// logStatsOnSignal logs the counters of every interface when we get a SIGUSR1
+func logStatsOnSignal(listeners []Listen) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			logStats(listeners)
+		}
+	}()
+}
@@ -0,0 +1,7 @@
+//go:build windows
+// +build windows
+
+package main
+
+// Windows has no SIGUSR1
+func logStatsOnSignal(listeners []Listen) {}
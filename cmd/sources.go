@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Max number of source IPs a sourceTable tracks
+const MAX_SOURCES = 1024
+
+// sourceCount is the number of packets seen from a source IP
+type sourceCount struct {
+	IP    string `json:"ip"`
+	Count uint64 `json:"count"`
+}
+
+// sourceTable counts packets by source IP, tracking at most maxEntries IPs
+// so a flood of spoofed sources can't use unbounded memory
+type sourceTable struct {
+	lock       sync.Mutex
+	maxEntries int
+	counts     map[string]uint64
+}
+
+func newSourceTable(maxEntries int) *sourceTable {
+	return &sourceTable{
+		maxEntries: maxEntries,
+		counts:     map[string]uint64{},
+	}
+}
+
+// Add counts a packet from the given source IP
+func (t *sourceTable) Add(ip string) {
+	t.lock.Lock()
+	if _, ok := t.counts[ip]; ok || len(t.counts) < t.maxEntries {
+		t.counts[ip]++
+	}
+	t.lock.Unlock()
+}
+
+// Top returns up to n source IPs with the highest packet counts
+func (t *sourceTable) Top(n int) []sourceCount {
+	ret := []sourceCount{}
+	t.lock.Lock()
+	for ip, count := range t.counts {
+		ret = append(ret, sourceCount{IP: ip, Count: count})
+	}
+	t.lock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count == ret[j].Count {
+			return ret[i].IP < ret[j].IP
+		}
+		return ret[i].Count > ret[j].Count
+	})
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+// Reset forgets all the sources
+func (t *sourceTable) Reset() {
+	t.lock.Lock()
+	t.counts = map[string]uint64{}
+	t.lock.Unlock()
+}
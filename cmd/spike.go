@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SPIKE_TOP_SOURCES = 5 // number of source IPs to report
+)
+
+// spikeDetector warns when the rate of packets forwarded from an interface
+// stays above a threshold for an entire window, like during a broadcast storm
+type spikeDetector struct {
+	threshold uint64       // packets/sec
+	buckets   []uint64     // packets forwarded during each second of the window
+	second    int64        // unix time of the current bucket
+	sources   *sourceTable // source IPs seen during the window
+	alerting  bool         // are we currently in an alert state?
+	lock      sync.Mutex   // Add & Check may be called by different goroutines
+}
+
+func newSpikeDetector(threshold uint64, window time.Duration) *spikeDetector {
+	seconds := int(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &spikeDetector{
+		threshold: threshold,
+		buckets:   make([]uint64, seconds),
+		sources:   newSourceTable(MAX_SOURCES),
+	}
+}
+
+// advance moves our sliding window forward to now, clearing any
+// buckets for seconds we have skipped over
+func (s *spikeDetector) advance(now time.Time) {
+	sec := now.Unix()
+	if s.second == 0 || sec-s.second >= int64(len(s.buckets)) {
+		for i := range s.buckets {
+			s.buckets[i] = 0
+		}
+	} else {
+		for t := s.second + 1; t <= sec; t++ {
+			s.buckets[t%int64(len(s.buckets))] = 0
+		}
+	}
+	if sec > s.second {
+		s.second = sec
+	}
+}
+
+// Add counts a forwarded packet from the given source IP
+func (s *spikeDetector) Add(srcip string, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.advance(now)
+	s.buckets[s.second%int64(len(s.buckets))]++
+	s.sources.Add(srcip)
+}
+
+// Rate returns the average packets/sec over the window
+func (s *spikeDetector) Rate(now time.Time) uint64 {
+	s.advance(now)
+	var total uint64
+	for _, b := range s.buckets {
+		total += b
+	}
+	return total / uint64(len(s.buckets))
+}
+
+// Check logs a warning when the rate first exceeds our threshold and
+// when it recovers.  Returns true while the rate exceeds our threshold.
+func (s *spikeDetector) Check(iname string, stats *Stats, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pps := s.Rate(now)
+	if pps > s.threshold {
+		if !s.alerting {
+			top := []string{}
+			for _, src := range s.sources.Top(SPIKE_TOP_SOURCES) {
+				top = append(top, fmt.Sprintf("%s=%d", src.IP, src.Count))
+			}
+			log.Warnf("%s: forwarding %d pps over the last %ds exceeds %d pps.  Top sources: %s",
+				iname, pps, len(s.buckets), s.threshold, strings.Join(top, ", "))
+			atomic.StoreUint64(&stats.Spiking, 1)
+		}
+		s.alerting = true
+	} else if s.alerting {
+		log.Infof("%s: forwarding %d pps is back under %d pps", iname, pps, s.threshold)
+		atomic.StoreUint64(&stats.Spiking, 0)
+		s.alerting = false
+	}
+
+	if !s.alerting {
+		// only track sources for the current window
+		s.sources.Reset()
+	}
+	return s.alerting
+}
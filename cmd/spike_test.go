@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpikeDetectorAdvance(t *testing.T) {
+	start := time.Unix(1600000000, 0) // a multiple of our 4s window
+	tests := []struct {
+		name    string
+		at      int64 // seconds since start
+		add     int   // packets to add
+		buckets []uint64
+	}{
+		{"first", 0, 4, []uint64{4, 0, 0, 0}},
+		{"next second", 1, 2, []uint64{4, 2, 0, 0}},
+		{"skip a second", 3, 1, []uint64{4, 2, 0, 1}},
+		{"wraps around", 4, 3, []uint64{3, 2, 0, 1}},
+		{"wraps again", 6, 0, []uint64{3, 0, 0, 1}},
+		{"same second", 6, 5, []uint64{3, 0, 5, 1}},
+		{"behind doesn't rewind", 2, 1, []uint64{3, 0, 6, 1}},
+		{"a whole window later", 10, 1, []uint64{0, 0, 1, 0}},
+		{"much later", 1000, 2, []uint64{2, 0, 0, 0}},
+	}
+	s := newSpikeDetector(10, 4*time.Second)
+	for _, test := range tests {
+		now := start.Add(time.Duration(test.at) * time.Second)
+		if test.add == 0 {
+			s.advance(now)
+		}
+		for i := 0; i < test.add; i++ {
+			s.Add("10.0.0.5", now)
+		}
+		for i := range s.buckets {
+			if s.buckets[i] != test.buckets[i] {
+				t.Errorf("%s: buckets are %v, expected %v", test.name, s.buckets, test.buckets)
+				break
+			}
+		}
+	}
+}
+
+func TestSpikeDetectorCheck(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	stats := &Stats{}
+	s := newSpikeDetector(10, 2*time.Second)
+	if s.Check("eth0", stats, start) || stats.Spiking != 0 {
+		t.Fatalf("alerting without any packets")
+	}
+	for sec := 0; sec < 2; sec++ {
+		for i := 0; i < 30; i++ {
+			s.Add("10.0.0.5", start.Add(time.Duration(sec)*time.Second))
+		}
+	}
+	if rate := s.Rate(start.Add(time.Second)); rate != 30 {
+		t.Errorf("rate is %d pps", rate)
+	}
+	if !s.Check("eth0", stats, start.Add(time.Second)) || stats.Spiking != 1 {
+		t.Errorf("not alerting at 30 pps")
+	}
+	// the window slides past the spike
+	if s.Check("eth0", stats, start.Add(3*time.Second)) || stats.Spiking != 0 {
+		t.Errorf("still alerting after the spike")
+	}
+	if window := newSpikeDetector(10, 0); len(window.buckets) != 1 {
+		t.Errorf("window is %d seconds", len(window.buckets))
+	}
+}
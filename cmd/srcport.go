@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// srcPortRange picks the UDP source port of the packets we send from a
+// range so stateful firewalls can match them
+type srcPortRange struct {
+	min  uint16
+	max  uint16
+	hash bool   // pick by source IP instead of round-robin
+	next uint32 // next round-robin port offset
+}
+
+// parseSrcPortRange parses a --src-port-range of <min>-<max>
+func parseSrcPortRange(value string, mode string) (*srcPortRange, error) {
+	split := strings.SplitN(value, "-", 2)
+	if len(split) != 2 {
+		return nil, fmt.Errorf("%s is not in the format of <min>-<max>", value)
+	}
+	min, err := strconv.ParseUint(split[0], 10, 16)
+	if err != nil || min == 0 {
+		return nil, fmt.Errorf("%s is not a valid port range", value)
+	}
+	max, err := strconv.ParseUint(split[1], 10, 16)
+	if err != nil || max < min {
+		return nil, fmt.Errorf("%s is not a valid port range", value)
+	}
+	return &srcPortRange{
+		min:  uint16(min),
+		max:  uint16(max),
+		hash: mode == "hash",
+	}, nil
+}
+
+// Port returns the source port to use for a packet from srcip
+func (r *srcPortRange) Port(srcip net.IP) uint16 {
+	size := uint32(r.max-r.min) + 1
+	var offset uint32
+	if r.hash {
+		h := fnv.New32a()
+		_, _ = h.Write(srcip.To4())
+		offset = h.Sum32() % size
+	} else {
+		offset = (atomic.AddUint32(&r.next, 1) - 1) % size
+	}
+	return r.min + uint16(offset)
+}
+
+// parseSrcPorts returns the set of --src-port(s) we forward packets from,
+// which is empty for any port, and an error for each one which is invalid
+func parseSrcPorts(ports []uint16) (map[uint16]bool, configErrors) {
+	allowed := map[uint16]bool{}
+	errs := configErrors{}
+	for _, port := range ports {
+		if port == 0 {
+			errs.Addf("--src-port %d must be between 1 and 65535", port)
+			continue
+		}
+		allowed[port] = true
+	}
+	return allowed, errs
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Stats holds the packet counters for a Listen interface.
+// All fields are updated via sync/atomic and must stay 64bit aligned.  The
+// drop counters by name are only set in a Snapshot, from the drops of their
+// DropReasons, so they can't disagree with Drops.
+type Stats struct {
+	Received     uint64 `json:"received"`      // complete packets received (reassembled datagrams count once)
+	Fragments    uint64 `json:"fragments"`     // IPv4 fragments received
+	Forwarded    uint64 `json:"forwarded"`     // packets received and forwarded to other interfaces
+	Spiking      uint64 `json:"spiking"`       // 1 if the --spike-pps alert is active
+	Truncated    uint64 `json:"truncated"`     // packets sent with a --truncate'd payload
+	SendErrors   uint64 `json:"send_errors"`   // packets we failed to send after any retries
+	DecodeErrors uint64 `json:"decode_errors"` // packets we were unable to decode
+	NonIPv4      uint64 `json:"non_ipv4"`      // packets which aren't IPv4
+	NonUDP       uint64 `json:"non_udp"`       // IPv4 packets which aren't UDP
+	Unscheduled  uint64 `json:"unscheduled"`   // packets dropped outside of the --schedule
+	Repeats      uint64 `json:"repeats"`       // packets dropped with an unchanged payload
+	QueueDrops   uint64 `json:"queue_drops"`   // packets not sent because our send queue was full
+	RateLimited  uint64 `json:"rate_limited"`  // packets dropped by --rate-limit-bytes
+	BadChecksums uint64 `json:"bad_checksums"` // packets dropped by --verify-checksum
+	Denied       uint64 `json:"denied"`        // packets dropped by --deny-payload
+	PayloadLens  uint64 `json:"payload_lens"`  // packets dropped by --payload-length
+	QueueDepth   uint64 `json:"queue_depth"`   // packets waiting to be sent when we last checked
+	QueueAlerts  uint64 `json:"queue_alerts"`  // times QueueDepth was at least --queue-depth-alert
+	LastPacket   uint64 `json:"last_packet"`   // unix time in nsec we last captured a packet or started
+	NatReplies   uint64 `json:"nat_replies"`   // replies we translated back to the requester
+
+	ReceivedBytes  uint64 `json:"received_bytes"`  // bytes of the packets in Received
+	ForwardedBytes uint64 `json:"forwarded_bytes"` // bytes of the packets in Forwarded
+	DroppedBytes   uint64 `json:"dropped_bytes"`   // bytes of received packets we didn't forward
+	SentBytes      uint64 `json:"sent_bytes"`      // bytes sent out this interface
+
+	drops [DROP_REASONS]uint64 // packets dropped for each DropReason
+	Drops map[string]uint64    `json:"drops,omitempty"` // non-zero drops by DropReason in a Snapshot
+}
+
+// The DropReasons of the packets we count as SendErrors
+var sendErrorReasons = []DropReason{DropMTU, DropNonIPv4Dst, DropSendError, DropNatFull, DropRetryFailed}
+
+// Snapshot returns a copy of the current counters
+func (s *Stats) Snapshot() Stats {
+	var counts [DROP_REASONS]uint64
+	drops := map[string]uint64{}
+	for reason := DropReason(0); reason < DROP_REASONS; reason++ {
+		counts[reason] = atomic.LoadUint64(&s.drops[reason])
+		if counts[reason] > 0 {
+			drops[reason.String()] = counts[reason]
+		}
+	}
+	var sendErrors uint64
+	for _, reason := range sendErrorReasons {
+		sendErrors += counts[reason]
+	}
+	return Stats{
+		Received:     atomic.LoadUint64(&s.Received),
+		Fragments:    atomic.LoadUint64(&s.Fragments),
+		Forwarded:    atomic.LoadUint64(&s.Forwarded),
+		Spiking:      atomic.LoadUint64(&s.Spiking),
+		Truncated:    atomic.LoadUint64(&s.Truncated),
+		SendErrors:   sendErrors,
+		DecodeErrors: atomic.LoadUint64(&s.DecodeErrors),
+		NonIPv4:      counts[DropNonIPv4],
+		NonUDP:       counts[DropNonUDP],
+		Unscheduled:  counts[DropUnscheduled],
+		Repeats:      counts[DropRepeat],
+		QueueDrops:   counts[DropQueueFull],
+		RateLimited:  counts[DropRateLimit],
+		BadChecksums: counts[DropChecksum],
+		Denied:       counts[DropDenied],
+		PayloadLens:  counts[DropPayloadLen],
+		QueueDepth:   atomic.LoadUint64(&s.QueueDepth),
+		QueueAlerts:  atomic.LoadUint64(&s.QueueAlerts),
+		LastPacket:   atomic.LoadUint64(&s.LastPacket),
+		NatReplies:   atomic.LoadUint64(&s.NatReplies),
+
+		ReceivedBytes:  atomic.LoadUint64(&s.ReceivedBytes),
+		ForwardedBytes: atomic.LoadUint64(&s.ForwardedBytes),
+		DroppedBytes:   atomic.LoadUint64(&s.DroppedBytes),
+		SentBytes:      atomic.LoadUint64(&s.SentBytes),
+
+		Drops: drops,
+	}
+}
+
+// Summary returns a one line summary of the main counters
+func (s Stats) Summary() string {
+	return fmt.Sprintf("received=%d/%dB fragments=%d forwarded=%d/%dB dropped=%dB sent=%dB send_errors=%d queue_depth=%d queue_alerts=%d",
+		s.Received, s.ReceivedBytes, s.Fragments, s.Forwarded, s.ForwardedBytes, s.DroppedBytes,
+		s.SentBytes, s.SendErrors, s.QueueDepth, s.QueueAlerts)
+}
+
+// SampleQueue records the current depth of our send queue.  Returns true if
+// the depth is at least alert, which is disabled when 0.
+func (s *Stats) SampleQueue(depth int, alert int) bool {
+	atomic.StoreUint64(&s.QueueDepth, uint64(depth))
+	if alert > 0 && depth >= alert {
+		atomic.AddUint64(&s.QueueAlerts, 1)
+		return true
+	}
+	return false
+}
+
+// CountDrop counts a packet we dropped for the reason
+func (s *Stats) CountDrop(reason DropReason) {
+	if reason >= 0 && reason < DROP_REASONS {
+		atomic.AddUint64(&s.drops[reason], 1)
+	}
+}
+
+// Dropped returns the number of packets we dropped for the reason
+func (s *Stats) Dropped(reason DropReason) uint64 {
+	if reason < 0 || reason >= DROP_REASONS {
+		return 0
+	}
+	return atomic.LoadUint64(&s.drops[reason])
+}
+
+// logStats logs the counters of every interface
+func logStats(listeners []Listen) {
+	for i := range listeners {
+		l := &listeners[i]
+		log.Infof("%s: %s", l.label, l.stats.Snapshot().Summary())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Our byte counters add up the size of each packet we received
+func TestStatsBytes(t *testing.T) {
+	sendq := make(chan Send, 10)
+	s := &SendPktFeed{}
+	s.RegisterSender(sendq, make(chan Send, 10), &Stats{}, "eth1")
+	l := Listen{iname: "bytes0", label: "bytes0", linkType: layers.LinkTypeRaw, stats: &Stats{},
+		capture: Capture{snaplen: DEFAULT_SNAPLEN}, policy: Policy{srcPorts: map[uint16]bool{5000: true}}}
+
+	packets := []struct {
+		srcPort uint16
+		payload int
+		data    func([]byte) []byte
+	}{
+		{5000, 10, nil},  // 38 bytes forwarded
+		{5000, 100, nil}, // 128 bytes forwarded
+		{6000, 200, nil}, // 228 bytes dropped by --src-port
+		{5000, 500, nil}, // 528 bytes forwarded
+		{5000, 50, func(data []byte) []byte { return data[:10] }}, // 10 bytes we can't decode
+	}
+	for _, p := range packets {
+		packet, _ := testPacket(t, "10.0.0.5", "10.0.0.255", p.srcPort, 1900, make([]byte, p.payload))
+		data := packet.Data()
+		if p.data != nil {
+			data = p.data(data)
+		}
+		captured := gopacket.NewPacket(data, layers.LinkTypeRaw, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		captured.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+		l.processPacket(s, captured, layers.LinkTypeRaw)
+	}
+
+	snap := l.stats.Snapshot()
+	if snap.Received != 5 || snap.ReceivedBytes != 38+128+228+528+10 {
+		t.Errorf("received %d packets, %d bytes", snap.Received, snap.ReceivedBytes)
+	}
+	if snap.Forwarded != 3 || snap.ForwardedBytes != 38+128+528 || len(sendq) != 3 {
+		t.Errorf("forwarded %d packets, %d bytes", snap.Forwarded, snap.ForwardedBytes)
+	}
+	if snap.DroppedBytes != 228+10 {
+		t.Errorf("dropped %d bytes", snap.DroppedBytes)
+	}
+	if snap.ReceivedBytes != snap.ForwardedBytes+snap.DroppedBytes {
+		t.Errorf("received %d bytes != forwarded %d + dropped %d", snap.ReceivedBytes, snap.ForwardedBytes, snap.DroppedBytes)
+	}
+
+	// we report them in the SIGUSR1 summary and the /topology
+	if summary := snap.Summary(); !strings.Contains(summary, "received=5/932B") ||
+		!strings.Contains(summary, "forwarded=3/694B dropped=238B sent=0B") {
+		t.Errorf("summary is %s", summary)
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"received_bytes":932`, `"forwarded_bytes":694`, `"dropped_bytes":238`, `"sent_bytes":0`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("%s is missing from %s", field, data)
+		}
+	}
+}
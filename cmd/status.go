@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long we wait for a client to send the request headers
+const STATUS_READ_TIMEOUT = 10 * time.Second
+
+// TopologyInterface describes how packets received on an interface are forwarded
+type TopologyInterface struct {
+	Interface     string        `json:"interface"`
+	Label         string        `json:"label"`
+	LinkType      string        `json:"link_type"`
+	Ports         []int32       `json:"ports"`
+	Filter        string        `json:"filter,omitempty"`
+	BroadcastOnly bool          `json:"broadcast_only"`
+	ForwardsTo    []string      `json:"forwards_to"`  // interfaces we send packets received here to
+	Destinations  []string      `json:"destinations"` // IPs we send packets from other interfaces to
+	Egress        string        `json:"egress,omitempty"`
+	Profile       string        `json:"profile,omitempty"`
+	State         string        `json:"state"` // active or spiking
+	Stats         Stats         `json:"stats"`
+	TopTalkers    []sourceCount `json:"top_talkers,omitempty"` // from the last --top-talkers report
+}
+
+// statusServer serves read only information about our Listeners via HTTP
+type statusServer struct {
+	listeners []Listen
+	spf       *SendPktFeed
+}
+
+// startStatusServer starts serving our status API on addr in the background
+func startStatusServer(addr string, listeners []Listen, spf *SendPktFeed) {
+	s := &statusServer{
+		listeners: listeners,
+		spf:       spf,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/topology", s.handleTopology)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: STATUS_READ_TIMEOUT,
+	}
+	go func() {
+		log.Infof("Serving status on http://%s/topology", addr)
+		if err := server.ListenAndServe(); err != nil {
+			log.WithError(err).Fatalf("Unable to serve --status-addr %s", addr)
+		}
+	}()
+}
+
+// topology returns the current forwarding topology of our Listeners
+func (s *statusServer) topology() []TopologyInterface {
+	ret := []TopologyInterface{}
+	for i := range s.listeners {
+		l := &s.listeners[i]
+		t := TopologyInterface{
+			Interface:     l.iname,
+			Label:         l.label,
+			LinkType:      l.linkType.String(),
+			Ports:         l.ports,
+			Filter:        l.capture.filter,
+			BroadcastOnly: l.policy.broadcastOnly,
+			ForwardsTo:    s.spf.Destinations(l.iname),
+			Destinations:  l.destinations(),
+			Egress:        l.egressName,
+			Profile:       l.rewrite.profile,
+			State:         "active",
+			Stats:         l.stats.Snapshot(),
+		}
+		if l.taps.talkers != nil {
+			t.TopTalkers = l.taps.talkers.Last()
+		}
+		if t.Stats.Spiking > 0 {
+			t.State = "spiking"
+		}
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+func (s *statusServer) handleTopology(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.topology()); err != nil {
+		log.WithError(err).Warnf("Unable to write /topology response")
+	}
+}
+
+// destinations returns the IPs we currently send packets to
+func (l *Listen) destinations() []string {
+	if !l.promisc {
+		if l.bcast.allSubnets && l.bcast.remote == nil {
+			if subnets := subnetBroadcasts(Interfaces[l.iname].Addresses); len(subnets) > 0 {
+				ret := []string{}
+				for _, ip := range subnets {
+					ret = append(ret, ip.String())
+				}
+				return ret
+			}
+		}
+		return []string{l.ipaddr}
+	}
+	l.lock.Lock()
+	ret := make([]string, 0, len(l.clients))
+	for ip := range l.clients {
+		ret = append(ret, ip)
+	}
+	l.lock.Unlock()
+	sort.Strings(ret)
+	return ret
+}
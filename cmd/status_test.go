@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// /topology reflects which interfaces a --pair limits forwarding to
+func TestHandleTopology(t *testing.T) {
+	cli := CLI{Interface: []string{"eth0", "eth1", "eth2", "eth3"}, Pair: []string{"eth0:eth1"}}
+	peers, err := parsePairs(&cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &statusServer{spf: &SendPktFeed{peers: peers}}
+	for _, iface := range cli.Interface {
+		s.spf.RegisterSender(make(chan Send), make(chan Send), &Stats{}, iface)
+		s.listeners = append(s.listeners, Listen{iname: iface, label: iface, linkType: layers.LinkTypeEthernet,
+			ports: []int32{1900}, ipaddr: "10.0.0.255", stats: &Stats{}})
+	}
+	s.listeners[2].label = "IoT"
+	s.listeners[3].stats.Spiking = 1
+
+	w := httptest.NewRecorder()
+	s.handleTopology(w, httptest.NewRequest("GET", "/topology", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type is %s", ct)
+	}
+	topology := []TopologyInterface{}
+	if err := json.NewDecoder(w.Body).Decode(&topology); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		iface      string
+		label      string
+		forwardsTo string
+		state      string
+	}{
+		{"eth0", "eth0", "eth1", "active"},
+		{"eth1", "eth1", "eth0", "active"},
+		{"eth2", "IoT", "eth3", "active"},
+		{"eth3", "eth3", "eth2", "spiking"},
+	}
+	if len(topology) != len(tests) {
+		t.Fatalf("topology has %d interfaces", len(topology))
+	}
+	for i, test := range tests {
+		ti := topology[i]
+		if ti.Interface != test.iface || ti.Label != test.label || ti.State != test.state {
+			t.Errorf("%s: %s is %s", test.iface, ti.Label, ti.State)
+		}
+		if forwardsTo := strings.Join(ti.ForwardsTo, ","); forwardsTo != test.forwardsTo {
+			t.Errorf("%s: forwards to %s instead of %s", test.iface, forwardsTo, test.forwardsTo)
+		}
+		if ti.LinkType != "Ethernet" || len(ti.Destinations) != 1 || ti.Destinations[0] != "10.0.0.255" {
+			t.Errorf("%s: %s sending to %v", test.iface, ti.LinkType, ti.Destinations)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logStartupSummary logs the effective configuration of each interface once
+// they are all initialized so it's easy to confirm wildcards, aliases, etc
+// resolved to what you expected
+func logStartupSummary(listeners []Listen) {
+	for i := range listeners {
+		l := &listeners[i]
+		mode := "broadcast"
+		if l.monitor {
+			mode = "receive-only"
+		} else if l.promisc {
+			mode = "clients"
+		}
+
+		addrs := []string{}
+		for _, addr := range Interfaces[l.iname].Addresses {
+			if addr.IP.To4() != nil {
+				ones, _ := addr.Netmask.Size()
+				addrs = append(addrs, fmt.Sprintf("%s/%d", addr.IP, ones))
+			}
+		}
+
+		log.Infof("%s: device=%s ifindex=%d link=%s mode=%s addrs=[%s] destinations=[%s] ports=%v timeout=%s bpf=%q",
+			l.label, l.device, l.netif.Index, l.linkType, mode, strings.Join(addrs, " "),
+			strings.Join(l.destinations(), " "), l.ports, l.timeout, l.bpfFilter(l.linkType))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLogStartupSummary(t *testing.T) {
+	Interfaces["sum0"] = pcap.Interface{Name: "sum0", Addresses: []pcap.InterfaceAddress{
+		{IP: net.ParseIP("192.168.1.1"), Netmask: net.CIDRMask(24, 32)},
+		{IP: net.ParseIP("fe80::1"), Netmask: net.CIDRMask(64, 128)},
+	}}
+	Interfaces["sum1"] = pcap.Interface{Name: "sum1", Addresses: []pcap.InterfaceAddress{
+		{IP: net.ParseIP("10.8.0.1"), Netmask: net.CIDRMask(32, 32)},
+	}}
+	defer delete(Interfaces, "sum0")
+	defer delete(Interfaces, "sum1")
+
+	listeners := []Listen{
+		{iname: "sum0", device: "sum0", label: "lan", netif: &net.Interface{Index: 3, Name: "sum0"},
+			linkType: layers.LinkTypeEthernet, ipaddr: "192.168.1.255", ports: []int32{1900, 5353},
+			timeout: 250 * time.Millisecond},
+		{iname: "sum1", device: "sum1", label: "sum1", netif: &net.Interface{Index: 7, Name: "sum1"},
+			linkType: layers.LinkTypeRaw, promisc: true, ports: []int32{1900}, timeout: time.Second,
+			clients: map[string]time.Time{"10.8.0.9": {}, "10.8.0.2": {}}, lock: &sync.Mutex{}},
+		{iname: "sum1", device: "sum1", label: "sum1", netif: &net.Interface{Index: 7, Name: "sum1"},
+			linkType: layers.LinkTypeIEEE80211Radio, promisc: true, monitor: true, ports: []int32{1900}, lock: &sync.Mutex{}},
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	logStartupSummary(listeners)
+	log.SetOutput(os.Stderr)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(listeners) {
+		t.Fatalf("logged %d lines: %s", len(lines), buf.String())
+	}
+
+	tests := [][]string{
+		{"lan: device=sum0 ifindex=3 link=Ethernet mode=broadcast", "addrs=[192.168.1.1/24]",
+			"destinations=[192.168.1.255]", "ports=[1900 5353] timeout=250ms",
+			"(udp port 1900 or udp port 5353) and (src net 192.168.1.0/24)"},
+		{"sum1: device=sum1 ifindex=7 link=Raw mode=clients", "addrs=[10.8.0.1/32]",
+			"destinations=[10.8.0.2 10.8.0.9]", "ports=[1900] timeout=1s"},
+		{"sum1: device=sum1 ifindex=7 link=RadioTap mode=receive-only", "destinations=[]"},
+	}
+	for i, expected := range tests {
+		for _, field := range expected {
+			if !strings.Contains(lines[i], field) {
+				t.Errorf("%q is missing from %s", field, lines[i])
+			}
+		}
+	}
+}
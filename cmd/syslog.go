@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// addSyslogHook also sends our logs to syslog at addr which is either
+// "local" or <udp|tcp>://host:port
+func addSyslogHook(addr string) error {
+	network, raddr := "", ""
+	if addr != "local" {
+		split := strings.SplitN(addr, "://", 2)
+		if len(split) != 2 || (split[0] != "udp" && split[0] != "tcp") {
+			return fmt.Errorf("%s is not in the format of local or <udp|tcp>://host:port", addr)
+		}
+		network, raddr = split[0], split[1]
+	}
+	hook, err := lsyslog.NewSyslogHook(network, raddr, syslog.LOG_DAEMON, "udp-proxy-2020")
+	if err != nil {
+		return err
+	}
+	log.AddHook(hook)
+	return nil
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// --syslog sends our logs with the syslog severity of their level
+func TestAddSyslogHook(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer server.Close()
+
+	hooks := log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	defer log.StandardLogger().ReplaceHooks(hooks)
+	if err := addSyslogHook("udp://" + server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		log      func(format string, args ...interface{})
+		severity syslog.Priority
+	}{
+		{"forwarded", log.Infof, syslog.LOG_INFO},
+		{"dropped", log.Warnf, syslog.LOG_WARNING},
+		{"send error", log.Errorf, syslog.LOG_ERR},
+	}
+	buf := make([]byte, 2048)
+	for _, test := range tests {
+		test.log("eth0: %s packet", test.name)
+		if err := server.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: nothing sent to syslog: %s", test.name, err)
+		}
+		msg := string(buf[:n])
+		if pri := fmt.Sprintf("<%d>", syslog.LOG_DAEMON|test.severity); !strings.HasPrefix(msg, pri) {
+			t.Errorf("%s: expected %s, got %q", test.name, pri, msg)
+		}
+		if !strings.Contains(msg, "udp-proxy-2020") || !strings.Contains(msg, "eth0: "+test.name+" packet") {
+			t.Errorf("%s: sent %q", test.name, msg)
+		}
+	}
+
+	for _, addr := range []string{"syslog.example.com:514", "http://syslog.example.com:514", "udp:/host"} {
+		if err := addSyslogHook(addr); err == nil || !strings.Contains(err.Error(), "is not in the format of") {
+			t.Errorf("%s: expected an error, got %v", addr, err)
+		}
+	}
+}
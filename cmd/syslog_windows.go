@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+)
+
+// syslog is not supported on Windows
+func addSyslogHook(addr string) error {
+	return fmt.Errorf("--syslog is not supported on Windows")
+}
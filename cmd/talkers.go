@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// topTalkers periodically reports the source IPs we forwarded the most
+// packets from on an interface
+type topTalkers struct {
+	n        int           // number of sources to report
+	interval time.Duration // how often to report
+	next     time.Time     // when we next report
+	sources  *sourceTable
+	last     []sourceCount // our last report
+	lock     sync.Mutex    // protects last
+}
+
+func newTopTalkers(n int, interval time.Duration) *topTalkers {
+	return &topTalkers{
+		n:        n,
+		interval: interval,
+		next:     time.Now().Add(interval),
+		sources:  newSourceTable(MAX_SOURCES),
+		last:     []sourceCount{},
+	}
+}
+
+// Report logs the top sources once per interval and starts counting again
+func (t *topTalkers) Report(iname string, now time.Time) {
+	if now.Before(t.next) {
+		return
+	}
+	t.next = now.Add(t.interval)
+	last := t.sources.Top(t.n)
+	t.sources.Reset()
+	t.lock.Lock()
+	t.last = last
+	t.lock.Unlock()
+
+	top := []string{}
+	for _, src := range last {
+		top = append(top, fmt.Sprintf("%s=%d", src.IP, src.Count))
+	}
+	if len(top) == 0 {
+		top = append(top, "none")
+	}
+	log.Infof("%s: top sources over the last %s: %s", iname, t.interval, strings.Join(top, ", "))
+}
+
+// Last returns the sources in our last report
+func (t *topTalkers) Last() []sourceCount {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.last
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSourceTableTop(t *testing.T) {
+	sources := newSourceTable(MAX_SOURCES)
+	for ip, count := range map[string]int{"10.0.0.5": 3, "10.0.0.6": 5, "10.0.0.7": 1, "10.0.0.8": 3} {
+		for i := 0; i < count; i++ {
+			sources.Add(ip)
+		}
+	}
+
+	tests := []struct {
+		n   int
+		top []sourceCount
+	}{
+		{0, []sourceCount{}},
+		{1, []sourceCount{{"10.0.0.6", 5}}},
+		// ties are sorted by IP
+		{3, []sourceCount{{"10.0.0.6", 5}, {"10.0.0.5", 3}, {"10.0.0.8", 3}}},
+		{10, []sourceCount{{"10.0.0.6", 5}, {"10.0.0.5", 3}, {"10.0.0.8", 3}, {"10.0.0.7", 1}}},
+	}
+	for _, test := range tests {
+		top := sources.Top(test.n)
+		if fmt.Sprint(top) != fmt.Sprint(test.top) {
+			t.Errorf("top %d: expected %v, got %v", test.n, test.top, top)
+		}
+	}
+}
+
+// New sources aren't tracked once the table is full, but known ones still count
+func TestSourceTableBound(t *testing.T) {
+	sources := newSourceTable(3)
+	for i := 0; i < 10; i++ {
+		sources.Add(fmt.Sprintf("10.0.0.%d", i))
+	}
+	sources.Add("10.0.0.2")
+	top := sources.Top(10)
+	expected := []sourceCount{{"10.0.0.2", 2}, {"10.0.0.0", 1}, {"10.0.0.1", 1}}
+	if fmt.Sprint(top) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, top)
+	}
+
+	sources.Reset()
+	sources.Add("10.0.0.9")
+	if top = sources.Top(10); len(top) != 1 || top[0].IP != "10.0.0.9" {
+		t.Errorf("after Reset: %v", top)
+	}
+}
+
+// Each report has the top sources since the last one
+func TestTopTalkersReport(t *testing.T) {
+	talkers := newTopTalkers(2, time.Minute)
+	now := time.Now()
+	for _, ip := range []string{"10.0.0.5", "10.0.0.6", "10.0.0.6", "10.0.0.7"} {
+		talkers.sources.Add(ip)
+	}
+	talkers.Report("talk0", now)
+	if last := talkers.Last(); len(last) != 0 {
+		t.Errorf("reported %v before the interval", last)
+	}
+
+	talkers.Report("talk0", now.Add(time.Minute))
+	expected := []sourceCount{{"10.0.0.6", 2}, {"10.0.0.5", 1}}
+	if last := talkers.Last(); fmt.Sprint(last) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, last)
+	}
+	talkers.Report("talk0", now.Add(2*time.Minute))
+	if last := talkers.Last(); len(last) != 0 {
+		t.Errorf("sources were counted again: %v", last)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Max number of packets waiting to be sent to the --tee collector
+const TEE_BUFFER_SIZE = 1000
+
+// teeWriter copies forwarded packets to a UDP collector without ever
+// blocking the caller.  Packets are dropped if the collector can't keep up.
+type teeWriter struct {
+	addr    string
+	conn    *net.UDPConn
+	encap   Encapsulator
+	queue   chan teeFrame
+	dropped uint64 // packets dropped because our queue was full
+}
+
+// newTeeWriter connects to the collector at addr and starts sending to it
+func newTeeWriter(addr string, encap Encapsulator) (*teeWriter, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	t := &teeWriter{
+		addr:  addr,
+		conn:  conn,
+		encap: encap,
+		queue: make(chan teeFrame, TEE_BUFFER_SIZE),
+	}
+	go t.run()
+	return t, nil
+}
+
+// Write queues a copy of the packet for the collector
+func (t *teeWriter) Write(linkType layers.LinkType, srcif string, data []byte) {
+	select {
+	case t.queue <- teeFrame{linkType: linkType, srcif: srcif, packet: data}:
+	default:
+		dropped := atomic.AddUint64(&t.dropped, 1)
+		rateLog.Warnf("tee", "Dropping packets for --tee %s which can't keep up (%d dropped)", t.addr, dropped)
+	}
+}
+
+func (t *teeWriter) run() {
+	for frame := range t.queue {
+		if _, err := t.conn.Write(t.encap.Encapsulate(frame)); err != nil {
+			rateLog.Warnf("tee", "Unable to send packet to --tee %s: %s", t.addr, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Every packet we tee is sent to the collector in its encapsulation
+func TestTeeWriter(t *testing.T) {
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer collector.Close()
+
+	tests := []struct {
+		encap    string
+		linkType layers.LinkType
+		srcif    string
+	}{
+		{TEE_ENCAP_RAW, layers.LinkTypeRaw, ""},
+		{TEE_ENCAP_FRAMED, layers.LinkTypeEthernet, "eth0"},
+		{TEE_ENCAP_FRAMED, layers.LinkTypeNull, "netns:c1:tun0"},
+	}
+	for _, test := range tests {
+		encap, err := newEncapsulator(test.encap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tee, err := newTeeWriter(collector.LocalAddr().String(), encap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := []byte("sent via " + test.encap)
+		tee.Write(test.linkType, test.srcif, packet)
+
+		buf := make([]byte, 1500)
+		if err = collector.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := collector.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: nothing sent to the collector: %s", test.encap, err)
+		}
+		frame, err := encap.Decapsulate(buf[:n])
+		if err != nil {
+			t.Fatalf("%s: %s", test.encap, err)
+		}
+		if !bytes.Equal(frame.packet, packet) {
+			t.Errorf("%s: sent %q", test.encap, frame.packet)
+		}
+		if test.encap == TEE_ENCAP_FRAMED && (frame.linkType != test.linkType || frame.srcif != test.srcif) {
+			t.Errorf("%s: sent a %s frame from %q", test.encap, frame.linkType, frame.srcif)
+		}
+		close(tee.queue)
+		tee.conn.Close()
+	}
+}
+
+// Write never blocks when the collector can't keep up
+func TestTeeWriterFull(t *testing.T) {
+	tee := &teeWriter{addr: "127.0.0.1:9", queue: make(chan teeFrame, 2)}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			tee.Write(layers.LinkTypeRaw, "eth0", []byte("hello"))
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing to a full tee blocked")
+	}
+	if len(tee.queue) != 2 || tee.dropped != 3 {
+		t.Errorf("queued %d and dropped %d packets", len(tee.queue), tee.dropped)
+	}
+}
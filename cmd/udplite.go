@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// UDP-Lite (RFC 3828) uses the same header as UDP except the length is
+// replaced by the number of bytes covered by the checksum.  gopacket can't
+// decode it via a DecodingLayerParser or serialize it, so we do it ourselves.
+
+// decodeUDPLite decodes the UDP-Lite header following our IPv4 header into
+// d.udp, where udp.Length is the checksum coverage.  Non-initial fragments
+// have no header to decode.
+func (d *Decoded) decodeUDPLite() bool {
+	data := d.ip4.Payload
+	if d.ip4.Protocol != layers.IPProtocolUDPLite || d.ip4.FragOffset != 0 || len(data) < 8 {
+		return false
+	}
+	d.udp = layers.UDP{
+		SrcPort:  layers.UDPPort(binary.BigEndian.Uint16(data[0:2])),
+		DstPort:  layers.UDPPort(binary.BigEndian.Uint16(data[2:4])),
+		Length:   binary.BigEndian.Uint16(data[4:6]),
+		Checksum: binary.BigEndian.Uint16(data[6:8]),
+	}
+	d.udp.Contents = data[:8]
+	d.udp.Payload = data[8:]
+	d.payload = gopacket.Payload(d.udp.Payload)
+	d.layers = append(d.layers, layers.LayerTypeUDPLite)
+	return true
+}
+
+// IsIPv4UDPLite returns true if we decoded both an IPv4 and UDP-Lite header
+func (d *Decoded) IsIPv4UDPLite() bool {
+	return d.Has(layers.LayerTypeIPv4) && d.Has(layers.LayerTypeUDPLite)
+}
+
+// serializeUDPLite prepends a UDP-Lite header to the payload already in the
+// buffer.  The checksum is mandatory for UDP-Lite, so we always compute it
+// over the IPv4 pseudo-header and the covered bytes.  A coverage which is
+// larger than the datagram (because we truncated it) covers everything.
+func serializeUDPLite(buffer gopacket.SerializeBuffer, ip4 *layers.IPv4, srcPort, dstPort layers.UDPPort, coverage uint16) error {
+	header, err := buffer.PrependBytes(8)
+	if err != nil {
+		return err
+	}
+	data := buffer.Bytes()
+	if int(coverage) > len(data) {
+		coverage = 0
+	}
+	binary.BigEndian.PutUint16(header[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(header[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(header[4:], coverage)
+	binary.BigEndian.PutUint16(header[6:], 0)
+
+	covered := data
+	if coverage != 0 {
+		covered = data[:coverage]
+	}
+
+	// pseudo-header length is the full datagram, not the coverage
+	sum := pseudoHeaderSum(ip4, layers.IPProtocolUDPLite, len(data))
+	csum := ^checksumFold(checksumAdd(sum, covered))
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(header[6:], csum)
+	return nil
+}
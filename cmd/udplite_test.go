@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// With --udplite we forward UDP-Lite packets with their checksum coverage intact
+func TestForwardUDPLite(t *testing.T) {
+	udplite := func(coverage uint16, payload string) []byte {
+		datagram := make([]byte, 8+len(payload))
+		binary.BigEndian.PutUint16(datagram[0:], 5000)
+		binary.BigEndian.PutUint16(datagram[2:], 1900)
+		binary.BigEndian.PutUint16(datagram[4:], coverage)
+		copy(datagram[8:], payload)
+		ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Flags: layers.IPv4DontFragment,
+			Protocol: layers.IPProtocolUDPLite, SrcIP: net.ParseIP("10.0.0.5").To4(), DstIP: net.ParseIP("10.0.0.255").To4()}
+		covered := datagram
+		if coverage != 0 {
+			covered = datagram[:coverage]
+		}
+		sum := pseudoHeaderSum(ip4, layers.IPProtocolUDPLite, len(datagram))
+		binary.BigEndian.PutUint16(datagram[6:], ^checksumFold(checksumAdd(sum, covered)))
+
+		buffer := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buffer, opts, ip4, gopacket.Payload(datagram)); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		udplite  bool
+		coverage uint16
+	}{
+		{"without --udplite", false, 0},
+		{"full coverage", true, 0},
+		{"header coverage", true, 8},
+		{"partial coverage", true, 12},
+	}
+	for _, test := range tests {
+		sendq := make(chan Send, 1)
+		s := &SendPktFeed{}
+		s.RegisterSender(sendq, make(chan Send, 1), &Stats{}, "eth1")
+		l := Listen{iname: "lite0", label: "lite0", linkType: layers.LinkTypeRaw, stats: &Stats{},
+			capture: Capture{snaplen: DEFAULT_SNAPLEN, udplite: test.udplite}}
+		data := udplite(test.coverage, "hello world")
+		packet := gopacket.NewPacket(data, layers.LinkTypeRaw, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		packet.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+		l.processPacket(s, packet, layers.LinkTypeRaw)
+		if !test.udplite {
+			if len(sendq) != 0 || l.stats.Dropped(DropNonUDP) != 1 {
+				t.Errorf("%s: forwarded %d packets, drops are %v", test.name, len(sendq), l.stats.Snapshot().Drops)
+			}
+			continue
+		}
+		if len(sendq) != 1 {
+			t.Fatalf("%s: forwarded %d packets, drops are %v", test.name, len(sendq), l.stats.Snapshot().Drops)
+		}
+
+		out := Listen{iname: "eth1", label: "eth1", linkType: layers.LinkTypeRaw, ports: []int32{1900},
+			rewrite: Rewrite{checksums: checksumPolicy{mode: CSUM_COMPUTE}}}
+		sndpkt := <-sendq
+		built, err := out.buildPacket(gopacket.NewSerializeBuffer(), sndpkt, net.ParseIP("192.168.1.255").To4(),
+			sndpkt.decoded.payload, sndpkt.decoded.ip4.Length)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		sent, err := decodePacket(built.data, layers.LinkTypeRaw)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !sent.IsIPv4UDPLite() || sent.ip4.Protocol != layers.IPProtocolUDPLite {
+			t.Fatalf("%s: sent %v", test.name, sent.layers)
+		}
+		if sent.udp.Length != test.coverage || sent.udp.SrcPort != 5000 || sent.udp.DstPort != 1900 ||
+			string(sent.payload) != "hello world" {
+			t.Errorf("%s: sent coverage %d %d->%d %q", test.name, sent.udp.Length, sent.udp.SrcPort,
+				sent.udp.DstPort, sent.payload)
+		}
+		if !sent.checksumsValid() {
+			t.Errorf("%s: sent an invalid checksum", test.name)
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	log "github.com/sirupsen/logrus"
 )
@@ -20,6 +26,16 @@ func stringInSlice(a string, list []string) bool {
 	return false
 }
 
+// Check to see if the int32 is in the slice
+func int32InSlice(a int32, list []int32) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
 // Check to see if the string prefix is in the slice
 func stringPrefixInSlice(a string, list []string) bool {
 	for _, b := range list {
@@ -30,8 +46,17 @@ func stringPrefixInSlice(a string, list []string) bool {
 	return false
 }
 
+// splits an <interface>@<value> argument into its two parts
+func splitInterfaceArg(arg string) (string, string, error) {
+	split := strings.SplitN(arg, "@", 2)
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return "", "", fmt.Errorf("%s is not in the correct format of <interface>@<value>", arg)
+	}
+	return split[0], split[1], nil
+}
+
 // takes a list of ports and builds our BPF filter
-func buildBPFFilter(ports []int32, addresses []pcap.InterfaceAddress, promisc bool) string {
+func buildBPFFilter(ports []int32, addresses []pcap.InterfaceAddress, promisc bool, defrag bool, udplite bool, filter string) string {
 	if len(ports) < 1 {
 		log.Fatal("--port must be specified one or more times")
 	}
@@ -39,22 +64,43 @@ func buildBPFFilter(ports []int32, addresses []pcap.InterfaceAddress, promisc bo
 	for _, p := range ports {
 		bpf_filters = append(bpf_filters, fmt.Sprintf("udp port %d", p))
 	}
+	// libpcap has no udplite keyword, so match the ports after the IPv4 header
+	if udplite {
+		for _, p := range ports {
+			bpf_filters = append(bpf_filters, fmt.Sprintf(
+				"(ip proto 136 and (ip[(ip[0]&0xf)*4:2] = %d or ip[(ip[0]&0xf)*4+2:2] = %d))", p, p))
+		}
+	}
 	var bpf_filter string
-	if len(ports) > 1 {
+	if len(bpf_filters) > 1 {
 		bpf_filter = strings.Join(bpf_filters, " or ")
 	} else {
 		bpf_filter = bpf_filters[0]
 	}
 
+	// non-initial IPv4 fragments don't have a UDP header so we can't filter
+	// them by port.  Let the defragmenter sort them out.
+	if defrag {
+		bpf_filter = fmt.Sprintf("%s or (ip proto 17 and ip[6:2] & 0x1fff != 0)", bpf_filter)
+		if udplite {
+			bpf_filter = fmt.Sprintf("%s or (ip proto 136 and ip[6:2] & 0x1fff != 0)", bpf_filter)
+		}
+	}
+
 	// add filter to accept only traffic with a src IP matching the interface
 	// This should avoid network loops with NIC/drivers which do not honor the
 	// pcap.SetDirection() call.
 	networks := []string{}
+	// /32 & point-to-point addresses have no other hosts on the network, so
+	// allow packets from the P2P peer instead.
 	for _, addr := range addresses {
 		if net, err := getNetwork(addr); err == nil {
-			if maskLen, _ := addr.Netmask.Size(); maskLen > 0 {
+			if maskLen, _ := addr.Netmask.Size(); maskLen > 0 && maskLen < 32 {
 				networks = append(networks, fmt.Sprintf("src net %s", net))
 			}
+			if addr.P2P != nil && addr.P2P.To4() != nil {
+				networks = append(networks, fmt.Sprintf("src host %s", addr.P2P.To4()))
+			}
 		}
 	}
 	var networkFilter string
@@ -63,9 +109,166 @@ func buildBPFFilter(ports []int32, addresses []pcap.InterfaceAddress, promisc bo
 		bpf_filter = fmt.Sprintf("(%s) and (%s)", bpf_filter, networkFilter)
 	}
 
+	// user provided filters must also match
+	if len(filter) > 0 {
+		bpf_filter = fmt.Sprintf("(%s) and (%s)", bpf_filter, filter)
+	}
+
 	return bpf_filter
 }
 
+// Names we accept for --ethertypes
+var etherTypeNames = map[string]uint16{
+	"ipv4": uint16(layers.EthernetTypeIPv4),
+	"ipv6": uint16(layers.EthernetTypeIPv6),
+	"arp":  uint16(layers.EthernetTypeARP),
+}
+
+// parses a list of EtherType names or numbers (0x0800)
+func parseEtherTypes(names []string) ([]uint16, error) {
+	types := []uint16{}
+	for _, name := range names {
+		if t, ok := etherTypeNames[strings.ToLower(name)]; ok {
+			types = append(types, t)
+			continue
+		}
+		t, err := strconv.ParseUint(name, 0, 16)
+		if err != nil {
+			return []uint16{}, fmt.Errorf("invalid EtherType: %s", name)
+		}
+		types = append(types, uint16(t))
+	}
+	return types, nil
+}
+
+// restrictEtherTypes limits an Ethernet BPF filter to the given EtherTypes.
+// 802.1Q tagged frames are matched by repeating the filter after the
+// "vlan" keyword, since that shifts the offsets of everything after it.
+func restrictEtherTypes(filter string, types []uint16) string {
+	if len(types) == 0 {
+		return filter
+	}
+	protos := []string{}
+	for _, t := range types {
+		protos = append(protos, fmt.Sprintf("ether proto 0x%04x", t))
+	}
+	match := fmt.Sprintf("(%s) and (%s)", filter, strings.Join(protos, " or "))
+	return fmt.Sprintf("(%s) or (vlan and (%s))", match, match)
+}
+
+// combines one or more BPF filters so that any of them may match
+func combineBPFFilters(filters []string) string {
+	var exprs = []string{}
+	for _, f := range filters {
+		if f = strings.TrimSpace(f); len(f) > 0 {
+			exprs = append(exprs, f)
+		}
+	}
+	switch len(exprs) {
+	case 0:
+		return ""
+	case 1:
+		return exprs[0]
+	}
+	return fmt.Sprintf("(%s)", strings.Join(exprs, ") or ("))
+}
+
+// parses a list of MAC address OUIs like aa:bb:cc, AA-BB-CC or aabbcc
+func parseOUIs(ouis []string) ([][]byte, error) {
+	ret := [][]byte{}
+	for _, oui := range ouis {
+		clean := strings.NewReplacer(":", "", "-", "", ".", "").Replace(oui)
+		b, err := hex.DecodeString(clean)
+		if err != nil || len(b) != 3 {
+			return ret, fmt.Errorf("%s is not a valid OUI like aa:bb:cc", oui)
+		}
+		ret = append(ret, b)
+	}
+	return ret, nil
+}
+
+// Returns true if the MAC address starts with one of the OUIs
+func ouiMatches(mac net.HardwareAddr, ouis [][]byte) bool {
+	for _, oui := range ouis {
+		if len(mac) >= len(oui) && bytes.Equal(mac[:len(oui)], oui) {
+			return true
+		}
+	}
+	return false
+}
+
+// The IPv4 multicast address space
+var multicastNet = net.IPNet{IP: net.IPv4(224, 0, 0, 0).To4(), Mask: net.CIDRMask(4, 32)}
+
+// parses a list of IPv4 multicast groups like 224.0.0.251 or 239.0.0.0/8
+func parseMulticastGroups(groups []string) ([]*net.IPNet, error) {
+	ret := []*net.IPNet{}
+	for _, group := range groups {
+		cidr := group
+		if !strings.Contains(cidr, "/") {
+			cidr += "/32"
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil || ipNet.IP.To4() == nil {
+			return ret, fmt.Errorf("%s is not a valid IPv4 address or CIDR", group)
+		}
+		if ones, _ := ipNet.Mask.Size(); ones < 4 || !multicastNet.Contains(ipNet.IP) {
+			return ret, fmt.Errorf("%s is not within the multicast range %s", group, multicastNet.String())
+		}
+		ret = append(ret, ipNet)
+	}
+	return ret, nil
+}
+
+// Returns true if the IP is within one of the networks
+func ipInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads a BPF filter from a file.  The filter may span multiple lines and
+// anything after a # is a comment.
+func readBPFFilterFile(fileName string) (string, error) {
+	data, err := os.ReadFile(fileName) // #nosec G304
+	if err != nil {
+		return "", err
+	}
+	words := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		words = append(words, strings.Fields(line)...)
+	}
+	if len(words) == 0 {
+		return "", fmt.Errorf("%s does not contain a BPF filter", fileName)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// Returns an error if the BPF filter can not be compiled for the given linktype
+func validateBPFFilter(linkType layers.LinkType, snaplen int, filter string) error {
+	if _, err := pcap.CompileBPFFilter(linkType, snaplen, filter); err != nil {
+		return fmt.Errorf("invalid BPF filter '%s': %s", filter, err.Error())
+	}
+	return nil
+}
+
+// fanoutGroup returns the PACKET_FANOUT group ID of the --fanout sockets of
+// our index'th interface.  Group IDs are shared by every process in a network
+// namespace and each interface needs its own, so we number them up from the
+// --fanout-group or our PID (mod 65536) so two instances rarely collide.
+func fanoutGroup(base uint16, pid int, index int) uint16 {
+	if base == 0 {
+		base = uint16(pid)
+	}
+	return base + uint16(index)
+}
+
 func parseTimeout(timeout int64) time.Duration {
 	d := fmt.Sprintf("%dms", timeout)
 	to, err := time.ParseDuration(d)
@@ -86,3 +289,148 @@ func getNetwork(addr pcap.InterfaceAddress) (string, error) {
 	mask := net.CIDRMask(len, 32)
 	return fmt.Sprintf("%s/%d", ip4.Mask(mask), len), nil
 }
+
+// Returns the broadcast address of every other IPv4 network on the interface
+// for a broadcast sent from srcip to dstip, or nothing if dstip isn't one of
+// our broadcast addresses
+func aliasBroadcasts(srcip net.IP, dstip net.IP, addresses []pcap.InterfaceAddress) []net.IP {
+	ret := []net.IP{}
+	if dstip.IsMulticast() || !isBroadcastOrMulticast(dstip, addresses) {
+		return ret
+	}
+	for _, addr := range addresses {
+		ip4 := addr.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		mask := addr.Netmask
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		if isHostMask(mask) {
+			continue // a /32 has no broadcast address
+		}
+		ipNet := net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+		bcast := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(bcast, binary.BigEndian.Uint32(ipNet.IP)|^binary.BigEndian.Uint32(mask))
+		// skip the network it was sent on
+		if ipNet.Contains(srcip) || bcast.Equal(dstip) {
+			continue
+		}
+		seen := false
+		for _, ip := range ret {
+			seen = seen || ip.Equal(bcast)
+		}
+		if !seen {
+			ret = append(ret, bcast)
+		}
+	}
+	return ret
+}
+
+// Returns the directed broadcast address of every IPv4 network on the
+// interface.  Point-to-point addresses have no broadcast, so we use the
+// address of the peer instead.
+func subnetBroadcasts(addresses []pcap.InterfaceAddress) []net.IP {
+	ret := []net.IP{}
+	for _, addr := range addresses {
+		ip4 := addr.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		var bcast net.IP
+		if addr.P2P != nil && addr.P2P.To4() != nil {
+			bcast = addr.P2P.To4()
+		} else {
+			mask := addr.Netmask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			if isHostMask(mask) {
+				continue // a /32 has no broadcast address
+			}
+			bcast = make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(bcast, binary.BigEndian.Uint32(ip4.Mask(mask))|^binary.BigEndian.Uint32(mask))
+		}
+		seen := false
+		for _, ip := range ret {
+			seen = seen || ip.Equal(bcast)
+		}
+		if !seen {
+			ret = append(ret, bcast)
+		}
+	}
+	return ret
+}
+
+// --fixed-ip keyword for the directed broadcast address of the interface
+const FIXED_IP_BROADCAST = "broadcast"
+
+// Returns true if the --fixed-ip value is broadcast or broadcast:<ip|cidr>
+func isBroadcastKeyword(value string) bool {
+	return value == FIXED_IP_BROADCAST || strings.HasPrefix(value, FIXED_IP_BROADCAST+":")
+}
+
+// Resolves a broadcast or broadcast:<ip|cidr> --fixed-ip to the directed
+// broadcast address of the interface's IPv4 network.  Interfaces with more than
+// one network must select which one via an IP or CIDR within it.
+func resolveBroadcastKeyword(value string, addrs []net.Addr) (string, error) {
+	var selector net.IP
+	if sel := strings.TrimPrefix(value, FIXED_IP_BROADCAST); len(sel) > 0 {
+		sel = sel[1:]
+		if ip, _, err := net.ParseCIDR(sel); err == nil {
+			selector = ip
+		} else if selector = net.ParseIP(sel); selector == nil || selector.To4() == nil {
+			return "", fmt.Errorf("%s is not a valid IPv4 address or CIDR", sel)
+		}
+	}
+
+	networks := []*net.IPNet{}
+	for _, addr := range addrs {
+		_, ipNet, err := net.ParseCIDR(addr.String())
+		if err != nil || ipNet.IP.To4() == nil || isHostMask(ipNet.Mask) {
+			continue
+		}
+		if selector == nil || ipNet.Contains(selector) {
+			networks = append(networks, ipNet)
+		}
+	}
+	switch {
+	case len(networks) == 0 && selector != nil:
+		return "", fmt.Errorf("no IPv4 network contains %s", selector)
+	case len(networks) == 0:
+		return "", fmt.Errorf("no IPv4 network with a broadcast address")
+	case len(networks) > 1:
+		names := []string{}
+		for _, n := range networks {
+			names = append(names, n.String())
+		}
+		return "", fmt.Errorf("multiple IPv4 networks (%s), use %s:<cidr> to pick one",
+			strings.Join(names, ", "), FIXED_IP_BROADCAST)
+	}
+	ipNet := networks[0]
+	bcast := make(net.IP, net.IPv4len)
+	mask := net.IP(ipNet.Mask).To4()
+	binary.BigEndian.PutUint32(bcast, binary.BigEndian.Uint32(ipNet.IP.To4())|^binary.BigEndian.Uint32(mask))
+	return bcast.String(), nil
+}
+
+// Returns true if the IPv4 netmask is a /32
+func isHostMask(mask net.IPMask) bool {
+	ones, bits := mask.Size()
+	return bits == 32 && ones == 32
+}
+
+// Returns true if the IP is the limited broadcast address, a multicast group
+// or the directed broadcast address of one of the interface's networks
+func isBroadcastOrMulticast(ip net.IP, addresses []pcap.InterfaceAddress) bool {
+	if ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return true
+	}
+	for _, addr := range addresses {
+		if addr.Broadaddr != nil && ip.Equal(addr.Broadaddr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+func TestFanoutGroup(t *testing.T) {
+	tests := []struct {
+		base  uint16
+		pid   int
+		index int
+		group uint16
+	}{
+		{0, 1234, 0, 1234},
+		{0, 1234, 2, 1236},
+		{0, 65536 + 10, 1, 11}, // PID mod 65536
+		{0, 65535, 1, 0},       // wraps around
+		{500, 1234, 0, 500},
+		{500, 1234, 3, 503},
+	}
+	for _, test := range tests {
+		if group := fanoutGroup(test.base, test.pid, test.index); group != test.group {
+			t.Errorf("fanoutGroup(%d, %d, %d) = %d, expected %d", test.base, test.pid, test.index, group, test.group)
+		}
+	}
+}
+
+func TestParseOUIs(t *testing.T) {
+	tests := []struct {
+		oui string
+		err bool
+		hex string
+	}{
+		{"aa:bb:cc", false, "aabbcc"},
+		{"AA-BB-CC", false, "aabbcc"},
+		{"aabbcc", false, "aabbcc"},
+		{"00.1a.2B", false, "001a2b"},
+		{"aa:bb", true, ""},
+		{"aa:bb:cc:dd", true, ""},
+		{"aabbc", true, ""},
+		{"", true, ""},
+		{"gg:hh:ii", true, ""},
+		{"aa:bb:c ", true, ""},
+		{"0xaabbcc", true, ""},
+	}
+	for _, test := range tests {
+		ouis, err := parseOUIs([]string{test.oui})
+		if test.err {
+			if err == nil || !strings.Contains(err.Error(), "is not a valid OUI like aa:bb:cc") {
+				t.Errorf("%q: expected an error, got %v", test.oui, err)
+			}
+			continue
+		}
+		if err != nil || len(ouis) != 1 || hex.EncodeToString(ouis[0]) != test.hex {
+			t.Errorf("%q: parsed %x: %v", test.oui, ouis, err)
+		}
+	}
+
+	// the first bad OUI is reported
+	if _, err := parseOUIs([]string{"aa:bb:cc", "xx:bb:cc", "aa"}); err == nil || !strings.HasPrefix(err.Error(), "xx:bb:cc") {
+		t.Errorf("expected an error for xx:bb:cc, got %v", err)
+	}
+}
+
+func TestOUIMatches(t *testing.T) {
+	ouis, err := parseOUIs([]string{"aa:bb:cc", "00:11:22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mac   net.HardwareAddr
+		match bool
+	}{
+		{net.HardwareAddr{0xaa, 0xbb, 0xcc, 0, 0, 1}, true},
+		{net.HardwareAddr{0x00, 0x11, 0x22, 0xff, 0xff, 0xff}, true},
+		{net.HardwareAddr{0xaa, 0xbb, 0xcd, 0, 0, 1}, false},
+		{net.HardwareAddr{0xaa, 0xbb}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if match := ouiMatches(test.mac, ouis); match != test.match {
+			t.Errorf("%s: match is %v", test.mac, match)
+		}
+	}
+}
+
+func TestParseMulticastGroups(t *testing.T) {
+	tests := []struct {
+		group   string
+		err     string
+		network string
+	}{
+		{"224.0.0.251", "", "224.0.0.251/32"},
+		{"239.255.255.250", "", "239.255.255.250/32"},
+		{"239.0.0.0/8", "", "239.0.0.0/8"},
+		{"239.1.2.3/16", "", "239.1.0.0/16"},
+		{"224.0.0.0/4", "", "224.0.0.0/4"},
+		{"192.168.1.255", "is not within the multicast range 224.0.0.0/4", ""},
+		{"240.0.0.1", "is not within the multicast range 224.0.0.0/4", ""},
+		{"224.0.0.0/3", "is not within the multicast range 224.0.0.0/4", ""},
+		{"ff02::fb", "is not a valid IPv4 address or CIDR", ""},
+		{"224.0.0.251/33", "is not a valid IPv4 address or CIDR", ""},
+		{"mdns", "is not a valid IPv4 address or CIDR", ""},
+	}
+	for _, test := range tests {
+		groups, err := parseMulticastGroups([]string{test.group})
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.group, test.err, err)
+			}
+			continue
+		}
+		if err != nil || len(groups) != 1 || groups[0].String() != test.network {
+			t.Errorf("%s: parsed %v: %v", test.group, groups, err)
+		}
+	}
+}
+
+func TestIPInNetworks(t *testing.T) {
+	groups, err := parseMulticastGroups([]string{"224.0.0.251", "239.255.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"224.0.0.251", true},
+		{"239.255.255.250", true},
+		{"224.0.0.252", false},
+		{"239.254.0.1", false},
+		{"10.0.0.1", false},
+	}
+	for _, test := range tests {
+		if allowed := ipInNetworks(net.ParseIP(test.ip), groups); allowed != test.allowed {
+			t.Errorf("%s: allowed is %v", test.ip, allowed)
+		}
+	}
+	if ipInNetworks(net.ParseIP("224.0.0.251"), nil) {
+		t.Errorf("no networks contain nothing")
+	}
+}
+
+// Each --filter is OR'd together into an expression libpcap can compile
+func TestCombineBPFFilters(t *testing.T) {
+	tests := []struct {
+		filters []string
+		expr    string
+	}{
+		{[]string{}, ""},
+		{[]string{" ", ""}, ""},
+		{[]string{"src net 10.0.0.0/8"}, "src net 10.0.0.0/8"},
+		{[]string{"src net 10.0.0.0/8", " src host 192.168.1.5 "}, "(src net 10.0.0.0/8) or (src host 192.168.1.5)"},
+		{[]string{"udp port 1900 or udp port 5353", "", "not src host 10.0.0.1"},
+			"(udp port 1900 or udp port 5353) or (not src host 10.0.0.1)"},
+	}
+	for _, test := range tests {
+		if expr := combineBPFFilters(test.filters); expr != test.expr {
+			t.Errorf("%q: expected %q, got %q", test.filters, test.expr, expr)
+		}
+		// every packet must still match our ports
+		expected := "udp port 1900"
+		if len(test.expr) > 0 {
+			expected = fmt.Sprintf("(udp port 1900) and (%s)", test.expr)
+		}
+		if filter := buildBPFFilter([]int32{1900}, nil, true, false, false, test.expr); filter != expected {
+			t.Errorf("%q: filter is %q", test.filters, filter)
+		}
+	}
+
+	if err := validateBPFFilter(layers.LinkTypeEthernet, DEFAULT_SNAPLEN, "udp"); err != nil {
+		t.Skipf("unable to compile BPF filters: %s", err)
+	}
+	for _, test := range tests[2:] {
+		filter := buildBPFFilter([]int32{1900}, nil, true, false, false, combineBPFFilters(test.filters))
+		if err := validateBPFFilter(layers.LinkTypeEthernet, DEFAULT_SNAPLEN, filter); err != nil {
+			t.Errorf("%q: %s", test.filters, err)
+		}
+	}
+	filter := buildBPFFilter([]int32{1900}, nil, true, false, false,
+		combineBPFFilters([]string{"src net 10.0.0.0/8", "src hots 10.0.0.1"}))
+	if err := validateBPFFilter(layers.LinkTypeEthernet, DEFAULT_SNAPLEN, filter); err == nil {
+		t.Errorf("%s compiled", filter)
+	}
+}
+
+func TestParseEtherTypes(t *testing.T) {
+	tests := []struct {
+		names []string
+		types []uint16
+		err   string
+	}{
+		{[]string{}, []uint16{}, ""},
+		{[]string{"IPv4", "arp"}, []uint16{0x0800, 0x0806}, ""},
+		{[]string{"ipv6", "0x88cc", "2048"}, []uint16{0x86dd, 0x88cc, 0x0800}, ""},
+		{[]string{"ipx"}, nil, "invalid EtherType: ipx"},
+		{[]string{"ipv4", "0x10000"}, nil, "invalid EtherType: 0x10000"},
+	}
+	for _, test := range tests {
+		types, err := parseEtherTypes(test.names)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: expected %q, got %v", test.names, test.err, err)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(types) != fmt.Sprint(test.types) {
+			t.Errorf("%v: parsed %v: %v", test.names, types, err)
+		}
+	}
+}
+
+// --ethertypes restricts Ethernet filters, including 802.1Q tagged frames
+func TestRestrictEtherTypes(t *testing.T) {
+	tests := []struct {
+		types  []uint16
+		filter string
+	}{
+		{[]uint16{}, "udp port 1900"},
+		{[]uint16{0x0800}, "((udp port 1900) and (ether proto 0x0800)) or (vlan and ((udp port 1900) and (ether proto 0x0800)))"},
+		{[]uint16{0x0800, 0x86dd}, "((udp port 1900) and (ether proto 0x0800 or ether proto 0x86dd)) or " +
+			"(vlan and ((udp port 1900) and (ether proto 0x0800 or ether proto 0x86dd)))"},
+	}
+	for _, test := range tests {
+		if filter := restrictEtherTypes("udp port 1900", test.types); filter != test.filter {
+			t.Errorf("%v: filter is %s", test.types, filter)
+		}
+	}
+
+	// only Ethernet frames have an EtherType
+	l := Listen{iname: "ether0", ports: []int32{1900}, promisc: true, capture: Capture{etherTypes: []uint16{0x0800}}}
+	if filter := l.bpfFilter(layers.LinkTypeEthernet); filter != tests[1].filter {
+		t.Errorf("Ethernet filter is %s", filter)
+	}
+	if filter := l.bpfFilter(layers.LinkTypeRaw); filter != "udp port 1900" {
+		t.Errorf("raw filter is %s", filter)
+	}
+
+	// and the compiled filter still matches tagged IPv4
+	insns, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, DEFAULT_SNAPLEN, tests[1].filter)
+	if err != nil {
+		t.Skipf("unable to compile BPF filters: %s", err)
+	}
+	raw := make([]bpf.RawInstruction, len(insns))
+	for i, insn := range insns {
+		raw[i] = bpf.RawInstruction{Op: insn.Code, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}
+	}
+	program, _ := bpf.Disassemble(raw)
+	vm, err := bpf.NewVM(program)
+	if err != nil {
+		t.Skipf("unable to run our BPF filter: %s", err) // libpcap may use extensions
+	}
+	packet, _ := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 1900, []byte("hello"))
+	frame := func(etherType layers.EthernetType, vlan bool) []byte {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, DstMAC: layers.EthernetBroadcast,
+			EthernetType: etherType}
+		ls := []gopacket.SerializableLayer{eth}
+		if vlan {
+			eth.EthernetType = layers.EthernetTypeDot1Q
+			ls = append(ls, &layers.Dot1Q{VLANIdentifier: 10, Type: etherType})
+		}
+		ls = append(ls, gopacket.Payload(packet.Data()))
+		buffer := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{}, ls...); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Bytes()
+	}
+	matches := []struct {
+		name  string
+		data  []byte
+		match bool
+	}{
+		{"ipv4", frame(layers.EthernetTypeIPv4, false), true},
+		{"tagged ipv4", frame(layers.EthernetTypeIPv4, true), true},
+		{"other ethertype", frame(layers.EthernetType(0x88b5), false), false},
+		{"tagged other ethertype", frame(layers.EthernetType(0x88b5), true), false},
+	}
+	for _, test := range matches {
+		n, err := vm.Run(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (n > 0) != test.match {
+			t.Errorf("%s: matched %v", test.name, n > 0)
+		}
+	}
+}
+
+// --alias-fanout forwards a broadcast on one of our networks to the other
+// networks on the same interface
+func TestAliasBroadcasts(t *testing.T) {
+	addresses := []pcap.InterfaceAddress{
+		{IP: net.ParseIP("192.168.1.1"), Netmask: net.CIDRMask(24, 32), Broadaddr: net.ParseIP("192.168.1.255")},
+		{IP: net.ParseIP("10.0.0.1"), Netmask: net.IPMask(net.ParseIP("255.255.255.0")), // 16 byte mask
+			Broadaddr: net.ParseIP("10.0.0.255")},
+		{IP: net.ParseIP("fe80::1"), Netmask: net.CIDRMask(64, 128)},
+		{IP: net.ParseIP("172.16.0.1"), Netmask: net.CIDRMask(16, 32), Broadaddr: net.ParseIP("172.16.255.255")},
+		{IP: net.ParseIP("172.16.0.2"), Netmask: net.CIDRMask(16, 32), // same network
+			Broadaddr: net.ParseIP("172.16.255.255")},
+	}
+	tests := []struct {
+		name   string
+		src    string
+		dst    string
+		bcasts string
+	}{
+		{"directed", "192.168.1.5", "192.168.1.255", "[10.0.0.255 172.16.255.255]"},
+		{"other alias", "172.16.9.9", "172.16.255.255", "[192.168.1.255 10.0.0.255]"},
+		{"limited", "10.0.0.5", "255.255.255.255", "[192.168.1.255 172.16.255.255]"},
+		{"another network's broadcast", "192.168.1.5", "10.0.0.255", "[172.16.255.255]"},
+		{"unicast", "192.168.1.5", "192.168.1.1", "[]"},
+		{"multicast", "192.168.1.5", "239.255.255.250", "[]"},
+		{"not ours", "192.168.1.5", "192.168.2.255", "[]"},
+	}
+	for _, test := range tests {
+		bcasts := aliasBroadcasts(net.ParseIP(test.src).To4(), net.ParseIP(test.dst).To4(), addresses)
+		if fmt.Sprint(bcasts) != test.bcasts {
+			t.Errorf("%s: sent to %v instead of %s", test.name, bcasts, test.bcasts)
+		}
+	}
+	if bcasts := aliasBroadcasts(net.ParseIP("192.168.1.5"), net.ParseIP("192.168.1.255"), addresses[:1]); len(bcasts) != 0 {
+		t.Errorf("sent to %v without any other networks", bcasts)
+	}
+}
+
+// --filter-file may document a filter over several lines with # comments
+func TestReadBPFFilterFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		contents string
+		filter   string
+		err      string
+	}{
+		{"src net 10.0.0.0/8\n", "src net 10.0.0.0/8", ""},
+		{"# only our lab\nsrc net 10.0.0.0/8   # the lab\n\tand not\n  src host 10.0.0.1 # the router\n",
+			"src net 10.0.0.0/8 and not src host 10.0.0.1", ""},
+		{"src host 10.0.0.5\r\n or src host 10.0.0.6\r\n", "src host 10.0.0.5 or src host 10.0.0.6", ""},
+		{"# nothing but comments\n\n   \n", "", "does not contain a BPF filter"},
+		{"", "", "does not contain a BPF filter"},
+	}
+	filters := []string{}
+	for i, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("filter%d.bpf", i))
+		if err := os.WriteFile(path, []byte(test.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		filter, err := readBPFFilterFile(path)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected %q, got %v", test.contents, test.err, err)
+			}
+			continue
+		}
+		if err != nil || filter != test.filter {
+			t.Errorf("%q: read %q: %v", test.contents, filter, err)
+		}
+		filters = append(filters, filter)
+	}
+	if _, err := readBPFFilterFile(filepath.Join(dir, "missing.bpf")); err == nil {
+		t.Errorf("missing file should be an error")
+	}
+
+	// our filters are OR'd with any others into a filter which compiles
+	filter := buildBPFFilter([]int32{1900}, nil, true, false, false,
+		combineBPFFilters(append(filters, "udp port 5353")))
+	if err := validateBPFFilter(layers.LinkTypeEthernet, DEFAULT_SNAPLEN, "udp"); err != nil {
+		t.Skipf("unable to compile BPF filters: %s", err)
+	}
+	if err := validateBPFFilter(layers.LinkTypeEthernet, DEFAULT_SNAPLEN, filter); err != nil {
+		t.Error(err)
+	}
+}
+
+// --all-subnets sends to the broadcast of each IPv4 network on the interface
+func TestSubnetBroadcasts(t *testing.T) {
+	twoSubnets := []pcap.InterfaceAddress{
+		{IP: net.ParseIP("192.168.1.1"), Netmask: net.CIDRMask(24, 32)},
+		{IP: net.ParseIP("fe80::1"), Netmask: net.CIDRMask(64, 128)},
+		{IP: net.ParseIP("10.0.0.1"), Netmask: net.IPMask(net.ParseIP("255.255.0.0"))}, // 16 byte mask
+	}
+	tests := []struct {
+		name      string
+		addresses []pcap.InterfaceAddress
+		dstips    string
+	}{
+		{"two subnets", twoSubnets, "[192.168.1.255 10.0.255.255]"},
+		{"point-to-point", []pcap.InterfaceAddress{
+			{IP: net.ParseIP("10.8.0.1"), Netmask: net.CIDRMask(32, 32), P2P: net.ParseIP("10.8.0.2")},
+			{IP: net.ParseIP("192.168.1.1"), Netmask: net.CIDRMask(24, 32)},
+		}, "[10.8.0.2 192.168.1.255]"},
+		{"host mask", []pcap.InterfaceAddress{{IP: net.ParseIP("10.8.0.1"), Netmask: net.CIDRMask(32, 32)}}, "[]"},
+		{"same subnet", []pcap.InterfaceAddress{
+			{IP: net.ParseIP("192.168.1.1"), Netmask: net.CIDRMask(24, 32)},
+			{IP: net.ParseIP("192.168.1.2"), Netmask: net.CIDRMask(24, 32)},
+		}, "[192.168.1.255]"},
+	}
+	for _, test := range tests {
+		if dstips := subnetBroadcasts(test.addresses); fmt.Sprint(dstips) != test.dstips {
+			t.Errorf("%s: expected %s, got %v", test.name, test.dstips, dstips)
+		}
+	}
+
+	Interfaces["subnet0"] = pcap.Interface{Name: "subnet0", Addresses: twoSubnets}
+	defer delete(Interfaces, "subnet0")
+	l := Listen{iname: "subnet0", ipaddr: "192.168.1.255"}
+	if dstips := l.broadcastIPs(); fmt.Sprint(dstips) != "[192.168.1.255]" {
+		t.Errorf("without --all-subnets we send to %v", dstips)
+	}
+	l.bcast.allSubnets = true
+	if dstips := l.broadcastIPs(); len(dstips) != 2 {
+		t.Errorf("with --all-subnets we send to %v", dstips)
+	}
+	l.bcast.remote = net.ParseIP("172.16.0.255")
+	l.ipaddr = "172.16.0.255"
+	if dstips := l.broadcastIPs(); fmt.Sprint(dstips) != "[172.16.0.255]" {
+		t.Errorf("with --remote-broadcast we send to %v", dstips)
+	}
+}
+
+func TestResolveBroadcastKeyword(t *testing.T) {
+	ipNet := func(cidr string) net.Addr {
+		ip, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &net.IPNet{IP: ip, Mask: network.Mask}
+	}
+	slash24 := []net.Addr{ipNet("192.168.1.10/24"), ipNet("fe80::1/64")}
+	subnets := []net.Addr{ipNet("192.168.1.10/24"), ipNet("10.1.0.1/16"), ipNet("172.16.0.1/32")}
+	tests := []struct {
+		value string
+		addrs []net.Addr
+		bcast string
+		err   string
+	}{
+		{"broadcast", slash24, "192.168.1.255", ""},
+		{"broadcast:192.168.1.0/24", slash24, "192.168.1.255", ""},
+		{"broadcast", subnets, "", "multiple IPv4 networks (192.168.1.0/24, 10.1.0.0/16), use broadcast:<cidr> to pick one"},
+		{"broadcast:10.1.2.3", subnets, "10.1.255.255", ""},
+		{"broadcast:10.1.0.0/16", subnets, "10.1.255.255", ""},
+		{"broadcast:192.168.1.77", subnets, "192.168.1.255", ""},
+		{"broadcast:172.16.0.1", subnets, "", "no IPv4 network contains 172.16.0.1"},
+		{"broadcast:fe80::1", slash24, "", "fe80::1 is not a valid IPv4 address or CIDR"},
+		{"broadcast:lan", slash24, "", "lan is not a valid IPv4 address or CIDR"},
+		{"broadcast", []net.Addr{ipNet("fe80::1/64")}, "", "no IPv4 network with a broadcast address"},
+	}
+	for _, test := range tests {
+		if !isBroadcastKeyword(test.value) {
+			t.Errorf("%s is not the broadcast keyword", test.value)
+		}
+		bcast, err := resolveBroadcastKeyword(test.value, test.addrs)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.value, test.err, err)
+			}
+		} else if err != nil || bcast != test.bcast {
+			t.Errorf("%s: resolved to %s: %v", test.value, bcast, err)
+		}
+	}
+	for _, value := range []string{"192.168.1.255", "broadcasts", "bcast"} {
+		if isBroadcastKeyword(value) {
+			t.Errorf("%s is the broadcast keyword", value)
+		}
+	}
+}
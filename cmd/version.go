@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// VersionInfo describes this binary and what it can do for --version-json
+type VersionInfo struct {
+	Version   string          `json:"version"`
+	CommitID  string          `json:"commit_id"`
+	Tag       string          `json:"tag"`
+	Delta     string          `json:"delta,omitempty"`
+	BuiltAt   string          `json:"built_at"`
+	GoVersion string          `json:"go_version"`
+	Platform  string          `json:"platform"`
+	Libpcap   string          `json:"libpcap"`
+	LinkTypes []string        `json:"link_types"` // link types we can forward packets out of
+	Features  map[string]bool `json:"features"`   // optional features of this build
+}
+
+// getVersionInfo returns the VersionInfo of this binary
+func getVersionInfo() VersionInfo {
+	tag := Tag
+	if len(Delta) > 0 {
+		tag = "Unknown"
+	}
+	linkTypes := []string{}
+	for _, lt := range validLinkTypes {
+		linkTypes = append(linkTypes, lt.String())
+	}
+	return VersionInfo{
+		Version:   Version,
+		CommitID:  CommitID,
+		Tag:       tag,
+		Delta:     Delta,
+		BuiltAt:   Buildinfos,
+		GoVersion: runtime.Version(),
+		Platform:  fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+		Libpcap:   pcap.Version(),
+		LinkTypes: linkTypes,
+		Features: map[string]bool{
+			"afpacket": AFPACKET_SUPPORTED,
+			"netns":    NETNS_SUPPORTED,
+			"ipv6":     false,
+		},
+	}
+}
+
+// printVersion writes our VersionInfo to out for --version or --version-json
+func printVersion(out io.Writer, asJSON bool) error {
+	v := getVersionInfo()
+	if asJSON {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(data))
+		return err
+	}
+
+	delta := ""
+	if len(v.Delta) > 0 {
+		delta = fmt.Sprintf(" [%s delta]", v.Delta)
+	}
+	features := []string{}
+	if !AFPACKET_SUPPORTED && !NETNS_SUPPORTED {
+		features = append(features, "none")
+	}
+	for _, f := range []string{"afpacket", "netns", "ipv6"} {
+		if v.Features[f] {
+			features = append(features, f)
+		}
+	}
+	fmt.Fprintf(out, "udp-proxy-2020 Version %s -- Copyright 2020-2022 Aaron Turner\n", v.Version)
+	fmt.Fprintf(out, "%s (%s)%s built at %s\n", v.CommitID, v.Tag, delta, v.BuiltAt)
+	fmt.Fprintf(out, "%s on %s with %s\n", v.GoVersion, v.Platform, v.Libpcap)
+	fmt.Fprintf(out, "Link types: %s\n", strings.Join(v.LinkTypes, ", "))
+	fmt.Fprintf(out, "Features: %s\n", strings.Join(features, ", "))
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// Tooling depends on the keys and types of --version-json
+func TestPrintVersionJSON(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := printVersion(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	v := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Fatalf("%s: %s", err, buf.String())
+	}
+
+	tests := []struct {
+		key   string
+		kind  string
+		value interface{} // expected value, if we know it
+	}{
+		{"version", "string", Version},
+		{"commit_id", "string", nil},
+		{"tag", "string", nil},
+		{"built_at", "string", nil},
+		{"go_version", "string", runtime.Version()},
+		{"platform", "string", runtime.GOOS + "/" + runtime.GOARCH},
+		{"libpcap", "string", pcap.Version()},
+		{"link_types", "array", nil},
+		{"features", "object", nil},
+	}
+	for _, test := range tests {
+		value, ok := v[test.key]
+		if !ok {
+			t.Errorf("no %s", test.key)
+			continue
+		}
+		kind := ""
+		switch value.(type) {
+		case string:
+			kind = "string"
+		case []interface{}:
+			kind = "array"
+		case map[string]interface{}:
+			kind = "object"
+		}
+		if kind != test.kind {
+			t.Errorf("%s is %T, expected %s", test.key, value, test.kind)
+		}
+		if test.value != nil && value != test.value {
+			t.Errorf("%s is %v, expected %v", test.key, value, test.value)
+		}
+	}
+	if _, ok := v["delta"]; ok != (len(Delta) > 0) {
+		t.Errorf("delta is only included when we have one: %v", v["delta"])
+	}
+
+	linkTypes, _ := v["link_types"].([]interface{})
+	if len(linkTypes) != len(validLinkTypes) {
+		t.Errorf("link types are %v", linkTypes)
+	}
+	for i := range linkTypes {
+		if i < len(validLinkTypes) && linkTypes[i] != validLinkTypes[i].String() {
+			t.Errorf("link type %d is %v, expected %s", i, linkTypes[i], validLinkTypes[i])
+		}
+	}
+	features, _ := v["features"].(map[string]interface{})
+	expected := map[string]bool{"afpacket": AFPACKET_SUPPORTED, "netns": NETNS_SUPPORTED, "ipv6": false}
+	if len(features) != len(expected) {
+		t.Errorf("features are %v", features)
+	}
+	for name, supported := range expected {
+		if features[name] != supported {
+			t.Errorf("feature %s is %v, expected %v", name, features[name], supported)
+		}
+	}
+}
+
+func TestPrintVersion(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := printVersion(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"udp-proxy-2020 Version " + Version,
+		"with " + pcap.Version(),
+		"Link types: " + validLinkTypes[0].String(),
+		"Features: ",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("no %q in %s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long we wait after a read error before trying again
+const ZERO_COPY_RETRY = 5 * time.Millisecond
+
+// readZeroCopy reads packets via ZeroCopyReadPacketData which avoids
+// allocating a buffer for every packet.  The data is only valid until our
+// next read, so receivePacket copies the packets it keeps.  Only returns
+// when the handle is closed.
+func (l *Listen) readZeroCopy(s *SendPktFeed) {
+	opts := gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	for {
+		data, ci, err := l.handle.ZeroCopyReadPacketData()
+		switch err {
+		case nil:
+		case pcap.NextErrorTimeoutExpired:
+			continue
+		case io.EOF, pcap.NextErrorNoMorePackets, pcap.NextErrorNotActivated:
+			log.Errorf("%s: Unable to read packets: %s", l.label, err)
+			return
+		default:
+			rateLog.Warnf("read:"+l.iname, "%s: Unable to read packet: %s", l.label, err)
+			time.Sleep(ZERO_COPY_RETRY)
+			continue
+		}
+
+		packet := gopacket.NewPacket(data, l.linkType, opts)
+		packet.Metadata().CaptureInfo = ci
+		l.receivePacket(s, packet)
+	}
+}
+
+// copyPacket returns a copy of the packet which doesn't share the underlying
+// data along with its decoded layers
+func copyPacket(packet gopacket.Packet, linkType layers.LinkType) (gopacket.Packet, *Decoded, error) {
+	data := make([]byte, len(packet.Data()))
+	copy(data, packet.Data())
+	c := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	c.Metadata().CaptureInfo = packet.Metadata().CaptureInfo
+	d, err := decodePacket(data, linkType)
+	return c, d, err
+}
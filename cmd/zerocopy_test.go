@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// The packets we keep must not change when libpcap reuses its buffer
+func TestCopyPacket(t *testing.T) {
+	payload := []byte("hello world")
+	packet, _ := testPacket(t, "10.0.0.5", "10.0.0.255", 5000, 9003, payload)
+	data := testFrame(t, layers.LinkTypeEthernet, packet.Data())
+	orig := make([]byte, len(data))
+	copy(orig, data)
+
+	p := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	p.Metadata().CaptureInfo = gopacket.CaptureInfo{Length: len(data), CaptureLength: len(data)}
+	c, d, err := copyPacket(p, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range data {
+		data[i] = 0xff
+	}
+
+	if !bytes.Equal(c.Data(), orig) {
+		t.Errorf("copied packet changed to %x", c.Data())
+	}
+	if !bytes.Equal(d.payload, payload) || !d.ip4.SrcIP.Equal(net.ParseIP("10.0.0.5")) || d.udp.SrcPort != 5000 {
+		t.Errorf("decoded %s:%d %q", d.ip4.SrcIP, d.udp.SrcPort, d.payload)
+	}
+	if app := c.ApplicationLayer(); app == nil || !bytes.Equal(app.Payload(), payload) {
+		t.Errorf("copied packet layers are wrong: %v", c.Layers())
+	}
+	if c.Metadata().CaptureLength != len(orig) {
+		t.Errorf("capture info was not copied: %+v", c.Metadata().CaptureInfo)
+	}
+}
+
+// openTestPcap writes count copies of an Ethernet frame to a pcap file and
+// opens it with libpcap.  Skips the test if we can't.
+func openTestPcap(t testing.TB, data []byte, count int) *pcap.Handle {
+	path := filepath.Join(t.TempDir(), "test.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pcapgo.NewWriter(f)
+	if err = w.WriteFileHeader(DEFAULT_SNAPLEN, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), Length: len(data), CaptureLength: len(data)}
+	for i := 0; i < count; i++ {
+		if err = w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		t.Skip(err)
+	}
+	return handle
+}
+
+// openBenchPcap opens a pcap file of b.N Ethernet frames of UDP packets
+func openBenchPcap(b *testing.B) *pcap.Handle {
+	packet, _ := testPacket(b, "10.0.0.5", "10.0.0.255", 5000, 9003, make([]byte, 512))
+	return openTestPcap(b, testFrame(b, layers.LinkTypeEthernet, packet.Data()), b.N)
+}
+
+// What receivePacket gets from capturePackets
+func BenchmarkReadPacketSource(b *testing.B) {
+	handle := openBenchPcap(b)
+	defer handle.Close()
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+	source.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packet, err := source.NextPacket()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = decodePacket(packet.Data(), handle.LinkType()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// What receivePacket gets from readZeroCopy
+func BenchmarkReadZeroCopy(b *testing.B) {
+	handle := openBenchPcap(b)
+	defer handle.Close()
+	opts := gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, ci, err := handle.ZeroCopyReadPacketData()
+		if err != nil {
+			b.Fatal(err)
+		}
+		packet := gopacket.NewPacket(data, handle.LinkType(), opts)
+		packet.Metadata().CaptureInfo = ci
+		if _, err = decodePacket(packet.Data(), handle.LinkType()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
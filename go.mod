@@ -7,7 +7,8 @@ require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/google/gopacket v1.1.18
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3
 )
 
 // see: https://github.com/sirupsen/logrus/issues/1275
-require golang.org/x/sys v0.0.0-20210817190340-bfb29a6856f2 // indirect
+require golang.org/x/sys v0.0.0-20210817190340-bfb29a6856f2